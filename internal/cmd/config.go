@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"go.yaml.in/yaml/v3"
+
+	"github.com/attachmentgenie/atc/pkg/atc"
+)
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect the configuration.",
+	Long:  "Inspect the configuration that would be used by the server command.",
+}
+
+var configPrintCmd = &cobra.Command{
+	Use:          "print",
+	Short:        "Print the effective configuration.",
+	Long:         "Print the effective configuration, resolved from defaults, the configuration file and flags, as YAML. Secrets are redacted.",
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := loadConfig(cmd.Flags())
+		if err != nil {
+			return err
+		}
+
+		enc := yaml.NewEncoder(cmd.OutOrStdout())
+		enc.SetIndent(2)
+		if err := enc.Encode(cfg); err != nil {
+			return fmt.Errorf("failed to encode config: %w", err)
+		}
+		return enc.Close()
+	},
+}
+
+var configValidateCmd = &cobra.Command{
+	Use:          "validate",
+	Short:        "Validate the configuration without starting any services.",
+	Long:         "Validate the configuration, resolved from defaults, the configuration file and flags, without starting any services.",
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := loadConfig(cmd.Flags())
+		if err != nil {
+			return err
+		}
+		if err := cfg.Validate(); err != nil {
+			return err
+		}
+
+		t, err := atc.New(cfg)
+		if err != nil {
+			return err
+		}
+		if err := t.ValidateTargets(); err != nil {
+			return err
+		}
+
+		fmt.Fprintln(cmd.OutOrStdout(), "Configuration is valid.")
+		return nil
+	},
+}
+
+var configFile string
+var configExpandEnv bool
+
+// legacyFlags maps the flags that predate the configuration file onto the
+// configuration options that replaced them.
+var legacyFlags = map[string]string{
+	"port":      "server.http-listen-port",
+	"log_level": "log.level",
+}
+
+// loadConfig builds the effective configuration: defaults first, then the
+// configuration file, and finally every flag that was set on the command line.
+func loadConfig(flags *pflag.FlagSet) (atc.Config, error) {
+	var c atc.Config
+	fs := flag.NewFlagSet("atc", flag.ContinueOnError)
+	c.RegisterFlags(fs)
+
+	if configFile != "" {
+		if err := atc.LoadConfigFile(configFile, configExpandEnv, &c); err != nil {
+			return c, err
+		}
+	}
+
+	var err error
+	flags.Visit(func(f *pflag.Flag) {
+		name := f.Name
+		if n, ok := legacyFlags[name]; ok {
+			name = n
+		}
+		if err != nil || fs.Lookup(name) == nil {
+			return
+		}
+		err = fs.Set(name, f.Value.String())
+	})
+	return c, err
+}
+
+func addConfigFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&configFile, "config.file", "", "YAML configuration file to load. Flags set on the command line take precedence over the file.")
+	flags.BoolVar(&configExpandEnv, "config.expand-env", false, "Expand ${VAR} and ${VAR:default} references in the configuration file with environment variables.")
+
+	fs := flag.NewFlagSet("atc", flag.ContinueOnError)
+	var c atc.Config
+	c.RegisterFlags(fs)
+	flags.AddGoFlagSet(fs)
+}
+
+func init() {
+	rootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configPrintCmd)
+	configCmd.AddCommand(configValidateCmd)
+	addConfigFlags(configCmd.PersistentFlags())
+}
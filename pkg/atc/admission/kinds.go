@@ -0,0 +1,224 @@
+package admission
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/nomad/api"
+	"golang.org/x/exp/slices"
+)
+
+func init() {
+	Register("constraint", func() Check { return &Constraint{} })
+	Register("default_resources", func() Check { return &DefaultResources{} })
+	Register("required_meta", func() Check { return &RequiredMeta{} })
+	Register("service_check", func() Check { return &ServiceCheck{Interval: 10 * time.Second, Timeout: 2 * time.Second} })
+}
+
+// Constraint requires a job level placement constraint, e.g. on the node
+// class. Mutating replaces the constraints of the job on the same attribute
+// and operator with the required one.
+type Constraint struct {
+	Attribute string `yaml:"attribute"`
+	Operator  string `yaml:"operator"`
+	Value     string `yaml:"value"`
+}
+
+func (c *Constraint) Validate() error {
+	if c.Attribute == "" && c.Operator == "" {
+		return fmt.Errorf("attribute or operator is required")
+	}
+	return nil
+}
+
+func (c *Constraint) Findings(job *api.Job) []string {
+	if slices.ContainsFunc(job.Constraints, c.equal) {
+		return nil
+	}
+	return []string{fmt.Sprintf("job lacks constraint %s", c)}
+}
+
+func (c *Constraint) Mutate(job *api.Job) {
+	job.Constraints = slices.DeleteFunc(job.Constraints, func(other *api.Constraint) bool {
+		return other == nil || (other.LTarget == c.Attribute && other.Operand == c.operator())
+	})
+	job.Constrain(api.NewConstraint(c.Attribute, c.operator(), c.Value))
+}
+
+func (c *Constraint) equal(other *api.Constraint) bool {
+	return other != nil && other.LTarget == c.Attribute && other.RTarget == c.Value && other.Operand == c.operator()
+}
+
+// operator defaults to equality, like in job specifications.
+func (c *Constraint) operator() string {
+	if c.Operator == "" {
+		return "="
+	}
+	return c.Operator
+}
+
+func (c *Constraint) String() string {
+	return fmt.Sprintf("%q %s %q", c.Attribute, c.operator(), c.Value)
+}
+
+// DefaultResources requires every task to set its CPU and memory resources
+// instead of relying on the defaults of Nomad. Mutating sets the resources
+// that are missing.
+type DefaultResources struct {
+	CPU      int `yaml:"cpu"`
+	MemoryMB int `yaml:"memory_mb"`
+}
+
+func (r *DefaultResources) Validate() error {
+	if r.CPU < 0 || r.MemoryMB < 0 {
+		return fmt.Errorf("resources must not be negative")
+	}
+	return nil
+}
+
+func (r *DefaultResources) Findings(job *api.Job) []string {
+	var findings []string
+	forEachTask(job, func(tg *api.TaskGroup, task *api.Task) {
+		res := task.Resources
+		if res == nil || (res.CPU == nil && res.Cores == nil) {
+			findings = append(findings, fmt.Sprintf("task %q in group %q does not set cpu", task.Name, groupName(tg)))
+		}
+		if res == nil || res.MemoryMB == nil {
+			findings = append(findings, fmt.Sprintf("task %q in group %q does not set memory", task.Name, groupName(tg)))
+		}
+	})
+	return findings
+}
+
+func (r *DefaultResources) Mutate(job *api.Job) {
+	forEachTask(job, func(_ *api.TaskGroup, task *api.Task) {
+		res := task.Resources
+		if res == nil {
+			res = &api.Resources{}
+		}
+		if res.CPU == nil && res.Cores == nil && r.CPU > 0 {
+			res.CPU = pointerOf(r.CPU)
+		}
+		if res.MemoryMB == nil && r.MemoryMB > 0 {
+			res.MemoryMB = pointerOf(r.MemoryMB)
+		}
+		if res.CPU != nil || res.Cores != nil || res.MemoryMB != nil {
+			task.Resources = res
+		}
+	})
+}
+
+// RequiredMeta requires job meta keys to be set.
+type RequiredMeta struct {
+	Keys []string `yaml:"keys"`
+}
+
+func (m *RequiredMeta) Validate() error {
+	if len(m.Keys) == 0 {
+		return fmt.Errorf("keys are required")
+	}
+	return nil
+}
+
+func (m *RequiredMeta) Findings(job *api.Job) []string {
+	var findings []string
+	for _, key := range m.Keys {
+		if job.Meta[key] == "" {
+			findings = append(findings, fmt.Sprintf("job meta %q is required", key))
+		}
+	}
+	return findings
+}
+
+// ServiceCheck requires every Consul service with a port to have a health
+// check. Mutating adds a check of the configured type to those services.
+type ServiceCheck struct {
+	Type     string        `yaml:"type"`
+	Path     string        `yaml:"path"`
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+func (c *ServiceCheck) Validate() error {
+	switch c.Type {
+	case "", "tcp":
+	case "http":
+		if c.Path == "" {
+			return fmt.Errorf("path is required for http checks")
+		}
+	default:
+		return fmt.Errorf("invalid check type %q, must be tcp or http", c.Type)
+	}
+	if c.Interval <= 0 || c.Timeout <= 0 {
+		return fmt.Errorf("interval and timeout must be positive")
+	}
+	return nil
+}
+
+func (c *ServiceCheck) Findings(job *api.Job) []string {
+	var findings []string
+	forEachService(job, func(service *api.Service) {
+		if len(service.Checks) == 0 {
+			findings = append(findings, fmt.Sprintf("service %q has no health check", service.Name))
+		}
+	})
+	return findings
+}
+
+func (c *ServiceCheck) Mutate(job *api.Job) {
+	checkType := c.Type
+	if checkType == "" {
+		checkType = "tcp"
+	}
+
+	forEachService(job, func(service *api.Service) {
+		if len(service.Checks) > 0 {
+			return
+		}
+		service.Checks = append(service.Checks, api.ServiceCheck{
+			Name:     fmt.Sprintf("%s %s check", service.Name, checkType),
+			Type:     checkType,
+			Path:     c.Path,
+			Interval: c.Interval,
+			Timeout:  c.Timeout,
+		})
+	})
+}
+
+func forEachTask(job *api.Job, fn func(*api.TaskGroup, *api.Task)) {
+	for _, tg := range job.TaskGroups {
+		for _, task := range tg.Tasks {
+			fn(tg, task)
+		}
+	}
+}
+
+// forEachService calls fn for every Consul service with a port, at the group
+// and at the task level.
+func forEachService(job *api.Job, fn func(*api.Service)) {
+	visit := func(services []*api.Service) {
+		for _, service := range services {
+			if service.PortLabel == "" || (service.Provider != "" && service.Provider != api.ServiceProviderConsul) {
+				continue
+			}
+			fn(service)
+		}
+	}
+	for _, tg := range job.TaskGroups {
+		visit(tg.Services)
+		for _, task := range tg.Tasks {
+			visit(task.Services)
+		}
+	}
+}
+
+func groupName(tg *api.TaskGroup) string {
+	if tg.Name == nil {
+		return ""
+	}
+	return *tg.Name
+}
+
+func pointerOf[T any](v T) *T {
+	return &v
+}
@@ -0,0 +1,185 @@
+package admission
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+// testJob is a service job with a group service and a task without
+// resources or checks.
+func testJob() *api.Job {
+	job := api.NewServiceJob("web", "web", "global", 50)
+	task := api.NewTask("server", "docker")
+	task.Resources = nil
+	group := api.NewTaskGroup("web", 1).AddTask(task)
+	group.Services = []*api.Service{{Name: "web", PortLabel: "http"}}
+	return job.AddTaskGroup(group)
+}
+
+func TestKinds(t *testing.T) {
+	tests := map[string]struct {
+		check Check
+		job   func() *api.Job
+		// findings of the job, and of the job after mutating it when the
+		// check is a mutator.
+		findings []string
+		mutated  []string
+	}{
+		"constraint missing": {
+			check:    &Constraint{Attribute: "${node.class}", Value: "general"},
+			job:      testJob,
+			findings: []string{`job lacks constraint "${node.class}" = "general"`},
+			mutated:  []string{},
+		},
+		"constraint replaces the value": {
+			check: &Constraint{Attribute: "${node.class}", Value: "general"},
+			job: func() *api.Job {
+				job := testJob()
+				job.Constrain(api.NewConstraint("${node.class}", "=", "batch"))
+				return job
+			},
+			findings: []string{`job lacks constraint "${node.class}" = "general"`},
+			mutated:  []string{},
+		},
+		"constraint present": {
+			check: &Constraint{Attribute: "${node.class}", Operator: "=", Value: "general"},
+			job: func() *api.Job {
+				job := testJob()
+				job.Constrain(api.NewConstraint("${node.class}", "=", "general"))
+				return job
+			},
+			findings: []string{},
+			mutated:  []string{},
+		},
+		"default resources": {
+			check: &DefaultResources{CPU: 100, MemoryMB: 128},
+			job:   testJob,
+			findings: []string{
+				`task "server" in group "web" does not set cpu`,
+				`task "server" in group "web" does not set memory`,
+			},
+			mutated: []string{},
+		},
+		"default resources accept cores": {
+			check: &DefaultResources{CPU: 100, MemoryMB: 128},
+			job: func() *api.Job {
+				job := testJob()
+				job.TaskGroups[0].Tasks[0].Resources = &api.Resources{Cores: pointerOf(2), MemoryMB: pointerOf(64)}
+				return job
+			},
+			findings: []string{},
+			mutated:  []string{},
+		},
+		"default resources without a default": {
+			check: &DefaultResources{MemoryMB: 128},
+			job:   testJob,
+			findings: []string{
+				`task "server" in group "web" does not set cpu`,
+				`task "server" in group "web" does not set memory`,
+			},
+			mutated: []string{`task "server" in group "web" does not set cpu`},
+		},
+		"required meta": {
+			check: &RequiredMeta{Keys: []string{"owner", "team"}},
+			job: func() *api.Job {
+				job := testJob()
+				job.SetMeta("team", "platform")
+				return job
+			},
+			findings: []string{`job meta "owner" is required`},
+		},
+		"service check": {
+			check:    &ServiceCheck{Type: "http", Path: "/health", Interval: 10 * time.Second, Timeout: 2 * time.Second},
+			job:      testJob,
+			findings: []string{`service "web" has no health check`},
+			mutated:  []string{},
+		},
+		"service check skips services without a port and nomad services": {
+			check: &ServiceCheck{Interval: 10 * time.Second, Timeout: 2 * time.Second},
+			job: func() *api.Job {
+				job := testJob()
+				job.TaskGroups[0].Services = []*api.Service{
+					{Name: "worker"},
+					{Name: "web", PortLabel: "http", Provider: "nomad"},
+				}
+				return job
+			},
+			findings: []string{},
+			mutated:  []string{},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			job := tc.job()
+			if got := tc.check.Findings(job); fmt.Sprint(got) != fmt.Sprint(tc.findings) {
+				t.Errorf("findings = %q, want %q", got, tc.findings)
+			}
+
+			m, ok := tc.check.(Mutator)
+			if !ok {
+				return
+			}
+			m.Mutate(job)
+			if got := tc.check.Findings(job); fmt.Sprint(got) != fmt.Sprint(tc.mutated) {
+				t.Errorf("findings after mutating = %q, want %q", got, tc.mutated)
+			}
+		})
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	resources := Rule{Name: "resources", Kind: "default_resources", Action: Mutate, Check: &DefaultResources{CPU: 100, MemoryMB: 128}}
+	memory := Rule{Name: "memory", Kind: "default_resources", Action: Mutate, Check: &DefaultResources{MemoryMB: 128}}
+	noDefaults := Rule{Name: "no-defaults", Kind: "default_resources", Action: Mutate, Check: &DefaultResources{}}
+	owner := Rule{Name: "owner", Kind: "required_meta", Action: Deny, Check: &RequiredMeta{Keys: []string{"owner"}}}
+	batch := Rule{Name: "batch", Kind: "required_meta", Action: Deny, Types: []string{api.JobTypeBatch}, Check: &RequiredMeta{Keys: []string{"owner"}}}
+
+	tests := map[string]struct {
+		rules   []Rule
+		mutated bool
+		actions map[Action]int
+	}{
+		"mutation changes the job": {
+			rules:   []Rule{resources},
+			mutated: true,
+			actions: map[Action]int{Mutate: 2},
+		},
+		"mutation without defaults warns": {
+			rules:   []Rule{noDefaults},
+			actions: map[Action]int{Warn: 2},
+		},
+		"later rules see the mutated job": {
+			rules:   []Rule{memory, noDefaults},
+			mutated: true,
+			actions: map[Action]int{Mutate: 2, Warn: 1},
+		},
+		"deny": {
+			rules:   []Rule{owner},
+			actions: map[Action]int{Deny: 1},
+		},
+		"rules of other job types are skipped": {
+			rules:   []Rule{batch},
+			actions: map[Action]int{},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			review := Evaluate(tc.rules, testJob())
+			if review.Mutated() != tc.mutated {
+				t.Errorf("mutated = %t, want %t", review.Mutated(), tc.mutated)
+			}
+			actions := map[Action]int{}
+			for _, d := range review.Decisions {
+				actions[d.Action]++
+			}
+			if fmt.Sprint(actions) != fmt.Sprint(tc.actions) {
+				t.Errorf("actions = %v, want %v", actions, tc.actions)
+			}
+		})
+	}
+}
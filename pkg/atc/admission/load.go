@@ -0,0 +1,196 @@
+package admission
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/nomad/api"
+	"go.yaml.in/yaml/v3"
+)
+
+type ruleFile struct {
+	Rules []ruleSpec `yaml:"rules"`
+}
+
+type ruleSpec struct {
+	Name   string    `yaml:"name"`
+	Kind   string    `yaml:"kind"`
+	Action Action    `yaml:"action"`
+	Types  []string  `yaml:"types"`
+	Spec   yaml.Node `yaml:"spec"`
+}
+
+// LoadRules reads and validates the rules of every YAML file in a directory.
+// Files are read in lexical order, and the rules within a file in the order
+// they are listed.
+func LoadRules(dir string) ([]Rule, error) {
+	rules, _, err := loadRules(dir)
+	return rules, err
+}
+
+func loadRules(dir string) ([]Rule, [sha256.Size]byte, error) {
+	var fingerprint [sha256.Size]byte
+
+	files, err := ruleFiles(dir)
+	if err != nil {
+		return nil, fingerprint, err
+	}
+
+	var (
+		rules []Rule
+		hash  = sha256.New()
+		seen  = map[string]string{}
+	)
+	for _, filename := range files {
+		buf, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, fingerprint, fmt.Errorf("failed to read admission rule file: %w", err)
+		}
+		fmt.Fprintf(hash, "%s\x00%d\x00", filename, len(buf))
+		hash.Write(buf)
+
+		var rf ruleFile
+		dec := yaml.NewDecoder(bytes.NewReader(buf))
+		dec.KnownFields(true)
+		if err := dec.Decode(&rf); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fingerprint, fmt.Errorf("failed to parse admission rule file %s: %w", filename, err)
+		}
+
+		for i, spec := range rf.Rules {
+			rule, err := spec.rule()
+			if err != nil {
+				return nil, fingerprint, fmt.Errorf("invalid admission rule %d in %s: %w", i, filename, err)
+			}
+			if other, ok := seen[rule.Name]; ok {
+				return nil, fingerprint, fmt.Errorf("duplicate admission rule %q in %s and %s", rule.Name, other, filename)
+			}
+			seen[rule.Name] = filename
+			rules = append(rules, rule)
+		}
+	}
+
+	copy(fingerprint[:], hash.Sum(nil))
+	return rules, fingerprint, nil
+}
+
+func ruleFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read admission rules directory: %w", err)
+	}
+
+	var files []string
+	for _, entry := range entries {
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		if entry.IsDir() || (ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+		files = append(files, filepath.Join(dir, entry.Name()))
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func (s ruleSpec) rule() (Rule, error) {
+	if s.Name == "" {
+		return Rule{}, fmt.Errorf("name is required")
+	}
+
+	check, ok := newCheck(s.Kind)
+	if !ok {
+		return Rule{}, fmt.Errorf("unknown kind %q of rule %q, must be one of %s", s.Kind, s.Name, strings.Join(Kinds(), ", "))
+	}
+
+	switch s.Action {
+	case Deny, Warn:
+	case Mutate:
+		if _, ok := check.(Mutator); !ok {
+			return Rule{}, fmt.Errorf("rule %q of kind %q cannot mutate jobs", s.Name, s.Kind)
+		}
+	default:
+		return Rule{}, fmt.Errorf("invalid action %q of rule %q, must be one of deny, warn or mutate", s.Action, s.Name)
+	}
+
+	if !s.Spec.IsZero() {
+		// Decoding a node directly does not report unknown fields.
+		buf, err := yaml.Marshal(&s.Spec)
+		if err != nil {
+			return Rule{}, err
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(buf))
+		dec.KnownFields(true)
+		if err := dec.Decode(check); err != nil {
+			return Rule{}, fmt.Errorf("invalid spec of rule %q: %w", s.Name, err)
+		}
+	}
+	if v, ok := check.(Validator); ok {
+		if err := v.Validate(); err != nil {
+			return Rule{}, fmt.Errorf("invalid spec of rule %q: %w", s.Name, err)
+		}
+	}
+
+	return Rule{
+		Name:   s.Name,
+		Kind:   s.Kind,
+		Action: s.Action,
+		Types:  s.Types,
+		Check:  check,
+	}, nil
+}
+
+// Engine holds the rules loaded from a directory, and reloads them when the
+// files in the directory change.
+type Engine struct {
+	dir string
+
+	mtx         sync.RWMutex
+	rules       []Rule
+	fingerprint [sha256.Size]byte
+}
+
+func NewEngine(dir string) *Engine {
+	return &Engine{dir: dir}
+}
+
+// Reload loads the rules when any of the rule files changed since the last
+// successful load, and reports whether they did. The current rules are kept
+// when the new ones fail to load.
+func (e *Engine) Reload() (bool, error) {
+	rules, fingerprint, err := loadRules(e.dir)
+	if err != nil {
+		return false, err
+	}
+
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	if fingerprint == e.fingerprint && e.rules != nil {
+		return false, nil
+	}
+	if rules == nil {
+		rules = []Rule{}
+	}
+	e.rules = rules
+	e.fingerprint = fingerprint
+	return true, nil
+}
+
+// Rules returns the currently loaded rules.
+func (e *Engine) Rules() []Rule {
+	e.mtx.RLock()
+	defer e.mtx.RUnlock()
+	return e.rules
+}
+
+// Evaluate applies the currently loaded rules to the job.
+func (e *Engine) Evaluate(job *api.Job) Review {
+	return Evaluate(e.Rules(), job)
+}
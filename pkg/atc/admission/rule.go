@@ -0,0 +1,179 @@
+package admission
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/hashicorp/nomad/api"
+	"golang.org/x/exp/slices"
+)
+
+// Action is what a rule does with a job that does not comply with it.
+type Action string
+
+const (
+	Deny   Action = "deny"
+	Warn   Action = "warn"
+	Mutate Action = "mutate"
+)
+
+// Check is implemented by every kind of rule.
+type Check interface {
+	// Findings describes every way in which the job does not comply with
+	// the rule.
+	Findings(job *api.Job) []string
+}
+
+// Mutator is implemented by the checks that can bring a job in compliance.
+type Mutator interface {
+	Mutate(job *api.Job)
+}
+
+// Validator is implemented by the checks whose settings can be invalid.
+type Validator interface {
+	Validate() error
+}
+
+var (
+	kindsMtx sync.RWMutex
+	kinds    = map[string]func() Check{}
+)
+
+// Register makes a kind of rule available to rule files. newCheck returns a
+// Check into which the spec of a rule is decoded. Register is meant to be
+// called from init functions, and panics when the kind is registered twice.
+func Register(kind string, newCheck func() Check) {
+	kindsMtx.Lock()
+	defer kindsMtx.Unlock()
+
+	if _, ok := kinds[kind]; ok {
+		panic(fmt.Sprintf("admission rule kind %q registered twice", kind))
+	}
+	kinds[kind] = newCheck
+}
+
+// Kinds returns the names of the registered kinds of rules.
+func Kinds() []string {
+	kindsMtx.RLock()
+	defer kindsMtx.RUnlock()
+
+	names := make([]string, 0, len(kinds))
+	for kind := range kinds {
+		names = append(names, kind)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func newCheck(kind string) (Check, bool) {
+	kindsMtx.RLock()
+	defer kindsMtx.RUnlock()
+
+	fn, ok := kinds[kind]
+	if !ok {
+		return nil, false
+	}
+	return fn(), true
+}
+
+// Rule is a check together with what to do with the jobs that fail it.
+type Rule struct {
+	Name   string
+	Kind   string
+	Action Action
+	// Types limits the rule to jobs of these types. It applies to all jobs
+	// when empty.
+	Types []string
+	Check Check
+}
+
+func (r Rule) applies(job *api.Job) bool {
+	if len(r.Types) == 0 {
+		return true
+	}
+	jobType := api.JobTypeService
+	if job.Type != nil {
+		jobType = *job.Type
+	}
+	return slices.Contains(r.Types, jobType)
+}
+
+// Decision records the outcome of a rule that the job did not comply with.
+type Decision struct {
+	Rule    string
+	Action  Action
+	Message string
+}
+
+// Review is the outcome of evaluating the rules against a job.
+type Review struct {
+	Decisions []Decision
+
+	mutated bool
+}
+
+// Messages returns the messages of the decisions with the given action,
+// prefixed with the name of their rule.
+func (r Review) Messages(action Action) []string {
+	var messages []string
+	for _, d := range r.Decisions {
+		if d.Action == action {
+			messages = append(messages, fmt.Sprintf("%s: %s", d.Rule, d.Message))
+		}
+	}
+	return messages
+}
+
+// Mutated reports whether any rule changed the job.
+func (r Review) Mutated() bool {
+	return r.mutated
+}
+
+// Evaluate applies the rules to the job in order. Rules that mutate the job
+// do so in place, so later rules see the job as mutated by earlier ones. The
+// findings of a mutating rule that left the job as it was, e.g. because it
+// has no default to set, are recorded as warnings.
+func Evaluate(rules []Rule, job *api.Job) Review {
+	var review Review
+	for _, rule := range rules {
+		if !rule.applies(job) {
+			continue
+		}
+
+		findings := rule.Check.Findings(job)
+		if len(findings) == 0 {
+			continue
+		}
+		action := rule.Action
+		if action == Mutate {
+			if mutate(rule.Check.(Mutator), job) {
+				review.mutated = true
+			} else {
+				action = Warn
+			}
+		}
+		for _, finding := range findings {
+			review.Decisions = append(review.Decisions, Decision{
+				Rule:    rule.Name,
+				Action:  action,
+				Message: finding,
+			})
+		}
+	}
+	return review
+}
+
+// mutate applies the mutation to the job and reports whether it changed it.
+func mutate(m Mutator, job *api.Job) bool {
+	before, err := json.Marshal(job)
+	if err != nil {
+		m.Mutate(job)
+		return true
+	}
+	m.Mutate(job)
+	after, err := json.Marshal(job)
+	return err != nil || !bytes.Equal(before, after)
+}
@@ -2,9 +2,12 @@ package atc
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
@@ -13,22 +16,127 @@ import (
 	"github.com/grafana/dskit/server"
 	"github.com/grafana/dskit/services"
 	"github.com/grafana/dskit/signals"
+	"github.com/hashicorp/consul/api"
 	"github.com/pkg/errors"
 	"go.uber.org/atomic"
 
+	"github.com/attachmentgenie/atc/pkg/atc/admission"
 	"github.com/attachmentgenie/atc/pkg/atc/autoscaler"
+	"github.com/attachmentgenie/atc/pkg/atc/configentry"
+	"github.com/attachmentgenie/atc/pkg/atc/consul"
 	"github.com/attachmentgenie/atc/pkg/atc/deployer"
 	"github.com/attachmentgenie/atc/pkg/atc/event_sink"
 	"github.com/attachmentgenie/atc/pkg/atc/forwarder"
 	"github.com/attachmentgenie/atc/pkg/atc/incident"
+	"github.com/attachmentgenie/atc/pkg/atc/leader"
+	"github.com/attachmentgenie/atc/pkg/atc/nomad"
 	"github.com/attachmentgenie/atc/pkg/atc/radar"
 	"github.com/attachmentgenie/atc/pkg/atc/redirecter"
+	"github.com/attachmentgenie/atc/pkg/atc/watcher"
 )
 
 type Config struct {
 	Name   string                 `yaml:"service"`
 	Server server.Config          `yaml:"server"`
 	Target flagext.StringSliceCSV `yaml:"target"`
+	DryRun bool                   `yaml:"dry_run"`
+
+	Autoscaler autoscaler.Config       `yaml:"autoscaler"`
+	Boundary   incident.BoundaryConfig `yaml:"boundary"`
+	Consul     consul.Config           `yaml:"consul"`
+	Deployer   deployer.Config         `yaml:"deployer"`
+	EventSink  event_sink.Config       `yaml:"event_sink"`
+	Forwarder  forwarder.Config        `yaml:"forwarder"`
+	Incident   incident.Config         `yaml:"incident"`
+	Leader     leader.Config           `yaml:"leader"`
+	Nomad      nomad.Config            `yaml:"nomad"`
+	Radar      radar.Config            `yaml:"radar"`
+	Redirecter redirecter.Config       `yaml:"redirecter"`
+	Watcher    watcher.Config          `yaml:"watcher"`
+}
+
+// RegisterFlags registers the flags of the server and all module
+// configurations.
+func (c *Config) RegisterFlags(f *flag.FlagSet) {
+	c.Target = []string{All}
+	f.Var(&c.Target, "target", "Comma-separated list of components to include in the instantiated process. Use the 'modules' command line flag to get a list of available components, and to see which components are included with 'all'.")
+
+	f.BoolVar(&c.DryRun, "dry-run", false, "Compute, log and expose the config entry changes of all modules without writing them to Consul.")
+
+	c.Server.RegisterFlags(f)
+	// ATC listens on 8088 rather than the dskit default of 80.
+	f.Lookup("server.http-listen-port").DefValue = "8088"
+	c.Server.HTTPListenPort = 8088
+
+	c.Autoscaler.RegisterFlags(f)
+	c.Boundary.RegisterFlags(f)
+	c.Consul.RegisterFlags(f)
+	c.Deployer.RegisterFlags(f)
+	c.EventSink.RegisterFlags(f)
+	c.Forwarder.RegisterFlags(f)
+	c.Incident.RegisterFlags(f)
+	c.Leader.RegisterFlags(f)
+	c.Nomad.RegisterFlags(f)
+	c.Radar.RegisterFlags(f)
+	c.Redirecter.RegisterFlags(f)
+	c.Watcher.RegisterFlags(f)
+}
+
+// Validate checks the configuration of every module, including the files it
+// refers to, without connecting to any external service.
+func (c *Config) Validate() error {
+	if err := c.Autoscaler.Validate(); err != nil {
+		return err
+	}
+	if c.Autoscaler.PolicyFile != "" {
+		if _, err := autoscaler.LoadPolicies(c.Autoscaler.PolicyFile); err != nil {
+			return err
+		}
+	}
+	if err := c.Boundary.Validate(); err != nil {
+		return err
+	}
+	if err := c.Consul.Validate(); err != nil {
+		return err
+	}
+	if err := c.Deployer.Validate(); err != nil {
+		return err
+	}
+	if c.Deployer.RulesDir != "" {
+		if _, err := admission.LoadRules(c.Deployer.RulesDir); err != nil {
+			return err
+		}
+	}
+	if err := c.EventSink.Validate(); err != nil {
+		return err
+	}
+	if err := c.Forwarder.Validate(); err != nil {
+		return err
+	}
+	if err := c.Incident.Validate(); err != nil {
+		return err
+	}
+	if err := c.Leader.Validate(); err != nil {
+		return err
+	}
+	if err := c.Nomad.Validate(); err != nil {
+		return err
+	}
+	if err := c.Radar.Validate(); err != nil {
+		return err
+	}
+	if err := c.Redirecter.Validate(); err != nil {
+		return err
+	}
+	if c.Redirecter.PolicyFile != "" {
+		if _, err := redirecter.LoadPolicies(c.Redirecter.PolicyFile); err != nil {
+			return err
+		}
+	}
+	if err := c.Watcher.Validate(); err != nil {
+		return err
+	}
+	return nil
 }
 
 type Atc struct {
@@ -36,26 +144,48 @@ type Atc struct {
 	logger log.Logger
 	Server *server.Server
 
+	ConsulClient  *api.Client
+	ConfigEntries *configentry.Writer
+	NomadClient   *nomad.Client
+
 	Autoscaler *autoscaler.Autoscaler
+	Boundary   *incident.Boundary
 	Deployer   *deployer.Deployer
 	EventSink  *event_sink.EventSink
 	Forwarder  *forwarder.Forwarder
 	Incident   *incident.Incident
+	Leader     *leader.Elector
 	Radar      *radar.Radar
 	Redirecter *redirecter.Redirecter
+	Watcher    *watcher.Watcher
 
 	// set during initialization
 	ServiceMap    map[string]services.Service
 	ModuleManager *modules.Manager
+
+	startTimesMtx sync.Mutex
+	startTimes    map[string]time.Time
 }
 
 func New(cfg Config) (*Atc, error) {
 	logger := initLogger(cfg.Server.LogFormat, cfg.Server.LogLevel)
 	cfg.Server.Log = logger
 
+	consulClient, err := consul.NewClient(cfg.Consul)
+	if err != nil {
+		return nil, err
+	}
+
+	nomadClient, err := nomad.NewClient(cfg.Nomad)
+	if err != nil {
+		return nil, err
+	}
+
 	atc := &Atc{
-		Cfg:    cfg,
-		logger: logger,
+		Cfg:          cfg,
+		logger:       logger,
+		ConsulClient: consulClient,
+		NomadClient:  nomadClient,
 	}
 
 	if err := atc.setupModuleManager(); err != nil {
@@ -65,12 +195,24 @@ func New(cfg Config) (*Atc, error) {
 	return atc, nil
 }
 
-func (t *Atc) Run() error {
+// ValidateTargets checks that every selected target is a known module that
+// may be targeted.
+func (t *Atc) ValidateTargets() error {
 	for _, module := range t.Cfg.Target {
+		if !t.ModuleManager.IsModuleRegistered(module) {
+			return fmt.Errorf("selected target (%s) is not a known module", module)
+		}
 		if !t.ModuleManager.IsTargetableModule(module) {
 			return fmt.Errorf("selected target (%s) is an internal module, which is not allowed", module)
 		}
 	}
+	return nil
+}
+
+func (t *Atc) Run() error {
+	if err := t.ValidateTargets(); err != nil {
+		return err
+	}
 
 	var err error
 	t.ServiceMap, err = t.ModuleManager.InitModuleServices(t.Cfg.Target...)
@@ -80,7 +222,8 @@ func (t *Atc) Run() error {
 
 	// get all services, create service manager and tell it to start
 	servs := []services.Service(nil)
-	for _, s := range t.ServiceMap {
+	for name, s := range t.ServiceMap {
+		s.AddListener(services.NewListener(nil, func() { t.setStartTime(name) }, nil, nil, nil))
 		servs = append(servs, s)
 	}
 
@@ -2,22 +2,93 @@ package autoscaler
 
 import (
 	"context"
+	"flag"
 	"fmt"
+	"net/url"
+	"sort"
+	"time"
+
 	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
 	"github.com/grafana/dskit/services"
-	"github.com/hashicorp/consul/api"
-	"github.com/hashicorp/consul/api/watch"
+	"github.com/hashicorp/nomad/api"
+	promapi "github.com/prometheus/client_golang/api"
+	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/attachmentgenie/atc/pkg/atc/leader"
+	"github.com/attachmentgenie/atc/pkg/atc/nomad"
+	"github.com/attachmentgenie/atc/pkg/atc/watcher"
 )
 
+type Config struct {
+	PolicyFile            string        `yaml:"policy_file"`
+	JobMeta               bool          `yaml:"job_meta"`
+	EvaluationInterval    time.Duration `yaml:"evaluation_interval"`
+	PolicyRefreshInterval time.Duration `yaml:"policy_refresh_interval"`
+	PrometheusAddress     string        `yaml:"prometheus_address"`
+}
+
+func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.PolicyFile, "autoscaler.policy-file", "", "YAML file listing the scaling policies of Nomad task groups.")
+	f.BoolVar(&cfg.JobMeta, "autoscaler.job-meta", true, "Read scaling policies from the atc.autoscaler.* meta of Nomad task groups. Policies in the policy file take precedence.")
+	f.DurationVar(&cfg.EvaluationInterval, "autoscaler.evaluation-interval", 30*time.Second, "Interval at which the scaling policies are evaluated.")
+	f.DurationVar(&cfg.PolicyRefreshInterval, "autoscaler.policy-refresh-interval", time.Minute, "Interval at which the scaling policies in the job meta are reloaded from Nomad.")
+	f.StringVar(&cfg.PrometheusAddress, "autoscaler.prometheus-address", "", "Address of the Prometheus HTTP API the queries of scaling checks are run against, e.g. http://127.0.0.1:9090.")
+}
+
+func (cfg *Config) Validate() error {
+	if cfg.EvaluationInterval <= 0 {
+		return fmt.Errorf("invalid autoscaler evaluation interval: %s", cfg.EvaluationInterval)
+	}
+	if cfg.PolicyRefreshInterval <= 0 {
+		return fmt.Errorf("invalid autoscaler policy refresh interval: %s", cfg.PolicyRefreshInterval)
+	}
+	if cfg.PrometheusAddress != "" {
+		if _, err := url.Parse(cfg.PrometheusAddress); err != nil {
+			return fmt.Errorf("invalid autoscaler prometheus address: %w", err)
+		}
+	}
+	return nil
+}
+
+// Autoscaler scales Nomad task groups based on the health of their Consul
+// services and the value of Prometheus queries. Only the leader scales.
 type Autoscaler struct {
 	services.Service
 
-	logger log.Logger
+	cfg        Config
+	client     *nomad.Client
+	prometheus promv1.API
+	logger     log.Logger
+
+	filePolicies []Policy
+	// metaPolicies holds the policies read from the job meta. It is nil
+	// until loaded from Nomad.
+	metaPolicies []Policy
+	// history holds the demand of the task groups with predictive scaling,
+	// by policy key.
+	history map[string]history
+
+	actionsTotal *prometheus.CounterVec
+	errorsTotal  *prometheus.CounterVec
 
-	watchServicesChan chan struct{}
+	elector   *leader.Elector
+	snapshots <-chan *watcher.Snapshot
 }
 
 func (f *Autoscaler) starting(ctx context.Context) error {
+	if f.cfg.PolicyFile == "" {
+		return nil
+	}
+
+	policies, err := LoadPolicies(f.cfg.PolicyFile)
+	if err != nil {
+		return err
+	}
+	f.filePolicies = policies
+	level.Info(f.logger).Log("msg", "loaded scaling policies", "file", f.cfg.PolicyFile, "policies", len(policies))
 	return nil
 }
 
@@ -25,69 +96,147 @@ func (f *Autoscaler) stopping(_ error) error {
 	return nil
 }
 
-func New(logger log.Logger) (*Autoscaler, error) {
+func New(cfg Config, client *nomad.Client, elector *leader.Elector, snapshots <-chan *watcher.Snapshot, logger log.Logger, reg prometheus.Registerer) (*Autoscaler, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
 
 	f := &Autoscaler{
-		logger: logger,
+		cfg:       cfg,
+		client:    client,
+		logger:    log.With(logger, "module", "autoscaler"),
+		elector:   elector,
+		snapshots: snapshots,
+		history:   map[string]history{},
+		actionsTotal: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "atc_autoscaler_scaling_actions_total",
+			Help: "Total number of scaling actions, by job, group and direction.",
+		}, []string{"namespace", "job", "group", "direction"}),
+		errorsTotal: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "atc_autoscaler_evaluation_errors_total",
+			Help: "Total number of scaling policy evaluations that failed, by job and group.",
+		}, []string{"namespace", "job", "group"}),
+	}
+	if cfg.PrometheusAddress != "" {
+		client, err := promapi.NewClient(promapi.Config{Address: cfg.PrometheusAddress})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create prometheus client: %w", err)
+		}
+		f.prometheus = promv1.NewAPI(client)
 	}
-	f.Service = services.NewBasicService(f.starting, f.watcher, f.stopping)
+	f.Service = services.NewBasicService(f.starting, f.running, f.stopping)
 	return f, nil
 }
 
-func (f *Autoscaler) watcher(ctx context.Context) error {
-	client, err := api.NewClient(&api.Config{})
-	if err != nil {
-		return fmt.Errorf("failed to connect to consul: %s", err.Error())
-	}
+func (f *Autoscaler) running(ctx context.Context) error {
+	evaluate := time.NewTicker(f.cfg.EvaluationInterval)
+	defer evaluate.Stop()
 
-	servicesWatcher, parseErr := watch.Parse(map[string]interface{}{"type": "services"})
-	if parseErr != nil {
-		return fmt.Errorf("failed to create services watcher plan: %s", parseErr.Error())
+	var refresh <-chan time.Time
+	if f.cfg.JobMeta {
+		ticker := time.NewTicker(f.cfg.PolicyRefreshInterval)
+		defer ticker.Stop()
+		refresh = ticker.C
 	}
 
-	servicesWatcher.HybridHandler = func(_ watch.BlockingParamVal, _ interface{}) {
+	var snapshot *watcher.Snapshot
+	for {
 		select {
 		case <-ctx.Done():
-		case f.watchServicesChan <- struct{}{}:
-		default:
-			// Event chan is full, discard event.
+			return nil
+
+		case snapshot = <-f.snapshots:
+		case <-refresh:
+			// The policies are read again at the next evaluation by the
+			// leader.
+			f.metaPolicies = nil
+
+		case <-evaluate.C:
+			if !f.elector.IsLeader() {
+				continue
+			}
+			if f.cfg.JobMeta && f.metaPolicies == nil {
+				if err := f.loadMetaPolicies(ctx); err != nil {
+					level.Error(f.logger).Log("msg", "failed to load scaling policies from job meta", "err", err)
+				}
+			}
+			policies := f.policies()
+			if !f.cfg.JobMeta || f.metaPolicies != nil {
+				f.pruneHistory(policies)
+			}
+			for _, p := range policies {
+				if err := f.evaluate(ctx, p, snapshot); err != nil {
+					level.Error(f.logger).Log("msg", "failed to evaluate scaling policy", "namespace", p.namespace(), "job", p.Job, "group", p.Group, "err", err)
+					f.errorsTotal.WithLabelValues(p.namespace(), p.Job, p.Group).Inc()
+				}
+			}
 		}
 	}
+}
 
-	checksWatcher, err := watch.Parse(map[string]interface{}{"type": "checks"})
+// loadMetaPolicies reads the scaling policies from the meta of the task
+// groups of every job. Jobs with an invalid policy are skipped.
+func (f *Autoscaler) loadMetaPolicies(ctx context.Context) error {
+	stubs, _, err := f.client.Jobs().List((&api.QueryOptions{Namespace: "*"}).WithContext(ctx))
 	if err != nil {
-		return fmt.Errorf("failed to create checks watcher plan: %w", err)
+		return fmt.Errorf("failed to list jobs: %w", err)
 	}
 
-	checksWatcher.HybridHandler = func(_ watch.BlockingParamVal, _ interface{}) {
-		select {
-		case <-ctx.Done():
-		case f.watchServicesChan <- struct{}{}:
-		default:
-			// Event chan is full, discard event.
+	policies := []Policy{}
+	for _, stub := range stubs {
+		if stub.Stop || stub.Type == api.JobTypeBatch || stub.Type == api.JobTypeSysbatch {
+			continue
 		}
-	}
-
-	errChan := make(chan error, 2)
 
-	defer func() {
-		servicesWatcher.Stop()
-		checksWatcher.Stop()
-	}()
+		job, _, err := f.client.Jobs().Info(stub.ID, (&api.QueryOptions{Namespace: stub.Namespace}).WithContext(ctx))
+		if err != nil {
+			return fmt.Errorf("failed to get job %s: %w", stub.ID, err)
+		}
+		jobPolicies, err := policiesFromMeta(job)
+		if err != nil {
+			level.Warn(f.logger).Log("msg", "ignoring invalid scaling policy in job meta", "namespace", stub.Namespace, "job", stub.ID, "err", err)
+			continue
+		}
+		policies = append(policies, jobPolicies...)
+	}
 
-	go func() {
-		errChan <- servicesWatcher.RunWithClientAndHclog(client, servicesWatcher.Logger)
-	}()
+	f.metaPolicies = policies
+	return nil
+}
 
-	go func() {
-		errChan <- checksWatcher.RunWithClientAndHclog(client, checksWatcher.Logger)
-	}()
+// policies returns the policies from the policy file and the job meta, the
+// former taking precedence, ordered by task group.
+func (f *Autoscaler) policies() []Policy {
+	byKey := map[string]Policy{}
+	for _, p := range f.metaPolicies {
+		byKey[p.key()] = p
+	}
+	for _, p := range f.filePolicies {
+		byKey[p.key()] = p
+	}
 
-	select {
-	case <-ctx.Done():
-		return nil
+	policies := make([]Policy, 0, len(byKey))
+	for _, p := range byKey {
+		policies = append(policies, p)
+	}
+	sort.Slice(policies, func(i, j int) bool {
+		return policies[i].key() < policies[j].key()
+	})
+	return policies
+}
 
-	case err = <-errChan:
-		return fmt.Errorf("services or checks watcher terminated: %w", err)
+// pruneHistory drops the demand history of task groups that no longer have
+// predictive scaling.
+func (f *Autoscaler) pruneHistory(policies []Policy) {
+	keep := map[string]struct{}{}
+	for _, p := range policies {
+		if p.Predictive != nil {
+			keep[p.key()] = struct{}{}
+		}
+	}
+	for key := range f.history {
+		if _, ok := keep[key]; !ok {
+			delete(f.history, key)
+		}
 	}
 }
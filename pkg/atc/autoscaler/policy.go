@@ -0,0 +1,234 @@
+package autoscaler
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/nomad/api"
+	"go.yaml.in/yaml/v3"
+)
+
+// metaPrefix prefixes the task group meta keys that configure a scaling
+// policy, e.g. atc.autoscaler.max.
+const metaPrefix = "atc.autoscaler."
+
+// Policy describes how the count of a Nomad task group is scaled.
+type Policy struct {
+	Job       string        `yaml:"job"`
+	Group     string        `yaml:"group"`
+	Namespace string        `yaml:"namespace"`
+	Min       int           `yaml:"min"`
+	Max       int           `yaml:"max"`
+	Cooldown  time.Duration `yaml:"cooldown"`
+
+	// Service is the Consul service registered by the group. Critical
+	// instances of the service are replaced by scaling out.
+	Service string `yaml:"service"`
+	// MinPassing is the number of passing instances to keep at least.
+	MinPassing int `yaml:"min_passing"`
+	// Checks add as many instances as needed to handle the value of their
+	// source.
+	Checks []Check `yaml:"checks"`
+	// Combine is how the instances needed by the checks are combined: max,
+	// min, avg or sum. Defaults to max.
+	Combine string `yaml:"combine"`
+
+	// Schedules replace min and max during recurring windows.
+	Schedules []Schedule `yaml:"schedules"`
+	// Predictive raises the count ahead of the demand expected from the
+	// history of the checks.
+	Predictive *Predictive `yaml:"predictive"`
+}
+
+// Check asks for one instance per TargetPerInstance of the value of its
+// source.
+type Check struct {
+	Name              string  `yaml:"name"`
+	Source            string  `yaml:"source"`
+	TargetPerInstance float64 `yaml:"target_per_instance"`
+
+	// Query is the query of the prometheus source.
+	Query string `yaml:"query"`
+	// Service and Status select the instances counted by the consul
+	// source. Status is passing, warning, critical, maintenance or any, and
+	// defaults to passing.
+	Service string `yaml:"service"`
+	Status  string `yaml:"status"`
+	// Value is the value of the static source.
+	Value float64 `yaml:"value"`
+}
+
+type policyFile struct {
+	Policies []Policy `yaml:"policies"`
+}
+
+// LoadPolicies reads and validates the scaling policies from a YAML file.
+func LoadPolicies(filename string) ([]Policy, error) {
+	buf, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read scaling policy file: %w", err)
+	}
+
+	var pf policyFile
+	dec := yaml.NewDecoder(bytes.NewReader(buf))
+	dec.KnownFields(true)
+	if err := dec.Decode(&pf); err != nil {
+		return nil, fmt.Errorf("failed to parse scaling policy file %s: %w", filename, err)
+	}
+
+	seen := map[string]struct{}{}
+	for i, p := range pf.Policies {
+		if err := p.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid scaling policy %d in %s: %w", i, filename, err)
+		}
+		if _, ok := seen[p.key()]; ok {
+			return nil, fmt.Errorf("duplicate scaling policy for %s in %s", p.key(), filename)
+		}
+		seen[p.key()] = struct{}{}
+	}
+	return pf.Policies, nil
+}
+
+func (p Policy) Validate() error {
+	if p.Job == "" || p.Group == "" {
+		return fmt.Errorf("job and group are required")
+	}
+	if p.Min < 0 || p.Max < p.Min {
+		return fmt.Errorf("invalid bounds of %s: min %d, max %d", p.key(), p.Min, p.Max)
+	}
+	if p.Max == 0 {
+		return fmt.Errorf("max of %s is required", p.key())
+	}
+	if p.Cooldown < 0 {
+		return fmt.Errorf("cooldown of %s must not be negative", p.key())
+	}
+	if p.MinPassing < 0 {
+		return fmt.Errorf("min_passing of %s must not be negative", p.key())
+	}
+	if p.MinPassing > 0 && p.Service == "" {
+		return fmt.Errorf("min_passing of %s requires a service", p.key())
+	}
+	if p.MinPassing == 0 && len(p.Checks) == 0 && len(p.Schedules) == 0 {
+		return fmt.Errorf("no min_passing, checks or schedules set for %s", p.key())
+	}
+	switch p.Combine {
+	case "", CombineMax, CombineMin, CombineAvg, CombineSum:
+	default:
+		return fmt.Errorf("invalid combine of %s: %q", p.key(), p.Combine)
+	}
+	for i, c := range p.Checks {
+		if err := c.Validate(); err != nil {
+			return fmt.Errorf("invalid check %d of %s: %w", i, p.key(), err)
+		}
+	}
+	for i, s := range p.Schedules {
+		if err := s.Validate(); err != nil {
+			return fmt.Errorf("invalid schedule %d of %s: %w", i, p.key(), err)
+		}
+	}
+	if p.Predictive != nil {
+		if len(p.Checks) == 0 {
+			return fmt.Errorf("predictive scaling of %s requires checks", p.key())
+		}
+		if err := p.Predictive.Validate(); err != nil {
+			return fmt.Errorf("invalid predictive scaling of %s: %w", p.key(), err)
+		}
+	}
+	return nil
+}
+
+func (c Check) Validate() error {
+	if c.TargetPerInstance <= 0 {
+		return fmt.Errorf("target_per_instance must be positive")
+	}
+	switch c.source() {
+	case SourcePrometheus:
+		if c.Query == "" {
+			return fmt.Errorf("query is required")
+		}
+	case SourceConsul:
+		if c.Service == "" {
+			return fmt.Errorf("service is required")
+		}
+		switch c.Status {
+		case "", "passing", "warning", "critical", "maintenance", "any":
+		default:
+			return fmt.Errorf("invalid status %q", c.Status)
+		}
+	case SourceStatic:
+		if c.Value < 0 {
+			return fmt.Errorf("value must not be negative")
+		}
+	default:
+		return fmt.Errorf("unknown source %q", c.Source)
+	}
+	return nil
+}
+
+func (c Check) source() string {
+	if c.Source == "" {
+		return SourcePrometheus
+	}
+	return c.Source
+}
+
+func (p Policy) namespace() string {
+	if p.Namespace == "" {
+		return api.DefaultNamespace
+	}
+	return p.Namespace
+}
+
+func (p Policy) key() string {
+	return p.namespace() + "/" + p.Job + "/" + p.Group
+}
+
+// policiesFromMeta builds the scaling policies of the task groups of a job
+// that configure one in their meta. A policy is enabled by setting
+// atc.autoscaler.max.
+func policiesFromMeta(job *api.Job) ([]Policy, error) {
+	var policies []Policy
+	for _, tg := range job.TaskGroups {
+		if tg.Name == nil || tg.Meta[metaPrefix+"max"] == "" {
+			continue
+		}
+
+		p := Policy{
+			Job:     *job.ID,
+			Group:   *tg.Name,
+			Service: tg.Meta[metaPrefix+"service"],
+		}
+		if job.Namespace != nil {
+			p.Namespace = *job.Namespace
+		}
+
+		var err error
+		meta := func(key string, parse func(string) error) {
+			if v, ok := tg.Meta[metaPrefix+key]; ok && err == nil {
+				if perr := parse(v); perr != nil {
+					err = fmt.Errorf("invalid %s%s of %s: %w", metaPrefix, key, p.key(), perr)
+				}
+			}
+		}
+		meta("min", func(v string) (err error) { p.Min, err = strconv.Atoi(v); return })
+		meta("max", func(v string) (err error) { p.Max, err = strconv.Atoi(v); return })
+		meta("cooldown", func(v string) (err error) { p.Cooldown, err = time.ParseDuration(v); return })
+		meta("min_passing", func(v string) (err error) { p.MinPassing, err = strconv.Atoi(v); return })
+		if query := tg.Meta[metaPrefix+"query"]; query != "" {
+			c := Check{Name: "meta", Query: query}
+			meta("target_per_instance", func(v string) (err error) { c.TargetPerInstance, err = strconv.ParseFloat(v, 64); return })
+			p.Checks = append(p.Checks, c)
+		}
+		if err == nil {
+			err = p.Validate()
+		}
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, p)
+	}
+	return policies, nil
+}
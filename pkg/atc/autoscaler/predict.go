@@ -0,0 +1,88 @@
+package autoscaler
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// defaultPredictiveDays is the number of previous days a prediction is based
+// on by default.
+const defaultPredictiveDays = 7
+
+// Predictive scales a task group ahead of time to the demand it had around
+// the same time on previous days.
+type Predictive struct {
+	// Lookahead is how far ahead the demand is predicted, which should cover
+	// the time new instances need to become healthy.
+	Lookahead time.Duration `yaml:"lookahead"`
+	// Days is the number of previous days the prediction is based on.
+	// Defaults to 7.
+	Days int `yaml:"days"`
+}
+
+func (p Predictive) Validate() error {
+	if p.Lookahead <= 0 {
+		return fmt.Errorf("lookahead must be positive")
+	}
+	if p.Days < 0 {
+		return fmt.Errorf("days must not be negative")
+	}
+	return nil
+}
+
+func (p Predictive) days() int {
+	if p.Days == 0 {
+		return defaultPredictiveDays
+	}
+	return p.Days
+}
+
+type sample struct {
+	time   time.Time
+	demand int
+}
+
+// history holds the demand of a task group at every evaluation, oldest
+// first. It is kept in memory by the leader, so it starts empty after a
+// restart or a change of leader.
+type history []sample
+
+// add records the demand at the given time and drops the samples that are
+// too old to be used by predictions.
+func (h history) add(now time.Time, demand int, p Predictive) history {
+	h = append(h, sample{time: now, demand: demand})
+
+	cutoff := now.Add(-time.Duration(p.days()) * 24 * time.Hour)
+	i := 0
+	for i < len(h) && h[i].time.Before(cutoff) {
+		i++
+	}
+	return h[i:]
+}
+
+// predict returns the demand expected within the lookahead, being the
+// average over previous days of the highest demand in the same period of
+// that day, and the number of days it was based on.
+func (h history) predict(now time.Time, p Predictive) (int, int) {
+	var total, days int
+	for day := 1; day <= p.days(); day++ {
+		from := now.Add(-time.Duration(day) * 24 * time.Hour)
+		to := from.Add(p.Lookahead)
+
+		peak := -1
+		for _, s := range h {
+			if !s.time.Before(from) && !s.time.After(to) {
+				peak = max(peak, s.demand)
+			}
+		}
+		if peak >= 0 {
+			total += peak
+			days++
+		}
+	}
+	if days == 0 {
+		return 0, 0
+	}
+	return int(math.Ceil(float64(total) / float64(days))), days
+}
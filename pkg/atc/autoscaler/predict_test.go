@@ -0,0 +1,66 @@
+package autoscaler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistoryPredict(t *testing.T) {
+	now := time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	samples := history{
+		{time: now.Add(-2*day + 5*time.Minute), demand: 3},
+		{time: now.Add(-day - time.Minute), demand: 50},
+		{time: now.Add(-day + 10*time.Minute), demand: 4},
+		{time: now.Add(-day + 20*time.Minute), demand: 6},
+		{time: now.Add(-day + 40*time.Minute), demand: 100},
+	}
+
+	tests := map[string]struct {
+		history  history
+		p        Predictive
+		want     int
+		wantDays int
+	}{
+		"no history": {p: Predictive{Lookahead: 30 * time.Minute}},
+		"average of the daily peaks": {
+			history:  samples,
+			p:        Predictive{Lookahead: 30 * time.Minute},
+			want:     5,
+			wantDays: 2,
+		},
+		"longer lookahead": {
+			history:  samples,
+			p:        Predictive{Lookahead: time.Hour},
+			want:     52,
+			wantDays: 2,
+		},
+		"fewer days": {
+			history:  samples,
+			p:        Predictive{Lookahead: 30 * time.Minute, Days: 1},
+			want:     6,
+			wantDays: 1,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, days := tc.history.predict(now, tc.p)
+			if got != tc.want || days != tc.wantDays {
+				t.Errorf("predict = %d over %d days, want %d over %d", got, days, tc.want, tc.wantDays)
+			}
+		})
+	}
+}
+
+func TestHistoryAdd(t *testing.T) {
+	now := time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC)
+	p := Predictive{Lookahead: time.Minute, Days: 2}
+
+	var h history
+	for _, age := range []time.Duration{72 * time.Hour, 48 * time.Hour, time.Hour, 0} {
+		h = h.add(now.Add(-age), 1, p)
+	}
+	if len(h) != 3 || !h[0].time.Equal(now.Add(-48*time.Hour)) {
+		t.Errorf("history = %v, want the samples of the last 2 days", h)
+	}
+}
@@ -0,0 +1,150 @@
+package autoscaler
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/hashicorp/nomad/api"
+
+	"github.com/attachmentgenie/atc/pkg/atc/watcher"
+)
+
+// evaluate computes the count the task group needs and scales it when that
+// differs from its current count.
+//
+// The count is the number of passing instances needed, being the highest of
+// min_passing and the combined needs of its checks, raised to the predicted
+// demand, plus one for every critical instance of the service of the group.
+// It is bounded by the min and max of the open schedule windows, or of the
+// policy when none is open. Within the cooldown the count is only changed to
+// bring it within these bounds.
+func (f *Autoscaler) evaluate(ctx context.Context, p Policy, snapshot *watcher.Snapshot) error {
+	status, _, err := f.client.Jobs().ScaleStatus(p.Job, (&api.QueryOptions{Namespace: p.namespace()}).WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to get scale status: %w", err)
+	}
+	if status.JobStopped {
+		return nil
+	}
+	group, ok := status.TaskGroups[p.Group]
+	if !ok {
+		return fmt.Errorf("task group %q not found", p.Group)
+	}
+	current := group.Desired
+	now := time.Now()
+
+	desired, reasons, err := f.demand(ctx, p, snapshot)
+	if err != nil {
+		return err
+	}
+	if p.Predictive != nil {
+		f.history[p.key()] = f.history[p.key()].add(now, desired, *p.Predictive)
+		if predicted, days := f.history[p.key()].predict(now, *p.Predictive); predicted > desired {
+			desired = predicted
+			reasons = append(reasons, fmt.Sprintf("predicted demand in %s is %d from %d days of history", p.Predictive.Lookahead, predicted, days))
+		}
+	}
+	if p.Service != "" && snapshot != nil {
+		if critical := snapshot.Health(p.Service).Critical; critical > 0 {
+			desired += critical
+			reasons = append(reasons, fmt.Sprintf("%d critical instances of service %s", critical, p.Service))
+		}
+	}
+
+	lo, hi, schedules := p.bounds(now)
+	bounds := "policy"
+	if len(schedules) > 0 {
+		bounds = "schedule " + strings.Join(schedules, ", ")
+	}
+	switch {
+	case desired < lo:
+		desired = lo
+		reasons = append(reasons, fmt.Sprintf("raised to min %d of %s", lo, bounds))
+	case desired > hi:
+		desired = hi
+		reasons = append(reasons, fmt.Sprintf("capped at max %d of %s", hi, bounds))
+	}
+
+	if desired == current {
+		return nil
+	}
+	if last := lastScaled(group.Events); time.Since(last) < p.Cooldown && current >= lo && current <= hi {
+		level.Debug(f.logger).Log("msg", "task group is in cooldown", "namespace", p.namespace(), "job", p.Job, "group", p.Group, "last_scaled", last)
+		return nil
+	}
+
+	reason := strings.Join(reasons, ", ")
+	meta := map[string]interface{}{"managed-by": "atc", "atc-module": "autoscaler"}
+	if _, _, err := f.client.Jobs().Scale(p.Job, p.Group, &desired, "atc autoscaler: "+reason, false, meta, (&api.WriteOptions{Namespace: p.namespace()}).WithContext(ctx)); err != nil {
+		return fmt.Errorf("failed to scale from %d to %d: %w", current, desired, err)
+	}
+
+	direction := "up"
+	if desired < current {
+		direction = "down"
+	}
+	level.Info(f.logger).Log("msg", "scaled task group", "namespace", p.namespace(), "job", p.Job, "group", p.Group, "from", current, "to", desired, "reason", reason)
+	f.actionsTotal.WithLabelValues(p.namespace(), p.Job, p.Group, direction).Inc()
+	return nil
+}
+
+// demand returns the number of passing instances the task group needs, and
+// the reasons for it.
+func (f *Autoscaler) demand(ctx context.Context, p Policy, snapshot *watcher.Snapshot) (int, []string, error) {
+	var (
+		demand  int
+		reasons []string
+	)
+	if p.MinPassing > 0 {
+		demand = p.MinPassing
+		reasons = append(reasons, fmt.Sprintf("min_passing is %d", p.MinPassing))
+	}
+	if len(p.Checks) == 0 {
+		return demand, reasons, nil
+	}
+
+	needs := make([]int, 0, len(p.Checks))
+	for i, c := range p.Checks {
+		name := c.Name
+		if name == "" {
+			name = fmt.Sprintf("check %d", i)
+		}
+
+		source, err := f.source(c, snapshot)
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid %s: %w", name, err)
+		}
+		value, err := source.Value(ctx)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to get the value of %s from %s: %w", name, c.source(), err)
+		}
+		needed := int(math.Ceil(value / c.TargetPerInstance))
+		needs = append(needs, needed)
+		reasons = append(reasons, fmt.Sprintf("%s is %g and needs %d instances", name, value, needed))
+	}
+
+	needed := combine(p.Combine, needs)
+	if len(needs) > 1 && p.Combine != "" && p.Combine != CombineMax {
+		reasons = append(reasons, fmt.Sprintf("%s of checks needs %d instances", p.Combine, needed))
+	}
+	return max(demand, needed), reasons, nil
+}
+
+// lastScaled returns the time of the most recent change of the count of a
+// task group, by ATC or otherwise.
+func lastScaled(events []api.ScalingEvent) time.Time {
+	var last time.Time
+	for _, e := range events {
+		if e.Count == nil || e.Error {
+			continue
+		}
+		if t := time.Unix(0, int64(e.Time)); t.After(last) {
+			last = t
+		}
+	}
+	return last
+}
@@ -0,0 +1,233 @@
+package autoscaler
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/hashicorp/nomad/api"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/attachmentgenie/atc/pkg/atc/nomad"
+	"github.com/attachmentgenie/atc/pkg/atc/watcher"
+)
+
+// fakeNomad serves the scale status of the web group of the shop job, and
+// records the scaling requests.
+type fakeNomad struct {
+	mtx      sync.Mutex
+	status   api.JobScaleStatusResponse
+	requests []api.ScalingRequest
+}
+
+func (n *fakeNomad) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	if r.URL.Path != "/v1/job/shop/scale" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		_ = json.NewEncoder(w).Encode(n.status)
+	case http.MethodPut, http.MethodPost:
+		var req api.ScalingRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		n.requests = append(n.requests, req)
+		_ = json.NewEncoder(w).Encode(api.JobRegisterResponse{EvalID: "eval-1"})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func testAutoscaler(t *testing.T, srv *httptest.Server) *Autoscaler {
+	t.Helper()
+	client, err := nomad.NewClient(nomad.Config{Address: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cfg Config
+	cfg.RegisterFlags(flag.NewFlagSet("test", flag.PanicOnError))
+	f, err := New(cfg, client, nil, nil, log.NewNopLogger(), prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// webSnapshot returns the instances of the web service.
+func webSnapshot(passing, critical int) *watcher.Snapshot {
+	var instances []watcher.Instance
+	for i := 0; i < passing+critical; i++ {
+		status := "passing"
+		if i >= passing {
+			status = "critical"
+		}
+		instances = append(instances, watcher.Instance{Service: "web", Status: status})
+	}
+	return &watcher.Snapshot{Instances: map[string][]watcher.Instance{"web": instances}}
+}
+
+func TestEvaluate(t *testing.T) {
+	demand := func(value float64) []Check {
+		return []Check{{Name: "requests", Source: SourceStatic, Value: value, TargetPerInstance: 100}}
+	}
+	peak := []Schedule{{Name: "peak", Cron: "0 0 * * *", Duration: 24 * time.Hour, Min: 6, Max: 8}}
+
+	tests := map[string]struct {
+		policy     Policy
+		snapshot   *watcher.Snapshot
+		current    int
+		lastScaled time.Duration
+		stopped    bool
+		// want is the count scaled to, or 0 when the group is not scaled.
+		want   int
+		reason string
+	}{
+		"demand of the checks": {
+			policy:  Policy{Min: 1, Max: 10, Checks: demand(250)},
+			current: 2,
+			want:    3,
+			reason:  "requests is 250 and needs 3 instances",
+		},
+		"min passing plus critical instances": {
+			policy:   Policy{Min: 1, Max: 10, Service: "web", MinPassing: 3},
+			snapshot: webSnapshot(3, 2),
+			current:  3,
+			want:     5,
+			reason:   "min_passing is 3, 2 critical instances of service web",
+		},
+		"demand plus critical instances": {
+			policy:   Policy{Min: 1, Max: 10, Service: "web", Checks: demand(400)},
+			snapshot: webSnapshot(3, 1),
+			current:  4,
+			want:     5,
+			reason:   "1 critical instances of service web",
+		},
+		"scaled down": {
+			policy:  Policy{Min: 1, Max: 10, Checks: demand(100)},
+			current: 4,
+			want:    1,
+		},
+		"capped at the max of the policy": {
+			policy:  Policy{Min: 1, Max: 10, Checks: demand(2000)},
+			current: 4,
+			want:    10,
+			reason:  "capped at max 10 of policy",
+		},
+		"raised to the min of the policy": {
+			policy:  Policy{Min: 2, Max: 10, Checks: demand(0)},
+			current: 4,
+			want:    2,
+			reason:  "raised to min 2 of policy",
+		},
+		"raised to the min of a schedule": {
+			policy:  Policy{Min: 1, Max: 10, Checks: demand(100), Schedules: peak},
+			current: 1,
+			want:    6,
+			reason:  "raised to min 6 of schedule peak",
+		},
+		"capped at the max of a schedule": {
+			policy:  Policy{Min: 1, Max: 10, Checks: demand(1000), Schedules: peak},
+			current: 6,
+			want:    8,
+			reason:  "capped at max 8 of schedule peak",
+		},
+		"unchanged count": {
+			policy:  Policy{Min: 1, Max: 10, Checks: demand(300)},
+			current: 3,
+		},
+		"in cooldown": {
+			policy:     Policy{Min: 1, Max: 10, Cooldown: 5 * time.Minute, Checks: demand(500)},
+			current:    3,
+			lastScaled: time.Minute,
+		},
+		"after cooldown": {
+			policy:     Policy{Min: 1, Max: 10, Cooldown: 5 * time.Minute, Checks: demand(500)},
+			current:    3,
+			lastScaled: 10 * time.Minute,
+			want:       5,
+		},
+		"outside the bounds in cooldown": {
+			policy:     Policy{Min: 1, Max: 10, Cooldown: 5 * time.Minute, Checks: demand(500), Schedules: peak},
+			current:    3,
+			lastScaled: time.Minute,
+			want:       6,
+			reason:     "raised to min 6 of schedule peak",
+		},
+		"stopped job": {
+			policy:  Policy{Min: 1, Max: 10, Checks: demand(500)},
+			current: 3,
+			stopped: true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			group := api.TaskGroupScaleStatus{Desired: tc.current}
+			if tc.lastScaled > 0 {
+				count := int64(tc.current)
+				group.Events = []api.ScalingEvent{
+					{Count: &count, Time: uint64(time.Now().Add(-tc.lastScaled).UnixNano())},
+					// Failed scaling attempts do not start a cooldown.
+					{Count: &count, Error: true, Time: uint64(time.Now().UnixNano())},
+				}
+			}
+			n := &fakeNomad{status: api.JobScaleStatusResponse{
+				JobID:      "shop",
+				JobStopped: tc.stopped,
+				TaskGroups: map[string]api.TaskGroupScaleStatus{"web": group},
+			}}
+			srv := httptest.NewServer(n)
+			defer srv.Close()
+			f := testAutoscaler(t, srv)
+
+			tc.policy.Job, tc.policy.Group = "shop", "web"
+			if err := f.evaluate(context.Background(), tc.policy, tc.snapshot); err != nil {
+				t.Fatal(err)
+			}
+
+			if tc.want == 0 {
+				if len(n.requests) != 0 {
+					t.Fatalf("scaled to %d, want the group left alone", *n.requests[0].Count)
+				}
+				return
+			}
+			if len(n.requests) != 1 {
+				t.Fatalf("%d scaling requests, want 1", len(n.requests))
+			}
+			req := n.requests[0]
+			if req.Count == nil || *req.Count != int64(tc.want) || req.Target["Group"] != "web" {
+				t.Errorf("scaled %v to %v, want web to %d", req.Target, req.Count, tc.want)
+			}
+			if !strings.HasPrefix(req.Message, "atc autoscaler: ") || !strings.Contains(req.Message, tc.reason) {
+				t.Errorf("message = %q, want it to contain %q", req.Message, tc.reason)
+			}
+			if req.Meta["managed-by"] != "atc" || req.Meta["atc-module"] != "autoscaler" {
+				t.Errorf("meta = %v, want the autoscaler of atc", req.Meta)
+			}
+		})
+	}
+}
+
+func TestEvaluateUnknownGroup(t *testing.T) {
+	n := &fakeNomad{status: api.JobScaleStatusResponse{JobID: "shop", TaskGroups: map[string]api.TaskGroupScaleStatus{}}}
+	srv := httptest.NewServer(n)
+	defer srv.Close()
+	f := testAutoscaler(t, srv)
+
+	err := f.evaluate(context.Background(), Policy{Job: "shop", Group: "web", Min: 1, Max: 10}, nil)
+	if err == nil || !strings.Contains(err.Error(), `task group "web" not found`) {
+		t.Errorf("error = %v, want the group not found", err)
+	}
+}
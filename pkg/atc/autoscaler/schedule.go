@@ -0,0 +1,85 @@
+package autoscaler
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/cronexpr"
+)
+
+// Schedule changes the bounds of a policy during a recurring window, which
+// opens at every time matched by Cron and lasts for Duration.
+type Schedule struct {
+	Name     string        `yaml:"name"`
+	Cron     string        `yaml:"cron"`
+	Duration time.Duration `yaml:"duration"`
+	// Timezone is the IANA time zone Cron is evaluated in. Defaults to UTC.
+	Timezone string `yaml:"timezone"`
+	// Min and Max replace the bounds of the policy while the window is
+	// open. A zero Max keeps the max of the policy.
+	Min int `yaml:"min"`
+	Max int `yaml:"max"`
+}
+
+func (s Schedule) Validate() error {
+	if _, err := cronexpr.Parse(s.Cron); err != nil {
+		return fmt.Errorf("invalid cron %q: %w", s.Cron, err)
+	}
+	if _, err := time.LoadLocation(s.Timezone); err != nil {
+		return fmt.Errorf("invalid timezone: %w", err)
+	}
+	if s.Duration <= 0 {
+		return fmt.Errorf("duration must be positive")
+	}
+	if s.Min < 0 || s.Max < 0 || (s.Max > 0 && s.Max < s.Min) {
+		return fmt.Errorf("invalid bounds: min %d, max %d", s.Min, s.Max)
+	}
+	return nil
+}
+
+// active reports whether the window of the schedule is open at the given
+// time, which is the case when it opened less than Duration ago.
+func (s Schedule) active(now time.Time) bool {
+	expr, err := cronexpr.Parse(s.Cron)
+	if err != nil {
+		return false
+	}
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return false
+	}
+
+	opened := expr.Next(now.Add(-s.Duration).In(loc))
+	return !opened.IsZero() && !opened.After(now)
+}
+
+// bounds returns the min and max of the policy at the given time, and the
+// schedules that set them. While windows are open their bounds replace the
+// bounds of the policy, and when several are open the highest min and the
+// highest max win.
+func (p Policy) bounds(now time.Time) (lo, hi int, active []string) {
+	for i, s := range p.Schedules {
+		if !s.active(now) {
+			continue
+		}
+
+		name := s.Name
+		if name == "" {
+			name = fmt.Sprintf("schedule %d", i)
+		}
+		if len(active) == 0 {
+			lo, hi = s.Min, 0
+		}
+		active = append(active, name)
+		lo = max(lo, s.Min)
+		hi = max(hi, s.Max)
+	}
+	if len(active) == 0 {
+		return p.Min, p.Max, nil
+	}
+
+	if hi == 0 {
+		hi = p.Max
+	}
+	return lo, max(lo, hi), active
+}
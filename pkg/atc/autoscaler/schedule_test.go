@@ -0,0 +1,80 @@
+package autoscaler
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestScheduleActive(t *testing.T) {
+	// 2026-10-19 is a Monday.
+	monday := func(hour, minute int) time.Time {
+		return time.Date(2026, 10, 19, hour, minute, 0, 0, time.UTC)
+	}
+	weekdays := Schedule{Cron: "0 8 * * 1-5", Duration: 10 * time.Hour}
+
+	tests := map[string]struct {
+		schedule Schedule
+		now      time.Time
+		want     bool
+	}{
+		"before the window":     {schedule: weekdays, now: monday(7, 59)},
+		"as the window opens":   {schedule: weekdays, now: monday(8, 0), want: true},
+		"during the window":     {schedule: weekdays, now: monday(17, 59), want: true},
+		"as the window closes":  {schedule: weekdays, now: monday(18, 0)},
+		"outside matching days": {schedule: weekdays, now: time.Date(2026, 10, 24, 9, 0, 0, 0, time.UTC)},
+		"window across midnight": {
+			schedule: Schedule{Cron: "0 22 * * *", Duration: 4 * time.Hour},
+			now:      monday(1, 0),
+			want:     true,
+		},
+		"in the time zone": {
+			schedule: Schedule{Cron: "0 8 * * *", Duration: time.Hour, Timezone: "Europe/Amsterdam"},
+			now:      monday(6, 30),
+			want:     true,
+		},
+		"outside the window in the time zone": {
+			schedule: Schedule{Cron: "0 8 * * *", Duration: time.Hour, Timezone: "Europe/Amsterdam"},
+			now:      monday(8, 30),
+		},
+		"invalid cron": {schedule: Schedule{Cron: "not a cron", Duration: time.Hour}, now: monday(8, 30)},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := tc.schedule.active(tc.now); got != tc.want {
+				t.Errorf("active at %s = %t, want %t", tc.now, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPolicyBounds(t *testing.T) {
+	now := time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC)
+	always := func(name string, lo, hi int) Schedule {
+		return Schedule{Name: name, Cron: "0 0 * * *", Duration: 24 * time.Hour, Min: lo, Max: hi}
+	}
+	never := Schedule{Name: "night", Cron: "0 22 * * *", Duration: time.Hour, Min: 20, Max: 30}
+
+	tests := map[string]struct {
+		schedules  []Schedule
+		lo, hi     int
+		wantActive []string
+	}{
+		"no schedules":       {lo: 2, hi: 10},
+		"inactive schedule":  {schedules: []Schedule{never}, lo: 2, hi: 10},
+		"keeps the max":      {schedules: []Schedule{always("peak", 5, 0)}, lo: 5, hi: 10, wantActive: []string{"peak"}},
+		"replaces the max":   {schedules: []Schedule{always("peak", 1, 4)}, lo: 1, hi: 4, wantActive: []string{"peak"}},
+		"min above the max":  {schedules: []Schedule{always("peak", 12, 0)}, lo: 12, hi: 12, wantActive: []string{"peak"}},
+		"highest bounds win": {schedules: []Schedule{always("a", 3, 8), never, always("b", 5, 6)}, lo: 5, hi: 8, wantActive: []string{"a", "b"}},
+		"unnamed schedule":   {schedules: []Schedule{never, always("", 3, 0)}, lo: 3, hi: 10, wantActive: []string{"schedule 1"}},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			p := Policy{Min: 2, Max: 10, Schedules: tc.schedules}
+			lo, hi, active := p.bounds(now)
+			if lo != tc.lo || hi != tc.hi || !slices.Equal(active, tc.wantActive) {
+				t.Errorf("bounds = %d, %d, %v, want %d, %d, %v", lo, hi, active, tc.lo, tc.hi, tc.wantActive)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package autoscaler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+
+	"github.com/attachmentgenie/atc/pkg/atc/watcher"
+)
+
+// Sources of the value of a check.
+const (
+	SourcePrometheus = "prometheus"
+	SourceConsul     = "consul"
+	SourceStatic     = "static"
+)
+
+// ScalingSource provides the current value of the metric a check scales on.
+type ScalingSource interface {
+	Value(ctx context.Context) (float64, error)
+}
+
+// PrometheusSource runs an instant query against the Prometheus HTTP API. The
+// query must return a single value.
+type PrometheusSource struct {
+	API    promv1.API
+	Query  string
+	Logger log.Logger
+}
+
+func (s PrometheusSource) Value(ctx context.Context) (float64, error) {
+	if s.API == nil {
+		return 0, errors.New("no prometheus address configured")
+	}
+
+	result, warnings, err := s.API.Query(ctx, s.Query, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	for _, w := range warnings {
+		level.Warn(s.Logger).Log("msg", "prometheus query returned a warning", "query", s.Query, "warning", w)
+	}
+
+	var value float64
+	switch v := result.(type) {
+	case *model.Scalar:
+		value = float64(v.Value)
+	case model.Vector:
+		if len(v) != 1 {
+			return 0, fmt.Errorf("query returned %d series instead of 1", len(v))
+		}
+		value = float64(v[0].Value)
+	default:
+		return 0, fmt.Errorf("query returned a %s instead of a scalar or vector", result.Type())
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, fmt.Errorf("query returned %g", value)
+	}
+	return value, nil
+}
+
+// ConsulSource counts the instances of a Consul service with the given
+// aggregated status, or all instances when the status is "any".
+type ConsulSource struct {
+	Snapshot *watcher.Snapshot
+	Service  string
+	Status   string
+}
+
+func (s ConsulSource) Value(_ context.Context) (float64, error) {
+	if s.Snapshot == nil {
+		return 0, errors.New("no consul snapshot received yet")
+	}
+
+	h := s.Snapshot.Health(s.Service)
+	switch s.Status {
+	case "", "passing":
+		return float64(h.Passing), nil
+	case "warning":
+		return float64(h.Warning), nil
+	case "critical":
+		return float64(h.Critical), nil
+	case "maintenance":
+		return float64(h.Maintenance), nil
+	case "any":
+		return float64(h.Total()), nil
+	}
+	return 0, fmt.Errorf("unknown instance status %q", s.Status)
+}
+
+// StaticSource always returns the same value. It is meant for testing
+// policies without a metrics backend.
+type StaticSource float64
+
+func (s StaticSource) Value(_ context.Context) (float64, error) {
+	return float64(s), nil
+}
+
+// source returns the source of the value of a check.
+func (f *Autoscaler) source(c Check, snapshot *watcher.Snapshot) (ScalingSource, error) {
+	switch c.source() {
+	case SourcePrometheus:
+		return PrometheusSource{API: f.prometheus, Query: c.Query, Logger: f.logger}, nil
+	case SourceConsul:
+		return ConsulSource{Snapshot: snapshot, Service: c.Service, Status: c.Status}, nil
+	case SourceStatic:
+		return StaticSource(c.Value), nil
+	}
+	return nil, fmt.Errorf("unknown source %q", c.Source)
+}
+
+// Ways to combine the instances needed by the checks of a policy.
+const (
+	CombineMax = "max"
+	CombineMin = "min"
+	CombineAvg = "avg"
+	CombineSum = "sum"
+)
+
+// combine returns the instances needed by all checks together.
+func combine(how string, needs []int) int {
+	result := needs[0]
+	for _, n := range needs[1:] {
+		switch how {
+		case CombineMin:
+			result = min(result, n)
+		case CombineAvg, CombineSum:
+			result += n
+		default:
+			result = max(result, n)
+		}
+	}
+	if how == CombineAvg {
+		result = int(math.Ceil(float64(result) / float64(len(needs))))
+	}
+	return result
+}
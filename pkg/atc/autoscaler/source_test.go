@@ -0,0 +1,102 @@
+package autoscaler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/log"
+	promapi "github.com/prometheus/client_golang/api"
+	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+)
+
+func TestCombine(t *testing.T) {
+	tests := map[string]struct {
+		how   string
+		needs []int
+		want  int
+	}{
+		"single":     {how: CombineMax, needs: []int{3}, want: 3},
+		"max":        {how: CombineMax, needs: []int{2, 5, 3}, want: 5},
+		"default":    {how: "", needs: []int{2, 5, 3}, want: 5},
+		"min":        {how: CombineMin, needs: []int{4, 2, 3}, want: 2},
+		"sum":        {how: CombineSum, needs: []int{1, 2, 3}, want: 6},
+		"avg":        {how: CombineAvg, needs: []int{2, 4}, want: 3},
+		"avg rounds": {how: CombineAvg, needs: []int{1, 2}, want: 2},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := combine(tc.how, tc.needs); got != tc.want {
+				t.Errorf("combine(%s, %v) = %d, want %d", tc.how, tc.needs, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPrometheusSource(t *testing.T) {
+	tests := map[string]struct {
+		data    string
+		want    float64
+		wantErr bool
+	}{
+		"vector": {
+			data: `{"resultType":"vector","result":[{"metric":{},"value":[1700000000,"42.5"]}]}`,
+			want: 42.5,
+		},
+		"scalar": {
+			data: `{"resultType":"scalar","result":[1700000000,"3"]}`,
+			want: 3,
+		},
+		"no series": {
+			data:    `{"resultType":"vector","result":[]}`,
+			wantErr: true,
+		},
+		"several series": {
+			data:    `{"resultType":"vector","result":[{"metric":{"a":"1"},"value":[1700000000,"1"]},{"metric":{"a":"2"},"value":[1700000000,"2"]}]}`,
+			wantErr: true,
+		},
+		"matrix": {
+			data:    `{"resultType":"matrix","result":[{"metric":{},"values":[[1700000000,"1"]]}]}`,
+			wantErr: true,
+		},
+		"nan": {
+			data:    `{"resultType":"scalar","result":[1700000000,"NaN"]}`,
+			wantErr: true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/api/v1/query" {
+					http.NotFound(w, r)
+					return
+				}
+				if err := r.ParseForm(); err != nil || r.Form.Get("query") != "sum(rate(requests_total[1m]))" {
+					http.Error(w, `{"status":"error","errorType":"bad_data","error":"unexpected query"}`, http.StatusBadRequest)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(`{"status":"success","data":` + tc.data + `}`))
+			}))
+			defer srv.Close()
+
+			client, err := promapi.NewClient(promapi.Config{Address: srv.URL})
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := PrometheusSource{API: promv1.NewAPI(client), Query: "sum(rate(requests_total[1m]))", Logger: log.NewNopLogger()}
+			got, err := s.Value(context.Background())
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("err = %v, want error %t", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("value = %g, want %g", got, tc.want)
+			}
+		})
+	}
+
+	if _, err := (PrometheusSource{}).Value(context.Background()); err == nil {
+		t.Error("value without a prometheus address succeeded")
+	}
+}
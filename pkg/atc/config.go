@@ -0,0 +1,48 @@
+package atc
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+
+	"github.com/pkg/errors"
+	"go.yaml.in/yaml/v3"
+)
+
+// LoadConfigFile reads a YAML configuration file on top of the values that are
+// already set in cfg. When expandEnv is set, ${VAR} and ${VAR:default}
+// references in the file are replaced by the value of the environment
+// variable before parsing, any other $ is left as is. Keys that do not
+// correspond to a configuration option are reported as an error.
+func LoadConfigFile(filename string, expandEnv bool, cfg *Config) error {
+	buf, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	if expandEnv {
+		buf = expandVariables(buf)
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(buf))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to parse config file %s: %w", filename, err)
+	}
+	return nil
+}
+
+// variableRef matches ${NAME} and ${NAME:default} references.
+var variableRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:[^}]*)?\}`)
+
+func expandVariables(buf []byte) []byte {
+	return variableRef.ReplaceAllFunc(buf, func(ref []byte) []byte {
+		m := variableRef.FindSubmatch(ref)
+		if v, ok := os.LookupEnv(string(m[1])); ok || len(m[2]) == 0 {
+			return []byte(v)
+		}
+		return m[2][1:]
+	})
+}
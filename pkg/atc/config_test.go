@@ -0,0 +1,31 @@
+package atc
+
+import "testing"
+
+func TestExpandVariables(t *testing.T) {
+	t.Setenv("ATC_TEST_TOKEN", "secret")
+	t.Setenv("ATC_TEST_EMPTY", "")
+
+	tests := map[string]struct {
+		in, want string
+	}{
+		"variable":                  {"token: ${ATC_TEST_TOKEN}", "token: secret"},
+		"unset variable":            {"token: ${ATC_TEST_UNSET}", "token: "},
+		"default":                   {"token: ${ATC_TEST_UNSET:fallback}", "token: fallback"},
+		"empty default":             {"token: ${ATC_TEST_UNSET:}", "token: "},
+		"set variable wins":         {"token: ${ATC_TEST_TOKEN:fallback}", "token: secret"},
+		"empty variable wins":       {"token: ${ATC_TEST_EMPTY:fallback}", "token: "},
+		"default with colon":        {"address: ${ATC_TEST_UNSET:127.0.0.1:8500}", "address: 127.0.0.1:8500"},
+		"bare variable is kept":     {"password: pa$ATC_TEST_TOKEN", "password: pa$ATC_TEST_TOKEN"},
+		"regex is kept":             {`pattern: "^web-[0-9]+$"`, `pattern: "^web-[0-9]+$"`},
+		"bcrypt hash is kept":       {"hash: $2y$10$abcdefghijklmnopqrstuv", "hash: $2y$10$abcdefghijklmnopqrstuv"},
+		"invalid reference is kept": {"value: ${1}", "value: ${1}"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := string(expandVariables([]byte(tc.in))); got != tc.want {
+				t.Errorf("expandVariables(%q) = %q, want %q", tc.in, got, tc.want)
+			}
+		})
+	}
+}
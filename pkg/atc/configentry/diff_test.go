@@ -0,0 +1,69 @@
+package configentry
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestLineDiff(t *testing.T) {
+	tests := map[string]struct {
+		before, after string
+		want          []string
+	}{
+		"equal":    {before: "a\nb", after: "a\nb", want: []string{"  a", "  b"}},
+		"created":  {after: "a\nb", want: []string{"+ a", "+ b"}},
+		"deleted":  {before: "a\nb", want: []string{"- a", "- b"}},
+		"nothing":  {},
+		"added":    {before: "a\nc", after: "a\nb\nc", want: []string{"  a", "+ b", "  c"}},
+		"removed":  {before: "a\nb\nc", after: "a\nc", want: []string{"  a", "- b", "  c"}},
+		"replaced": {before: "a\nb\nc", after: "a\nx\nc", want: []string{"  a", "- b", "+ x", "  c"}},
+		"moved": {
+			before: "a\nb\nc\nd",
+			after:  "b\nc\na\nd",
+			want:   []string{"- a", "  b", "  c", "+ a", "  d"},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			want := ""
+			if len(tc.want) > 0 {
+				want = strings.Join(tc.want, "\n") + "\n"
+			}
+			if got := lineDiff(tc.before, tc.after); got != want {
+				t.Errorf("diff =\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestDiffEntries(t *testing.T) {
+	current := &api.ServiceResolverConfigEntry{Kind: api.ServiceResolver, Name: "web", ModifyIndex: 10}
+	desired := &api.ServiceResolverConfigEntry{
+		Kind:     api.ServiceResolver,
+		Name:     "web",
+		Failover: map[string]api.ServiceResolverFailover{"*": {Datacenters: []string{"dc2"}}},
+	}
+
+	diff, err := diffEntries(current, desired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(diff, "ModifyIndex") {
+		t.Errorf("diff shows the modify index:\n%s", diff)
+	}
+	if !strings.Contains(diff, "+ ") || !strings.Contains(diff, `"dc2"`) || strings.Contains(diff, "- ") {
+		t.Errorf("diff =\n%s\nwant only the failover added", diff)
+	}
+
+	diff, err = diffEntries(current, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(diff), "\n") {
+		if !strings.HasPrefix(line, "- ") {
+			t.Errorf("line %q of a deleted entry is not removed", line)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package configentry
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// ChangesHandler lists the most recent change per module and config entry as
+// JSON.
+func (w *Writer) ChangesHandler() http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		changes := w.Changes()
+		sort.Slice(changes, func(i, j int) bool {
+			return changes[i].Time.After(changes[j].Time)
+		})
+
+		rw.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(rw).Encode(struct {
+			DryRun  bool     `json:"dry_run"`
+			Changes []Change `json:"changes"`
+		}{
+			DryRun:  w.dryRun,
+			Changes: changes,
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package configentry
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Meta keys stamped on every config entry written by ATC.
+const (
+	MetaManagedBy  = "managed-by"
+	MetaModule     = "atc-module"
+	MetaGeneration = "atc-generation"
+	MetaReason     = "atc-reason"
+
+	ManagedByValue = "atc"
+)
+
+var (
+	// ErrUnmanaged is returned when a config entry that was not written by
+	// ATC would be modified.
+	ErrUnmanaged = errors.New("config entry is not managed by atc")
+	// ErrNotOwner is returned when a config entry written by one module would
+	// be modified by another.
+	ErrNotOwner = errors.New("config entry is managed by another module")
+	// ErrConflict is returned when a config entry was modified concurrently.
+	ErrConflict = errors.New("config entry was modified concurrently")
+)
+
+// IsManaged reports whether a config entry was written by ATC.
+func IsManaged(entry api.ConfigEntry) bool {
+	return entry != nil && entry.GetMeta()[MetaManagedBy] == ManagedByValue
+}
+
+// checkOwner verifies that module may modify the current config entry.
+func checkOwner(module string, current api.ConfigEntry) error {
+	if current == nil {
+		return nil
+	}
+	if !IsManaged(current) {
+		return ErrUnmanaged
+	}
+	if owner := current.GetMeta()[MetaModule]; owner != module {
+		return fmt.Errorf("%w: %s", ErrNotOwner, owner)
+	}
+	return nil
+}
+
+// generation returns the generation the next write of an entry gets.
+func generation(current api.ConfigEntry) int {
+	if current == nil {
+		return 1
+	}
+	gen, _ := strconv.Atoi(current.GetMeta()[MetaGeneration])
+	return gen + 1
+}
+
+// stamp adds the ownership meta to a config entry.
+func stamp(entry api.ConfigEntry, module, reason string, gen int) error {
+	meta := map[string]string{}
+	for k, v := range entry.GetMeta() {
+		meta[k] = v
+	}
+	meta[MetaManagedBy] = ManagedByValue
+	meta[MetaModule] = module
+	meta[MetaGeneration] = strconv.Itoa(gen)
+	meta[MetaReason] = reason
+
+	switch e := entry.(type) {
+	case *api.ServiceResolverConfigEntry:
+		e.Meta = meta
+	case *api.ServiceRouterConfigEntry:
+		e.Meta = meta
+	case *api.ServiceSplitterConfigEntry:
+		e.Meta = meta
+	case *api.ServiceConfigEntry:
+		e.Meta = meta
+	default:
+		return fmt.Errorf("unsupported config entry kind %s", entry.GetKind())
+	}
+	return nil
+}
+
+// Owned returns the config entries of a kind that were written by module.
+func (w *Writer) Owned(module, kind string) ([]api.ConfigEntry, error) {
+	entries, _, err := w.client.ConfigEntries().List(kind, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s config entries: %w", kind, err)
+	}
+
+	var owned []api.ConfigEntry
+	for _, entry := range entries {
+		if checkOwner(module, entry) == nil {
+			owned = append(owned, entry)
+		}
+	}
+	return owned, nil
+}
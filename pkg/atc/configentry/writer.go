@@ -0,0 +1,267 @@
+package configentry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/hashicorp/consul/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	OperationUpsert = "upsert"
+	OperationDelete = "delete"
+)
+
+// Change is a config entry write that was performed, or that would have been
+// performed in dry-run mode.
+type Change struct {
+	Module    string          `json:"module"`
+	Operation string          `json:"operation"`
+	Kind      string          `json:"kind"`
+	Name      string          `json:"name"`
+	Entry     api.ConfigEntry `json:"entry,omitempty"`
+	Diff      string          `json:"diff"`
+	DryRun    bool            `json:"dry_run"`
+	Time      time.Time       `json:"time"`
+}
+
+// Writer is the single path through which modules write Consul config
+// entries. In dry-run mode it computes and records the changes, but never
+// writes them to Consul.
+type Writer struct {
+	client *api.Client
+	dryRun bool
+	logger log.Logger
+
+	mtx     sync.Mutex
+	changes map[string]Change
+
+	changesTotal   *prometheus.CounterVec
+	refusedTotal   *prometheus.CounterVec
+	conflictsTotal *prometheus.CounterVec
+}
+
+func New(client *api.Client, dryRun bool, logger log.Logger, reg prometheus.Registerer) *Writer {
+	return &Writer{
+		client:  client,
+		dryRun:  dryRun,
+		logger:  log.With(logger, "component", "config-entry-writer"),
+		changes: map[string]Change{},
+		changesTotal: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "atc_config_entry_changes_total",
+			Help: "Total number of config entry changes, by module and operation. Changes made in dry-run mode are counted but not applied.",
+		}, []string{"module", "operation", "dry_run"}),
+		refusedTotal: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "atc_config_entry_refused_total",
+			Help: "Total number of config entry changes refused because the entry is not owned by the module.",
+		}, []string{"module"}),
+		conflictsTotal: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "atc_config_entry_conflicts_total",
+			Help: "Total number of config entry writes rejected because the entry was modified concurrently.",
+		}, []string{"module"}),
+	}
+}
+
+// DryRun reports whether changes are only recorded instead of written.
+func (w *Writer) DryRun() bool {
+	return w.dryRun
+}
+
+// Upsert creates or replaces a config entry on behalf of a module. The entry
+// is stamped with ownership meta, and is only written when it does not exist
+// yet or is owned by the same module. The write fails with ErrConflict when
+// the entry is modified by someone else in the meantime.
+func (w *Writer) Upsert(module, reason string, entry api.ConfigEntry) error {
+	kind, name := entry.GetKind(), entry.GetName()
+
+	current, err := w.current(module, kind, name)
+	if err != nil {
+		return err
+	}
+	if err := w.checkOwner(module, kind, name, current); err != nil {
+		return err
+	}
+	if err := stamp(entry, module, reason, generation(current)); err != nil {
+		return err
+	}
+	diff, err := diffEntries(current, entry)
+	if err != nil {
+		return err
+	}
+
+	if !w.dryRun {
+		var index uint64
+		if current != nil {
+			index = current.GetModifyIndex()
+		}
+		ok, _, err := w.client.ConfigEntries().CAS(entry, index, nil)
+		if err != nil {
+			return fmt.Errorf("failed to write %s %s: %w", kind, name, err)
+		}
+		if !ok {
+			return w.conflict(module, kind, name)
+		}
+	}
+	w.record(module, OperationUpsert, kind, name, entry, diff)
+	return nil
+}
+
+// Delete removes a config entry on behalf of a module, provided the entry is
+// owned by that module. Deleting an entry that does not exist is a no-op.
+func (w *Writer) Delete(module, kind, name string) error {
+	current, err := w.current(module, kind, name)
+	if err != nil || current == nil {
+		return err
+	}
+	if err := w.checkOwner(module, kind, name, current); err != nil {
+		return err
+	}
+	diff, err := diffEntries(current, nil)
+	if err != nil {
+		return err
+	}
+
+	if !w.dryRun {
+		ok, _, err := w.client.ConfigEntries().DeleteCAS(kind, name, current.GetModifyIndex(), nil)
+		if err != nil {
+			return fmt.Errorf("failed to delete %s %s: %w", kind, name, err)
+		}
+		if !ok {
+			return w.conflict(module, kind, name)
+		}
+	}
+	w.record(module, OperationDelete, kind, name, nil, diff)
+	return nil
+}
+
+func (w *Writer) checkOwner(module, kind, name string, current api.ConfigEntry) error {
+	if err := checkOwner(module, current); err != nil {
+		w.refusedTotal.WithLabelValues(module).Inc()
+		level.Warn(w.logger).Log("msg", "refusing to modify config entry", "module", module, "kind", kind, "name", name, "err", err)
+		return fmt.Errorf("refusing to modify %s %s: %w", kind, name, err)
+	}
+	return nil
+}
+
+func (w *Writer) conflict(module, kind, name string) error {
+	w.conflictsTotal.WithLabelValues(module).Inc()
+	level.Warn(w.logger).Log("msg", "config entry was modified concurrently, write rejected", "module", module, "kind", kind, "name", name)
+	return fmt.Errorf("failed to write %s %s: %w", kind, name, ErrConflict)
+}
+
+// Changes returns the most recent change per module and config entry.
+func (w *Writer) Changes() []Change {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	changes := make([]Change, 0, len(w.changes))
+	for _, c := range w.changes {
+		changes = append(changes, c)
+	}
+	return changes
+}
+
+func (w *Writer) record(module, operation, kind, name string, entry api.ConfigEntry, diff string) {
+	w.changesTotal.WithLabelValues(module, operation, fmt.Sprint(w.dryRun)).Inc()
+
+	msg := "applied config entry change"
+	if w.dryRun {
+		msg = "dry-run: config entry change not applied"
+	}
+	level.Info(w.logger).Log("msg", msg, "module", module, "operation", operation, "kind", kind, "name", name, "diff", diff)
+
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	w.changes[module+"/"+kind+"/"+name] = Change{
+		Module:    module,
+		Operation: operation,
+		Kind:      kind,
+		Name:      name,
+		Entry:     entry,
+		Diff:      diff,
+		DryRun:    w.dryRun,
+		Time:      time.Now(),
+	}
+}
+
+// current returns the config entry a change applies to. In dry-run mode that
+// is the entry as it would have been after the changes recorded so far.
+func (w *Writer) current(module, kind, name string) (api.ConfigEntry, error) {
+	if w.dryRun {
+		w.mtx.Lock()
+		change, ok := w.changes[module+"/"+kind+"/"+name]
+		w.mtx.Unlock()
+		if ok {
+			return change.Entry, nil
+		}
+	}
+	return w.get(kind, name)
+}
+
+// get returns the config entry currently stored in Consul, or nil when it
+// does not exist.
+func (w *Writer) get(kind, name string) (api.ConfigEntry, error) {
+	current, _, err := w.client.ConfigEntries().Get(kind, name, nil)
+	if IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s %s: %w", kind, name, err)
+	}
+	return current, nil
+}
+
+// diffEntries renders the difference between the current and the desired
+// config entry as a line diff of their JSON encoding. A nil desired entry
+// means the entry is deleted.
+func diffEntries(current, desired api.ConfigEntry) (string, error) {
+	before, err := encode(current)
+	if err != nil {
+		return "", err
+	}
+	after, err := encode(desired)
+	if err != nil {
+		return "", err
+	}
+	return lineDiff(before, after), nil
+}
+
+// encode renders an entry as indented JSON without the fields that Consul
+// manages itself.
+func encode(entry api.ConfigEntry) (string, error) {
+	if entry == nil {
+		return "", nil
+	}
+
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode config entry: %w", err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(buf, &fields); err != nil {
+		return "", fmt.Errorf("failed to encode config entry: %w", err)
+	}
+	delete(fields, "CreateIndex")
+	delete(fields, "ModifyIndex")
+
+	buf, err = json.MarshalIndent(fields, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to encode config entry: %w", err)
+	}
+	return string(buf), nil
+}
+
+// IsNotFound reports whether err is the response to a config entry that does
+// not exist.
+func IsNotFound(err error) bool {
+	var statusErr api.StatusError
+	return errors.As(err, &statusErr) && statusErr.Code == http.StatusNotFound
+}
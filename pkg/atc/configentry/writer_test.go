@@ -0,0 +1,339 @@
+package configentry
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/hashicorp/consul/api"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// fakeConfig serves the service-resolver config entries of /v1/config, with
+// the check-and-set semantics of Consul.
+type fakeConfig struct {
+	mtx       sync.Mutex
+	index     uint64
+	resolvers map[string]*api.ServiceResolverConfigEntry
+	writes    int
+	// beforeWrite is called before a write is applied, to modify the entry
+	// concurrently.
+	beforeWrite func()
+}
+
+func (c *fakeConfig) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	const prefix = "/v1/config/service-resolver/"
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/v1/config/service-resolver":
+		entries := []*api.ServiceResolverConfigEntry{}
+		for _, e := range c.resolvers {
+			entries = append(entries, e)
+		}
+		_ = json.NewEncoder(w).Encode(entries)
+
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, prefix):
+		e, ok := c.resolvers[strings.TrimPrefix(r.URL.Path, prefix)]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(e)
+
+	case r.Method == http.MethodPut && r.URL.Path == "/v1/config":
+		var e api.ServiceResolverConfigEntry
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !c.write(e.Name, r.URL.Query().Get("cas")) {
+			_, _ = w.Write([]byte("false"))
+			return
+		}
+		c.index++
+		e.ModifyIndex = c.index
+		c.resolvers[e.Name] = &e
+		_, _ = w.Write([]byte("true"))
+
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, prefix):
+		name := strings.TrimPrefix(r.URL.Path, prefix)
+		if !c.write(name, r.URL.Query().Get("cas")) {
+			_, _ = w.Write([]byte("false"))
+			return
+		}
+		delete(c.resolvers, name)
+		_, _ = w.Write([]byte("true"))
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// write counts a write of the resolver of a service, and reports whether its
+// cas index matches the stored entry.
+func (c *fakeConfig) write(name, index string) bool {
+	c.writes++
+	if c.beforeWrite != nil {
+		c.beforeWrite()
+	}
+	cas, _ := strconv.ParseUint(index, 10, 64)
+	current, ok := c.resolvers[name]
+	if !ok {
+		return cas == 0
+	}
+	return current.ModifyIndex == cas
+}
+
+func (c *fakeConfig) put(e *api.ServiceResolverConfigEntry) {
+	c.index++
+	e.Kind, e.ModifyIndex = api.ServiceResolver, c.index
+	c.resolvers[e.Name] = e
+}
+
+func (c *fakeConfig) resolver(name string) *api.ServiceResolverConfigEntry {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.resolvers[name]
+}
+
+func (c *fakeConfig) writeCount() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.writes
+}
+
+func owned(module string, gen int) map[string]string {
+	return map[string]string{MetaManagedBy: ManagedByValue, MetaModule: module, MetaGeneration: strconv.Itoa(gen)}
+}
+
+func testWriter(t *testing.T, dryRun bool, resolvers ...*api.ServiceResolverConfigEntry) (*Writer, *fakeConfig, *prometheus.Registry) {
+	t.Helper()
+	config := &fakeConfig{resolvers: map[string]*api.ServiceResolverConfigEntry{}}
+	for _, e := range resolvers {
+		config.put(e)
+	}
+	srv := httptest.NewServer(config)
+	t.Cleanup(srv.Close)
+	client, err := api.NewClient(&api.Config{Address: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := prometheus.NewRegistry()
+	return New(client, dryRun, log.NewNopLogger(), reg), config, reg
+}
+
+// counter returns the sum of a counter over all its labels.
+func counter(t *testing.T, reg *prometheus.Registry, name string) float64 {
+	t.Helper()
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sum float64
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			sum += m.GetCounter().GetValue()
+		}
+	}
+	return sum
+}
+
+func resolverEntry(name, failover string) *api.ServiceResolverConfigEntry {
+	return &api.ServiceResolverConfigEntry{
+		Kind:     api.ServiceResolver,
+		Name:     name,
+		Failover: map[string]api.ServiceResolverFailover{"*": {Datacenters: []string{failover}}},
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	w, config, reg := testWriter(t, false)
+
+	if err := w.Upsert("forwarder", "web is critical", resolverEntry("web", "dc2")); err != nil {
+		t.Fatal(err)
+	}
+	e := config.resolver("web")
+	if e == nil || e.Meta[MetaModule] != "forwarder" || e.Meta[MetaGeneration] != "1" || e.Meta[MetaReason] != "web is critical" || !IsManaged(e) {
+		t.Fatalf("written entry = %+v, want it stamped with the ownership of the forwarder", e)
+	}
+
+	// An entry owned by the module is replaced with the next generation.
+	if err := w.Upsert("forwarder", "web is still critical", resolverEntry("web", "dc3")); err != nil {
+		t.Fatal(err)
+	}
+	e = config.resolver("web")
+	if e.Meta[MetaGeneration] != "2" || e.Failover["*"].Datacenters[0] != "dc3" {
+		t.Fatalf("replaced entry = %+v, want generation 2 failing over to dc3", e)
+	}
+
+	changes := w.Changes()
+	if len(changes) != 1 || changes[0].Operation != OperationUpsert || changes[0].DryRun || !strings.Contains(changes[0].Diff, "dc3") {
+		t.Errorf("changes = %+v, want the last upsert of web", changes)
+	}
+	if n := counter(t, reg, "atc_config_entry_changes_total"); n != 2 {
+		t.Errorf("%v changes counted, want 2", n)
+	}
+}
+
+func TestRefuseNotOwned(t *testing.T) {
+	tests := map[string]struct {
+		meta map[string]string
+		err  error
+	}{
+		"unmanaged entry":                 {meta: map[string]string{"owner": "platform-team"}, err: ErrUnmanaged},
+		"unmanaged entry without meta":    {err: ErrUnmanaged},
+		"entry managed by another module": {meta: owned("redirecter", 3), err: ErrNotOwner},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			existing := resolverEntry("web", "dc9")
+			existing.Meta = tc.meta
+			w, config, reg := testWriter(t, false, existing)
+
+			if err := w.Upsert("forwarder", "web is critical", resolverEntry("web", "dc2")); !errors.Is(err, tc.err) {
+				t.Errorf("upsert error = %v, want %v", err, tc.err)
+			}
+			if err := w.Delete("forwarder", api.ServiceResolver, "web"); !errors.Is(err, tc.err) {
+				t.Errorf("delete error = %v, want %v", err, tc.err)
+			}
+			if n := config.writeCount(); n != 0 {
+				t.Errorf("%d writes, want the entry left alone", n)
+			}
+			if e := config.resolver("web"); e == nil || e.Failover["*"].Datacenters[0] != "dc9" {
+				t.Errorf("entry = %+v, want it unchanged", e)
+			}
+			if n := counter(t, reg, "atc_config_entry_refused_total"); n != 2 {
+				t.Errorf("%v refusals counted, want 2", n)
+			}
+			if changes := w.Changes(); len(changes) != 0 {
+				t.Errorf("changes = %+v, want none recorded", changes)
+			}
+		})
+	}
+}
+
+func TestConflict(t *testing.T) {
+	tests := map[string]func(w *Writer) error{
+		"upsert of a new entry": func(w *Writer) error {
+			return w.Upsert("forwarder", "api is critical", resolverEntry("api", "dc2"))
+		},
+		"upsert of an existing entry": func(w *Writer) error {
+			return w.Upsert("forwarder", "web is critical", resolverEntry("web", "dc2"))
+		},
+		"delete": func(w *Writer) error {
+			return w.Delete("forwarder", api.ServiceResolver, "web")
+		},
+	}
+	for name, write := range tests {
+		t.Run(name, func(t *testing.T) {
+			existing := resolverEntry("web", "dc9")
+			existing.Meta = owned("forwarder", 1)
+			w, config, reg := testWriter(t, false, existing)
+
+			// Another writer modifies the entries after they were read, and
+			// before the write of the writer arrives.
+			config.beforeWrite = func() {
+				config.beforeWrite = nil
+				for _, name := range []string{"web", "api"} {
+					e := resolverEntry(name, "dc5")
+					e.Meta = owned("forwarder", 7)
+					config.put(e)
+				}
+			}
+
+			if err := write(w); !errors.Is(err, ErrConflict) {
+				t.Fatalf("error = %v, want a conflict", err)
+			}
+			if n := config.writeCount(); n != 1 {
+				t.Errorf("%d writes, want the rejected write not retried", n)
+			}
+			if e := config.resolver("web"); e == nil || e.Meta[MetaGeneration] != "7" {
+				t.Errorf("entry = %+v, want the concurrent write kept", e)
+			}
+			if n := counter(t, reg, "atc_config_entry_conflicts_total"); n != 1 {
+				t.Errorf("%v conflicts counted, want 1", n)
+			}
+			if changes := w.Changes(); len(changes) != 0 {
+				t.Errorf("changes = %+v, want the rejected write not recorded", changes)
+			}
+		})
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	existing := resolverEntry("api", "dc9")
+	existing.Meta = owned("forwarder", 4)
+	w, config, reg := testWriter(t, true, existing)
+
+	if err := w.Upsert("forwarder", "web is critical", resolverEntry("web", "dc2")); err != nil {
+		t.Fatal(err)
+	}
+	changes := w.Changes()
+	if len(changes) != 1 || !changes[0].DryRun || changes[0].Operation != OperationUpsert || !strings.Contains(changes[0].Diff, "dc2") {
+		t.Fatalf("changes = %+v, want the upsert of web recorded as a dry-run", changes)
+	}
+
+	// A later change applies to the entry as it would have been written.
+	if err := w.Upsert("forwarder", "web is still critical", resolverEntry("web", "dc3")); err != nil {
+		t.Fatal(err)
+	}
+	if e := w.Changes()[0].Entry; e.GetMeta()[MetaGeneration] != "2" {
+		t.Errorf("recorded entry = %+v, want generation 2", e)
+	}
+	if err := w.Delete("forwarder", api.ServiceResolver, "web"); err != nil {
+		t.Fatal(err)
+	}
+	if c := w.Changes()[0]; c.Operation != OperationDelete || !strings.Contains(c.Diff, "dc3") {
+		t.Errorf("change = %+v, want the delete of the recorded entry", c)
+	}
+
+	// An entry in Consul is deleted from what is stored there.
+	if err := w.Delete("forwarder", api.ServiceResolver, "api"); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := config.writeCount(); n != 0 {
+		t.Errorf("%d writes in dry-run mode, want none", n)
+	}
+	if config.resolver("web") != nil || config.resolver("api") == nil {
+		t.Error("config entries modified in dry-run mode")
+	}
+	if n := counter(t, reg, "atc_config_entry_changes_total"); n != 4 {
+		t.Errorf("%v changes counted, want 4", n)
+	}
+}
+
+func TestDeleteMissing(t *testing.T) {
+	w, config, _ := testWriter(t, false)
+	if err := w.Delete("forwarder", api.ServiceResolver, "web"); err != nil {
+		t.Fatal(err)
+	}
+	if n := config.writeCount(); n != 0 || len(w.Changes()) != 0 {
+		t.Errorf("%d writes and changes %+v, want a missing entry left alone", n, w.Changes())
+	}
+}
+
+func TestOwned(t *testing.T) {
+	web, other, unmanaged := resolverEntry("web", "dc2"), resolverEntry("api", "dc2"), resolverEntry("db", "dc2")
+	web.Meta, other.Meta = owned("forwarder", 1), owned("redirecter", 1)
+	w, _, _ := testWriter(t, false, web, other, unmanaged)
+
+	entries, err := w.Owned("forwarder", api.ServiceResolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].GetName() != "web" {
+		t.Errorf("owned entries = %+v, want web only", entries)
+	}
+}
@@ -0,0 +1,109 @@
+package consul
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/grafana/dskit/flagext"
+	"github.com/hashicorp/consul/api"
+)
+
+// Config configures the Consul client shared by all modules. Settings left
+// empty fall back to the CONSUL_* environment variables and the defaults of
+// the Consul API client.
+type Config struct {
+	Address    string         `yaml:"address"`
+	Scheme     string         `yaml:"scheme"`
+	Token      flagext.Secret `yaml:"token"`
+	TokenFile  string         `yaml:"token_file"`
+	Datacenter string         `yaml:"datacenter"`
+	Partition  string         `yaml:"partition"`
+	Namespace  string         `yaml:"namespace"`
+	TLS        TLSConfig      `yaml:"tls"`
+}
+
+type TLSConfig struct {
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	ServerName         string `yaml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.Address, "consul.address", "", "Address of the Consul agent, e.g. 127.0.0.1:8500. Defaults to CONSUL_HTTP_ADDR.")
+	f.StringVar(&cfg.Scheme, "consul.scheme", "", "URI scheme used to connect to the Consul agent, http or https.")
+	f.Var(&cfg.Token, "consul.token", "ACL token used to authenticate with Consul. Defaults to CONSUL_HTTP_TOKEN.")
+	f.StringVar(&cfg.TokenFile, "consul.token-file", "", "File containing the ACL token used to authenticate with Consul.")
+	f.StringVar(&cfg.Datacenter, "consul.datacenter", "", "Datacenter to query. Defaults to the datacenter of the agent.")
+	f.StringVar(&cfg.Partition, "consul.partition", "", "Admin partition to use (Consul Enterprise only).")
+	f.StringVar(&cfg.Namespace, "consul.namespace", "", "Namespace to use (Consul Enterprise only).")
+	f.StringVar(&cfg.TLS.CAFile, "consul.tls.ca-file", "", "CA certificate used to verify the Consul agent.")
+	f.StringVar(&cfg.TLS.CertFile, "consul.tls.cert-file", "", "Client certificate presented to the Consul agent.")
+	f.StringVar(&cfg.TLS.KeyFile, "consul.tls.key-file", "", "Private key of the client certificate.")
+	f.StringVar(&cfg.TLS.ServerName, "consul.tls.server-name", "", "Server name used to verify the certificate of the Consul agent.")
+	f.BoolVar(&cfg.TLS.InsecureSkipVerify, "consul.tls.insecure-skip-verify", false, "Skip verification of the certificate of the Consul agent.")
+}
+
+func (cfg *Config) Validate() error {
+	if cfg.Token.String() != "" && cfg.TokenFile != "" {
+		return fmt.Errorf("consul token and token file are mutually exclusive")
+	}
+	if (cfg.TLS.CertFile == "") != (cfg.TLS.KeyFile == "") {
+		return fmt.Errorf("consul tls cert file and key file must be set together")
+	}
+	return nil
+}
+
+// NewClient creates a Consul API client from the configuration.
+func NewClient(cfg Config) (*api.Client, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	conf := api.DefaultConfig()
+	if cfg.Address != "" {
+		conf.Address = cfg.Address
+	}
+	if cfg.Scheme != "" {
+		conf.Scheme = cfg.Scheme
+	}
+	// A token file takes precedence over a token in the Consul client, so
+	// only keep the one that was configured explicitly.
+	if token := cfg.Token.String(); token != "" {
+		conf.Token = token
+		conf.TokenFile = ""
+	}
+	if cfg.TokenFile != "" {
+		conf.Token = ""
+		conf.TokenFile = cfg.TokenFile
+	}
+	if cfg.Datacenter != "" {
+		conf.Datacenter = cfg.Datacenter
+	}
+	if cfg.Partition != "" {
+		conf.Partition = cfg.Partition
+	}
+	if cfg.Namespace != "" {
+		conf.Namespace = cfg.Namespace
+	}
+	if cfg.TLS.CAFile != "" {
+		conf.TLSConfig.CAFile = cfg.TLS.CAFile
+	}
+	if cfg.TLS.CertFile != "" {
+		conf.TLSConfig.CertFile = cfg.TLS.CertFile
+		conf.TLSConfig.KeyFile = cfg.TLS.KeyFile
+	}
+	if cfg.TLS.ServerName != "" {
+		conf.TLSConfig.Address = cfg.TLS.ServerName
+	}
+	if cfg.TLS.InsecureSkipVerify {
+		conf.TLSConfig.InsecureSkipVerify = true
+	}
+
+	client, err := api.NewClient(conf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create consul client: %w", err)
+	}
+	return client, nil
+}
@@ -0,0 +1,125 @@
+package consul
+
+import (
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/grafana/dskit/flagext"
+	"go.yaml.in/yaml/v3"
+)
+
+func TestValidate(t *testing.T) {
+	tests := map[string]struct {
+		cfg Config
+		err string
+	}{
+		"defaults":                   {cfg: Config{}},
+		"token":                      {cfg: Config{Token: flagext.SecretWithValue("secret")}},
+		"token file":                 {cfg: Config{TokenFile: "/run/secrets/consul-token"}},
+		"token and token file":       {cfg: Config{Token: flagext.SecretWithValue("secret"), TokenFile: "/run/secrets/consul-token"}, err: "mutually exclusive"},
+		"cert file without key":      {cfg: Config{TLS: TLSConfig{CertFile: "client.pem"}}, err: "must be set together"},
+		"key file without cert":      {cfg: Config{TLS: TLSConfig{KeyFile: "client-key.pem"}}, err: "must be set together"},
+		"cert file and key file":     {cfg: Config{TLS: TLSConfig{CertFile: "client.pem", KeyFile: "client-key.pem"}}},
+		"empty token and token file": {cfg: Config{Token: flagext.SecretWithValue(""), TokenFile: "/run/secrets/consul-token"}},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := tc.cfg.Validate()
+			if tc.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("error = %v, want it to contain %q", err, tc.err)
+			}
+			if _, err := NewClient(tc.cfg); err == nil {
+				t.Error("NewClient accepted an invalid config")
+			}
+		})
+	}
+}
+
+func TestTokenIsSecret(t *testing.T) {
+	var cfg Config
+	fs := flag.NewFlagSet("test", flag.PanicOnError)
+	cfg.RegisterFlags(fs)
+	if err := fs.Parse([]string{"-consul.token=s3cr3t"}); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Token.String() != "s3cr3t" {
+		t.Fatalf("token = %q, want the flag value", cfg.Token.String())
+	}
+
+	out, err := yaml.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(out), "s3cr3t") || !strings.Contains(string(out), "token: '********'") {
+		t.Errorf("marshalled config = %s, want the token redacted", out)
+	}
+
+	var parsed Config
+	if err := yaml.Unmarshal([]byte("token: s3cr3t\n"), &parsed); err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Token.String() != "s3cr3t" {
+		t.Errorf("token = %q, want it read from yaml", parsed.Token.String())
+	}
+}
+
+// TestToken checks which token the client sends when the token or the token
+// file is configured next to the CONSUL_HTTP_TOKEN* environment variables.
+func TestToken(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		cfg  Config
+		env  map[string]string
+		want string
+	}{
+		"token":                        {cfg: Config{Token: flagext.SecretWithValue("from-config")}, want: "from-config"},
+		"token file":                   {cfg: Config{TokenFile: tokenFile}, want: "from-file"},
+		"token from the environment":   {env: map[string]string{"CONSUL_HTTP_TOKEN": "from-env"}, want: "from-env"},
+		"token wins over the env file": {cfg: Config{Token: flagext.SecretWithValue("from-config")}, env: map[string]string{"CONSUL_HTTP_TOKEN_FILE": tokenFile}, want: "from-config"},
+		"token file wins over the env": {cfg: Config{TokenFile: tokenFile}, env: map[string]string{"CONSUL_HTTP_TOKEN": "from-env"}, want: "from-file"},
+		"no token":                     {want: ""},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("CONSUL_HTTP_TOKEN", "")
+			t.Setenv("CONSUL_HTTP_TOKEN_FILE", "")
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+
+			var got string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.Header.Get("X-Consul-Token")
+				_, _ = w.Write([]byte(`{}`))
+			}))
+			defer srv.Close()
+
+			tc.cfg.Address = srv.URL
+			client, err := NewClient(tc.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := client.Agent().Self(); err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("token = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
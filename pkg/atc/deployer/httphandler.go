@@ -1,12 +1,310 @@
 package deployer
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/log/level"
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/nomad/api"
+
+	"github.com/attachmentgenie/atc/pkg/atc/admission"
 )
 
-func (f *Deployer) OkHandler() http.HandlerFunc {
+// maxRequestSize bounds the size of the job payloads read by the deployer.
+const maxRequestSize = 16 << 20
+
+type reviewKey struct{}
+
+// review is the outcome of checking a job against the deployment policy and
+// the admission rules. It is added to the Nomad response of the request.
+type review struct {
+	denials  []string
+	warnings []string
+	mutated  bool
+
+	// rollout is set on register requests whose deployment is supervised
+	// once Nomad accepted the job.
+	rollout *rollout
+}
+
+// ProxyHandler passes requests through to Nomad unmodified, along with the
+// credentials of the caller.
+func (f *Deployer) ProxyHandler() http.Handler {
+	return f.proxy
+}
+
+// RegisterHandler checks the job of a Nomad job register request against the
+// deployment policy and the admission rules, and forwards compliant requests
+// to Nomad.
+func (f *Deployer) RegisterHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "OK")
+		var req api.JobRegisterRequest
+		if !f.decode(w, r, "register", &req) {
+			return
+		}
+		if req.Job == nil {
+			f.reject(w, "register", "Job must be specified")
+			return
+		}
+
+		rev := f.review("register", req.Job)
+		if len(rev.denials) > 0 {
+			level.Info(f.logger).Log("msg", "rejected job that violates the deployment policy", "job", jobID(req.Job), "violations", strings.Join(rev.denials, "; "))
+			f.reject(w, "register", "job violates the deployment policy:\n"+policyError(rev.denials).Error())
+			return
+		}
+		if rev.mutated && !f.encode(w, r, "register", req) {
+			return
+		}
+
+		if f.cfg.SuperviseRollouts {
+			rev.rollout = &rollout{job: jobID(req.Job), namespace: jobNamespace(r, req.Job)}
+		}
+
+		level.Debug(f.logger).Log("msg", "forwarding job to nomad", "job", jobID(req.Job), "mutated", rev.mutated)
+		f.requestsTotal.WithLabelValues("register", "forwarded").Inc()
+		f.proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), reviewKey{}, rev)))
+	}
+}
+
+// ValidateHandler forwards Nomad job validate requests to Nomad, and adds the
+// deployment policy violations and admission rule warnings of the job to
+// the response.
+func (f *Deployer) ValidateHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req api.JobValidateRequest
+		if !f.decode(w, r, "validate", &req) {
+			return
+		}
+		if req.Job == nil {
+			f.reject(w, "validate", "Job must be specified")
+			return
+		}
+
+		// Nomad validates the job as it would be registered, mutations included.
+		rev := f.review("validate", req.Job)
+		if rev.mutated && !f.encode(w, r, "validate", req) {
+			return
+		}
+
+		result := "forwarded"
+		if len(rev.denials) > 0 {
+			result = "rejected"
+		}
+		f.requestsTotal.WithLabelValues("validate", result).Inc()
+		f.proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), reviewKey{}, rev)))
+	}
+}
+
+// review checks the job against the deployment policy and the admission
+// rules, and applies the mutations of the rules to the job. Every rule
+// decision is logged and counted.
+func (f *Deployer) review(endpoint string, job *api.Job) *review {
+	rev := &review{denials: f.cfg.violations(job)}
+	if f.rules == nil {
+		return rev
+	}
+
+	result := f.rules.Evaluate(job)
+	for _, d := range result.Decisions {
+		level.Info(f.logger).Log("msg", "admission rule decision", "endpoint", endpoint, "job", jobID(job), "rule", d.Rule, "action", d.Action, "reason", d.Message)
+		f.ruleDecisionsTotal.WithLabelValues(endpoint, d.Rule, string(d.Action)).Inc()
+	}
+
+	rev.denials = append(rev.denials, result.Messages(admission.Deny)...)
+	rev.warnings = result.Messages(admission.Warn)
+	for _, msg := range result.Messages(admission.Mutate) {
+		rev.warnings = append(rev.warnings, msg+" (corrected by ATC)")
+	}
+	rev.mutated = result.Mutated()
+	return rev
+}
+
+// decode reads the request body into v and leaves a copy of it in place, so
+// the request can still be forwarded.
+func (f *Deployer) decode(w http.ResponseWriter, r *http.Request, endpoint string, v any) bool {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	if err == nil {
+		err = json.Unmarshal(body, v)
+	}
+	if err != nil {
+		f.reject(w, endpoint, fmt.Sprintf("Failed to decode request: %s", err))
+		return false
+	}
+
+	setBody(r, body)
+	return true
+}
+
+// encode replaces the request body with v.
+func (f *Deployer) encode(w http.ResponseWriter, r *http.Request, endpoint string, v any) bool {
+	body, err := json.Marshal(v)
+	if err != nil {
+		f.requestsTotal.WithLabelValues(endpoint, "error").Inc()
+		http.Error(w, fmt.Sprintf("failed to encode mutated job: %s", err), http.StatusInternalServerError)
+		return false
+	}
+
+	setBody(r, body)
+	return true
+}
+
+func setBody(r *http.Request, body []byte) {
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+}
+
+func (f *Deployer) reject(w http.ResponseWriter, endpoint, msg string) {
+	f.requestsTotal.WithLabelValues(endpoint, "rejected").Inc()
+	http.Error(w, msg, http.StatusBadRequest)
+}
+
+func (f *Deployer) newProxy() *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(f.client.Address)
+			r.SetXForwarded()
+			if rev, _ := r.In.Context().Value(reviewKey{}).(*review); rev.readsResponse() {
+				// The response is read and rewritten, so it must not be
+				// compressed.
+				r.Out.Header.Del("Accept-Encoding")
+			}
+		},
+		Transport:      f.client.HTTPClient.Transport,
+		ModifyResponse: f.modifyResponse,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			level.Error(f.logger).Log("msg", "failed to forward request to nomad", "path", r.URL.Path, "err", err)
+			http.Error(w, fmt.Sprintf("failed to forward request to nomad: %s", err), http.StatusBadGateway)
+		},
+	}
+}
+
+func (rev *review) readsResponse() bool {
+	return rev != nil && (len(rev.denials) > 0 || len(rev.warnings) > 0 || rev.rollout != nil)
+}
+
+// modifyResponse adds the deployment policy violations and admission rule
+// warnings recorded on the request to the Nomad response, and starts
+// following the deployment of registered jobs. Violations are only recorded
+// on validate requests, as register requests that violate the policy are
+// not forwarded.
+func (f *Deployer) modifyResponse(resp *http.Response) error {
+	rev, _ := resp.Request.Context().Value(reviewKey{}).(*review)
+	if !rev.readsResponse() {
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		if len(rev.denials) == 0 {
+			return nil
+		}
+		return appendViolations(resp, rev.denials)
+	}
+
+	// Fields are kept as is, other than the ones the review adds to.
+	var fields map[string]json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&fields); err != nil {
+		return fmt.Errorf("failed to decode nomad response: %w", err)
+	}
+	resp.Body.Close()
+
+	if rev.rollout != nil {
+		var index uint64
+		if err := json.Unmarshal(fields["JobModifyIndex"], &index); err == nil {
+			f.track(rev.rollout.job, rev.rollout.namespace, index)
+		}
+	}
+
+	if len(rev.warnings) > 0 {
+		var warnings string
+		_ = json.Unmarshal(fields["Warnings"], &warnings)
+		fields["Warnings"], _ = json.Marshal(formatWarnings(warnings, rev.warnings))
+	}
+	if len(rev.denials) > 0 {
+		var validationErrors []string
+		_ = json.Unmarshal(fields["ValidationErrors"], &validationErrors)
+		validationErrors = append(validationErrors, rev.denials...)
+		fields["ValidationErrors"], _ = json.Marshal(validationErrors)
+		fields["Error"], _ = json.Marshal(policyError(validationErrors).Error())
+	}
+
+	body, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	setResponseBody(resp, body)
+	return nil
+}
+
+// appendViolations adds the deployment policy violations to an error
+// response of Nomad, which is plain text, so the caller sees them along with
+// the reason Nomad failed the request.
+func appendViolations(resp *http.Response, violations []string) error {
+	msg, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read nomad response: %w", err)
+	}
+	resp.Body.Close()
+
+	body := strings.TrimRight(string(msg), "\n") + "\n\njob violates the deployment policy:\n" + policyError(violations).Error()
+	setResponseBody(resp, []byte(body))
+	return nil
+}
+
+func setResponseBody(resp *http.Response, body []byte) {
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+}
+
+// policyError formats the violations the way Nomad formats validation errors.
+func policyError(violations []string) error {
+	var err *multierror.Error
+	for _, v := range violations {
+		err = multierror.Append(err, errors.New(v))
+	}
+	return err
+}
+
+// formatWarnings appends the warnings to the warnings returned by Nomad, in
+// the same format.
+func formatWarnings(existing string, warnings []string) string {
+	var b strings.Builder
+	if existing != "" {
+		b.WriteString(strings.TrimRight(existing, "\n"))
+		b.WriteString("\n")
+	}
+	fmt.Fprintf(&b, "%d warning(s):\n\n", len(warnings))
+	for _, w := range warnings {
+		fmt.Fprintf(&b, "* %s\n", w)
+	}
+	return b.String()
+}
+
+// jobNamespace returns the namespace the job is registered in, which is set
+// either in the job or as a query parameter.
+func jobNamespace(r *http.Request, job *api.Job) string {
+	if job.Namespace != nil && *job.Namespace != "" {
+		return *job.Namespace
+	}
+	return r.URL.Query().Get("namespace")
+}
+
+func jobID(job *api.Job) string {
+	if job.ID != nil {
+		return *job.ID
+	}
+	if job.Name != nil {
+		return *job.Name
 	}
+	return ""
 }
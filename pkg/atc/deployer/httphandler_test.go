@@ -0,0 +1,85 @@
+package deployer
+
+import (
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/attachmentgenie/atc/pkg/atc/nomad"
+)
+
+func testDeployer(t *testing.T, validate http.HandlerFunc) *Deployer {
+	t.Helper()
+
+	srv := httptest.NewServer(validate)
+	t.Cleanup(srv.Close)
+
+	var cfg Config
+	cfg.RegisterFlags(flag.NewFlagSet("test", flag.PanicOnError))
+	cfg.AllowedDatacenters = []string{"dc1"}
+
+	client, err := nomad.NewClient(nomad.Config{Address: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := New(cfg, client, nil, log.NewNopLogger(), prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestValidateHandler(t *testing.T) {
+	tests := map[string]struct {
+		status int
+		body   string
+		job    string
+		want   []string
+	}{
+		"compliant job": {
+			status: http.StatusOK,
+			body:   `{"DriverConfigValidated":true,"ValidationErrors":null,"Error":"","Warnings":""}`,
+			job:    `{"Job":{"ID":"web","Datacenters":["dc1"]}}`,
+			want:   []string{`"ValidationErrors":null`},
+		},
+		"violations are added to the validation errors": {
+			status: http.StatusOK,
+			body:   `{"DriverConfigValidated":true,"ValidationErrors":["group missing"],"Error":"1 error occurred","Warnings":""}`,
+			job:    `{"Job":{"ID":"web","Datacenters":["dc9"]}}`,
+			want:   []string{`"group missing"`, `"datacenter \"dc9\" is not allowed"`, `"DriverConfigValidated":true`},
+		},
+		"violations are added to nomad errors": {
+			status: http.StatusForbidden,
+			body:   "Permission denied\n",
+			job:    `{"Job":{"ID":"web","Datacenters":["dc9"]}}`,
+			want:   []string{"Permission denied\n\njob violates the deployment policy:\n", `datacenter "dc9" is not allowed`},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			d := testDeployer(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.status)
+				io.WriteString(w, tc.body)
+			})
+
+			rec := httptest.NewRecorder()
+			d.ValidateHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/v1/validate/job", strings.NewReader(tc.job)))
+
+			if rec.Code != tc.status {
+				t.Errorf("status = %d, want %d", rec.Code, tc.status)
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(rec.Body.String(), want) {
+					t.Errorf("response %q does not contain %q", rec.Body.String(), want)
+				}
+			}
+		})
+	}
+}
@@ -2,92 +2,195 @@ package deployer
 
 import (
 	"context"
+	"flag"
 	"fmt"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/flagext"
 	"github.com/grafana/dskit/services"
-	"github.com/hashicorp/consul/api"
-	"github.com/hashicorp/consul/api/watch"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/attachmentgenie/atc/pkg/atc/admission"
+	"github.com/attachmentgenie/atc/pkg/atc/nomad"
+	"github.com/attachmentgenie/atc/pkg/atc/watcher"
 )
 
+type Config struct {
+	AllowedDatacenters flagext.StringSliceCSV `yaml:"allowed_datacenters"`
+	AllowedRegistries  flagext.StringSliceCSV `yaml:"allowed_registries"`
+	RequiredMeta       flagext.StringSliceCSV `yaml:"required_meta"`
+
+	RulesDir          string        `yaml:"rules_dir"`
+	RulesReloadPeriod time.Duration `yaml:"rules_reload_period"`
+
+	SuperviseRollouts     bool          `yaml:"supervise_rollouts"`
+	RolloutHealthyWindow  time.Duration `yaml:"rollout_healthy_window"`
+	RolloutCriticalWindow time.Duration `yaml:"rollout_critical_window"`
+	RolloutPollInterval   time.Duration `yaml:"rollout_poll_interval"`
+}
+
+func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	f.Var(&cfg.AllowedDatacenters, "deployer.allowed-datacenters", "Comma-separated list of datacenters jobs may be deployed to. All datacenters are allowed when empty.")
+	f.Var(&cfg.AllowedRegistries, "deployer.allowed-registries", "Comma-separated list of registries, optionally including a path, that task images must be pulled from. All registries are allowed when empty.")
+	f.Var(&cfg.RequiredMeta, "deployer.required-meta", "Comma-separated list of meta keys every job must set.")
+	f.StringVar(&cfg.RulesDir, "deployer.rules-dir", "", "Directory of YAML files with the admission rules that deny, warn about or mutate submitted jobs.")
+	f.DurationVar(&cfg.RulesReloadPeriod, "deployer.rules-reload-period", 10*time.Second, "Interval at which the admission rules directory is checked for changes.")
+	f.BoolVar(&cfg.SuperviseRollouts, "deployer.supervise-rollouts", true, "Follow the deployments of the jobs registered through the deployer, promoting or reverting them based on the Consul checks of their allocations.")
+	f.DurationVar(&cfg.RolloutHealthyWindow, "deployer.rollout-healthy-window", time.Minute, "How long the checks of all canaries must stay passing before the deployment is promoted.")
+	f.DurationVar(&cfg.RolloutCriticalWindow, "deployer.rollout-critical-window", 30*time.Second, "How long the checks of new allocations may stay critical before the deployment is failed and the job reverted to its last stable version.")
+	f.DurationVar(&cfg.RolloutPollInterval, "deployer.rollout-poll-interval", 5*time.Second, "Interval at which the supervised deployments are checked.")
+}
+
+func (cfg *Config) Validate() error {
+	for _, registry := range cfg.AllowedRegistries {
+		if registry == "" || strings.Contains(registry, "://") {
+			return fmt.Errorf("invalid deployer allowed registry: %q", registry)
+		}
+	}
+	for _, key := range cfg.RequiredMeta {
+		if key == "" {
+			return fmt.Errorf("invalid deployer required meta key: %q", key)
+		}
+	}
+	if cfg.RulesReloadPeriod <= 0 {
+		return fmt.Errorf("invalid deployer rules reload period: %s", cfg.RulesReloadPeriod)
+	}
+	if cfg.RolloutHealthyWindow < 0 || cfg.RolloutCriticalWindow < 0 {
+		return fmt.Errorf("deployer rollout windows must not be negative")
+	}
+	if cfg.RolloutPollInterval <= 0 {
+		return fmt.Errorf("invalid deployer rollout poll interval: %s", cfg.RolloutPollInterval)
+	}
+	return nil
+}
+
+// Deployer is a policy-enforcing gateway in front of the Nomad jobs API.
+// Jobs that comply with the policy are passed through to Nomad, after the
+// admission rules applied their mutations.
 type Deployer struct {
 	services.Service
 
+	cfg    Config
+	client *nomad.Client
+	proxy  *httputil.ReverseProxy
+	rules  *admission.Engine
 	logger log.Logger
 
-	watchServicesChan chan struct{}
+	requestsTotal      *prometheus.CounterVec
+	ruleDecisionsTotal *prometheus.CounterVec
+	ruleReloadsTotal   *prometheus.CounterVec
+	rulesLoaded        prometheus.Gauge
+
+	rolloutsMtx         sync.Mutex
+	rollouts            map[string]*rollout
+	rolloutsTracked     prometheus.Gauge
+	rolloutActionsTotal *prometheus.CounterVec
+
+	snapshots <-chan *watcher.Snapshot
 }
 
 func (f *Deployer) starting(ctx context.Context) error {
-	return nil
+	if f.rules == nil {
+		return nil
+	}
+	return f.reloadRules()
 }
 
 func (f *Deployer) stopping(_ error) error {
 	return nil
 }
 
-func New(logger log.Logger) (*Deployer, error) {
+func New(cfg Config, client *nomad.Client, snapshots <-chan *watcher.Snapshot, logger log.Logger, reg prometheus.Registerer) (*Deployer, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
 
 	f := &Deployer{
-		logger: logger,
+		cfg:       cfg,
+		client:    client,
+		logger:    log.With(logger, "module", "deployer"),
+		rollouts:  map[string]*rollout{},
+		snapshots: snapshots,
+		requestsTotal: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "atc_deployer_requests_total",
+			Help: "Total number of job requests handled by the deployer, by endpoint and result.",
+		}, []string{"endpoint", "result"}),
+		ruleDecisionsTotal: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "atc_deployer_rule_decisions_total",
+			Help: "Total number of admission rule decisions, by endpoint, rule and action.",
+		}, []string{"endpoint", "rule", "action"}),
+		ruleReloadsTotal: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "atc_deployer_rule_reloads_total",
+			Help: "Total number of admission rule reloads, by result.",
+		}, []string{"result"}),
+		rulesLoaded: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "atc_deployer_rules",
+			Help: "Number of admission rules currently loaded.",
+		}),
+		rolloutsTracked: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "atc_deployer_rollouts",
+			Help: "Number of job rollouts currently supervised.",
+		}),
+		rolloutActionsTotal: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "atc_deployer_rollout_actions_total",
+			Help: "Total number of actions taken on supervised deployments, by action.",
+		}, []string{"action"}),
 	}
-	f.Service = services.NewBasicService(f.starting, f.watcher, f.stopping)
+	if cfg.RulesDir != "" {
+		f.rules = admission.NewEngine(cfg.RulesDir)
+	}
+	f.proxy = f.newProxy()
+	f.Service = services.NewBasicService(f.starting, f.running, f.stopping)
 	return f, nil
 }
 
-func (f *Deployer) watcher(ctx context.Context) error {
-	client, err := api.NewClient(&api.Config{})
-	if err != nil {
-		return fmt.Errorf("failed to connect to consul: %s", err.Error())
+func (f *Deployer) running(ctx context.Context) error {
+	var reload <-chan time.Time
+	if f.rules != nil {
+		ticker := time.NewTicker(f.cfg.RulesReloadPeriod)
+		defer ticker.Stop()
+		reload = ticker.C
 	}
 
-	servicesWatcher, parseErr := watch.Parse(map[string]interface{}{"type": "services"})
-	if parseErr != nil {
-		return fmt.Errorf("failed to create services watcher plan: %s", parseErr.Error())
-	}
+	poll := time.NewTicker(f.cfg.RolloutPollInterval)
+	defer poll.Stop()
 
-	servicesWatcher.HybridHandler = func(_ watch.BlockingParamVal, _ interface{}) {
+	var snapshot *watcher.Snapshot
+	for {
 		select {
 		case <-ctx.Done():
-		case f.watchServicesChan <- struct{}{}:
-		default:
-			// Event chan is full, discard event.
-		}
-	}
+			return nil
 
-	checksWatcher, err := watch.Parse(map[string]interface{}{"type": "checks"})
-	if err != nil {
-		return fmt.Errorf("failed to create checks watcher plan: %w", err)
-	}
+		case <-reload:
+			if err := f.reloadRules(); err != nil {
+				level.Error(f.logger).Log("msg", "failed to reload admission rules, keeping the current rules", "dir", f.cfg.RulesDir, "err", err)
+			}
 
-	checksWatcher.HybridHandler = func(_ watch.BlockingParamVal, _ interface{}) {
-		select {
-		case <-ctx.Done():
-		case f.watchServicesChan <- struct{}{}:
-		default:
-			// Event chan is full, discard event.
+		case snapshot = <-f.snapshots:
+		case <-poll.C:
+			f.supervise(snapshot)
 		}
 	}
+}
 
-	errChan := make(chan error, 2)
-
-	defer func() {
-		servicesWatcher.Stop()
-		checksWatcher.Stop()
-	}()
-
-	go func() {
-		errChan <- servicesWatcher.RunWithClientAndHclog(client, servicesWatcher.Logger)
-	}()
-
-	go func() {
-		errChan <- checksWatcher.RunWithClientAndHclog(client, checksWatcher.Logger)
-	}()
-
-	select {
-	case <-ctx.Done():
-		return nil
+func (f *Deployer) reloadRules() error {
+	changed, err := f.rules.Reload()
+	if err != nil {
+		f.ruleReloadsTotal.WithLabelValues("failure").Inc()
+		return err
+	}
+	f.ruleReloadsTotal.WithLabelValues("success").Inc()
 
-	case err = <-errChan:
-		return fmt.Errorf("services or checks watcher terminated: %w", err)
+	if changed {
+		rules := f.rules.Rules()
+		f.rulesLoaded.Set(float64(len(rules)))
+		level.Info(f.logger).Log("msg", "loaded admission rules", "dir", f.cfg.RulesDir, "rules", len(rules))
 	}
+	return nil
 }
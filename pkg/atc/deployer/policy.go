@@ -0,0 +1,88 @@
+package deployer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/nomad/api"
+	"golang.org/x/exp/slices"
+)
+
+// imageDrivers are the task drivers whose "image" config option refers to an
+// OCI image.
+var imageDrivers = []string{"docker", "podman", "containerd-driver"}
+
+// violations checks a job against the deployment policy and returns a
+// description of every rule it breaks.
+func (cfg Config) violations(job *api.Job) []string {
+	var violations []string
+
+	if len(cfg.AllowedDatacenters) > 0 {
+		if len(job.Datacenters) == 0 {
+			violations = append(violations, "job does not set datacenters")
+		}
+		for _, dc := range job.Datacenters {
+			if !slices.Contains(cfg.AllowedDatacenters, dc) {
+				violations = append(violations, fmt.Sprintf("datacenter %q is not allowed", dc))
+			}
+		}
+	}
+
+	for _, key := range cfg.RequiredMeta {
+		if job.Meta[key] == "" {
+			violations = append(violations, fmt.Sprintf("job meta %q is required", key))
+		}
+	}
+
+	if len(cfg.AllowedRegistries) > 0 {
+		for _, tg := range job.TaskGroups {
+			for _, task := range tg.Tasks {
+				if !slices.Contains(imageDrivers, task.Driver) {
+					continue
+				}
+				image, _ := task.Config["image"].(string)
+				if !cfg.registryAllowed(image) {
+					violations = append(violations, fmt.Sprintf("image %q of task %q in group %q is not from an allowed registry", image, task.Name, groupName(tg)))
+				}
+			}
+		}
+	}
+
+	sort.Strings(violations)
+	return violations
+}
+
+// registryAllowed reports whether the image is pulled from one of the allowed
+// registries. An allowed registry may include a path, to only allow the
+// repositories below it.
+func (cfg Config) registryAllowed(image string) bool {
+	reference := normalizeImage(image)
+	for _, registry := range cfg.AllowedRegistries {
+		registry = strings.TrimSuffix(registry, "/")
+		if strings.HasPrefix(reference, registry+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeImage prefixes image references without a registry host with the
+// Docker Hub registry, the way Docker resolves them.
+func normalizeImage(image string) string {
+	host, rest, found := strings.Cut(image, "/")
+	if found && (strings.ContainsAny(host, ".:") || host == "localhost") {
+		return image
+	}
+	if !found {
+		return "docker.io/library/" + image
+	}
+	return "docker.io/" + host + "/" + rest
+}
+
+func groupName(tg *api.TaskGroup) string {
+	if tg.Name == nil {
+		return ""
+	}
+	return *tg.Name
+}
@@ -0,0 +1,42 @@
+package deployer
+
+import (
+	"testing"
+)
+
+func TestNormalizeImage(t *testing.T) {
+	tests := map[string]string{
+		"nginx":                               "docker.io/library/nginx",
+		"nginx:1.27":                          "docker.io/library/nginx:1.27",
+		"grafana/grafana":                     "docker.io/grafana/grafana",
+		"docker.io/library/redis:7":           "docker.io/library/redis:7",
+		"registry.example.com/team/app:v1":    "registry.example.com/team/app:v1",
+		"registry.example.com:5000/app":       "registry.example.com:5000/app",
+		"localhost/app":                       "localhost/app",
+		"localhost:5000/app":                  "localhost:5000/app",
+		"ghcr.io/org/app@sha256:0123456789ab": "ghcr.io/org/app@sha256:0123456789ab",
+	}
+	for image, want := range tests {
+		if got := normalizeImage(image); got != want {
+			t.Errorf("normalizeImage(%q) = %q, want %q", image, got, want)
+		}
+	}
+}
+
+func TestRegistryAllowed(t *testing.T) {
+	cfg := Config{AllowedRegistries: []string{"registry.example.com/team/", "docker.io/library"}}
+	tests := map[string]bool{
+		"nginx":                               true,
+		"docker.io/library/nginx":             true,
+		"grafana/grafana":                     false,
+		"registry.example.com/team/app":       true,
+		"registry.example.com/other/app":      false,
+		"registry.example.com/teamster/app":   false,
+		"registry.example.com.evil.com/team/": false,
+	}
+	for image, want := range tests {
+		if got := cfg.registryAllowed(image); got != want {
+			t.Errorf("registryAllowed(%q) = %t, want %t", image, got, want)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package deployer
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/hashicorp/nomad/api"
+
+	"github.com/attachmentgenie/atc/pkg/atc/watcher"
+)
+
+// deploymentWait is how long a registered job is followed while no
+// deployment shows up for it. Jobs without an update strategy, like batch
+// jobs, never get one.
+const deploymentWait = time.Minute
+
+// rollout follows the deployment of a job registered through the deployer.
+type rollout struct {
+	job       string
+	namespace string
+	// index is the JobModifyIndex returned when the job was registered.
+	index      uint64
+	registered time.Time
+
+	deployment    string
+	passingSince  time.Time
+	criticalSince time.Time
+	// failed is set once the deployment was failed, until the job is
+	// reverted.
+	failed bool
+}
+
+func (r *rollout) key() string {
+	return r.namespace + "/" + r.job
+}
+
+// track starts following the deployment of a job, replacing the rollout of an
+// earlier version of the same job.
+func (f *Deployer) track(job, namespace string, index uint64) {
+	if namespace == "" {
+		namespace = api.DefaultNamespace
+	}
+
+	r := &rollout{job: job, namespace: namespace, index: index, registered: time.Now()}
+
+	f.rolloutsMtx.Lock()
+	defer f.rolloutsMtx.Unlock()
+	f.rollouts[r.key()] = r
+	f.rolloutsTracked.Set(float64(len(f.rollouts)))
+}
+
+func (f *Deployer) untrack(r *rollout) {
+	f.rolloutsMtx.Lock()
+	defer f.rolloutsMtx.Unlock()
+	if f.rollouts[r.key()] == r {
+		delete(f.rollouts, r.key())
+	}
+	f.rolloutsTracked.Set(float64(len(f.rollouts)))
+}
+
+// supervise checks the Consul health of the allocations of every followed
+// deployment. Canaries that stay passing for the healthy window are
+// promoted, while deployments with allocations that stay critical for the
+// critical window are failed and the job is reverted to its last stable
+// version.
+func (f *Deployer) supervise(snapshot *watcher.Snapshot) {
+	f.rolloutsMtx.Lock()
+	rollouts := make([]*rollout, 0, len(f.rollouts))
+	for _, r := range f.rollouts {
+		rollouts = append(rollouts, r)
+	}
+	f.rolloutsMtx.Unlock()
+
+	allocations := allocationHealth(snapshot)
+	for _, r := range rollouts {
+		done, err := f.superviseRollout(r, allocations)
+		if err != nil {
+			level.Error(f.logger).Log("msg", "failed to supervise rollout", "job", r.job, "namespace", r.namespace, "deployment", r.deployment, "err", err)
+			continue
+		}
+		if done {
+			f.untrack(r)
+		}
+	}
+}
+
+func (f *Deployer) superviseRollout(r *rollout, allocations map[string]watcher.Health) (bool, error) {
+	q := &api.QueryOptions{Namespace: r.namespace}
+	w := &api.WriteOptions{Namespace: r.namespace}
+
+	dep, _, err := f.client.Jobs().LatestDeployment(r.job, q)
+	if err != nil {
+		return false, fmt.Errorf("failed to get latest deployment: %w", err)
+	}
+	if dep == nil || dep.JobModifyIndex < r.index {
+		if time.Since(r.registered) > deploymentWait {
+			level.Debug(f.logger).Log("msg", "no deployment for job, no longer following it", "job", r.job, "namespace", r.namespace)
+			return true, nil
+		}
+		return false, nil
+	}
+	if r.deployment != dep.ID {
+		r.deployment = dep.ID
+		r.passingSince, r.criticalSince, r.failed = time.Time{}, time.Time{}, false
+		level.Info(f.logger).Log("msg", "following deployment", "job", r.job, "namespace", r.namespace, "deployment", dep.ID, "version", dep.JobVersion)
+	}
+	if r.failed {
+		// The revert after failing the deployment did not go through.
+		return f.revert(r, dep, w)
+	}
+
+	switch dep.Status {
+	case api.DeploymentStatusSuccessful, api.DeploymentStatusFailed, api.DeploymentStatusCancelled:
+		level.Info(f.logger).Log("msg", "deployment finished", "job", r.job, "namespace", r.namespace, "deployment", dep.ID, "status", dep.Status)
+		return true, nil
+	}
+
+	allocs, _, err := f.client.Deployments().Allocations(dep.ID, q)
+	if err != nil {
+		return false, fmt.Errorf("failed to list deployment allocations: %w", err)
+	}
+
+	// Canaries are ready for promotion once all of them registered their
+	// services and every one of those is passing.
+	var (
+		critical = 0
+		canaries = 0
+		ready    = canariesPlaced(dep)
+	)
+	for _, alloc := range allocs {
+		if alloc.ClientStatus != api.AllocClientStatusRunning && alloc.ClientStatus != api.AllocClientStatusPending {
+			continue
+		}
+		h, registered := allocations[alloc.ID]
+		critical += h.Critical
+		if alloc.DeploymentStatus == nil || !alloc.DeploymentStatus.Canary {
+			continue
+		}
+		canaries++
+		if !registered || h.Passing != h.Total() {
+			ready = false
+		}
+	}
+	ready = ready && canaries > 0
+
+	now := time.Now()
+	if critical == 0 {
+		r.criticalSince = time.Time{}
+	} else if r.criticalSince.IsZero() {
+		r.criticalSince = now
+	} else if now.Sub(r.criticalSince) >= f.cfg.RolloutCriticalWindow {
+		return f.revert(r, dep, w)
+	}
+
+	if !ready {
+		r.passingSince = time.Time{}
+		return false, nil
+	}
+	if r.passingSince.IsZero() {
+		r.passingSince = now
+	}
+	if now.Sub(r.passingSince) < f.cfg.RolloutHealthyWindow {
+		return false, nil
+	}
+
+	if _, _, err := f.client.Deployments().PromoteAll(dep.ID, w); err != nil {
+		return false, fmt.Errorf("failed to promote deployment: %w", err)
+	}
+	level.Info(f.logger).Log("msg", "promoted canaries", "job", r.job, "namespace", r.namespace, "deployment", dep.ID, "version", dep.JobVersion)
+	f.rolloutActionsTotal.WithLabelValues("promote").Inc()
+	r.passingSince = time.Time{}
+	// The deployment is followed until it finishes, as the allocations
+	// replaced after the promotion can still go critical.
+	return false, nil
+}
+
+// revert fails the deployment and registers the last stable version of the
+// job before the one being deployed again. The stable version is looked up
+// before the deployment is failed, and the rollout is only done once the job
+// is reverted, so a failed call is retried on the next poll.
+func (f *Deployer) revert(r *rollout, dep *api.Deployment, w *api.WriteOptions) (bool, error) {
+	versions, _, _, err := f.client.Jobs().Versions(r.job, false, &api.QueryOptions{Namespace: r.namespace})
+	if err != nil {
+		return false, fmt.Errorf("failed to list job versions: %w", err)
+	}
+
+	var current uint64
+	var stable *api.Job
+	for _, v := range versions {
+		if v.Version == nil {
+			continue
+		}
+		current = max(current, *v.Version)
+		if *v.Version >= dep.JobVersion || v.Stable == nil || !*v.Stable {
+			continue
+		}
+		if stable == nil || *v.Version > *stable.Version {
+			stable = v
+		}
+	}
+
+	if !r.failed {
+		if _, _, err := f.client.Deployments().Fail(dep.ID, w); err != nil {
+			return false, fmt.Errorf("failed to fail deployment: %w", err)
+		}
+		r.failed = true
+		level.Warn(f.logger).Log("msg", "failed deployment with critical allocations", "job", r.job, "namespace", r.namespace, "deployment", dep.ID, "version", dep.JobVersion, "critical_for", time.Since(r.criticalSince))
+		f.rolloutActionsTotal.WithLabelValues("fail").Inc()
+	}
+
+	if stable == nil {
+		level.Warn(f.logger).Log("msg", "no stable job version to revert to", "job", r.job, "namespace", r.namespace)
+		return true, nil
+	}
+	// A revert by Nomad itself or a newer registration is left alone.
+	if current != dep.JobVersion {
+		level.Info(f.logger).Log("msg", "job moved on from the failed version, not reverting it", "job", r.job, "namespace", r.namespace, "version", current)
+		return true, nil
+	}
+
+	// Reverting only succeeds while the failed version is still current.
+	if _, _, err := f.client.Jobs().Revert(r.job, *stable.Version, &dep.JobVersion, w, "", ""); err != nil {
+		return false, fmt.Errorf("failed to revert job to version %d: %w", *stable.Version, err)
+	}
+	level.Warn(f.logger).Log("msg", "reverted job to last stable version", "job", r.job, "namespace", r.namespace, "version", *stable.Version)
+	f.rolloutActionsTotal.WithLabelValues("revert").Inc()
+	return true, nil
+}
+
+// canariesPlaced reports whether the deployment has canaries awaiting
+// promotion, and all of them have been placed.
+func canariesPlaced(dep *api.Deployment) bool {
+	awaiting := false
+	for _, state := range dep.TaskGroups {
+		if state.DesiredCanaries == 0 || state.Promoted {
+			continue
+		}
+		if len(state.PlacedCanaries) < state.DesiredCanaries {
+			return false
+		}
+		awaiting = true
+	}
+	return awaiting
+}
+
+// allocationHealth aggregates the health of the Consul services registered
+// by Nomad per allocation. Nomad registers services with IDs of the form
+// _nomad-task-<allocation id>-<task or group>-<service>-<port>.
+func allocationHealth(snapshot *watcher.Snapshot) map[string]watcher.Health {
+	allocations := map[string]watcher.Health{}
+	if snapshot == nil {
+		return allocations
+	}
+
+	for _, instances := range snapshot.Instances {
+		for _, instance := range instances {
+			rest, ok := strings.CutPrefix(instance.ID, "_nomad-task-")
+			if !ok || len(rest) < 36 {
+				continue
+			}
+			id := rest[:36]
+
+			h := allocations[id]
+			h.Add(instance.Status)
+			allocations[id] = h
+		}
+	}
+	return allocations
+}
@@ -0,0 +1,130 @@
+package deployer
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+
+	"github.com/attachmentgenie/atc/pkg/atc/watcher"
+)
+
+const testAllocation = "0b0c6bd4-7f4c-4b7a-9e1e-4d3c1a2b5e6f"
+
+// fakeNomad serves a running deployment of version 2 of the web job, whose
+// last stable version is 1, and counts the calls to fail and revert.
+type fakeNomad struct {
+	mtx         sync.Mutex
+	calls       map[string]int
+	failRevert  int
+	failVersion int
+	version     int
+}
+
+func (n *fakeNomad) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	n.calls[r.URL.Path]++
+
+	w.Header().Set("X-Nomad-Index", "1")
+	w.Header().Set("X-Nomad-LastContact", "0")
+	var body any
+	switch r.URL.Path {
+	case "/v1/job/web/deployment":
+		body = map[string]any{"ID": "d1", "JobID": "web", "JobVersion": 2, "JobModifyIndex": 10, "Status": "running"}
+	case "/v1/deployment/allocations/d1":
+		body = []map[string]any{{"ID": testAllocation, "ClientStatus": "running"}}
+	case "/v1/job/web/versions":
+		if n.failVersion > 0 {
+			n.failVersion--
+			http.Error(w, "no leader", http.StatusInternalServerError)
+			return
+		}
+		body = map[string]any{"Versions": []map[string]any{
+			{"ID": "web", "Version": n.version, "Stable": false},
+			{"ID": "web", "Version": 1, "Stable": true},
+			{"ID": "web", "Version": 0, "Stable": true},
+		}}
+	case "/v1/deployment/fail/d1":
+		body = map[string]any{}
+	case "/v1/job/web/revert":
+		if n.failRevert > 0 {
+			n.failRevert--
+			http.Error(w, "no leader", http.StatusInternalServerError)
+			return
+		}
+		n.version++
+		body = map[string]any{}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func criticalSnapshot() *watcher.Snapshot {
+	return &watcher.Snapshot{Instances: map[string][]watcher.Instance{
+		"web": {{ID: "_nomad-task-" + testAllocation + "-group-web-web-http", Service: "web", Status: api.HealthCritical}},
+	}}
+}
+
+func TestRevert(t *testing.T) {
+	tests := map[string]struct {
+		failVersion, failRevert int
+		// version is the current version of the job.
+		version int
+		// polls until the rollout is done, and the revert calls made.
+		polls   int
+		reverts int
+	}{
+		"revert": {
+			version: 2,
+			polls:   2,
+			reverts: 1,
+		},
+		"versions fail before the deployment is failed": {
+			failVersion: 1,
+			version:     2,
+			polls:       3,
+			reverts:     1,
+		},
+		"revert is retried on the next poll": {
+			failRevert: 2,
+			version:    2,
+			polls:      4,
+			reverts:    3,
+		},
+		"newer version is left alone": {
+			version: 3,
+			polls:   2,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			nomad := &fakeNomad{calls: map[string]int{}, failVersion: tc.failVersion, failRevert: tc.failRevert, version: tc.version}
+			d := testDeployer(t, nomad.ServeHTTP)
+			d.cfg.RolloutCriticalWindow = 0
+			d.track("web", "", 5)
+
+			for i := 0; i < tc.polls; i++ {
+				if len(d.rollouts) == 0 {
+					t.Fatalf("rollout done after %d polls, want %d", i, tc.polls)
+				}
+				d.supervise(criticalSnapshot())
+			}
+			if len(d.rollouts) != 0 {
+				t.Fatalf("rollout not done after %d polls", tc.polls)
+			}
+
+			if got := nomad.calls["/v1/deployment/fail/d1"]; got != 1 {
+				t.Errorf("deployment failed %d times, want once", got)
+			}
+			if got := nomad.calls["/v1/job/web/revert"]; got != tc.reverts {
+				t.Errorf("job reverted %d times, want %d", got, tc.reverts)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package event_sink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/backoff"
+)
+
+// deadLetter is the record of a batch of events a sink failed to receive.
+type deadLetter struct {
+	batch
+	Sink     string
+	Attempts int
+	Error    string
+	Time     time.Time
+}
+
+// deliver sends the buffered events to a sink until the context is done.
+// Failed deliveries are retried with an exponential backoff, and batches
+// that fail every attempt are moved to the dead letters of the sink, so they
+// do not hold back the batches after them.
+func (f *EventSink) deliver(ctx context.Context, name string) {
+	sink, q := f.sinks[name], f.queues[name]
+	retries := backoff.New(ctx, backoff.Config{
+		MinBackoff: f.cfg.RetryMinBackoff,
+		MaxBackoff: f.cfg.RetryMaxBackoff,
+	})
+
+	for {
+		e, err := q.next(ctx)
+		if err != nil {
+			return
+		}
+
+		err = sink.Send(ctx, e.index, e.events)
+		if ctx.Err() != nil {
+			return
+		}
+		switch {
+		case err == nil:
+			f.deliveriesTotal.WithLabelValues(name, "delivered").Inc()
+
+		case retries.NumRetries()+1 < f.cfg.MaxAttempts:
+			level.Warn(f.logger).Log("msg", "failed to deliver events, retrying", "sink", name, "index", e.index, "attempt", retries.NumRetries()+1, "err", err)
+			f.deliveriesTotal.WithLabelValues(name, "failed").Inc()
+			retries.Wait()
+			continue
+
+		default:
+			level.Error(f.logger).Log("msg", "failed to deliver events, moving them to the dead letters", "sink", name, "index", e.index, "attempts", f.cfg.MaxAttempts, "err", err)
+			f.deliveriesTotal.WithLabelValues(name, "failed").Inc()
+			f.deadLetterBatch(name, e, f.cfg.MaxAttempts, err)
+		}
+
+		retries.Reset()
+		if err := q.ack(e.index); err != nil {
+			level.Error(f.logger).Log("msg", "failed to acknowledge delivered events", "sink", name, "index", e.index, "err", err)
+		}
+		f.updateDepth(name)
+	}
+}
+
+// deadLetterBatch moves a batch to the dead letters of a sink, or drops it
+// when it cannot be written.
+func (f *EventSink) deadLetterBatch(name string, e entry, attempts int, cause error) {
+	if err := f.deadLetter(name, e, attempts, cause); err != nil {
+		level.Error(f.logger).Log("msg", "failed to write dead letter, dropping events", "sink", name, "index", e.index, "err", err)
+		f.droppedTotal.WithLabelValues(name).Inc()
+		return
+	}
+	f.deadLettersTotal.WithLabelValues(name).Inc()
+}
+
+// deadLetter appends a batch to the dead letter file of a sink.
+func (f *EventSink) deadLetter(name string, e entry, attempts int, cause error) error {
+	dir := filepath.Join(f.cfg.DataDir, "dead-letter")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	rec, err := json.Marshal(deadLetter{
+		batch:    batch{Index: e.index, Events: e.events},
+		Sink:     name,
+		Attempts: attempts,
+		Error:    cause.Error(),
+		Time:     time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, name+".jsonl"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(rec, '\n')); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write dead letter: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,254 @@
+package event_sink
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+// Encodings of the events delivered to a sink.
+const (
+	// FormatNomad is the JSON encoding of the Nomad event stream.
+	FormatNomad = "nomad"
+	// FormatCloudEvents encodes every event as a CloudEvents 1.0 event.
+	FormatCloudEvents = "cloudevents"
+	// FormatOTLP encodes the events as OTLP/HTTP JSON log records.
+	FormatOTLP = "otlp"
+)
+
+// Modes of the CloudEvents HTTP protocol binding.
+const (
+	CloudEventsStructured = "structured"
+	CloudEventsBinary     = "binary"
+)
+
+// message is an encoded request to a webhook.
+type message struct {
+	header http.Header
+	body   []byte
+}
+
+// encoder encodes events in the format of a sink.
+type encoder struct {
+	format string
+	mode   string
+	source string
+	// address is the address of the Nomad cluster the events come from.
+	address string
+}
+
+func newEncoder(cfg SinkConfig, address string) encoder {
+	e := encoder{format: cfg.Format, mode: cfg.CloudEventsMode, source: cfg.CloudEventsSource, address: address}
+	if e.format == "" {
+		e.format = FormatNomad
+	}
+	if e.mode == "" {
+		e.mode = CloudEventsStructured
+	}
+	if e.source == "" {
+		e.source = address
+	}
+	return e
+}
+
+// requests encodes the events of an index as webhook requests. CloudEvents
+// are sent one per request, so receivers do not need batch support.
+func (e encoder) requests(index uint64, events []api.Event) ([]message, error) {
+	switch e.format {
+	case FormatCloudEvents:
+		msgs := make([]message, 0, len(events))
+		for i, event := range events {
+			ce := e.cloudEvent(index, i, event)
+			if e.mode == CloudEventsBinary {
+				msg, err := ce.binary()
+				if err != nil {
+					return nil, err
+				}
+				msgs = append(msgs, msg)
+				continue
+			}
+
+			body, err := json.Marshal(ce)
+			if err != nil {
+				return nil, err
+			}
+			msgs = append(msgs, message{header: http.Header{"Content-Type": {"application/cloudevents+json"}}, body: body})
+		}
+		return msgs, nil
+
+	case FormatOTLP:
+		body, err := json.Marshal(e.otlpLogs(index, events))
+		if err != nil {
+			return nil, err
+		}
+		return []message{{header: http.Header{"Content-Type": {"application/json"}}, body: body}}, nil
+	}
+
+	body, err := json.Marshal(batch{Index: index, Events: events})
+	if err != nil {
+		return nil, err
+	}
+	return []message{{header: http.Header{"Content-Type": {"application/json"}}, body: body}}, nil
+}
+
+// lines encodes the events of an index as lines of JSON.
+func (e encoder) lines(index uint64, events []api.Event) ([][]byte, error) {
+	var values []any
+	switch e.format {
+	case FormatCloudEvents:
+		for i, event := range events {
+			values = append(values, e.cloudEvent(index, i, event))
+		}
+	case FormatOTLP:
+		values = append(values, e.otlpLogs(index, events))
+	default:
+		for _, event := range events {
+			values = append(values, event)
+		}
+	}
+
+	lines := make([][]byte, 0, len(values))
+	for _, v := range values {
+		line, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+// cloudEvent is a CloudEvents 1.0 event in the structured JSON format.
+type cloudEvent struct {
+	SpecVersion     string    `json:"specversion"`
+	ID              string    `json:"id"`
+	Source          string    `json:"source"`
+	Type            string    `json:"type"`
+	Subject         string    `json:"subject,omitempty"`
+	DataContentType string    `json:"datacontenttype"`
+	NomadIndex      string    `json:"nomadindex"`
+	Data            api.Event `json:"data"`
+}
+
+// cloudEvent wraps a Nomad event. Its ID is derived from the index and the
+// position of the event, so receivers can drop the events that are
+// delivered again after a retry.
+func (e encoder) cloudEvent(index uint64, i int, event api.Event) cloudEvent {
+	return cloudEvent{
+		SpecVersion:     "1.0",
+		ID:              fmt.Sprintf("%d-%d", index, i),
+		Source:          e.source,
+		Type:            "com.hashicorp.nomad." + strings.ToLower(string(event.Topic)) + "." + event.Type,
+		Subject:         event.Key,
+		DataContentType: "application/json",
+		NomadIndex:      strconv.FormatUint(index, 10),
+		Data:            event,
+	}
+}
+
+// binary encodes the event in the binary mode of the HTTP protocol binding,
+// with the attributes in headers and the data as the body.
+func (ce cloudEvent) binary() (message, error) {
+	body, err := json.Marshal(ce.Data)
+	if err != nil {
+		return message{}, err
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", ce.DataContentType)
+	header.Set("ce-specversion", ce.SpecVersion)
+	header.Set("ce-id", ce.ID)
+	header.Set("ce-source", ce.Source)
+	header.Set("ce-type", ce.Type)
+	if ce.Subject != "" {
+		header.Set("ce-subject", ce.Subject)
+	}
+	header.Set("ce-nomadindex", ce.NomadIndex)
+	return message{header: header, body: body}, nil
+}
+
+// The OTLP JSON encoding of an ExportLogsServiceRequest, limited to the
+// fields the event sink sets.
+type (
+	otlpLogs struct {
+		ResourceLogs []otlpResourceLogs `json:"resourceLogs"`
+	}
+	otlpResourceLogs struct {
+		Resource  otlpResource    `json:"resource"`
+		ScopeLogs []otlpScopeLogs `json:"scopeLogs"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeLogs struct {
+		Scope      otlpScope       `json:"scope"`
+		LogRecords []otlpLogRecord `json:"logRecords"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpLogRecord struct {
+		ObservedTimeUnixNano string          `json:"observedTimeUnixNano"`
+		SeverityNumber       int             `json:"severityNumber"`
+		SeverityText         string          `json:"severityText"`
+		Body                 otlpValue       `json:"body"`
+		Attributes           []otlpAttribute `json:"attributes"`
+	}
+	otlpAttribute struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue *string `json:"stringValue,omitempty"`
+		// IntValue is a decimal string, as 64 bit integers are in OTLP JSON.
+		IntValue *string `json:"intValue,omitempty"`
+	}
+)
+
+// otlpSeverityInfo is the INFO severity number of the OpenTelemetry log data
+// model.
+const otlpSeverityInfo = 9
+
+func stringValue(s string) otlpValue {
+	return otlpValue{StringValue: &s}
+}
+
+// otlpLogs encodes the events as log records of the atc service, with the
+// Nomad event as the body.
+func (e encoder) otlpLogs(index uint64, events []api.Event) otlpLogs {
+	now := strconv.FormatInt(time.Now().UnixNano(), 10)
+	idx := strconv.FormatUint(index, 10)
+
+	records := make([]otlpLogRecord, 0, len(events))
+	for _, event := range events {
+		body, _ := json.Marshal(event)
+		records = append(records, otlpLogRecord{
+			ObservedTimeUnixNano: now,
+			SeverityNumber:       otlpSeverityInfo,
+			SeverityText:         "INFO",
+			Body:                 stringValue(string(body)),
+			Attributes: []otlpAttribute{
+				{Key: "nomad.topic", Value: stringValue(string(event.Topic))},
+				{Key: "nomad.event_type", Value: stringValue(event.Type)},
+				{Key: "nomad.key", Value: stringValue(event.Key)},
+				{Key: "nomad.index", Value: otlpValue{IntValue: &idx}},
+			},
+		})
+	}
+
+	return otlpLogs{ResourceLogs: []otlpResourceLogs{{
+		Resource: otlpResource{Attributes: []otlpAttribute{
+			{Key: "service.name", Value: stringValue("atc")},
+			{Key: "nomad.address", Value: stringValue(e.address)},
+		}},
+		ScopeLogs: []otlpScopeLogs{{
+			Scope:      otlpScope{Name: "atc/event_sink"},
+			LogRecords: records,
+		}},
+	}}}
+}
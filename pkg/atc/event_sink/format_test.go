@@ -0,0 +1,212 @@
+package event_sink
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/grafana/dskit/flagext"
+	"github.com/hashicorp/nomad/api"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// request is a request received by a webhook.
+type request struct {
+	header http.Header
+	body   []byte
+}
+
+func twoEvents() []api.Event {
+	return []api.Event{
+		{Topic: "Job", Type: "JobRegistered", Key: "web", Index: 7},
+		{Topic: "Deployment", Type: "DeploymentStatusUpdate", Key: "d1", Index: 7},
+	}
+}
+
+// send delivers two events of index 7 through a webhook sink and returns the
+// requests it made.
+func send(t *testing.T, cfg SinkConfig) []request {
+	t.Helper()
+	var (
+		mtx      sync.Mutex
+		requests []request
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mtx.Lock()
+		defer mtx.Unlock()
+		requests = append(requests, request{header: r.Header, body: body})
+	}))
+	defer srv.Close()
+
+	cfg.Type, cfg.URL = SinkWebhook, flagext.SecretWithValue(srv.URL)
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	sink, err := newSink(cfg, "http://nomad.example.com:4646", prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	if err := sink.Send(context.Background(), 7, twoEvents()); err != nil {
+		t.Fatal(err)
+	}
+	return requests
+}
+
+func TestCloudEventsStructured(t *testing.T) {
+	requests := send(t, SinkConfig{Format: FormatCloudEvents})
+	if len(requests) != 2 {
+		t.Fatalf("requests = %d, want one per event", len(requests))
+	}
+
+	wants := []struct{ id, typ, subject string }{
+		{"7-0", "com.hashicorp.nomad.job.JobRegistered", "web"},
+		{"7-1", "com.hashicorp.nomad.deployment.DeploymentStatusUpdate", "d1"},
+	}
+	for i, want := range wants {
+		if ct := requests[i].header.Get("Content-Type"); ct != "application/cloudevents+json" {
+			t.Errorf("content type = %s, want application/cloudevents+json", ct)
+		}
+		var ce map[string]any
+		if err := json.Unmarshal(requests[i].body, &ce); err != nil {
+			t.Fatal(err)
+		}
+		if ce["specversion"] != "1.0" || ce["id"] != want.id || ce["type"] != want.typ || ce["subject"] != want.subject ||
+			ce["source"] != "http://nomad.example.com:4646" || ce["nomadindex"] != "7" || ce["datacontenttype"] != "application/json" {
+			t.Errorf("event %d = %v, want %+v", i, ce, want)
+		}
+		if data, ok := ce["data"].(map[string]any); !ok || data["Key"] != want.subject {
+			t.Errorf("data = %v, want the nomad event", ce["data"])
+		}
+	}
+}
+
+func TestCloudEventsBinary(t *testing.T) {
+	requests := send(t, SinkConfig{Format: FormatCloudEvents, CloudEventsMode: CloudEventsBinary, CloudEventsSource: "/nomad/dc1"})
+	if len(requests) != 2 {
+		t.Fatalf("requests = %d, want one per event", len(requests))
+	}
+
+	h := requests[0].header
+	for name, want := range map[string]string{
+		"Content-Type":   "application/json",
+		"Ce-Specversion": "1.0",
+		"Ce-Id":          "7-0",
+		"Ce-Source":      "/nomad/dc1",
+		"Ce-Type":        "com.hashicorp.nomad.job.JobRegistered",
+		"Ce-Subject":     "web",
+		"Ce-Nomadindex":  "7",
+	} {
+		if got := h.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	var event api.Event
+	if err := json.Unmarshal(requests[0].body, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Topic != "Job" || event.Key != "web" {
+		t.Errorf("body = %+v, want the nomad event", event)
+	}
+}
+
+func TestOTLP(t *testing.T) {
+	requests := send(t, SinkConfig{Format: FormatOTLP})
+	if len(requests) != 1 {
+		t.Fatalf("requests = %d, want one per index", len(requests))
+	}
+	if ct := requests[0].header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("content type = %s, want application/json", ct)
+	}
+
+	var logs otlpLogs
+	if err := json.Unmarshal(requests[0].body, &logs); err != nil {
+		t.Fatal(err)
+	}
+	if len(logs.ResourceLogs) != 1 || len(logs.ResourceLogs[0].ScopeLogs) != 1 {
+		t.Fatalf("logs = %+v, want a single resource and scope", logs)
+	}
+	resource := attributes(logs.ResourceLogs[0].Resource.Attributes)
+	if resource["service.name"] != "atc" || resource["nomad.address"] != "http://nomad.example.com:4646" {
+		t.Errorf("resource = %v", resource)
+	}
+
+	records := logs.ResourceLogs[0].ScopeLogs[0].LogRecords
+	if len(records) != 2 {
+		t.Fatalf("records = %d, want one per event", len(records))
+	}
+	r := records[1]
+	if r.SeverityNumber != otlpSeverityInfo || r.SeverityText != "INFO" || r.ObservedTimeUnixNano == "" {
+		t.Errorf("record = %+v, want an info record", r)
+	}
+	attrs := attributes(r.Attributes)
+	if attrs["nomad.topic"] != "Deployment" || attrs["nomad.event_type"] != "DeploymentStatusUpdate" || attrs["nomad.key"] != "d1" || attrs["nomad.index"] != "7" {
+		t.Errorf("attributes = %v", attrs)
+	}
+	var event api.Event
+	if r.Body.StringValue == nil || json.Unmarshal([]byte(*r.Body.StringValue), &event) != nil || event.Key != "d1" {
+		t.Errorf("body = %+v, want the nomad event", r.Body)
+	}
+}
+
+// attributes returns the values of OTLP attributes by key.
+func attributes(attrs []otlpAttribute) map[string]string {
+	values := map[string]string{}
+	for _, a := range attrs {
+		switch {
+		case a.Value.StringValue != nil:
+			values[a.Key] = *a.Value.StringValue
+		case a.Value.IntValue != nil:
+			values[a.Key] = *a.Value.IntValue
+		}
+	}
+	return values
+}
+
+func TestFileLines(t *testing.T) {
+	tests := map[string]struct {
+		format string
+		lines  int
+	}{
+		"nomad":       {format: FormatNomad, lines: 2},
+		"cloudevents": {format: FormatCloudEvents, lines: 2},
+		"otlp":        {format: FormatOTLP, lines: 1},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "events.log")
+			sink, err := newSink(SinkConfig{Type: SinkFile, Path: path, Format: tc.format}, "http://nomad.example.com:4646", prometheus.NewRegistry())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := sink.Send(context.Background(), 7, twoEvents()); err != nil {
+				t.Fatal(err)
+			}
+			if err := sink.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			buf, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(strings.TrimSpace(string(buf)), "\n")
+			if len(lines) != tc.lines {
+				t.Fatalf("lines = %d, want %d", len(lines), tc.lines)
+			}
+			for _, line := range lines {
+				if !json.Valid([]byte(line)) {
+					t.Errorf("invalid line %s", line)
+				}
+			}
+		})
+	}
+}
@@ -2,92 +2,431 @@ package event_sink
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/backoff"
+	"github.com/grafana/dskit/flagext"
 	"github.com/grafana/dskit/services"
-	"github.com/hashicorp/consul/api"
-	"github.com/hashicorp/consul/api/watch"
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/nomad/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/attachmentgenie/atc/pkg/atc/leader"
+	"github.com/attachmentgenie/atc/pkg/atc/nomad"
 )
 
+// maxBatchSize bounds the size of the events of a single Nomad index.
+const maxBatchSize = 64 << 20
+
+type Config struct {
+	Topics    flagext.StringSliceCSV `yaml:"topics"`
+	Namespace string                 `yaml:"namespace"`
+	DataDir   string                 `yaml:"data_dir"`
+	Sinks     []SinkConfig           `yaml:"sinks"`
+
+	BufferMaxBytes  flagext.Bytes `yaml:"buffer_max_bytes"`
+	MaxAttempts     int           `yaml:"max_attempts"`
+	RetryMinBackoff time.Duration `yaml:"retry_min_backoff"`
+	RetryMaxBackoff time.Duration `yaml:"retry_max_backoff"`
+}
+
+func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	cfg.Topics = []string{"Job", "Allocation", "Deployment", "Node", "Evaluation"}
+	f.Var(&cfg.Topics, "event-sink.topics", "Comma-separated list of Nomad event topics to subscribe to, optionally filtered on a key as in Job:web.")
+	f.StringVar(&cfg.Namespace, "event-sink.namespace", "*", "Nomad namespace to receive events from, * for all namespaces.")
+	f.StringVar(&cfg.DataDir, "event-sink.data-dir", "data/event-sink", "Directory the buffers of the sinks and the index of the last buffered Nomad event are kept in, so deliveries resume after a restart.")
+	cfg.BufferMaxBytes = 64 << 20
+	f.Var(&cfg.BufferMaxBytes, "event-sink.buffer-max-bytes", "Maximum size of the events buffered on disk for a sink. The event stream is held back while the buffer of a sink is full.")
+	f.IntVar(&cfg.MaxAttempts, "event-sink.max-attempts", 10, "Number of attempts to deliver events to a sink before they are moved to the dead letters of the sink.")
+	f.DurationVar(&cfg.RetryMinBackoff, "event-sink.retry-min-backoff", time.Second, "Time to wait before the first retry of a failed delivery. The wait doubles with every attempt.")
+	f.DurationVar(&cfg.RetryMaxBackoff, "event-sink.retry-max-backoff", 5*time.Minute, "Maximum time to wait between retries of a failed delivery.")
+}
+
+func (cfg *Config) Validate() error {
+	if _, err := cfg.topics(); err != nil {
+		return err
+	}
+	if len(cfg.Sinks) > 0 && cfg.DataDir == "" {
+		return fmt.Errorf("event sink data dir is required")
+	}
+	if cfg.BufferMaxBytes == 0 {
+		return fmt.Errorf("invalid event sink buffer max bytes: %s", cfg.BufferMaxBytes.String())
+	}
+	if cfg.MaxAttempts <= 0 {
+		return fmt.Errorf("invalid event sink max attempts: %d", cfg.MaxAttempts)
+	}
+	if cfg.RetryMinBackoff <= 0 || cfg.RetryMaxBackoff < cfg.RetryMinBackoff {
+		return fmt.Errorf("invalid event sink retry backoff: min %s, max %s", cfg.RetryMinBackoff, cfg.RetryMaxBackoff)
+	}
+
+	names := map[string]struct{}{}
+	prometheusSinks := 0
+	for i, s := range cfg.Sinks {
+		if err := s.Validate(); err != nil {
+			return fmt.Errorf("invalid event sink %d: %w", i, err)
+		}
+		if _, ok := names[s.name()]; ok {
+			return fmt.Errorf("duplicate event sink name %q", s.name())
+		}
+		names[s.name()] = struct{}{}
+		if s.Type == SinkPrometheus {
+			prometheusSinks++
+		}
+	}
+	if prometheusSinks > 1 {
+		return fmt.Errorf("at most one prometheus event sink can be configured")
+	}
+	return nil
+}
+
+// topics returns the topic filters in the form expected by the Nomad event
+// stream.
+func (cfg *Config) topics() (map[api.Topic][]string, error) {
+	topics := map[api.Topic][]string{}
+	for _, t := range cfg.Topics {
+		topic, key, _ := strings.Cut(t, ":")
+		if topic == "" {
+			return nil, fmt.Errorf("invalid event sink topic: %q", t)
+		}
+		if key == "" {
+			key = "*"
+		}
+		topics[api.Topic(topic)] = append(topics[api.Topic(topic)], key)
+	}
+	if len(topics) == 0 {
+		return nil, fmt.Errorf("at least one event sink topic is required")
+	}
+	return topics, nil
+}
+
+// EventSink delivers the events of the Nomad event stream to the configured
+// sinks. Only the leader subscribes to the stream. Events are buffered on
+// disk for every sink, and delivered from there by a loop per sink. The
+// index of the last buffered events is kept in Consul KV next to the leader
+// lock when leader election is enabled, so a new leader resumes the stream
+// where the previous one left off, and in the data dir otherwise.
 type EventSink struct {
 	services.Service
 
+	cfg    Config
+	client *nomad.Client
 	logger log.Logger
+	reg    prometheus.Registerer
+
+	topics map[api.Topic][]string
+	sinks  map[string]Sink
+	queues map[string]*queue
+	// index is the Nomad index of the last events buffered for every sink.
+	index uint64
+	// state holds the index when leader election is enabled.
+	state *leader.SharedState
+
+	eventsTotal       *prometheus.CounterVec
+	deliveriesTotal   *prometheus.CounterVec
+	deadLettersTotal  *prometheus.CounterVec
+	droppedTotal      *prometheus.CounterVec
+	queueDepth        *prometheus.GaugeVec
+	queueBytes        *prometheus.GaugeVec
+	backpressureTotal prometheus.Counter
+	streamErrors      prometheus.Counter
+	indexGauge        prometheus.Gauge
 
-	watchServicesChan chan struct{}
+	elector    *leader.Elector
+	leadership <-chan struct{}
 }
 
 func (f *EventSink) starting(ctx context.Context) error {
+	if len(f.cfg.Sinks) == 0 {
+		level.Info(f.logger).Log("msg", "no event sinks configured, not subscribing to the nomad event stream")
+		return nil
+	}
+
+	if err := os.MkdirAll(f.cfg.DataDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create event sink data dir: %w", err)
+	}
+	index, err := readIndex(f.indexFile())
+	if err != nil {
+		return fmt.Errorf("failed to load event index: %w", err)
+	}
+	f.index = index
+	f.indexGauge.Set(float64(index))
+
+	for _, cfg := range f.cfg.Sinks {
+		name := cfg.name()
+		sink, err := newSink(cfg, f.client.Address.String(), f.reg)
+		if err != nil {
+			return fmt.Errorf("failed to create event sink %s: %w", name, err)
+		}
+		f.sinks[name] = sink
+
+		q, err := openQueue(filepath.Join(f.cfg.DataDir, "queue", name), int64(f.cfg.BufferMaxBytes), log.With(f.logger, "sink", name))
+		if err != nil {
+			return fmt.Errorf("failed to open buffer of event sink %s: %w", name, err)
+		}
+		f.droppedTotal.WithLabelValues(name).Add(float64(q.skipped))
+		f.queues[name] = q
+		f.updateDepth(name)
+	}
+	level.Info(f.logger).Log("msg", "resuming nomad event stream", "index", f.index, "sinks", len(f.sinks))
 	return nil
 }
 
 func (f *EventSink) stopping(_ error) error {
-	return nil
+	var err *multierror.Error
+	for name, sink := range f.sinks {
+		if cerr := sink.Close(); cerr != nil {
+			err = multierror.Append(err, fmt.Errorf("failed to close event sink %s: %w", name, cerr))
+		}
+	}
+	for name, q := range f.queues {
+		if cerr := q.close(); cerr != nil {
+			err = multierror.Append(err, fmt.Errorf("failed to close buffer of event sink %s: %w", name, cerr))
+		}
+	}
+	return err.ErrorOrNil()
 }
 
-func New(logger log.Logger) (*EventSink, error) {
+func New(cfg Config, client *nomad.Client, elector *leader.Elector, logger log.Logger, reg prometheus.Registerer) (*EventSink, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	topics, _ := cfg.topics()
 
 	f := &EventSink{
-		logger: logger,
+		cfg:        cfg,
+		client:     client,
+		logger:     log.With(logger, "module", "event_sink"),
+		reg:        reg,
+		topics:     topics,
+		sinks:      map[string]Sink{},
+		queues:     map[string]*queue{},
+		state:      elector.SharedState("event-sink-index"),
+		elector:    elector,
+		leadership: elector.Subscribe(),
+		eventsTotal: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "atc_event_sink_events_received_total",
+			Help: "Total number of events received from the Nomad event stream, by topic.",
+		}, []string{"topic"}),
+		deliveriesTotal: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "atc_event_sink_deliveries_total",
+			Help: "Total number of attempts to deliver event batches to sinks, by sink and result.",
+		}, []string{"sink", "result"}),
+		deadLettersTotal: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "atc_event_sink_dead_letters_total",
+			Help: "Total number of event batches moved to the dead letters of a sink after failing every attempt.",
+		}, []string{"sink"}),
+		droppedTotal: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "atc_event_sink_dropped_total",
+			Help: "Total number of event batches that were neither delivered nor kept as dead letters, by sink.",
+		}, []string{"sink"}),
+		queueDepth: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "atc_event_sink_queue_depth",
+			Help: "Number of event batches buffered for a sink.",
+		}, []string{"sink"}),
+		queueBytes: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "atc_event_sink_queue_bytes",
+			Help: "Size of the event batches buffered for a sink.",
+		}, []string{"sink"}),
+		backpressureTotal: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "atc_event_sink_backpressure_seconds_total",
+			Help: "Total time the event stream was held back by full sink buffers.",
+		}),
+		streamErrors: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "atc_event_sink_stream_errors_total",
+			Help: "Total number of times the Nomad event stream failed.",
+		}),
+		indexGauge: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "atc_event_sink_index",
+			Help: "Nomad index of the last events buffered for every sink.",
+		}),
 	}
-	f.Service = services.NewBasicService(f.starting, f.watcher, f.stopping)
+	f.Service = services.NewBasicService(f.starting, f.running, f.stopping)
 	return f, nil
 }
 
-func (f *EventSink) watcher(ctx context.Context) error {
-	client, err := api.NewClient(&api.Config{})
-	if err != nil {
-		return fmt.Errorf("failed to connect to consul: %s", err.Error())
+func (f *EventSink) running(ctx context.Context) error {
+	if len(f.sinks) == 0 {
+		<-ctx.Done()
+		return nil
 	}
 
-	servicesWatcher, parseErr := watch.Parse(map[string]interface{}{"type": "services"})
-	if parseErr != nil {
-		return fmt.Errorf("failed to create services watcher plan: %s", parseErr.Error())
+	// Buffered events are delivered by followers too, as no other replica
+	// has them.
+	var wg sync.WaitGroup
+	for name := range f.sinks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f.deliver(ctx, name)
+		}()
 	}
+	defer wg.Wait()
+
+	retries := backoff.New(ctx, backoff.Config{
+		MinBackoff: time.Second,
+		MaxBackoff: time.Minute,
+	})
+	for {
+		if f.elector.IsLeader() {
+			if err := f.stream(ctx, retries); err != nil {
+				level.Error(f.logger).Log("msg", "nomad event stream failed", "index", f.index, "err", err)
+				f.streamErrors.Inc()
+				retries.Wait()
+				continue
+			}
+		}
 
-	servicesWatcher.HybridHandler = func(_ watch.BlockingParamVal, _ interface{}) {
 		select {
 		case <-ctx.Done():
-		case f.watchServicesChan <- struct{}{}:
-		default:
-			// Event chan is full, discard event.
+			return nil
+		case <-f.leadership:
 		}
 	}
+}
+
+// stream buffers the events of the Nomad event stream until the context is
+// done or this replica loses its leadership.
+func (f *EventSink) stream(ctx context.Context, retries *backoff.Backoff) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	checksWatcher, err := watch.Parse(map[string]interface{}{"type": "checks"})
+	if err := f.loadIndex(ctx); err != nil {
+		return err
+	}
+	stream, err := f.client.EventStream().Stream(ctx, f.topics, f.index+1, &api.QueryOptions{Namespace: f.cfg.Namespace})
 	if err != nil {
-		return fmt.Errorf("failed to create checks watcher plan: %w", err)
+		return fmt.Errorf("failed to subscribe: %w", err)
 	}
 
-	checksWatcher.HybridHandler = func(_ watch.BlockingParamVal, _ interface{}) {
+	for {
 		select {
 		case <-ctx.Done():
-		case f.watchServicesChan <- struct{}{}:
-		default:
-			// Event chan is full, discard event.
+			return nil
+
+		case <-f.leadership:
+			if !f.elector.IsLeader() {
+				level.Info(f.logger).Log("msg", "lost leadership, unsubscribing from the nomad event stream")
+				return nil
+			}
+
+		case events, ok := <-stream:
+			if !ok {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return errors.New("stream closed")
+			}
+			if events.Err != nil {
+				return events.Err
+			}
+			if events.IsHeartbeat() {
+				continue
+			}
+			retries.Reset()
+
+			// Nomad resumes at the closest index it still has, which may
+			// include events that were buffered before.
+			if events.Index <= f.index {
+				continue
+			}
+			if err := f.buffer(ctx, events.Index, events.Events); err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return err
+			}
 		}
 	}
+}
 
-	errChan := make(chan error, 2)
-
-	defer func() {
-		servicesWatcher.Stop()
-		checksWatcher.Stop()
-	}()
+// buffer appends the events of an index to the buffer of every sink, and
+// records the index once all buffers hold them. A full buffer holds back
+// the event stream until its sink caught up.
+func (f *EventSink) buffer(ctx context.Context, index uint64, events []api.Event) error {
+	for _, e := range events {
+		f.eventsTotal.WithLabelValues(string(e.Topic)).Inc()
+	}
 
-	go func() {
-		errChan <- servicesWatcher.RunWithClientAndHclog(client, servicesWatcher.Logger)
-	}()
+	for name, q := range f.queues {
+		waited, err := q.append(ctx, index, events)
+		f.backpressureTotal.Add(waited.Seconds())
+		if waited >= time.Second {
+			level.Warn(f.logger).Log("msg", "held back the event stream while the buffer of a sink was full", "sink", name, "waited", waited)
+		}
+		if errors.Is(err, errBatchTooLarge) {
+			// The batch could not be read back from the buffer, so it goes
+			// to the dead letters right away.
+			level.Error(f.logger).Log("msg", "events exceed the maximum batch size, moving them to the dead letters", "sink", name, "index", index, "events", len(events))
+			f.deadLetterBatch(name, entry{index: index, events: events}, 0, err)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to buffer events for sink %s: %w", name, err)
+		}
+		f.updateDepth(name)
+	}
 
-	go func() {
-		errChan <- checksWatcher.RunWithClientAndHclog(client, checksWatcher.Logger)
-	}()
+	f.index = index
+	f.indexGauge.Set(float64(index))
+	return f.saveIndex(ctx)
+}
 
-	select {
-	case <-ctx.Done():
+// loadIndex takes over the index of the previous leader. The index in the
+// data dir is kept when no leader stored one yet.
+func (f *EventSink) loadIndex(ctx context.Context) error {
+	if f.state == nil {
+		return nil
+	}
+	value, err := f.state.Load(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load event index: %w", err)
+	}
+	if value == nil {
 		return nil
+	}
+	index, err := strconv.ParseUint(string(value), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid event index in %s: %w", f.state.Key(), err)
+	}
+	if index != f.index {
+		level.Info(f.logger).Log("msg", "resuming nomad event stream at the index of the previous leader", "index", index)
+	}
+	f.index = index
+	f.indexGauge.Set(float64(index))
+	return nil
+}
 
-	case err = <-errChan:
-		return fmt.Errorf("services or checks watcher terminated: %w", err)
+// saveIndex records the index once the events are buffered for every sink.
+func (f *EventSink) saveIndex(ctx context.Context) error {
+	if f.state == nil {
+		if err := writeIndex(f.indexFile(), f.index); err != nil {
+			return fmt.Errorf("failed to save event index: %w", err)
+		}
+		return nil
+	}
+	if err := f.state.Store(ctx, []byte(strconv.FormatUint(f.index, 10))); err != nil {
+		return fmt.Errorf("failed to save event index: %w", err)
 	}
+	return nil
+}
+
+func (f *EventSink) updateDepth(name string) {
+	depth, size := f.queues[name].depth()
+	f.queueDepth.WithLabelValues(name).Set(float64(depth))
+	f.queueBytes.WithLabelValues(name).Set(float64(size))
+}
+
+func (f *EventSink) indexFile() string {
+	return filepath.Join(f.cfg.DataDir, "index")
 }
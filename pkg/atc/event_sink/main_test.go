@@ -0,0 +1,295 @@
+package event_sink
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/backoff"
+	"github.com/grafana/dskit/services"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/hashicorp/nomad/api"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/attachmentgenie/atc/pkg/atc/leader"
+	"github.com/attachmentgenie/atc/pkg/atc/nomad"
+)
+
+// fakeStream serves the Nomad event stream, and records the indexes it was
+// requested at. Like Nomad it may send events before the requested index,
+// here it always sends every event.
+type fakeStream struct {
+	mtx       sync.Mutex
+	batches   []api.Events
+	requested []uint64
+}
+
+func (s *fakeStream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/event/stream" {
+		http.NotFound(w, r)
+		return
+	}
+	index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+
+	s.mtx.Lock()
+	s.requested = append(s.requested, index)
+	enc := json.NewEncoder(w)
+	for _, b := range s.batches {
+		_ = enc.Encode(b)
+	}
+	s.mtx.Unlock()
+	w.(http.Flusher).Flush()
+
+	<-r.Context().Done()
+}
+
+func (s *fakeStream) add(index uint64) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.batches = append(s.batches, api.Events{Index: index, Events: []api.Event{{Topic: "Job", Type: "JobRegistered", Key: "web", Index: index}}})
+}
+
+func (s *fakeStream) lastRequested() uint64 {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if len(s.requested) == 0 {
+		return 0
+	}
+	return s.requested[len(s.requested)-1]
+}
+
+func testConfig(dataDir string) Config {
+	var cfg Config
+	cfg.RegisterFlags(flag.NewFlagSet("test", flag.PanicOnError))
+	cfg.DataDir = dataDir
+	cfg.Sinks = []SinkConfig{{Type: SinkFile, Path: filepath.Join(dataDir, "events.jsonl")}}
+	return cfg
+}
+
+func testEventSink(t *testing.T, cfg Config, srv *httptest.Server, elector *leader.Elector) *EventSink {
+	t.Helper()
+	client, err := nomad.NewClient(nomad.Config{Address: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := New(cfg, client, elector, log.NewNopLogger(), prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// eventually fails the test when cond does not hold within a few seconds.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func deliveredIndexes(t *testing.T, path string) []uint64 {
+	t.Helper()
+	buf, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var indexes []uint64
+	for _, line := range strings.Split(strings.TrimSpace(string(buf)), "\n") {
+		if line == "" {
+			continue
+		}
+		var e api.Event
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatal(err)
+		}
+		indexes = append(indexes, e.Index)
+	}
+	return indexes
+}
+
+func TestStreamResumesAtStoredIndex(t *testing.T) {
+	stream := &fakeStream{}
+	stream.add(5)
+	stream.add(7)
+	srv := httptest.NewServer(stream)
+	defer srv.Close()
+
+	elector, err := leader.New(leader.Config{}, nil, log.NewNopLogger(), prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig(t.TempDir())
+	events := cfg.Sinks[0].Path
+	ctx := context.Background()
+
+	run := func(f *EventSink) {
+		t.Helper()
+		// The elector is started after the event sink subscribed to it.
+		if err := services.StartAndAwaitRunning(ctx, elector); err != nil {
+			t.Fatal(err)
+		}
+		if err := services.StartAndAwaitRunning(ctx, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stop := func(f *EventSink) {
+		t.Helper()
+		if err := services.StopAndAwaitTerminated(ctx, f); err != nil {
+			t.Fatal(err)
+		}
+		if err := services.StopAndAwaitTerminated(ctx, elector); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f := testEventSink(t, cfg, srv, elector)
+	run(f)
+	eventually(t, "delivery of index 5 and 7", func() bool { return len(deliveredIndexes(t, events)) == 2 })
+	stop(f)
+	if index, err := readIndex(f.indexFile()); err != nil || index != 7 {
+		t.Fatalf("stored index = %d (%v), want 7", index, err)
+	}
+	if got := stream.lastRequested(); got != 1 {
+		t.Errorf("first subscription at index %d, want 1", got)
+	}
+
+	// A restarted event sink subscribes after the stored index, and drops
+	// the events Nomad sends again.
+	stream.add(9)
+	elector, err = leader.New(leader.Config{}, nil, log.NewNopLogger(), prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f = testEventSink(t, cfg, srv, elector)
+	run(f)
+	eventually(t, "delivery of index 9", func() bool { return len(deliveredIndexes(t, events)) == 3 })
+	stop(f)
+	if got := stream.lastRequested(); got != 8 {
+		t.Errorf("resumed at index %d, want 8", got)
+	}
+	if got := deliveredIndexes(t, events); got[0] != 5 || got[1] != 7 || got[2] != 9 {
+		t.Errorf("delivered indexes = %v, want 5, 7 and 9 once", got)
+	}
+}
+
+// fakeKV serves the Consul KV reads and check-and-set transactions of the
+// shared state.
+type fakeKV struct {
+	mtx   sync.Mutex
+	index uint64
+	pairs map[string]*consul.KVPair
+}
+
+func (kv *fakeKV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	kv.mtx.Lock()
+	defer kv.mtx.Unlock()
+	w.Header().Set("X-Consul-Index", "1")
+
+	switch {
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		pair, ok := kv.pairs[strings.TrimPrefix(r.URL.Path, "/v1/kv/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode([]*consul.KVPair{pair})
+
+	case r.Method == http.MethodPut && r.URL.Path == "/v1/txn":
+		var ops []struct{ KV consul.KVTxnOp }
+		if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		op := ops[0].KV
+		var current uint64
+		if pair, ok := kv.pairs[op.Key]; ok {
+			current = pair.ModifyIndex
+		}
+		if op.Verb != consul.KVCAS || op.Index != current {
+			w.WriteHeader(http.StatusConflict)
+			_ = json.NewEncoder(w).Encode(map[string]any{"Errors": []map[string]any{{"OpIndex": 0, "What": "index is stale"}}})
+			return
+		}
+		kv.index++
+		kv.pairs[op.Key] = &consul.KVPair{Key: op.Key, Value: op.Value, ModifyIndex: kv.index}
+		_ = json.NewEncoder(w).Encode(map[string]any{"Results": []map[string]any{{"KV": map[string]any{"Key": op.Key, "ModifyIndex": kv.index}}}})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (kv *fakeKV) value(key string) string {
+	kv.mtx.Lock()
+	defer kv.mtx.Unlock()
+	if pair, ok := kv.pairs[key]; ok {
+		return string(pair.Value)
+	}
+	return ""
+}
+
+func TestStreamResumesAtLeaderIndex(t *testing.T) {
+	stream := &fakeStream{}
+	stream.add(40)
+	stream.add(42)
+	srv := httptest.NewServer(stream)
+	defer srv.Close()
+
+	// The previous leader buffered the events up to index 41.
+	kv := &fakeKV{index: 10, pairs: map[string]*consul.KVPair{
+		"atc/leader/event-sink-index": {Key: "atc/leader/event-sink-index", Value: []byte("41"), ModifyIndex: 10},
+	}}
+	consulSrv := httptest.NewServer(kv)
+	defer consulSrv.Close()
+	client, err := consul.NewClient(&consul.Config{Address: consulSrv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	elector, err := leader.New(leader.Config{Enabled: true, Key: "atc/leader", SessionTTL: 15 * time.Second, RetryInterval: time.Second}, client, log.NewNopLogger(), prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := testConfig(t.TempDir())
+	f := testEventSink(t, cfg, srv, elector)
+	if err := f.starting(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.stopping(nil) }()
+
+	// The stream is run as it is by a leader.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- f.stream(ctx, backoff.New(ctx, backoff.Config{MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond})) }()
+	eventually(t, "the index of 42 in consul", func() bool { return kv.value("atc/leader/event-sink-index") == "42" })
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if got := stream.lastRequested(); got != 42 {
+		t.Errorf("resumed at index %d, want 42 after the index of the previous leader", got)
+	}
+	if got := indexes(f.queues[SinkFile]); len(got) != 1 || got[0] != 42 {
+		t.Errorf("buffered indexes = %v, want 42 only", got)
+	}
+	if _, err := os.Stat(f.indexFile()); !os.IsNotExist(err) {
+		t.Errorf("index file written with leader election enabled: %v", err)
+	}
+}
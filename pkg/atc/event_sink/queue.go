@@ -0,0 +1,317 @@
+package event_sink
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/hashicorp/nomad/api"
+)
+
+// segmentBytes is the size at which the queue starts a new segment file.
+// Segments are removed once all their batches are acknowledged.
+const segmentBytes = 1 << 20
+
+// errBatchTooLarge is returned for batches that would not fit in a record of
+// a segment.
+var errBatchTooLarge = errors.New("batch exceeds the maximum batch size")
+
+type entry struct {
+	index  uint64
+	events []api.Event
+	size   int64
+}
+
+type segment struct {
+	path string
+	size int64
+	// last is the index of the last batch in the segment.
+	last uint64
+}
+
+// queue is the write-ahead buffer of a sink. Batches are appended to segment
+// files before they are delivered, and acknowledged once the sink received
+// them, so they survive a restart without being delivered twice.
+type queue struct {
+	dir      string
+	maxBytes int64
+	logger   log.Logger
+	// skipped is the number of records in the segments that could not be
+	// read when the queue was opened.
+	skipped int
+
+	mtx      sync.Mutex
+	entries  []entry
+	bytes    int64
+	segments []segment
+	active   *os.File
+	// last is the index of the last appended batch, acked the index of the
+	// last acknowledged one.
+	last  uint64
+	acked uint64
+	// changed is closed and replaced whenever batches are appended or
+	// acknowledged.
+	changed chan struct{}
+}
+
+// openQueue loads the batches in dir that were not acknowledged yet.
+func openQueue(dir string, maxBytes int64, logger log.Logger) (*queue, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create queue dir: %w", err)
+	}
+
+	q := &queue{dir: dir, maxBytes: maxBytes, logger: logger, changed: make(chan struct{})}
+	acked, err := readIndex(q.ackFile())
+	if err != nil {
+		return nil, err
+	}
+	q.acked, q.last = acked, acked
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if err := q.load(path); err != nil {
+			return nil, err
+		}
+	}
+	q.removeSegments()
+	return q, nil
+}
+
+// load reads the batches of a segment. Records that cannot be decoded, like
+// a batch that was only partly written, are skipped.
+func (q *queue) load(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open queue segment: %w", err)
+	}
+	defer file.Close()
+
+	seg := segment{path: path}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, maxBatchSize)
+	for line := 1; scanner.Scan(); line++ {
+		size := int64(len(scanner.Bytes()) + 1)
+		seg.size += size
+
+		var b batch
+		if err := json.Unmarshal(scanner.Bytes(), &b); err != nil {
+			level.Warn(q.logger).Log("msg", "skipping unreadable batch in queue segment", "segment", path, "line", line, "err", err)
+			q.skipped++
+			continue
+		}
+		seg.last = b.Index
+		if b.Index <= q.last {
+			continue
+		}
+		q.entries = append(q.entries, entry{index: b.Index, events: b.Events, size: size})
+		q.bytes += size
+		q.last = b.Index
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read queue segment %s: %w", path, err)
+	}
+	q.segments = append(q.segments, seg)
+	return nil
+}
+
+// append writes a batch to the queue, waiting while the queue is full.
+// Batches that were appended before are skipped, batches larger than
+// maxBatchSize are refused with errBatchTooLarge. It returns how long it
+// waited for room.
+func (q *queue) append(ctx context.Context, index uint64, events []api.Event) (time.Duration, error) {
+	rec, err := json.Marshal(batch{Index: index, Events: events})
+	if err != nil {
+		return 0, err
+	}
+	rec = append(rec, '\n')
+	size := int64(len(rec))
+	if size > maxBatchSize {
+		return 0, errBatchTooLarge
+	}
+
+	var waited time.Duration
+	q.mtx.Lock()
+	for len(q.entries) > 0 && q.bytes+size > q.maxBytes {
+		changed := q.changed
+		q.mtx.Unlock()
+
+		start := time.Now()
+		select {
+		case <-ctx.Done():
+			return waited, ctx.Err()
+		case <-changed:
+		}
+		waited += time.Since(start)
+		q.mtx.Lock()
+	}
+	defer q.mtx.Unlock()
+
+	if index <= q.last {
+		return waited, nil
+	}
+	if err := q.write(index, rec); err != nil {
+		return waited, err
+	}
+	q.entries = append(q.entries, entry{index: index, events: events, size: size})
+	q.bytes += size
+	q.last = index
+	q.broadcast()
+	return waited, nil
+}
+
+// write appends a record to the active segment, starting a new segment when
+// there is none or the active one is full.
+func (q *queue) write(index uint64, rec []byte) error {
+	if q.active == nil || q.segments[len(q.segments)-1].size >= segmentBytes {
+		if q.active != nil {
+			if err := q.active.Close(); err != nil {
+				return err
+			}
+		}
+
+		path := filepath.Join(q.dir, fmt.Sprintf("%020d.log", index))
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return fmt.Errorf("failed to create queue segment: %w", err)
+		}
+		q.active = file
+		q.segments = append(q.segments, segment{path: path})
+	}
+
+	if _, err := q.active.Write(rec); err != nil {
+		return fmt.Errorf("failed to write queue segment: %w", err)
+	}
+	if err := q.active.Sync(); err != nil {
+		return fmt.Errorf("failed to sync queue segment: %w", err)
+	}
+	seg := &q.segments[len(q.segments)-1]
+	seg.size += int64(len(rec))
+	seg.last = index
+	return nil
+}
+
+// next returns the oldest batch that was not acknowledged yet, waiting for
+// one to be appended when the queue is empty.
+func (q *queue) next(ctx context.Context) (entry, error) {
+	for {
+		q.mtx.Lock()
+		if len(q.entries) > 0 {
+			e := q.entries[0]
+			q.mtx.Unlock()
+			return e, nil
+		}
+		changed := q.changed
+		q.mtx.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return entry{}, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// ack records that the batches up to and including index were handled, and
+// removes the segments that only hold handled batches.
+func (q *queue) ack(index uint64) error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	i := 0
+	for i < len(q.entries) && q.entries[i].index <= index {
+		q.bytes -= q.entries[i].size
+		i++
+	}
+	q.entries = q.entries[i:]
+	q.acked = max(q.acked, index)
+	q.broadcast()
+
+	if err := writeIndex(q.ackFile(), q.acked); err != nil {
+		return fmt.Errorf("failed to save acknowledged index: %w", err)
+	}
+	q.removeSegments()
+	return nil
+}
+
+// removeSegments deletes the segments before the active one whose batches
+// are all acknowledged.
+func (q *queue) removeSegments() {
+	for len(q.segments) > 1 || (len(q.segments) == 1 && q.active == nil) {
+		seg := q.segments[0]
+		if seg.last > q.acked {
+			return
+		}
+		if err := os.Remove(seg.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return
+		}
+		q.segments = q.segments[1:]
+	}
+}
+
+func (q *queue) broadcast() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+// depth returns the number and size of the batches that were not
+// acknowledged yet.
+func (q *queue) depth() (int, int64) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return len(q.entries), q.bytes
+}
+
+func (q *queue) close() error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if q.active == nil {
+		return nil
+	}
+	err := q.active.Close()
+	q.active = nil
+	return err
+}
+
+func (q *queue) ackFile() string {
+	return filepath.Join(q.dir, "acked")
+}
+
+func readIndex(path string) (uint64, error) {
+	buf, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read index: %w", err)
+	}
+
+	index, err := strconv.ParseUint(strings.TrimSpace(string(buf)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid index in %s: %w", path, err)
+	}
+	return index, nil
+}
+
+// writeIndex replaces the index file, so it is never left half written.
+func writeIndex(path string, index uint64) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatUint(index, 10)+"\n"), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,106 @@
+package event_sink
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/hashicorp/nomad/api"
+)
+
+func testEvents(topic string) []api.Event {
+	return []api.Event{{Topic: api.Topic(topic), Type: "JobRegistered", Key: "web"}}
+}
+
+func indexes(q *queue) []uint64 {
+	var list []uint64
+	for _, e := range q.entries {
+		list = append(list, e.index)
+	}
+	return list
+}
+
+func TestQueueReopen(t *testing.T) {
+	dir := t.TempDir()
+	q, err := openQueue(dir, 1<<20, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, index := range []uint64{1, 2, 3, 2} {
+		if _, err := q.append(context.Background(), index, testEvents("Job")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.ack(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	q, err = openQueue(dir, 1<<20, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := indexes(q); len(got) != 2 || got[0] != 2 || got[1] != 3 {
+		t.Errorf("batches after reopening = %v, want [2 3]", got)
+	}
+	if q.skipped != 0 {
+		t.Errorf("skipped = %d, want 0", q.skipped)
+	}
+}
+
+func TestQueueSkipsUnreadableBatches(t *testing.T) {
+	dir := t.TempDir()
+	segment := strings.Join([]string{
+		`{"Index":1,"Events":[{"Topic":"Job"}]}`,
+		`not json`,
+		`{"Index":2,"Events":[{"Topic":"Job"}]}`,
+		`{"Index":3,"Events":[{"To`,
+	}, "\n")
+	if err := os.WriteFile(filepath.Join(dir, "00000000000000000001.log"), []byte(segment), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	q, err := openQueue(dir, 1<<20, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := indexes(q); len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Errorf("batches = %v, want [1 2]", got)
+	}
+	if q.skipped != 2 {
+		t.Errorf("skipped = %d, want 2", q.skipped)
+	}
+
+	// The events of the partly written batch are received again.
+	if _, err := q.append(context.Background(), 3, testEvents("Job")); err != nil {
+		t.Fatal(err)
+	}
+	if got := indexes(q); len(got) != 3 || got[2] != 3 {
+		t.Errorf("batches = %v, want [1 2 3]", got)
+	}
+}
+
+func TestQueueBatchTooLarge(t *testing.T) {
+	q, err := openQueue(t.TempDir(), 1<<20, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := testEvents("Job")
+	events[0].Payload = map[string]any{"Job": strings.Repeat("x", maxBatchSize)}
+	if _, err := q.append(context.Background(), 1, events); !errors.Is(err, errBatchTooLarge) {
+		t.Fatalf("err = %v, want %v", err, errBatchTooLarge)
+	}
+	if _, err := q.append(context.Background(), 2, testEvents("Job")); err != nil {
+		t.Fatal(err)
+	}
+	if got := indexes(q); len(got) != 1 || got[0] != 2 {
+		t.Errorf("batches = %v, want [2]", got)
+	}
+}
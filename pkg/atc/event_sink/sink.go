@@ -0,0 +1,254 @@
+package event_sink
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/grafana/dskit/flagext"
+	"github.com/hashicorp/go-cleanhttp"
+	"github.com/hashicorp/nomad/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Types of sinks.
+const (
+	SinkWebhook    = "webhook"
+	SinkFile       = "file"
+	SinkStdout     = "stdout"
+	SinkPrometheus = "prometheus"
+)
+
+// SinkConfig configures a destination of the Nomad events.
+type SinkConfig struct {
+	// Name identifies the sink in logs and metrics. Defaults to the type.
+	Name string `yaml:"name"`
+	Type string `yaml:"type"`
+
+	// URL, Headers and Timeout configure the webhook sink, which posts the
+	// events of every Nomad index. The URL may carry a token, so it is kept
+	// out of the printed config and of errors.
+	URL     flagext.Secret            `yaml:"url"`
+	Headers map[string]flagext.Secret `yaml:"headers"`
+	Timeout time.Duration             `yaml:"timeout"`
+
+	// Path is the file the file sink appends the events to, one JSON object
+	// per line.
+	Path string `yaml:"path"`
+
+	// Format is the encoding of the events: nomad, cloudevents or otlp.
+	// Defaults to nomad.
+	Format string `yaml:"format"`
+	// CloudEventsMode is the structured or binary mode of the CloudEvents
+	// HTTP binding. Only webhooks support the binary mode.
+	CloudEventsMode string `yaml:"cloudevents_mode"`
+	// CloudEventsSource is the source of the CloudEvents. Defaults to the
+	// address of Nomad.
+	CloudEventsSource string `yaml:"cloudevents_source"`
+}
+
+// validName matches the sink names that can be used as the name of a file,
+// as the buffer and dead letters of a sink are stored by name.
+var validName = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]*$`)
+
+func (cfg SinkConfig) Validate() error {
+	if !validName.MatchString(cfg.name()) {
+		return fmt.Errorf("invalid name %q", cfg.name())
+	}
+	switch cfg.Type {
+	case SinkWebhook:
+		u, err := url.Parse(cfg.URL.String())
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid url, must be an http or https url")
+		}
+		if cfg.Timeout < 0 {
+			return fmt.Errorf("timeout must not be negative")
+		}
+	case SinkFile:
+		if cfg.Path == "" {
+			return fmt.Errorf("path is required")
+		}
+	case SinkStdout, SinkPrometheus:
+	default:
+		return fmt.Errorf("unknown type %q", cfg.Type)
+	}
+
+	switch cfg.Format {
+	case "", FormatNomad, FormatCloudEvents, FormatOTLP:
+	default:
+		return fmt.Errorf("unknown format %q", cfg.Format)
+	}
+	if cfg.Type == SinkPrometheus && cfg.Format != "" {
+		return fmt.Errorf("the prometheus sink has no format")
+	}
+	switch cfg.CloudEventsMode {
+	case "", CloudEventsStructured:
+	case CloudEventsBinary:
+		if cfg.Type != SinkWebhook {
+			return fmt.Errorf("the binary cloudevents mode is only supported by webhooks")
+		}
+	default:
+		return fmt.Errorf("unknown cloudevents mode %q", cfg.CloudEventsMode)
+	}
+	return nil
+}
+
+func (cfg SinkConfig) name() string {
+	if cfg.Name == "" {
+		return cfg.Type
+	}
+	return cfg.Name
+}
+
+// Sink delivers the events of a Nomad index to a destination.
+type Sink interface {
+	Send(ctx context.Context, index uint64, events []api.Event) error
+	Close() error
+}
+
+// newSink creates the sink, encoding the events of the Nomad cluster at
+// address in the format of the sink.
+func newSink(cfg SinkConfig, address string, reg prometheus.Registerer) (Sink, error) {
+	enc := newEncoder(cfg, address)
+	switch cfg.Type {
+	case SinkWebhook:
+		timeout := cfg.Timeout
+		if timeout == 0 {
+			timeout = 10 * time.Second
+		}
+		client := cleanhttp.DefaultPooledClient()
+		client.Timeout = timeout
+		return &webhookSink{cfg: cfg, client: client, enc: enc}, nil
+
+	case SinkFile:
+		file, err := os.OpenFile(cfg.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open event file: %w", err)
+		}
+		return &writerSink{w: file, closer: file, enc: enc}, nil
+
+	case SinkStdout:
+		return &writerSink{w: os.Stdout, enc: enc}, nil
+
+	case SinkPrometheus:
+		return &prometheusSink{
+			eventsTotal: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+				Name: "atc_event_sink_nomad_events_total",
+				Help: "Total number of Nomad events, by topic and type.",
+			}, []string{"topic", "type"}),
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown sink type %q", cfg.Type)
+}
+
+// batch is the JSON encoding of the events of a Nomad index, as they are
+// sent on the Nomad event stream.
+type batch struct {
+	Index  uint64
+	Events []api.Event
+}
+
+type webhookSink struct {
+	cfg    SinkConfig
+	client *http.Client
+	enc    encoder
+}
+
+func (s *webhookSink) Send(ctx context.Context, index uint64, events []api.Event) error {
+	msgs, err := s.enc.requests(index, events)
+	if err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		if err := s.post(ctx, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *webhookSink) post(ctx context.Context, msg message) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.cfg.URL.String(), bytes.NewReader(msg.body))
+	if err != nil {
+		return err
+	}
+	req.Header = msg.header
+	for k, v := range s.cfg.Headers {
+		req.Header.Set(k, v.String())
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		// The error of the client carries the URL, which is a secret.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return fmt.Errorf("failed to post to webhook: %w", urlErr.Err)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *webhookSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// writerSink writes the encoded events as lines of JSON.
+type writerSink struct {
+	w      io.Writer
+	closer io.Closer
+	enc    encoder
+}
+
+func (s *writerSink) Send(_ context.Context, index uint64, events []api.Event) error {
+	lines, err := s.enc.lines(index, events)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(s.w)
+	for _, line := range lines {
+		w.Write(line)
+		w.WriteByte('\n')
+	}
+	return w.Flush()
+}
+
+func (s *writerSink) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+// prometheusSink counts the events.
+type prometheusSink struct {
+	eventsTotal *prometheus.CounterVec
+}
+
+func (s *prometheusSink) Send(_ context.Context, _ uint64, events []api.Event) error {
+	for _, e := range events {
+		s.eventsTotal.WithLabelValues(string(e.Topic), e.Type).Inc()
+	}
+	return nil
+}
+
+func (s *prometheusSink) Close() error {
+	return nil
+}
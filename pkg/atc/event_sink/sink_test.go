@@ -0,0 +1,46 @@
+package event_sink
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/grafana/dskit/flagext"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.yaml.in/yaml/v3"
+)
+
+func TestWebhookURLIsSecret(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	address := srv.URL + "/hook?token=s3cr3t"
+	srv.Close()
+
+	cfg := SinkConfig{Type: SinkWebhook, URL: flagext.SecretWithValue(address)}
+	out, err := yaml.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(out), "s3cr3t") {
+		t.Errorf("marshalled config = %s, want the url redacted", out)
+	}
+
+	invalid := SinkConfig{Type: SinkWebhook, URL: flagext.SecretWithValue("ftp://events.example.com/?token=s3cr3t")}
+	if err := invalid.Validate(); err == nil || strings.Contains(err.Error(), "s3cr3t") {
+		t.Errorf("error = %v, want an invalid url without the url", err)
+	}
+
+	sink, err := newSink(cfg, "http://nomad.example.com:4646", prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	err = sink.Send(context.Background(), 7, twoEvents())
+	if err == nil {
+		t.Fatal("delivery to a closed server succeeded")
+	}
+	if strings.Contains(err.Error(), "s3cr3t") {
+		t.Errorf("error = %v, want it without the url", err)
+	}
+}
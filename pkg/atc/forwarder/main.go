@@ -2,22 +2,77 @@ package forwarder
 
 import (
 	"context"
+	"flag"
 	"fmt"
+	"time"
+
 	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/flagext"
 	"github.com/grafana/dskit/services"
 	"github.com/hashicorp/consul/api"
-	"github.com/hashicorp/consul/api/watch"
+
+	"github.com/attachmentgenie/atc/pkg/atc/configentry"
+	"github.com/attachmentgenie/atc/pkg/atc/leader"
+	"github.com/attachmentgenie/atc/pkg/atc/radar"
+	"github.com/attachmentgenie/atc/pkg/atc/watcher"
 )
 
+type Config struct {
+	ConnectTimeout   time.Duration          `yaml:"connect_timeout"`
+	Datacenters      flagext.StringSliceCSV `yaml:"datacenters"`
+	SyncInterval     time.Duration          `yaml:"sync_interval"`
+	SuppressFlapping bool                   `yaml:"suppress_flapping"`
+}
+
+func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	f.DurationVar(&cfg.ConnectTimeout, "forwarder.connect-timeout", 15*time.Second, "ConnectTimeout set on the service-resolver entries created by the forwarder.")
+	f.Var(&cfg.Datacenters, "forwarder.datacenters", "Comma-separated list of datacenters, in order of preference, to fail over to. Defaults to the healthy datacenters and cluster peers ranked by the radar.")
+	f.DurationVar(&cfg.SyncInterval, "forwarder.sync-interval", time.Minute, "Interval at which the health of failover datacenters is rechecked in absence of local changes.")
+	f.BoolVar(&cfg.SuppressFlapping, "forwarder.suppress-flapping", false, "Do not fail over services the radar flags as flapping, until they are critical for longer than the radar flap window.")
+}
+
+func (cfg *Config) Validate() error {
+	if cfg.ConnectTimeout < 0 {
+		return fmt.Errorf("invalid forwarder connect timeout: %s", cfg.ConnectTimeout)
+	}
+	if cfg.SyncInterval <= 0 {
+		return fmt.Errorf("invalid forwarder sync interval: %s", cfg.SyncInterval)
+	}
+	return nil
+}
+
 type Forwarder struct {
 	services.Service
 
+	cfg    Config
+	client *api.Client
+	writer *configentry.Writer
 	logger log.Logger
 
-	watchServicesChan chan struct{}
+	// local is the datacenter of the local agent, read once when starting.
+	local string
+
+	// radar ranks the failover targets when no datacenters are configured
+	// and flags flapping services. It is nil when neither is needed.
+	radar *radar.Radar
+
+	// failovers holds the failover targets of the service-resolver entries
+	// written by this forwarder, keyed by service name. It is nil until
+	// loaded from Consul.
+	failovers map[string][]api.ServiceResolverFailoverTarget
+
+	elector    *leader.Elector
+	leadership <-chan struct{}
+	snapshots  <-chan *watcher.Snapshot
 }
 
 func (f *Forwarder) starting(ctx context.Context) error {
+	self, err := f.client.Agent().Self()
+	if err != nil {
+		return fmt.Errorf("failed to query local agent: %w", err)
+	}
+	f.local, _ = self["Config"]["Datacenter"].(string)
 	return nil
 }
 
@@ -25,69 +80,73 @@ func (f *Forwarder) stopping(_ error) error {
 	return nil
 }
 
-func New(logger log.Logger) (*Forwarder, error) {
+func New(cfg Config, client *api.Client, writer *configentry.Writer, radar *radar.Radar, elector *leader.Elector, snapshots <-chan *watcher.Snapshot, logger log.Logger) (*Forwarder, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
 
 	f := &Forwarder{
-		logger: logger,
+		cfg:        cfg,
+		client:     client,
+		writer:     writer,
+		radar:      radar,
+		logger:     log.With(logger, "module", "forwarder"),
+		elector:    elector,
+		leadership: elector.Subscribe(),
+		snapshots:  snapshots,
 	}
-	f.Service = services.NewBasicService(f.starting, f.watcher, f.stopping)
+	f.Service = services.NewBasicService(f.starting, f.running, f.stopping)
 	return f, nil
 }
 
-func (f *Forwarder) watcher(ctx context.Context) error {
-	client, err := api.NewClient(&api.Config{})
-	if err != nil {
-		return fmt.Errorf("failed to connect to consul: %s", err.Error())
-	}
-
-	servicesWatcher, parseErr := watch.Parse(map[string]interface{}{"type": "services"})
-	if parseErr != nil {
-		return fmt.Errorf("failed to create services watcher plan: %s", parseErr.Error())
-	}
+func (f *Forwarder) running(ctx context.Context) error {
+	ticker := time.NewTicker(f.cfg.SyncInterval)
+	defer ticker.Stop()
 
-	servicesWatcher.HybridHandler = func(_ watch.BlockingParamVal, _ interface{}) {
+	var snapshot *watcher.Snapshot
+	for {
 		select {
 		case <-ctx.Done():
-		case f.watchServicesChan <- struct{}{}:
-		default:
-			// Event chan is full, discard event.
+			return nil
+
+		case snapshot = <-f.snapshots:
+		case <-ticker.C:
+		case <-f.leadership:
+			// Another replica may have changed the failovers while this one
+			// was a follower.
+			f.failovers = nil
 		}
-	}
-
-	checksWatcher, err := watch.Parse(map[string]interface{}{"type": "checks"})
-	if err != nil {
-		return fmt.Errorf("failed to create checks watcher plan: %w", err)
-	}
 
-	checksWatcher.HybridHandler = func(_ watch.BlockingParamVal, _ interface{}) {
-		select {
-		case <-ctx.Done():
-		case f.watchServicesChan <- struct{}{}:
-		default:
-			// Event chan is full, discard event.
+		if snapshot == nil || !f.elector.IsLeader() {
+			continue
 		}
-	}
-
-	errChan := make(chan error, 2)
 
-	defer func() {
-		servicesWatcher.Stop()
-		checksWatcher.Stop()
-	}()
-
-	go func() {
-		errChan <- servicesWatcher.RunWithClientAndHclog(client, servicesWatcher.Logger)
-	}()
+		if f.failovers == nil {
+			if err := f.loadFailovers(); err != nil {
+				level.Error(f.logger).Log("msg", "failed to load failover service-resolvers", "err", err)
+				continue
+			}
+		}
 
-	go func() {
-		errChan <- checksWatcher.RunWithClientAndHclog(client, checksWatcher.Logger)
-	}()
+		if err := f.reconcile(snapshot); err != nil {
+			level.Error(f.logger).Log("msg", "failed to reconcile failover service-resolvers", "err", err)
+		}
+	}
+}
 
-	select {
-	case <-ctx.Done():
-		return nil
+// loadFailovers picks up the failovers written by earlier forwarders, so they
+// are removed once the service recovers.
+func (f *Forwarder) loadFailovers() error {
+	owned, err := f.writer.Owned("forwarder", api.ServiceResolver)
+	if err != nil {
+		return err
+	}
 
-	case err = <-errChan:
-		return fmt.Errorf("services or checks watcher terminated: %w", err)
+	f.failovers = map[string][]api.ServiceResolverFailoverTarget{}
+	for _, entry := range owned {
+		if resolver, ok := entry.(*api.ServiceResolverConfigEntry); ok {
+			f.failovers[resolver.Name] = resolverTargets(resolver.Failover["*"])
+		}
 	}
+	return nil
 }
@@ -0,0 +1,194 @@
+package forwarder
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-kit/log/level"
+	"github.com/hashicorp/consul/api"
+	"golang.org/x/exp/slices"
+
+	"github.com/attachmentgenie/atc/pkg/atc/configentry"
+	"github.com/attachmentgenie/atc/pkg/atc/watcher"
+)
+
+// reconcile compares the local health of every service in the snapshot with
+// the failover service-resolvers written so far, and creates, updates or
+// deletes service-resolver entries accordingly.
+func (f *Forwarder) reconcile(snapshot *watcher.Snapshot) error {
+	datacenters, err := f.failoverDatacenters()
+	if err != nil {
+		return err
+	}
+
+	for name := range snapshot.Services {
+		if name == "consul" {
+			continue
+		}
+
+		if health := snapshot.Health(name); health.Total() == 0 || health.Available() {
+			f.removeFailover(name)
+			continue
+		}
+
+		if _, ok := f.failovers[name]; !ok && f.cfg.SuppressFlapping && f.radar != nil && f.radar.IsFlapping(name) {
+			level.Warn(f.logger).Log("msg", "service is critical but flapping, not failing over", "service", name)
+			continue
+		}
+
+		targets := f.rankedTargets(name, datacenters)
+		if len(targets) == 0 {
+			level.Warn(f.logger).Log("msg", "service is critical but no healthy failover target is available", "service", name)
+			continue
+		}
+
+		if slices.Equal(f.failovers[name], targets) {
+			continue
+		}
+
+		reason := "no available instances in the local datacenter"
+		if err := f.writer.Upsert("forwarder", reason, failoverResolver(name, targets, f.cfg)); err != nil {
+			level.Error(f.logger).Log("msg", "failed to write failover service-resolver", "service", name, "err", err)
+			continue
+		}
+		level.Info(f.logger).Log("msg", "wrote failover service-resolver", "service", name, "targets", targetNames(targets), "dry_run", f.writer.DryRun())
+		f.failovers[name] = targets
+	}
+
+	// Services that were deregistered altogether no longer need a resolver.
+	for name := range f.failovers {
+		if _, ok := snapshot.Services[name]; !ok {
+			f.removeFailover(name)
+		}
+	}
+
+	return nil
+}
+
+func (f *Forwarder) removeFailover(name string) {
+	if _, ok := f.failovers[name]; !ok {
+		return
+	}
+
+	err := f.writer.Delete("forwarder", api.ServiceResolver, name)
+	if errors.Is(err, configentry.ErrUnmanaged) || errors.Is(err, configentry.ErrNotOwner) {
+		// The entry was taken over, it is no longer ours to remove.
+		delete(f.failovers, name)
+		return
+	}
+	if err != nil {
+		level.Error(f.logger).Log("msg", "failed to delete failover service-resolver", "service", name, "err", err)
+		return
+	}
+	level.Info(f.logger).Log("msg", "deleted failover service-resolver", "service", name, "dry_run", f.writer.DryRun())
+	delete(f.failovers, name)
+}
+
+// failoverDatacenters returns the configured failover datacenters, or every
+// datacenter known to the agent except the local one when none are configured.
+func (f *Forwarder) failoverDatacenters() ([]string, error) {
+	datacenters := []string(f.cfg.Datacenters)
+	if len(datacenters) == 0 {
+		// Datacenters are sorted by estimated round trip time.
+		var err error
+		datacenters, err = f.client.Catalog().Datacenters()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list datacenters: %w", err)
+		}
+	}
+
+	return slices.DeleteFunc(slices.Clone(datacenters), func(dc string) bool {
+		return dc == f.local
+	}), nil
+}
+
+// healthyDatacenters returns the datacenters that have at least one passing
+// instance of the service, preserving the order of preference.
+func (f *Forwarder) healthyDatacenters(name string, datacenters []string) []api.ServiceResolverFailoverTarget {
+	var healthy []api.ServiceResolverFailoverTarget
+	for _, dc := range datacenters {
+		target := api.ServiceResolverFailoverTarget{Datacenter: dc}
+		if f.passing(name, target) {
+			healthy = append(healthy, target)
+		}
+	}
+	return healthy
+}
+
+// rankedTargets returns the failover targets of the service ranked by the
+// radar when no datacenters are configured. The health the radar ranked by
+// may be a refresh interval old, so every target is checked again. Services
+// the radar has not mapped yet fail over to the healthy datacenters.
+func (f *Forwarder) rankedTargets(name string, datacenters []string) []api.ServiceResolverFailoverTarget {
+	if f.radar == nil || len(f.cfg.Datacenters) > 0 {
+		return f.healthyDatacenters(name, datacenters)
+	}
+	ranked, ok := f.radar.Failover(name)
+	if !ok {
+		return f.healthyDatacenters(name, datacenters)
+	}
+
+	var targets []api.ServiceResolverFailoverTarget
+	for _, t := range ranked {
+		target := api.ServiceResolverFailoverTarget{Datacenter: t.Datacenter, Peer: t.Peer}
+		if f.passing(name, target) {
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
+// passing reports whether the service has a passing instance in the
+// datacenter or peer of the target.
+func (f *Forwarder) passing(name string, target api.ServiceResolverFailoverTarget) bool {
+	entries, _, err := f.client.Health().Service(name, "", true, &api.QueryOptions{Datacenter: target.Datacenter, Peer: target.Peer})
+	return err == nil && len(entries) > 0
+}
+
+// failoverResolver fails over to the targets in order. Failovers to
+// datacenters only are written as a list of datacenters, which older Consul
+// versions understand as well.
+func failoverResolver(name string, targets []api.ServiceResolverFailoverTarget, cfg Config) *api.ServiceResolverConfigEntry {
+	failover := api.ServiceResolverFailover{Targets: targets}
+	if !slices.ContainsFunc(targets, func(t api.ServiceResolverFailoverTarget) bool { return t.Peer != "" }) {
+		failover = api.ServiceResolverFailover{}
+		for _, t := range targets {
+			failover.Datacenters = append(failover.Datacenters, t.Datacenter)
+		}
+	}
+
+	return &api.ServiceResolverConfigEntry{
+		Kind:           api.ServiceResolver,
+		Name:           name,
+		ConnectTimeout: cfg.ConnectTimeout,
+		Failover: map[string]api.ServiceResolverFailover{
+			"*": failover,
+		},
+	}
+}
+
+// resolverTargets returns the failover targets of a service-resolver written
+// by failoverResolver.
+func resolverTargets(failover api.ServiceResolverFailover) []api.ServiceResolverFailoverTarget {
+	if len(failover.Targets) > 0 {
+		return failover.Targets
+	}
+	var targets []api.ServiceResolverFailoverTarget
+	for _, dc := range failover.Datacenters {
+		targets = append(targets, api.ServiceResolverFailoverTarget{Datacenter: dc})
+	}
+	return targets
+}
+
+func targetNames(targets []api.ServiceResolverFailoverTarget) string {
+	names := make([]string, 0, len(targets))
+	for _, t := range targets {
+		if t.Peer != "" {
+			names = append(names, "peer:"+t.Peer)
+			continue
+		}
+		names = append(names, t.Datacenter)
+	}
+	return strings.Join(names, ",")
+}
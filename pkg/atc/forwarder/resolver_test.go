@@ -0,0 +1,393 @@
+package forwarder
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/services"
+	"github.com/hashicorp/consul/api"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/attachmentgenie/atc/pkg/atc/configentry"
+	"github.com/attachmentgenie/atc/pkg/atc/leader"
+	"github.com/attachmentgenie/atc/pkg/atc/radar"
+	"github.com/attachmentgenie/atc/pkg/atc/watcher"
+)
+
+// fakeConsul serves the local agent of dc1, the instances of the services
+// per datacenter and peer, and the service-resolver config entries.
+type fakeConsul struct {
+	mtx   sync.Mutex
+	index uint64
+	// health holds the instances of a service per datacenter, or per peer
+	// prefixed with "peer:".
+	health    map[string]map[string]watcher.Health
+	resolvers map[string]*api.ServiceResolverConfigEntry
+	writes    int
+}
+
+func (c *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	query := r.URL.Query()
+	target := query.Get("dc")
+	if peer := query.Get("peer"); peer != "" {
+		target = "peer:" + peer
+	} else if target == "" {
+		target = "dc1"
+	}
+
+	path := r.URL.Path
+	switch {
+	case path == "/v1/agent/self":
+		_ = json.NewEncoder(w).Encode(map[string]any{"Config": map[string]any{"Datacenter": "dc1"}})
+
+	case path == "/v1/catalog/datacenters":
+		_ = json.NewEncoder(w).Encode([]string{"dc1", "dc2", "dc3"})
+
+	case path == "/v1/catalog/services":
+		svcs := map[string][]string{}
+		for name, health := range c.health {
+			if _, ok := health[target]; ok {
+				svcs[name] = []string{}
+			}
+		}
+		_ = json.NewEncoder(w).Encode(svcs)
+
+	case strings.HasPrefix(path, "/v1/health/service/"):
+		name := strings.TrimPrefix(path, "/v1/health/service/")
+		h := c.health[name][target]
+		entries := []*api.ServiceEntry{}
+		add := func(n int, status string) {
+			for i := 0; i < n; i++ {
+				entries = append(entries, &api.ServiceEntry{
+					Node:    &api.Node{Node: fmt.Sprintf("node-%d", len(entries))},
+					Service: &api.AgentService{ID: fmt.Sprintf("%s-%d", name, len(entries)), Service: name},
+					Checks:  api.HealthChecks{{Status: status}},
+				})
+			}
+		}
+		add(h.Passing, api.HealthPassing)
+		if !query.Has("passing") {
+			add(h.Critical, api.HealthCritical)
+		}
+		_ = json.NewEncoder(w).Encode(entries)
+
+	case path == "/v1/coordinate/datacenters", path == "/v1/config/service-intentions":
+		_, _ = w.Write([]byte("[]"))
+
+	case path == "/v1/config/service-resolver":
+		entries := []*api.ServiceResolverConfigEntry{}
+		for _, e := range c.resolvers {
+			entries = append(entries, e)
+		}
+		_ = json.NewEncoder(w).Encode(entries)
+
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "/v1/config/service-resolver/"):
+		e, ok := c.resolvers[strings.TrimPrefix(path, "/v1/config/service-resolver/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(e)
+
+	case r.Method == http.MethodPut && path == "/v1/config":
+		var e api.ServiceResolverConfigEntry
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !c.cas(e.Name, query.Get("cas")) {
+			_, _ = w.Write([]byte("false"))
+			return
+		}
+		c.index++
+		e.ModifyIndex = c.index
+		c.resolvers[e.Name] = &e
+		c.writes++
+		_, _ = w.Write([]byte("true"))
+
+	case r.Method == http.MethodDelete && strings.HasPrefix(path, "/v1/config/service-resolver/"):
+		name := strings.TrimPrefix(path, "/v1/config/service-resolver/")
+		if !c.cas(name, query.Get("cas")) {
+			_, _ = w.Write([]byte("false"))
+			return
+		}
+		delete(c.resolvers, name)
+		c.writes++
+		_, _ = w.Write([]byte("true"))
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// cas reports whether a write with the cas index applies to the current
+// resolver of a service.
+func (c *fakeConsul) cas(name, index string) bool {
+	cas, _ := strconv.ParseUint(index, 10, 64)
+	current, ok := c.resolvers[name]
+	if !ok {
+		return cas == 0
+	}
+	return current.ModifyIndex == cas
+}
+
+func (c *fakeConsul) resolver(name string) *api.ServiceResolverConfigEntry {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.resolvers[name]
+}
+
+func testForwarder(t *testing.T, srv *httptest.Server, cfg Config, radar *radar.Radar, elector *leader.Elector, snapshots <-chan *watcher.Snapshot) *Forwarder {
+	t.Helper()
+	client, err := api.NewClient(&api.Config{Address: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elector == nil {
+		if elector, err = leader.New(leader.Config{}, nil, log.NewNopLogger(), prometheus.NewRegistry()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writer := configentry.New(client, false, log.NewNopLogger(), prometheus.NewRegistry())
+	f, err := New(cfg, client, writer, radar, elector, snapshots, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// testRadar starts a radar on the fake Consul and waits until it mapped the
+// services of the snapshot.
+func testRadar(t *testing.T, srv *httptest.Server, snapshot *watcher.Snapshot) *radar.Radar {
+	t.Helper()
+	client, err := api.NewClient(&api.Config{Address: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cfg radar.Config
+	cfg.RegisterFlags(flag.NewFlagSet("test", flag.PanicOnError))
+	cfg.Peers = []string{"p1"}
+	cfg.RefreshInterval = time.Hour
+
+	snapshots := make(chan *watcher.Snapshot, 1)
+	r, err := radar.New(cfg, client, snapshots, log.NewNopLogger(), prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := services.StartAndAwaitRunning(context.Background(), r); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = services.StopAndAwaitTerminated(context.Background(), r) })
+
+	snapshots <- snapshot
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, ok := r.Failover("web"); ok {
+			return r
+		}
+	}
+	t.Fatal("radar did not map the snapshot")
+	return nil
+}
+
+// webSnapshot is a snapshot of the local datacenter with a single web
+// instance, or without web when status is empty.
+func webSnapshot(status string) *watcher.Snapshot {
+	s := &watcher.Snapshot{
+		Services:  map[string][]string{"consul": {}},
+		Instances: map[string][]watcher.Instance{"consul": {{ID: "consul", Service: "consul", Status: api.HealthCritical}}},
+	}
+	if status != "" {
+		s.Services["web"] = []string{}
+		s.Instances["web"] = []watcher.Instance{{ID: "web-1", Service: "web", Node: "node-1", Status: status}}
+	}
+	return s
+}
+
+// ownedResolver is a failover of web to dc2 written by an earlier forwarder.
+func ownedResolver() *api.ServiceResolverConfigEntry {
+	return &api.ServiceResolverConfigEntry{
+		Kind: api.ServiceResolver,
+		Name: "web",
+		Meta: map[string]string{
+			configentry.MetaManagedBy:  configentry.ManagedByValue,
+			configentry.MetaModule:     "forwarder",
+			configentry.MetaGeneration: "1",
+		},
+		Failover:    map[string]api.ServiceResolverFailover{"*": {Datacenters: []string{"dc2"}}},
+		ModifyIndex: 1,
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	tests := []struct {
+		name        string
+		datacenters []string
+		radar       bool
+		health      map[string]watcher.Health
+		existing    bool
+		status      string
+		want        *api.ServiceResolverFailover
+	}{
+		{
+			name:        "critical service fails over to the configured datacenters",
+			datacenters: []string{"dc1", "dc3", "dc2"},
+			health:      map[string]watcher.Health{"dc2": {Passing: 1}, "dc3": {Passing: 2}},
+			status:      api.HealthCritical,
+			want:        &api.ServiceResolverFailover{Datacenters: []string{"dc3", "dc2"}},
+		},
+		{
+			name:        "configured datacenters without passing instances are skipped",
+			datacenters: []string{"dc3", "dc2"},
+			health:      map[string]watcher.Health{"dc2": {Passing: 1}, "dc3": {Critical: 2}},
+			status:      api.HealthCritical,
+			want:        &api.ServiceResolverFailover{Datacenters: []string{"dc2"}},
+		},
+		{
+			name:   "critical service fails over to the targets ranked by the radar",
+			radar:  true,
+			health: map[string]watcher.Health{"dc2": {Passing: 1, Critical: 1}, "dc3": {Passing: 2}, "peer:p1": {Passing: 1}},
+			status: api.HealthCritical,
+			want: &api.ServiceResolverFailover{Targets: []api.ServiceResolverFailoverTarget{
+				{Peer: "p1"},
+				{Datacenter: "dc3"},
+				{Datacenter: "dc2"},
+			}},
+		},
+		{
+			name:     "critical service keeps its failover",
+			health:   map[string]watcher.Health{"dc2": {Passing: 1}},
+			existing: true,
+			status:   api.HealthCritical,
+			want:     &api.ServiceResolverFailover{Datacenters: []string{"dc2"}},
+		},
+		{
+			name:   "critical service without healthy targets is left alone",
+			health: map[string]watcher.Health{"dc2": {Critical: 1}},
+			status: api.HealthCritical,
+		},
+		{
+			name:     "recovery removes the resolver",
+			health:   map[string]watcher.Health{"dc2": {Passing: 1}},
+			existing: true,
+			status:   api.HealthPassing,
+		},
+		{
+			name:     "deregistration removes the resolver",
+			health:   map[string]watcher.Health{"dc2": {Passing: 1}},
+			existing: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			consul := &fakeConsul{
+				index:     1,
+				health:    map[string]map[string]watcher.Health{"web": tt.health},
+				resolvers: map[string]*api.ServiceResolverConfigEntry{},
+			}
+			if tt.existing {
+				consul.resolvers["web"] = ownedResolver()
+			}
+			srv := httptest.NewServer(consul)
+			defer srv.Close()
+
+			var cfg Config
+			cfg.RegisterFlags(flag.NewFlagSet("test", flag.PanicOnError))
+			cfg.Datacenters = tt.datacenters
+			snapshot := webSnapshot(tt.status)
+			var r *radar.Radar
+			if tt.radar {
+				r = testRadar(t, srv, snapshot)
+			}
+			f := testForwarder(t, srv, cfg, r, nil, nil)
+			if err := f.starting(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.loadFailovers(); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := f.reconcile(snapshot); err != nil {
+				t.Fatal(err)
+			}
+			resolver := consul.resolver("web")
+			if tt.want == nil {
+				if resolver != nil {
+					t.Fatalf("resolver = %+v, want none", resolver.Failover)
+				}
+				if _, ok := f.failovers["web"]; ok {
+					t.Errorf("failovers = %v, want no failover of web", f.failovers)
+				}
+				return
+			}
+			if resolver == nil {
+				t.Fatal("resolver = nil, want a failover")
+			}
+			if got := resolver.Failover["*"]; !reflect.DeepEqual(got, *tt.want) {
+				t.Errorf("failover = %+v, want %+v", got, *tt.want)
+			}
+			if resolver.Meta[configentry.MetaModule] != "forwarder" {
+				t.Errorf("meta = %v, want owned by the forwarder", resolver.Meta)
+			}
+			if consul.resolver("consul") != nil {
+				t.Error("consul failed over, want it skipped")
+			}
+
+			// Reconciling an unchanged snapshot writes nothing.
+			writes := consul.writes
+			if err := f.reconcile(snapshot); err != nil {
+				t.Fatal(err)
+			}
+			if consul.writes != writes {
+				t.Errorf("writes = %d, want %d after an unchanged snapshot", consul.writes, writes)
+			}
+		})
+	}
+}
+
+func TestForwarderFollower(t *testing.T) {
+	consul := &fakeConsul{
+		health:    map[string]map[string]watcher.Health{"web": {"dc2": {Passing: 1}}},
+		resolvers: map[string]*api.ServiceResolverConfigEntry{},
+	}
+	srv := httptest.NewServer(consul)
+	defer srv.Close()
+
+	// An elector that never acquired the lock keeps this replica a follower.
+	elector, err := leader.New(leader.Config{Enabled: true, Key: "atc/leader", SessionTTL: 15 * time.Second, RetryInterval: time.Second}, nil, log.NewNopLogger(), prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cfg Config
+	cfg.RegisterFlags(flag.NewFlagSet("test", flag.PanicOnError))
+	snapshots := make(chan *watcher.Snapshot)
+	f := testForwarder(t, srv, cfg, nil, elector, snapshots)
+	if err := services.StartAndAwaitRunning(context.Background(), f); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = services.StopAndAwaitTerminated(context.Background(), f) }()
+
+	// The second snapshot is only taken once the first one was handled.
+	snapshots <- webSnapshot(api.HealthCritical)
+	snapshots <- webSnapshot(api.HealthCritical)
+
+	consul.mtx.Lock()
+	defer consul.mtx.Unlock()
+	if consul.writes != 0 || len(consul.resolvers) != 0 {
+		t.Errorf("writes = %d, resolvers = %v, want none from a follower", consul.writes, consul.resolvers)
+	}
+}
@@ -0,0 +1,312 @@
+package incident
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/flagext"
+	"github.com/grafana/dskit/services"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/attachmentgenie/atc/pkg/atc/leader"
+)
+
+// boundaryPrefix marks the Boundary targets and roles managed by ATC.
+const boundaryPrefix = "atc-incident-"
+
+type BoundaryConfig struct {
+	Address      string         `yaml:"address"`
+	Token        flagext.Secret `yaml:"token"`
+	AuthMethodID string         `yaml:"auth_method_id"`
+	LoginName    string         `yaml:"login_name"`
+	Password     flagext.Secret `yaml:"password"`
+	ScopeID      string         `yaml:"scope_id"`
+	GroupID      string         `yaml:"group_id"`
+	GrantTTL     time.Duration  `yaml:"grant_ttl"`
+	SyncInterval time.Duration  `yaml:"sync_interval"`
+}
+
+func (cfg *BoundaryConfig) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.Address, "boundary.address", "", "Address of the Boundary controller API. Access is only granted when set.")
+	f.Var(&cfg.Token, "boundary.token", "Boundary auth token.")
+	f.StringVar(&cfg.AuthMethodID, "boundary.auth-method-id", "", "Password auth method to log in with when no token is set or the token expired.")
+	f.StringVar(&cfg.LoginName, "boundary.login-name", "", "Login name for the password auth method.")
+	f.Var(&cfg.Password, "boundary.password", "Password for the password auth method.")
+	f.StringVar(&cfg.ScopeID, "boundary.scope-id", "", "Project scope the targets and roles are created in.")
+	f.StringVar(&cfg.GroupID, "boundary.group-id", "", "Group of the on-call responders that is granted access to the hosts of an incident.")
+	f.DurationVar(&cfg.GrantTTL, "boundary.grant-ttl", 4*time.Hour, "How long after an incident opened its access is revoked, even if the incident is not resolved.")
+	f.DurationVar(&cfg.SyncInterval, "boundary.sync-interval", time.Minute, "Interval at which the targets and roles in Boundary are reconciled in absence of incident changes.")
+}
+
+func (cfg *BoundaryConfig) Validate() error {
+	if cfg.Address == "" {
+		return nil
+	}
+	if u, err := url.Parse(cfg.Address); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid boundary address %q", cfg.Address)
+	}
+	if cfg.ScopeID == "" {
+		return fmt.Errorf("boundary scope id is required")
+	}
+	if cfg.GroupID == "" {
+		return fmt.Errorf("boundary group id is required")
+	}
+	if cfg.Token.String() == "" && (cfg.AuthMethodID == "" || cfg.LoginName == "") {
+		return fmt.Errorf("either a boundary token or an auth method id and login name are required")
+	}
+	if cfg.GrantTTL <= 0 {
+		return fmt.Errorf("invalid boundary grant ttl: %s", cfg.GrantTTL)
+	}
+	if cfg.SyncInterval <= 0 {
+		return fmt.Errorf("invalid boundary sync interval: %s", cfg.SyncInterval)
+	}
+	return nil
+}
+
+// Boundary grants the on-call group just-in-time access to the hosts of open
+// incidents. Every affected instance gets a Boundary target and a role that
+// allows the group to connect to it, which are removed once the incident
+// resolves or the grant expires.
+type Boundary struct {
+	services.Service
+
+	cfg      BoundaryConfig
+	client   *boundaryClient
+	incident *Incident
+	logger   log.Logger
+
+	elector    *leader.Elector
+	leadership <-chan struct{}
+	changes    <-chan struct{}
+
+	grants      prometheus.Gauge
+	errorsTotal prometheus.Counter
+}
+
+func (f *Boundary) starting(ctx context.Context) error {
+	return nil
+}
+
+func (f *Boundary) stopping(_ error) error {
+	return nil
+}
+
+func NewBoundary(cfg BoundaryConfig, incident *Incident, elector *leader.Elector, logger log.Logger, reg prometheus.Registerer) (*Boundary, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	f := &Boundary{
+		cfg:        cfg,
+		client:     newBoundaryClient(cfg),
+		incident:   incident,
+		logger:     log.With(logger, "module", "boundary"),
+		elector:    elector,
+		leadership: elector.Subscribe(),
+		changes:    incident.Subscribe(),
+		grants: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "atc_boundary_grants",
+			Help: "Number of Boundary targets the on-call group is granted access to.",
+		}),
+		errorsTotal: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "atc_boundary_sync_errors_total",
+			Help: "Total number of failed reconciliations of the Boundary grants.",
+		}),
+	}
+	f.Service = services.NewBasicService(f.starting, f.running, f.stopping)
+	return f, nil
+}
+
+func (f *Boundary) running(ctx context.Context) error {
+	ticker := time.NewTicker(f.cfg.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case <-f.changes:
+		case <-f.leadership:
+		case <-ticker.C:
+		}
+
+		if !f.incident.Leading() {
+			continue
+		}
+		if err := f.reconcile(ctx, time.Now()); err != nil {
+			level.Error(f.logger).Log("msg", "failed to reconcile boundary grants", "err", err)
+			f.errorsTotal.Inc()
+		}
+	}
+}
+
+// grant is the access to an instance affected by an incident.
+type grant struct {
+	incident Record
+	instance Instance
+	expires  time.Time
+}
+
+// targetName names the target and role of an instance, so every replica
+// finds the grants of the others.
+func targetName(service string, i Instance) string {
+	return boundaryPrefix + service + "-" + i.ID
+}
+
+// targetDescription describes the target of an instance. The service is
+// read back from it by targetService.
+func targetDescription(service string, i Instance, id string) string {
+	return fmt.Sprintf("Access to %s on %s for incident %s", service, i.Node, id)
+}
+
+// targetService returns the service of a target created by ATC, so the
+// incident is annotated when access is revoked, also by another replica than
+// the one that granted it. The name is ambiguous when the service or instance
+// contain dashes, so it is only used for targets without a description.
+func (f *Boundary) targetService(t boundaryTarget) string {
+	if rest, ok := strings.CutPrefix(t.Description, "Access to "); ok {
+		if service, _, ok := strings.Cut(rest, " on "); ok {
+			return service
+		}
+	}
+	var service string
+	for _, rec := range append(f.incident.Open(), f.incident.Recent()...) {
+		if strings.HasPrefix(t.Name, boundaryPrefix+rec.Service+"-") && len(rec.Service) > len(service) {
+			service = rec.Service
+		}
+	}
+	return service
+}
+
+// desired returns the grants of the open incidents that did not expire, and
+// the grants of the open incidents that did.
+func (f *Boundary) desired(now time.Time) (desired, expired map[string]grant) {
+	desired, expired = map[string]grant{}, map[string]grant{}
+	for _, rec := range f.incident.Open() {
+		expires := rec.Opened.Add(f.cfg.GrantTTL)
+		grants := desired
+		if !now.Before(expires) {
+			grants = expired
+		}
+		for _, i := range rec.Instances {
+			if i.Address == "" || i.Port == 0 {
+				level.Debug(f.logger).Log("msg", "not granting access to instance without address", "service", rec.Service, "instance", i.ID)
+				continue
+			}
+			grants[targetName(rec.Service, i)] = grant{incident: rec, instance: i, expires: expires}
+		}
+	}
+	return desired, expired
+}
+
+// reconcile creates the targets and roles of the desired grants, and removes
+// the ones of resolved or expired incidents. Expired grants are removed as
+// soon as their incident is known. Other grants are only removed once the
+// incidents settled, so a replica that does not know the incidents of an
+// ongoing outage yet does not cut the access of the on-call group.
+func (f *Boundary) reconcile(ctx context.Context, now time.Time) error {
+	desired, expired := f.desired(now)
+	settled := f.incident.Settled(now)
+	revoke := func(name string) bool {
+		if _, ok := desired[name]; ok {
+			return false
+		}
+		_, ok := expired[name]
+		return settled || ok
+	}
+
+	targets, err := f.client.listTargets(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list boundary targets: %w", err)
+	}
+	roles, err := f.client.listRoles(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list boundary roles: %w", err)
+	}
+
+	existing := map[string]boundaryTarget{}
+	for _, t := range targets {
+		if strings.HasPrefix(t.Name, boundaryPrefix) {
+			existing[t.Name] = t
+		}
+	}
+	granted := map[string]boundaryRole{}
+	for _, r := range roles {
+		if strings.HasPrefix(r.Name, boundaryPrefix) {
+			granted[r.Name] = r
+		}
+	}
+
+	for name, g := range desired {
+		target, ok := existing[name]
+		if !ok {
+			// A role left behind with an earlier target grants access to
+			// a target that no longer exists.
+			if role, ok := granted[name]; ok {
+				if err := f.client.deleteRole(ctx, role.ID); err != nil {
+					return fmt.Errorf("failed to delete boundary role %s: %w", name, err)
+				}
+				delete(granted, name)
+			}
+			target, err = f.client.createTarget(ctx, boundaryTarget{
+				Name:              name,
+				Description:       targetDescription(g.incident.Service, g.instance, g.incident.ID),
+				Type:              "tcp",
+				Address:           g.instance.Address,
+				SessionMaxSeconds: uint32(g.expires.Sub(now).Seconds()),
+				Attributes:        map[string]any{"default_port": g.instance.Port},
+			})
+			if err != nil {
+				return fmt.Errorf("failed to create boundary target %s: %w", name, err)
+			}
+		}
+		if _, ok := granted[name]; ok {
+			continue
+		}
+
+		_, err := f.client.createRole(ctx, boundaryRole{
+			Name:        name,
+			Description: fmt.Sprintf("On-call access to %s for incident %s, until %s", g.incident.Service, g.incident.ID, g.expires.Format(time.RFC3339)),
+		}, []string{f.cfg.GroupID}, []string{"ids=" + target.ID + ";actions=read,authorize-session"})
+		if err != nil {
+			return fmt.Errorf("failed to create boundary role %s: %w", name, err)
+		}
+		level.Info(f.logger).Log("msg", "granted access to incident host", "incident", g.incident.ID, "target", target.ID, "address", g.instance.Address, "port", g.instance.Port, "expires", g.expires)
+		f.incident.Annotate(g.incident.Service, EventAccess, "granted %s access to %s:%d through boundary target %s until %s",
+			f.cfg.GroupID, g.instance.Address, g.instance.Port, target.ID, g.expires.Format(time.RFC3339))
+	}
+
+	// Roles are removed before their targets, so access is revoked even
+	// when removing the target fails.
+	for name, role := range granted {
+		if !revoke(name) {
+			continue
+		}
+		if err := f.client.deleteRole(ctx, role.ID); err != nil {
+			return fmt.Errorf("failed to delete boundary role %s: %w", name, err)
+		}
+	}
+	for name, target := range existing {
+		if !revoke(name) {
+			continue
+		}
+		if err := f.client.deleteTarget(ctx, target.ID); err != nil {
+			return fmt.Errorf("failed to delete boundary target %s: %w", name, err)
+		}
+		level.Info(f.logger).Log("msg", "revoked access to incident host", "target", target.ID, "name", name)
+		if service := f.targetService(target); service != "" {
+			f.incident.Annotate(service, EventAccess, "revoked access through boundary target %s", target.ID)
+		}
+	}
+
+	f.grants.Set(float64(len(desired)))
+	return nil
+}
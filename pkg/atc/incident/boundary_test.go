@@ -0,0 +1,359 @@
+package incident
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/flagext"
+	"github.com/grafana/dskit/services"
+	"github.com/hashicorp/consul/api"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/attachmentgenie/atc/pkg/atc/leader"
+	"github.com/attachmentgenie/atc/pkg/atc/watcher"
+)
+
+// fakeBoundary serves the Boundary targets and roles of a scope, after
+// logging in with the password auth method.
+type fakeBoundary struct {
+	mtx     sync.Mutex
+	next    int
+	targets map[string]boundaryTarget
+	roles   map[string]boundaryRole
+}
+
+func (b *fakeBoundary) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if r.URL.Path == "/v1/auth-methods/ampw_1:authenticate" {
+		var req struct {
+			Attributes map[string]string `json:"attributes"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Attributes["password"] != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"attributes": map[string]string{"token": "at_test"}})
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer at_test" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	path, action, _ := strings.Cut(r.URL.Path, ":")
+	switch {
+	case r.Method == http.MethodGet && path == "/v1/targets":
+		items := []boundaryTarget{}
+		for _, t := range b.targets {
+			items = append(items, t)
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"items": items})
+
+	case r.Method == http.MethodGet && path == "/v1/roles":
+		items := []boundaryRole{}
+		for _, role := range b.roles {
+			items = append(items, role)
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"items": items})
+
+	case r.Method == http.MethodPost && path == "/v1/targets":
+		var t boundaryTarget
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b.next++
+		t.ID, t.Version = fmt.Sprintf("ttcp_%d", b.next), 1
+		b.targets[t.ID] = t
+		_ = json.NewEncoder(w).Encode(t)
+
+	case r.Method == http.MethodPost && path == "/v1/roles":
+		var role boundaryRole
+		if err := json.NewDecoder(r.Body).Decode(&role); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b.next++
+		role.ID, role.Version = fmt.Sprintf("r_%d", b.next), 1
+		b.roles[role.ID] = role
+		_ = json.NewEncoder(w).Encode(role)
+
+	case r.Method == http.MethodPost && strings.HasPrefix(path, "/v1/roles/"):
+		role, ok := b.roles[strings.TrimPrefix(path, "/v1/roles/")]
+		var req struct {
+			Version      uint32   `json:"version"`
+			PrincipalIDs []string `json:"principal_ids"`
+			GrantStrings []string `json:"grant_strings"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !ok || req.Version != role.Version {
+			http.Error(w, "invalid role update", http.StatusBadRequest)
+			return
+		}
+		switch action {
+		case "add-principals":
+			role.PrincipalIDs = append(role.PrincipalIDs, req.PrincipalIDs...)
+		case "add-grants":
+			role.GrantStrings = append(role.GrantStrings, req.GrantStrings...)
+		}
+		role.Version++
+		b.roles[role.ID] = role
+		_ = json.NewEncoder(w).Encode(role)
+
+	case r.Method == http.MethodDelete && strings.HasPrefix(path, "/v1/targets/"):
+		delete(b.targets, strings.TrimPrefix(path, "/v1/targets/"))
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodDelete && strings.HasPrefix(path, "/v1/roles/"):
+		delete(b.roles, strings.TrimPrefix(path, "/v1/roles/"))
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// granted returns the targets the group is granted access to by name, with
+// their address.
+func (b *fakeBoundary) granted(t *testing.T) map[string]string {
+	t.Helper()
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	grants := map[string]string{}
+	for _, role := range b.roles {
+		target := ""
+		for _, tgt := range b.targets {
+			if len(role.GrantStrings) == 1 && role.GrantStrings[0] == "ids="+tgt.ID+";actions=read,authorize-session" {
+				target = tgt.Address
+			}
+		}
+		if target == "" || len(role.PrincipalIDs) != 1 || role.PrincipalIDs[0] != "g_oncall" {
+			t.Errorf("role %s = %+v, want access of g_oncall to a target", role.Name, role)
+			continue
+		}
+		grants[role.Name] = target
+	}
+	if len(b.targets) != len(grants) {
+		t.Errorf("targets = %d, want one per role (%d)", len(b.targets), len(grants))
+	}
+	return grants
+}
+
+func testBoundary(t *testing.T, srv *httptest.Server) *Boundary {
+	t.Helper()
+	elector, err := leader.New(leader.Config{}, nil, log.NewNopLogger(), prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := services.StartAndAwaitRunning(context.Background(), elector); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = services.StopAndAwaitTerminated(context.Background(), elector) })
+
+	var cfg Config
+	cfg.RegisterFlags(flag.NewFlagSet("test", flag.PanicOnError))
+	cfg.OpenAfter = 0
+	incident, err := New(cfg, nil, elector, nil, log.NewNopLogger(), prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := incident.starting(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var bcfg BoundaryConfig
+	bcfg.RegisterFlags(flag.NewFlagSet("test", flag.PanicOnError))
+	bcfg.Address = srv.URL
+	bcfg.AuthMethodID, bcfg.LoginName, bcfg.Password = "ampw_1", "atc", flagext.SecretWithValue("secret")
+	bcfg.ScopeID, bcfg.GroupID = "p_1", "g_oncall"
+	b, err := NewBoundary(bcfg, incident, elector, log.NewNopLogger(), prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func hostSnapshot(statuses map[string]string) *watcher.Snapshot {
+	s := &watcher.Snapshot{Instances: map[string][]watcher.Instance{}}
+	for service, status := range statuses {
+		s.Instances[service] = []watcher.Instance{{ID: service + "-1", Service: service, Node: "node-1", Address: "10.0.0.1", Port: 8080, Status: status}}
+	}
+	return s
+}
+
+func TestBoundaryGrants(t *testing.T) {
+	boundary := &fakeBoundary{targets: map[string]boundaryTarget{}, roles: map[string]boundaryRole{}}
+	srv := httptest.NewServer(boundary)
+	defer srv.Close()
+	b := testBoundary(t, srv)
+	ctx := context.Background()
+	now := time.Now()
+
+	b.incident.evaluate(hostSnapshot(map[string]string{"web": api.HealthCritical, "api": api.HealthPassing}), now)
+	for i := 0; i < 2; i++ {
+		if err := b.reconcile(ctx, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	grants := boundary.granted(t)
+	if len(grants) != 1 || grants["atc-incident-web-web-1"] != "10.0.0.1" {
+		t.Fatalf("grants = %v, want web-1", grants)
+	}
+
+	// Access is revoked when the incident resolves.
+	later := now.Add(b.incident.cfg.ResolveAfter)
+	b.incident.evaluate(hostSnapshot(map[string]string{"web": api.HealthPassing, "api": api.HealthCritical}), now.Add(time.Second))
+	b.incident.evaluate(hostSnapshot(map[string]string{"web": api.HealthPassing, "api": api.HealthCritical}), later.Add(time.Second))
+	if err := b.reconcile(ctx, later.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	grants = boundary.granted(t)
+	if len(grants) != 1 || grants["atc-incident-api-api-1"] == "" {
+		t.Fatalf("grants = %v, want api-1 only", grants)
+	}
+
+	// And once the grant expired, although the incident is still open.
+	if err := b.reconcile(ctx, now.Add(time.Second+b.cfg.GrantTTL)); err != nil {
+		t.Fatal(err)
+	}
+	if grants := boundary.granted(t); len(grants) != 0 {
+		t.Fatalf("grants = %v, want none after the grant ttl", grants)
+	}
+	if len(b.incident.Open()) != 1 {
+		t.Fatal("api incident resolved, want it open")
+	}
+
+	rec, err := b.incident.Get(b.incident.Recent()[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var access []string
+	for _, e := range rec.Events {
+		if e.Type == EventAccess {
+			access = append(access, strings.Fields(e.Message)[0])
+		}
+	}
+	if len(access) != 2 || access[0] != "granted" || access[1] != "revoked" {
+		t.Errorf("access events of web = %v, want granted and revoked", access)
+	}
+}
+
+func TestBoundaryKeepsGrantsUntilSettled(t *testing.T) {
+	boundary := &fakeBoundary{targets: map[string]boundaryTarget{}, roles: map[string]boundaryRole{}}
+	srv := httptest.NewServer(boundary)
+	defer srv.Close()
+	ctx := context.Background()
+	now := time.Now()
+
+	previous := testBoundary(t, srv)
+	previous.incident.evaluate(hostSnapshot(map[string]string{"web": api.HealthCritical}), now)
+	if err := previous.reconcile(ctx, now); err != nil {
+		t.Fatal(err)
+	}
+
+	// A replica that has not seen the outage yet leaves the grants of the
+	// previous one alone until open-after passed.
+	b := testBoundary(t, srv)
+	b.incident.cfg.OpenAfter = time.Minute
+	if err := b.reconcile(ctx, now.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if grants := boundary.granted(t); len(grants) != 1 {
+		t.Fatalf("grants = %v, want web-1 to be kept", grants)
+	}
+	if err := b.reconcile(ctx, now.Add(2*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if grants := boundary.granted(t); len(grants) != 0 {
+		t.Fatalf("grants = %v, want none once settled", grants)
+	}
+}
+
+func TestBoundaryRevokesExpiredGrantsBeforeSettled(t *testing.T) {
+	boundary := &fakeBoundary{targets: map[string]boundaryTarget{}, roles: map[string]boundaryRole{}}
+	srv := httptest.NewServer(boundary)
+	defer srv.Close()
+	ctx := context.Background()
+	now := time.Now()
+
+	previous := testBoundary(t, srv)
+	previous.incident.evaluate(hostSnapshot(map[string]string{"web-api": api.HealthCritical, "db": api.HealthCritical}), now)
+	if err := previous.reconcile(ctx, now); err != nil {
+		t.Fatal(err)
+	}
+	if grants := boundary.granted(t); len(grants) != 2 {
+		t.Fatalf("grants = %v, want web-api-1 and db-1", grants)
+	}
+
+	// The new leader has not settled yet, but knows the web-api incident
+	// opened longer than the grant ttl ago.
+	b := testBoundary(t, srv)
+	b.incident.cfg.OpenAfter = time.Minute
+	b.cfg.GrantTTL = 30 * time.Second
+	b.incident.evaluate(hostSnapshot(map[string]string{"web-api": api.HealthCritical}), now.Add(-2*time.Minute))
+	b.incident.evaluate(hostSnapshot(map[string]string{"web-api": api.HealthCritical}), now.Add(-time.Minute))
+	if b.incident.Settled(now.Add(time.Second)) || len(b.incident.Open()) != 1 {
+		t.Fatal("want an open web-api incident on a replica that did not settle")
+	}
+	if err := b.reconcile(ctx, now.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if grants := boundary.granted(t); len(grants) != 1 || grants["atc-incident-db-db-1"] == "" {
+		t.Fatalf("grants = %v, want the expired web-api-1 revoked and db-1 kept", grants)
+	}
+
+	// The revocation is annotated, although the grant was made by the
+	// previous leader.
+	var access []string
+	for _, e := range b.incident.Open()[0].Events {
+		if e.Type == EventAccess {
+			access = append(access, e.Message)
+		}
+	}
+	if len(access) != 1 || !strings.HasPrefix(access[0], "revoked") {
+		t.Errorf("access events of web-api = %v, want the revocation", access)
+	}
+}
+
+func TestTargetService(t *testing.T) {
+	boundary := &fakeBoundary{targets: map[string]boundaryTarget{}, roles: map[string]boundaryRole{}}
+	srv := httptest.NewServer(boundary)
+	defer srv.Close()
+	b := testBoundary(t, srv)
+	b.incident.evaluate(hostSnapshot(map[string]string{"web": api.HealthCritical, "web-api": api.HealthCritical}), time.Now())
+
+	tests := map[string]struct {
+		target boundaryTarget
+		want   string
+	}{
+		"description": {
+			target: boundaryTarget{Name: "atc-incident-web-api-web-api-1", Description: targetDescription("web-api", Instance{Node: "node-1"}, "inc-1")},
+			want:   "web-api",
+		},
+		"name of a known incident": {
+			target: boundaryTarget{Name: "atc-incident-web-api-web-api-1"},
+			want:   "web-api",
+		},
+		"name of an unknown incident": {
+			target: boundaryTarget{Name: "atc-incident-db-db-1"},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := b.targetService(tc.target); got != tc.want {
+				t.Errorf("service = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package incident
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-cleanhttp"
+)
+
+// errUnauthorized is returned when Boundary rejects the token.
+var errUnauthorized = errors.New("unauthorized")
+
+// boundaryTarget is the subset of a Boundary target used by ATC.
+type boundaryTarget struct {
+	ID          string         `json:"id,omitempty"`
+	ScopeID     string         `json:"scope_id,omitempty"`
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Type        string         `json:"type,omitempty"`
+	Address     string         `json:"address,omitempty"`
+	Version     uint32         `json:"version,omitempty"`
+	CreatedTime time.Time      `json:"created_time,omitzero"`
+	Attributes  map[string]any `json:"attributes,omitempty"`
+	// SessionMaxSeconds bounds the sessions of the target.
+	SessionMaxSeconds uint32 `json:"session_max_seconds,omitempty"`
+}
+
+// boundaryRole is the subset of a Boundary role used by ATC.
+type boundaryRole struct {
+	ID           string    `json:"id,omitempty"`
+	ScopeID      string    `json:"scope_id,omitempty"`
+	Name         string    `json:"name"`
+	Description  string    `json:"description,omitempty"`
+	Version      uint32    `json:"version,omitempty"`
+	CreatedTime  time.Time `json:"created_time,omitzero"`
+	PrincipalIDs []string  `json:"principal_ids,omitempty"`
+	GrantStrings []string  `json:"grant_strings,omitempty"`
+}
+
+// boundaryClient is a minimal client of the Boundary controller API.
+type boundaryClient struct {
+	cfg    BoundaryConfig
+	client *http.Client
+
+	mtx   sync.Mutex
+	token string
+}
+
+func newBoundaryClient(cfg BoundaryConfig) *boundaryClient {
+	client := cleanhttp.DefaultPooledClient()
+	client.Timeout = 30 * time.Second
+	return &boundaryClient{cfg: cfg, client: client, token: cfg.Token.String()}
+}
+
+// do sends a request to Boundary, authenticating with the auth method first
+// when there is no token or the token expired.
+func (c *boundaryClient) do(ctx context.Context, method, path string, in, out any) error {
+	err := c.request(ctx, method, path, in, out)
+	if errors.Is(err, errUnauthorized) && c.cfg.AuthMethodID != "" {
+		if err := c.authenticate(ctx); err != nil {
+			return err
+		}
+		err = c.request(ctx, method, path, in, out)
+	}
+	return err
+}
+
+func (c *boundaryClient) request(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		buf, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(buf)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(c.cfg.Address, "/")+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	c.mtx.Lock()
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	c.mtx.Unlock()
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return errUnauthorized
+	}
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("boundary returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// authenticate logs in with the password auth method.
+func (c *boundaryClient) authenticate(ctx context.Context) error {
+	c.mtx.Lock()
+	c.token = ""
+	c.mtx.Unlock()
+
+	var resp struct {
+		Attributes struct {
+			Token string `json:"token"`
+		} `json:"attributes"`
+	}
+	err := c.request(ctx, http.MethodPost, "/v1/auth-methods/"+url.PathEscape(c.cfg.AuthMethodID)+":authenticate", map[string]any{
+		"attributes": map[string]string{
+			"login_name": c.cfg.LoginName,
+			"password":   c.cfg.Password.String(),
+		},
+	}, &resp)
+	if err != nil {
+		return fmt.Errorf("failed to authenticate to boundary: %w", err)
+	}
+
+	c.mtx.Lock()
+	c.token = resp.Attributes.Token
+	c.mtx.Unlock()
+	return nil
+}
+
+func (c *boundaryClient) listTargets(ctx context.Context) ([]boundaryTarget, error) {
+	var resp struct {
+		Items []boundaryTarget `json:"items"`
+	}
+	err := c.do(ctx, http.MethodGet, "/v1/targets?scope_id="+url.QueryEscape(c.cfg.ScopeID), nil, &resp)
+	return resp.Items, err
+}
+
+func (c *boundaryClient) createTarget(ctx context.Context, target boundaryTarget) (boundaryTarget, error) {
+	target.ScopeID = c.cfg.ScopeID
+	var created boundaryTarget
+	err := c.do(ctx, http.MethodPost, "/v1/targets", target, &created)
+	return created, err
+}
+
+func (c *boundaryClient) deleteTarget(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/v1/targets/"+url.PathEscape(id), nil, nil)
+}
+
+func (c *boundaryClient) listRoles(ctx context.Context) ([]boundaryRole, error) {
+	var resp struct {
+		Items []boundaryRole `json:"items"`
+	}
+	err := c.do(ctx, http.MethodGet, "/v1/roles?scope_id="+url.QueryEscape(c.cfg.ScopeID), nil, &resp)
+	return resp.Items, err
+}
+
+// createRole creates a role of the principals with the grants.
+func (c *boundaryClient) createRole(ctx context.Context, role boundaryRole, principals, grants []string) (boundaryRole, error) {
+	role.ScopeID = c.cfg.ScopeID
+	var created boundaryRole
+	if err := c.do(ctx, http.MethodPost, "/v1/roles", role, &created); err != nil {
+		return created, err
+	}
+	if err := c.do(ctx, http.MethodPost, "/v1/roles/"+url.PathEscape(created.ID)+":add-principals", map[string]any{
+		"version":       created.Version,
+		"principal_ids": principals,
+	}, &created); err != nil {
+		return created, err
+	}
+	err := c.do(ctx, http.MethodPost, "/v1/roles/"+url.PathEscape(created.ID)+":add-grants", map[string]any{
+		"version":       created.Version,
+		"grant_strings": grants,
+	}, &created)
+	return created, err
+}
+
+func (c *boundaryClient) deleteRole(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/v1/roles/"+url.PathEscape(id), nil, nil)
+}
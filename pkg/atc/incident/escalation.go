@@ -0,0 +1,140 @@
+package incident
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log/level"
+)
+
+// EscalationStep notifies notifiers once an incident is unacknowledged for
+// After since it opened.
+type EscalationStep struct {
+	After  time.Duration `yaml:"after"`
+	Notify []string      `yaml:"notify"`
+}
+
+// escalation is the notification state of an incident.
+type escalation struct {
+	// Step is the number of escalation steps taken.
+	Step int `json:"step"`
+	// Notified maps the notifiers of the steps taken to the step they were
+	// first notified in.
+	Notified map[string]int `json:"notified"`
+	// Sent maps the notifiers to the status they were last told about.
+	Sent map[string]string `json:"sent"`
+}
+
+// steps returns the escalation steps, which default to notifying every
+// notifier as soon as an incident opens.
+func (cfg *Config) steps() []EscalationStep {
+	if len(cfg.Escalation) > 0 || len(cfg.Notifiers) == 0 {
+		return cfg.Escalation
+	}
+	step := EscalationStep{}
+	for _, n := range cfg.Notifiers {
+		step.Notify = append(step.Notify, n.name())
+	}
+	return []EscalationStep{step}
+}
+
+// notifyLoop sends the notifications of the incidents while this replica is
+// the leader, until the context is done.
+func (f *Incident) notifyLoop(ctx context.Context) {
+	ticker := time.NewTicker(evaluationInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-f.changes:
+		case <-ticker.C:
+		}
+
+		if f.Leading() {
+			f.escalate(ctx, time.Now())
+		}
+	}
+}
+
+// escalate takes the escalation steps that are due for the unacknowledged
+// incidents, and tells every notified notifier about the status changes of
+// its incidents. Failed notifications are sent again on the next run.
+func (f *Incident) escalate(ctx context.Context, now time.Time) {
+	seen := map[string]struct{}{}
+	for _, rec := range append(f.Open(), f.Recent()...) {
+		seen[rec.ID] = struct{}{}
+
+		f.mtx.Lock()
+		esc, ok := f.escalations[rec.ID]
+		if !ok {
+			if rec.Resolved != nil {
+				// Resolved before it was escalated.
+				f.mtx.Unlock()
+				continue
+			}
+			esc = &escalation{Notified: map[string]int{}, Sent: map[string]string{}}
+			f.escalations[rec.ID] = esc
+		}
+
+		for esc.Step < len(f.steps) && rec.Acknowledged == nil && rec.Resolved == nil && now.Sub(rec.Opened) >= f.steps[esc.Step].After {
+			step := f.steps[esc.Step]
+			for _, name := range step.Notify {
+				if _, ok := esc.Notified[name]; !ok {
+					esc.Notified[name] = esc.Step
+				}
+			}
+			if esc.Step > 0 {
+				f.annotate(rec.ID, EventEscalated, "escalated to %s after %s unacknowledged", strings.Join(step.Notify, ", "), step.After)
+				level.Info(f.logger).Log("msg", "escalated incident", "incident", rec.ID, "step", esc.Step, "notify", strings.Join(step.Notify, ","))
+			}
+			esc.Step++
+		}
+
+		// Notifications are sent without holding the mutex.
+		due := map[string]notification{}
+		for name, step := range esc.Notified {
+			if esc.Sent[name] != rec.Status {
+				due[name] = notification{Incident: rec, Step: step, First: esc.Sent[name] == "", ExternalURL: f.incidentURL(rec.ID)}
+			}
+		}
+		f.mtx.Unlock()
+
+		for name, msg := range due {
+			if err := f.notifiers[name].send(ctx, msg); err != nil {
+				level.Warn(f.logger).Log("msg", "failed to notify, retrying", "incident", rec.ID, "notifier", name, "err", err)
+				f.notificationsTotal.WithLabelValues(name, "failed").Inc()
+				continue
+			}
+			f.notificationsTotal.WithLabelValues(name, "sent").Inc()
+
+			f.mtx.Lock()
+			if msg.First {
+				f.annotate(rec.ID, EventNotified, "notified %s", name)
+			}
+			esc.Sent[name] = rec.Status
+			f.mtx.Unlock()
+		}
+	}
+
+	f.mtx.Lock()
+	for id := range f.escalations {
+		if _, ok := seen[id]; !ok {
+			delete(f.escalations, id)
+		}
+	}
+	f.mtx.Unlock()
+	f.sync(ctx)
+}
+
+// incidentURL links to an incident through the external URL of ATC.
+func (f *Incident) incidentURL(id string) string {
+	if f.cfg.ExternalURL == "" {
+		return ""
+	}
+	return strings.TrimRight(f.cfg.ExternalURL, "/") + "/v1/incidents/" + url.PathEscape(id)
+}
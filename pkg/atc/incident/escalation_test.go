@@ -0,0 +1,117 @@
+package incident
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/flagext"
+	"github.com/hashicorp/consul/api"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/attachmentgenie/atc/pkg/atc/leader"
+)
+
+// receiver records the events of the webhook notifications by path.
+type receiver struct {
+	mtx    sync.Mutex
+	events map[string][]string
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var payload webhookPayload
+	if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.events[req.URL.Path] = append(r.events[req.URL.Path], payload.Event)
+}
+
+func (r *receiver) received(path string) []string {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.events[path]
+}
+
+func TestEscalate(t *testing.T) {
+	recv := &receiver{events: map[string][]string{}}
+	srv := httptest.NewServer(recv)
+	defer srv.Close()
+
+	elector, err := leader.New(leader.Config{}, nil, log.NewNopLogger(), prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cfg Config
+	cfg.RegisterFlags(flag.NewFlagSet("test", flag.PanicOnError))
+	cfg.OpenAfter = 0
+	cfg.Notifiers = []NotifierConfig{
+		{Name: "chat", Type: NotifierWebhook, URL: flagext.SecretWithValue(srv.URL + "/chat")},
+		{Name: "pager", Type: NotifierWebhook, URL: flagext.SecretWithValue(srv.URL + "/pager")},
+	}
+	cfg.Escalation = []EscalationStep{
+		{Notify: []string{"chat"}},
+		{After: 10 * time.Minute, Notify: []string{"chat", "pager"}},
+	}
+	f, err := New(cfg, nil, elector, nil, log.NewNopLogger(), prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	now := time.Now()
+
+	f.evaluate(snapshot(api.HealthCritical), now)
+	id := f.Open()[0].ID
+	f.escalate(ctx, now)
+	f.escalate(ctx, now.Add(time.Minute))
+	if got := recv.received("/chat"); len(got) != 1 || got[0] != EventOpened {
+		t.Fatalf("chat received %v, want [opened]", got)
+	}
+	if got := recv.received("/pager"); len(got) != 0 {
+		t.Fatalf("pager received %v before the second step", got)
+	}
+
+	// The second step only notifies the notifiers that were not notified
+	// before.
+	f.escalate(ctx, now.Add(10*time.Minute))
+	if got := recv.received("/pager"); len(got) != 1 || got[0] != EventEscalated {
+		t.Fatalf("pager received %v, want [escalated]", got)
+	}
+	if got := recv.received("/chat"); len(got) != 1 {
+		t.Fatalf("chat received %v, want [opened]", got)
+	}
+
+	// Every notified notifier is told about the acknowledgement.
+	if _, err := f.Acknowledge(ctx, id, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	f.escalate(ctx, now.Add(11*time.Minute))
+	for _, path := range []string{"/chat", "/pager"} {
+		got := recv.received(path)
+		if got[len(got)-1] != StatusAcknowledged {
+			t.Errorf("%s received %v, want acknowledged last", path, got)
+		}
+	}
+
+	rec, _ := f.Get(id)
+	var escalated, notified int
+	for _, e := range rec.Events {
+		switch e.Type {
+		case EventEscalated:
+			escalated++
+		case EventNotified:
+			notified++
+		}
+	}
+	if escalated != 1 || notified != 2 {
+		t.Errorf("escalated %d and notified %d times on the timeline, want 1 and 2", escalated, notified)
+	}
+}
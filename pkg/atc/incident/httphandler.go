@@ -0,0 +1,82 @@
+package incident
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// IncidentsHandler lists the open and the recently resolved incidents as
+// JSON.
+func (f *Incident) IncidentsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, struct {
+			Open   []Record `json:"open"`
+			Recent []Record `json:"recent"`
+		}{
+			Open:   f.Open(),
+			Recent: f.Recent(),
+		})
+	}
+}
+
+// IncidentHandler returns a single incident as JSON.
+func (f *Incident) IncidentHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rec, err := f.Get(mux.Vars(r)["id"])
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, rec)
+	}
+}
+
+// AcknowledgeHandler acknowledges an incident on behalf of the responder in
+// the by query parameter or the by field of a JSON body. Acknowledged
+// incidents are not escalated further.
+func (f *Incident) AcknowledgeHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		by := r.URL.Query().Get("by")
+		if by == "" && r.ContentLength != 0 {
+			var body struct {
+				By string `json:"by"`
+			}
+			if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&body); err != nil {
+				http.Error(w, "invalid acknowledgement: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			by = body.By
+		}
+		if by == "" {
+			by = "anonymous"
+		}
+
+		rec, err := f.Acknowledge(r.Context(), mux.Vars(r)["id"], by)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, rec)
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrResolved):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -2,22 +2,172 @@ package incident
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
 	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
 	"github.com/grafana/dskit/services"
 	"github.com/hashicorp/consul/api"
-	"github.com/hashicorp/consul/api/watch"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/attachmentgenie/atc/pkg/atc/configentry"
+	"github.com/attachmentgenie/atc/pkg/atc/leader"
+	"github.com/attachmentgenie/atc/pkg/atc/watcher"
 )
 
+// evaluationInterval is how often incidents are evaluated in absence of new
+// snapshots, so they open and resolve once their delays passed.
+const evaluationInterval = 5 * time.Second
+
+// mitigators are the modules whose service-resolvers mitigate an outage.
+var mitigators = []string{"forwarder", "redirecter"}
+
+var (
+	// ErrNotFound is returned for an incident that does not exist or is no
+	// longer retained.
+	ErrNotFound = errors.New("incident not found")
+	// ErrResolved is returned when a resolved incident would be acknowledged.
+	ErrResolved = errors.New("incident is resolved")
+)
+
+type Config struct {
+	CriticalThreshold int           `yaml:"critical_threshold"`
+	CriticalRatio     float64       `yaml:"critical_ratio"`
+	OpenAfter         time.Duration `yaml:"open_after"`
+	ResolveAfter      time.Duration `yaml:"resolve_after"`
+	Retention         time.Duration `yaml:"retention"`
+	ExternalURL       string        `yaml:"external_url"`
+
+	Notifiers  []NotifierConfig `yaml:"notifiers"`
+	Escalation []EscalationStep `yaml:"escalation"`
+}
+
+func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	f.IntVar(&cfg.CriticalThreshold, "incident.critical-threshold", 1, "Number of critical instances at which an incident is opened for a service. 0 disables the threshold.")
+	f.Float64Var(&cfg.CriticalRatio, "incident.critical-ratio", 0, "Fraction of critical instances, between 0 and 1, at which an incident is opened for a service. 0 disables the ratio.")
+	f.DurationVar(&cfg.OpenAfter, "incident.open-after", 30*time.Second, "How long a service has to stay critical before an incident is opened.")
+	f.DurationVar(&cfg.ResolveAfter, "incident.resolve-after", 5*time.Minute, "How long a service has to stay below the threshold before its incident is resolved. A service that goes critical again within this time continues the same incident.")
+	f.DurationVar(&cfg.Retention, "incident.retention", 24*time.Hour, "How long resolved incidents are kept.")
+	f.StringVar(&cfg.ExternalURL, "incident.external-url", "", "URL ATC is reachable on, used to link to incidents from notifications.")
+}
+
+func (cfg *Config) Validate() error {
+	if cfg.CriticalThreshold < 0 {
+		return fmt.Errorf("invalid incident critical threshold: %d", cfg.CriticalThreshold)
+	}
+	if cfg.CriticalRatio < 0 || cfg.CriticalRatio > 1 {
+		return fmt.Errorf("invalid incident critical ratio: %g", cfg.CriticalRatio)
+	}
+	if cfg.CriticalThreshold == 0 && cfg.CriticalRatio == 0 {
+		return fmt.Errorf("either the incident critical threshold or ratio must be set")
+	}
+	if cfg.OpenAfter < 0 {
+		return fmt.Errorf("invalid incident open after: %s", cfg.OpenAfter)
+	}
+	if cfg.ResolveAfter < 0 {
+		return fmt.Errorf("invalid incident resolve after: %s", cfg.ResolveAfter)
+	}
+	if cfg.Retention <= 0 {
+		return fmt.Errorf("invalid incident retention: %s", cfg.Retention)
+	}
+	if cfg.ExternalURL != "" {
+		if u, err := url.Parse(cfg.ExternalURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid incident external url %q", cfg.ExternalURL)
+		}
+	}
+
+	names := map[string]struct{}{}
+	for i, n := range cfg.Notifiers {
+		if err := n.Validate(); err != nil {
+			return fmt.Errorf("invalid incident notifier %d: %w", i, err)
+		}
+		if _, ok := names[n.name()]; ok {
+			return fmt.Errorf("duplicate incident notifier name %q", n.name())
+		}
+		names[n.name()] = struct{}{}
+	}
+	for i, step := range cfg.Escalation {
+		if step.After < 0 || (i > 0 && step.After < cfg.Escalation[i-1].After) {
+			return fmt.Errorf("invalid incident escalation step %d: after must not be negative or before the previous step", i)
+		}
+		if len(step.Notify) == 0 {
+			return fmt.Errorf("invalid incident escalation step %d: no notifiers", i)
+		}
+		for _, name := range step.Notify {
+			if _, ok := names[name]; !ok {
+				return fmt.Errorf("invalid incident escalation step %d: unknown notifier %q", i, name)
+			}
+		}
+	}
+	return nil
+}
+
+// Incident opens, continues and resolves incidents from the health of the
+// services. Only the leader evaluates incidents when leader election is
+// enabled. It keeps them, along with their escalation, in Consul KV next to
+// the leader lock, where followers serve them from and acknowledge them, and
+// where a new leader continues them.
 type Incident struct {
 	services.Service
 
+	cfg    Config
+	writer *configentry.Writer
 	logger log.Logger
 
-	watchServicesChan chan struct{}
+	mtx sync.Mutex
+	// open holds the unresolved incidents by service, recent the resolved
+	// ones that are retained.
+	open   map[string]*Record
+	recent []*Record
+	// pending holds since when services crossed the threshold without an
+	// incident being opened yet.
+	pending map[string]time.Time
+
+	subscribers []chan struct{}
+	snapshots   <-chan *watcher.Snapshot
+
+	// escalations holds the notification state of the incidents by ID.
+	escalations map[string]*escalation
+	// notifiers and steps are only used by the notification loop.
+	notifiers map[string]*notifier
+	steps     []EscalationStep
+	changes   <-chan struct{}
+
+	// shared is set when the incidents are kept in Consul KV. states and
+	// values hold the keys of the incidents by ID, and the values last
+	// loaded or stored. leading is set once this replica loaded the
+	// incidents as leader.
+	shared  bool
+	leading bool
+	states  map[string]*leader.SharedState
+	values  map[string][]byte
+	// syncMtx serializes the writes to Consul KV, which are made without
+	// the mutex held.
+	syncMtx sync.Mutex
+	// started is when this replica started evaluating incidents.
+	started time.Time
+
+	elector    *leader.Elector
+	leadership <-chan struct{}
+
+	openIncidents prometheus.Gauge
+	openedTotal   *prometheus.CounterVec
+	flapsTotal    *prometheus.CounterVec
+
+	notificationsTotal *prometheus.CounterVec
 }
 
 func (f *Incident) starting(ctx context.Context) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.started = time.Now()
 	return nil
 }
 
@@ -25,69 +175,437 @@ func (f *Incident) stopping(_ error) error {
 	return nil
 }
 
-func New(logger log.Logger) (*Incident, error) {
+func New(cfg Config, writer *configentry.Writer, elector *leader.Elector, snapshots <-chan *watcher.Snapshot, logger log.Logger, reg prometheus.Registerer) (*Incident, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
 
 	f := &Incident{
-		logger: logger,
+		cfg:       cfg,
+		writer:    writer,
+		logger:    log.With(logger, "module", "incident"),
+		open:      map[string]*Record{},
+		pending:   map[string]time.Time{},
+		snapshots: snapshots,
+
+		notifiers:   map[string]*notifier{},
+		steps:       cfg.steps(),
+		escalations: map[string]*escalation{},
+		shared:      elector.SharedState(incidentsKey) != nil,
+		states:      map[string]*leader.SharedState{},
+		values:      map[string][]byte{},
+		elector:     elector,
+		leadership:  elector.Subscribe(),
+
+		openIncidents: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "atc_incident_open_incidents",
+			Help: "Number of incidents that are not resolved.",
+		}),
+		openedTotal: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "atc_incident_opened_total",
+			Help: "Total number of incidents opened, by service.",
+		}, []string{"service"}),
+		flapsTotal: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "atc_incident_flaps_total",
+			Help: "Total number of times a service went critical again during an incident, by service.",
+		}, []string{"service"}),
+		notificationsTotal: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "atc_incident_notifications_total",
+			Help: "Total number of incident notifications, by notifier and result.",
+		}, []string{"notifier", "result"}),
 	}
-	f.Service = services.NewBasicService(f.starting, f.watcher, f.stopping)
+	for _, n := range cfg.Notifiers {
+		f.notifiers[n.name()] = newNotifier(n)
+	}
+	if len(f.notifiers) > 0 {
+		f.changes = f.Subscribe()
+	}
+	f.Service = services.NewBasicService(f.starting, f.running, f.stopping)
 	return f, nil
 }
 
-func (f *Incident) watcher(ctx context.Context) error {
-	client, err := api.NewClient(&api.Config{})
-	if err != nil {
-		return fmt.Errorf("failed to connect to consul: %s", err.Error())
-	}
+func (f *Incident) running(ctx context.Context) error {
+	ticker := time.NewTicker(evaluationInterval)
+	defer ticker.Stop()
+
+	if len(f.notifiers) > 0 {
+		var wg sync.WaitGroup
+		defer wg.Wait()
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
 
-	servicesWatcher, parseErr := watch.Parse(map[string]interface{}{"type": "services"})
-	if parseErr != nil {
-		return fmt.Errorf("failed to create services watcher plan: %s", parseErr.Error())
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f.notifyLoop(ctx)
+		}()
 	}
 
-	servicesWatcher.HybridHandler = func(_ watch.BlockingParamVal, _ interface{}) {
+	var snapshot *watcher.Snapshot
+	for {
 		select {
 		case <-ctx.Done():
-		case f.watchServicesChan <- struct{}{}:
+			return nil
+
+		case snapshot = <-f.snapshots:
+		case <-f.leadership:
+		case <-ticker.C:
+		}
+
+		if f.shared && !f.lead(ctx) {
+			continue
+		}
+
+		if snapshot == nil {
+			continue
+		}
+		f.evaluate(snapshot, time.Now())
+		f.mitigate(time.Now())
+		f.sync(ctx)
+	}
+}
+
+// lead loads the incidents from Consul KV until this replica is the leader
+// and loaded them once as leader, so followers serve the incidents of the
+// leader and a new leader continues them. It reports whether this replica
+// leads.
+func (f *Incident) lead(ctx context.Context) bool {
+	isLeader := f.elector.IsLeader()
+	if isLeader && f.Leading() {
+		return true
+	}
+
+	f.mtx.Lock()
+	f.leading = false
+	f.mtx.Unlock()
+	if err := f.load(ctx); err != nil {
+		level.Error(f.logger).Log("msg", "failed to load incidents", "err", err)
+		return false
+	}
+	if isLeader {
+		level.Info(f.logger).Log("msg", "continuing the incidents of the previous leader", "open", len(f.Open()))
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.leading = isLeader
+	return isLeader
+}
+
+// Leading reports whether this replica evaluates the incidents. Followers
+// serve the incidents of the leader, as does a new leader until it loaded
+// them.
+func (f *Incident) Leading() bool {
+	if !f.shared {
+		return f.elector.IsLeader()
+	}
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.leading && f.elector.IsLeader()
+}
+
+// Settled reports whether this replica leads and knows every incident of an
+// ongoing outage: it continued the incidents of the previous leader from
+// Consul KV, or it evaluated incidents for at least open-after so none of
+// them is still pending.
+func (f *Incident) Settled(now time.Time) bool {
+	if !f.Leading() {
+		return false
+	}
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.shared || (!f.started.IsZero() && now.Sub(f.started) >= f.cfg.OpenAfter)
+}
+
+// crossed reports whether a service is critical enough for an incident.
+func (f *Incident) crossed(h watcher.Health) bool {
+	if f.cfg.CriticalThreshold > 0 && h.Critical >= f.cfg.CriticalThreshold {
+		return true
+	}
+	return f.cfg.CriticalRatio > 0 && h.Total() > 0 && float64(h.Critical)/float64(h.Total()) >= f.cfg.CriticalRatio
+}
+
+// evaluate opens, continues and resolves the incidents of the services in a
+// snapshot. Services that recover and go critical again within the resolve
+// delay continue their incident, so a flapping check produces one incident.
+func (f *Incident) evaluate(snapshot *watcher.Snapshot, now time.Time) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	names := map[string]struct{}{}
+	for name := range snapshot.Instances {
+		names[name] = struct{}{}
+	}
+	for name := range f.open {
+		names[name] = struct{}{}
+	}
+	for name := range f.pending {
+		names[name] = struct{}{}
+	}
+
+	changed := false
+	for name := range names {
+		h := snapshot.Health(name)
+		crossed := f.crossed(h)
+
+		rec := f.open[name]
+		switch {
+		case rec != nil && crossed:
+			if !rec.clearSince.IsZero() {
+				rec.clearSince = time.Time{}
+				rec.Flaps++
+				changed = true
+				rec.event(now, EventRecurred, "%d of %d instances are critical again", h.Critical, h.Total())
+				f.flapsTotal.WithLabelValues(name).Inc()
+				level.Info(f.logger).Log("msg", "service went critical again during incident", "incident", rec.ID, "service", name)
+			}
+			if rec.update(h, snapshot.Instances[name]) {
+				changed = true
+			}
+
+		case rec != nil:
+			rec.update(h, snapshot.Instances[name])
+			if rec.clearSince.IsZero() {
+				rec.clearSince = now
+			}
+			if now.Sub(rec.clearSince) >= f.cfg.ResolveAfter {
+				f.resolve(rec, now)
+				changed = true
+			}
+
+		case crossed:
+			since, ok := f.pending[name]
+			if !ok {
+				since = now
+				f.pending[name] = now
+			}
+			if now.Sub(since) < f.cfg.OpenAfter {
+				continue
+			}
+			delete(f.pending, name)
+
+			rec = newRecord(name, now)
+			rec.update(h, snapshot.Instances[name])
+			changed = true
+			rec.event(now, EventOpened, "%d of %d instances are critical", h.Critical, h.Total())
+			f.open[name] = rec
+			f.openedTotal.WithLabelValues(name).Inc()
+			level.Warn(f.logger).Log("msg", "opened incident", "incident", rec.ID, "service", name, "critical", h.Critical, "total", h.Total())
+
 		default:
-			// Event chan is full, discard event.
+			delete(f.pending, name)
 		}
 	}
 
-	checksWatcher, err := watch.Parse(map[string]interface{}{"type": "checks"})
-	if err != nil {
-		return fmt.Errorf("failed to create checks watcher plan: %w", err)
+	f.prune(now)
+	f.openIncidents.Set(float64(len(f.open)))
+	if changed {
+		f.notify()
+	}
+}
+
+func (f *Incident) resolve(rec *Record, now time.Time) {
+	rec.Resolved = &now
+	rec.event(now, EventResolved, "service stayed below the threshold for %s", f.cfg.ResolveAfter)
+	delete(f.open, rec.Service)
+	f.recent = append(f.recent, rec)
+	level.Info(f.logger).Log("msg", "resolved incident", "incident", rec.ID, "service", rec.Service, "duration", now.Sub(rec.Opened))
+}
+
+// prune forgets the resolved incidents that are past their retention.
+func (f *Incident) prune(now time.Time) {
+	i := 0
+	for i < len(f.recent) && now.Sub(*f.recent[i].Resolved) > f.cfg.Retention {
+		i++
 	}
+	f.recent = f.recent[i:]
+}
 
-	checksWatcher.HybridHandler = func(_ watch.BlockingParamVal, _ interface{}) {
+// mitigate marks the open incidents of services that the forwarder or the
+// redirecter wrote a service-resolver for as mitigated. The resolvers are
+// read from Consul, so every replica sees the mitigations of the leader.
+func (f *Incident) mitigate(now time.Time) {
+	f.mtx.Lock()
+	unmitigated := 0
+	for _, rec := range f.open {
+		if rec.Mitigated == nil {
+			unmitigated++
+		}
+	}
+	f.mtx.Unlock()
+	if unmitigated == 0 {
+		return
+	}
+
+	mitigatedBy := map[string]string{}
+	for _, module := range mitigators {
+		owned, err := f.writer.Owned(module, api.ServiceResolver)
+		if err != nil {
+			level.Error(f.logger).Log("msg", "failed to list mitigating service-resolvers", "module", module, "err", err)
+			return
+		}
+		for _, entry := range owned {
+			mitigatedBy[entry.GetName()] = module
+		}
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	for name, rec := range f.open {
+		module, ok := mitigatedBy[name]
+		if !ok || rec.Mitigated != nil {
+			continue
+		}
+		rec.Mitigated, rec.MitigatedBy = &now, module
+		rec.event(now, EventMitigated, "the %s wrote a service-resolver for %s", module, name)
+		level.Info(f.logger).Log("msg", "incident mitigated", "incident", rec.ID, "service", name, "by", module)
+		f.notify()
+	}
+}
+
+// Subscribe returns a channel that receives a notification whenever an
+// incident opens, changes or resolves. Subscribe must be called before the
+// module is started.
+func (f *Incident) Subscribe() <-chan struct{} {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	ch := make(chan struct{}, 1)
+	f.subscribers = append(f.subscribers, ch)
+	return ch
+}
+
+// notify wakes up the subscribers. It must be called with the mutex held.
+func (f *Incident) notify() {
+	for _, ch := range f.subscribers {
 		select {
-		case <-ctx.Done():
-		case f.watchServicesChan <- struct{}{}:
+		case ch <- struct{}{}:
 		default:
-			// Event chan is full, discard event.
+			// A notification is already pending.
 		}
 	}
+}
 
-	errChan := make(chan error, 2)
+// Annotate adds an event to the timeline of the open or else the most
+// recent incident of a service.
+func (f *Incident) Annotate(service, typ, msg string, args ...any) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
 
-	defer func() {
-		servicesWatcher.Stop()
-		checksWatcher.Stop()
-	}()
+	rec := f.open[service]
+	for i := len(f.recent) - 1; rec == nil && i >= 0; i-- {
+		if f.recent[i].Service == service {
+			rec = f.recent[i]
+		}
+	}
+	if rec != nil {
+		rec.event(time.Now(), typ, msg, args...)
+	}
+}
 
-	go func() {
-		errChan <- servicesWatcher.RunWithClientAndHclog(client, servicesWatcher.Logger)
-	}()
+// annotate adds an event to the timeline of an incident. It must be called
+// with the mutex held.
+func (f *Incident) annotate(id, typ, msg string, args ...any) {
+	if rec := f.find(id); rec != nil {
+		rec.event(time.Now(), typ, msg, args...)
+	}
+}
+
+// Acknowledge records that someone is handling an incident. Followers
+// acknowledge the incident in Consul KV, for the leader to take over.
+func (f *Incident) Acknowledge(ctx context.Context, id, by string) (Record, error) {
+	if f.shared && !f.Leading() {
+		return f.acknowledgeStored(ctx, id, by)
+	}
 
-	go func() {
-		errChan <- checksWatcher.RunWithClientAndHclog(client, checksWatcher.Logger)
-	}()
+	f.mtx.Lock()
+	rec := f.find(id)
+	if rec == nil {
+		f.mtx.Unlock()
+		return Record{}, ErrNotFound
+	}
+	if rec.Resolved != nil {
+		c := rec.clone()
+		f.mtx.Unlock()
+		return c, ErrResolved
+	}
+	acknowledged := rec.Acknowledged == nil
+	if acknowledged {
+		now := time.Now()
+		rec.Acknowledged, rec.AcknowledgedBy = &now, by
+		rec.event(now, EventAcknowledged, "acknowledged by %s", by)
+		level.Info(f.logger).Log("msg", "incident acknowledged", "incident", rec.ID, "service", rec.Service, "by", by)
+		f.notify()
+	}
+	c := rec.clone()
+	f.mtx.Unlock()
+
+	if acknowledged {
+		f.sync(ctx)
+	}
+	return c, nil
+}
+
+// all returns the open and the recent incidents. It must be called with the
+// mutex held.
+func (f *Incident) all() []*Record {
+	all := make([]*Record, 0, len(f.open)+len(f.recent))
+	for _, rec := range f.open {
+		all = append(all, rec)
+	}
+	return append(all, f.recent...)
+}
+
+func (f *Incident) find(id string) *Record {
+	for _, rec := range f.open {
+		if rec.ID == id {
+			return rec
+		}
+	}
+	for _, rec := range f.recent {
+		if rec.ID == id {
+			return rec
+		}
+	}
+	return nil
+}
+
+// Get returns an open or recent incident.
+func (f *Incident) Get(id string) (Record, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	rec := f.find(id)
+	if rec == nil {
+		return Record{}, ErrNotFound
+	}
+	return rec.clone(), nil
+}
+
+// Open returns the unresolved incidents, oldest first.
+func (f *Incident) Open() []Record {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	open := make([]Record, 0, len(f.open))
+	for _, rec := range f.open {
+		open = append(open, rec.clone())
+	}
+	sort.Slice(open, func(i, j int) bool {
+		return open[i].Opened.Before(open[j].Opened)
+	})
+	return open
+}
 
-	select {
-	case <-ctx.Done():
-		return nil
+// Recent returns the retained resolved incidents, most recently resolved
+// first.
+func (f *Incident) Recent() []Record {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
 
-	case err = <-errChan:
-		return fmt.Errorf("services or checks watcher terminated: %w", err)
+	recent := make([]Record, 0, len(f.recent))
+	for i := len(f.recent) - 1; i >= 0; i-- {
+		recent = append(recent, f.recent[i].clone())
 	}
+	return recent
 }
@@ -0,0 +1,204 @@
+package incident
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/hashicorp/consul/api"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/attachmentgenie/atc/pkg/atc/configentry"
+	"github.com/attachmentgenie/atc/pkg/atc/leader"
+)
+
+// testEvaluator returns a replica without leader election that opens
+// incidents after 30 seconds and resolves them after a minute.
+func testEvaluator(t *testing.T, writer *configentry.Writer) *Incident {
+	t.Helper()
+	elector, err := leader.New(leader.Config{}, nil, log.NewNopLogger(), prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cfg Config
+	cfg.RegisterFlags(flag.NewFlagSet("test", flag.PanicOnError))
+	cfg.OpenAfter = 30 * time.Second
+	cfg.ResolveAfter = time.Minute
+	f, err := New(cfg, writer, elector, nil, log.NewNopLogger(), prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func eventTypes(rec Record) []string {
+	var types []string
+	for _, e := range rec.Events {
+		types = append(types, e.Type)
+	}
+	return types
+}
+
+func TestOpenAfter(t *testing.T) {
+	f := testEvaluator(t, nil)
+	now := time.Now()
+
+	// A service that recovers before open-after passed opens no incident.
+	f.evaluate(snapshot(api.HealthCritical), now)
+	f.evaluate(snapshot(api.HealthPassing), now.Add(20*time.Second))
+	f.evaluate(snapshot(api.HealthCritical), now.Add(40*time.Second))
+	if open := f.Open(); len(open) != 0 {
+		t.Fatalf("open incidents = %+v, want none while pending", open)
+	}
+
+	// The delay starts over when it goes critical again.
+	f.evaluate(snapshot(api.HealthCritical), now.Add(69*time.Second))
+	if open := f.Open(); len(open) != 0 {
+		t.Fatalf("open incidents = %+v, want none before open-after passed", open)
+	}
+	f.evaluate(snapshot(api.HealthCritical), now.Add(70*time.Second))
+	open := f.Open()
+	if len(open) != 1 || open[0].Service != "web" || !open[0].Opened.Equal(now.Add(70*time.Second)) {
+		t.Fatalf("open incidents = %+v, want web opened after 70s", open)
+	}
+	if open[0].Status != StatusOpen || open[0].Critical != 1 || !slices.Equal(eventTypes(open[0]), []string{EventOpened}) {
+		t.Errorf("incident = %+v, want one critical instance", open[0])
+	}
+}
+
+func TestResolveAfter(t *testing.T) {
+	f := testEvaluator(t, nil)
+	f.cfg.OpenAfter = 0
+	now := time.Now()
+
+	f.evaluate(snapshot(api.HealthCritical), now)
+	id := f.Open()[0].ID
+
+	// The service has to stay below the threshold for resolve-after.
+	f.evaluate(snapshot(api.HealthPassing), now.Add(time.Second))
+	f.evaluate(snapshot(api.HealthPassing), now.Add(time.Minute))
+	if len(f.Open()) != 1 {
+		t.Fatal("incident resolved before resolve-after passed")
+	}
+	f.evaluate(snapshot(api.HealthPassing), now.Add(time.Minute+time.Second))
+	if len(f.Open()) != 0 {
+		t.Fatal("incident open after resolve-after passed")
+	}
+	rec, err := f.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Status != StatusResolved || !rec.Resolved.Equal(now.Add(time.Minute+time.Second)) || !slices.Equal(eventTypes(rec), []string{EventOpened, EventResolved}) {
+		t.Errorf("incident = %+v, want it resolved after a minute", rec)
+	}
+
+	// A later outage opens a new incident.
+	f.evaluate(snapshot(api.HealthCritical), now.Add(time.Hour))
+	if open := f.Open(); len(open) != 1 || open[0].ID == id {
+		t.Errorf("open incidents = %+v, want a new incident", open)
+	}
+}
+
+func TestFlapsContinueIncident(t *testing.T) {
+	f := testEvaluator(t, nil)
+	f.cfg.OpenAfter = 0
+	now := time.Now()
+
+	f.evaluate(snapshot(api.HealthCritical), now)
+	for i := 1; i <= 3; i++ {
+		at := now.Add(time.Duration(i) * 40 * time.Second)
+		f.evaluate(snapshot(api.HealthPassing), at)
+		f.evaluate(snapshot(api.HealthCritical), at.Add(20*time.Second))
+	}
+
+	open := f.Open()
+	if len(open) != 1 || len(f.Recent()) != 0 {
+		t.Fatalf("open incidents = %+v, recent = %+v, want one incident", open, f.Recent())
+	}
+	rec := open[0]
+	want := []string{EventOpened, EventRecurred, EventRecurred, EventRecurred}
+	if rec.Flaps != 3 || !slices.Equal(eventTypes(rec), want) {
+		t.Errorf("incident = %+v, want 3 flaps with events %v", rec, want)
+	}
+}
+
+func TestMitigate(t *testing.T) {
+	var lists atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/config/service-resolver" {
+			http.NotFound(w, r)
+			return
+		}
+		lists.Add(1)
+		owned := func(name, module string) *api.ServiceResolverConfigEntry {
+			return &api.ServiceResolverConfigEntry{Kind: api.ServiceResolver, Name: name, Meta: map[string]string{
+				configentry.MetaManagedBy: configentry.ManagedByValue,
+				configentry.MetaModule:    module,
+			}}
+		}
+		_ = json.NewEncoder(w).Encode([]*api.ServiceResolverConfigEntry{
+			owned("web", "forwarder"),
+			owned("api", "redirecter"),
+			owned("db", "autoscaler"),
+			{Kind: api.ServiceResolver, Name: "cache"},
+		})
+	}))
+	defer srv.Close()
+	client, err := api.NewClient(&api.Config{Address: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := testEvaluator(t, configentry.New(client, false, log.NewNopLogger(), prometheus.NewRegistry()))
+	f.cfg.OpenAfter = 0
+	now := time.Now()
+
+	f.evaluate(hostSnapshot(map[string]string{
+		"web":   api.HealthCritical,
+		"api":   api.HealthCritical,
+		"db":    api.HealthCritical,
+		"cache": api.HealthCritical,
+	}), now)
+	f.mitigate(now.Add(time.Second))
+
+	mitigated := map[string]string{}
+	for _, rec := range f.Open() {
+		if rec.Mitigated != nil {
+			mitigated[rec.Service] = rec.MitigatedBy
+			if rec.Status != StatusMitigated || !slices.Equal(eventTypes(rec), []string{EventOpened, EventMitigated}) {
+				t.Errorf("incident = %+v, want it mitigated", rec)
+			}
+		}
+	}
+	if len(mitigated) != 2 || mitigated["web"] != "forwarder" || mitigated["api"] != "redirecter" {
+		t.Errorf("mitigated = %v, want web by the forwarder and api by the redirecter", mitigated)
+	}
+	if n := lists.Load(); n != 2 {
+		t.Errorf("resolvers listed %d times, want once per mitigating module", n)
+	}
+
+	// A mitigated incident is not marked again.
+	f.mitigate(now.Add(2 * time.Second))
+	for _, rec := range f.Open() {
+		if rec.Service == "web" && (!rec.Mitigated.Equal(now.Add(time.Second)) || len(rec.Events) != 2) {
+			t.Errorf("incident = %+v, want it mitigated once", rec)
+		}
+	}
+
+	// Resolvers are not listed when every open incident is mitigated.
+	f.evaluate(hostSnapshot(map[string]string{"web": api.HealthCritical, "api": api.HealthCritical}), now.Add(3*time.Second))
+	f.evaluate(hostSnapshot(map[string]string{"web": api.HealthCritical, "api": api.HealthCritical}), now.Add(2*time.Minute))
+	if open := f.Open(); len(open) != 2 {
+		t.Fatalf("open incidents = %+v, want web and api", open)
+	}
+	lists.Store(0)
+	f.mitigate(now.Add(2 * time.Minute))
+	if n := lists.Load(); n != 0 {
+		t.Errorf("resolvers listed %d times, want none without unmitigated incidents", n)
+	}
+}
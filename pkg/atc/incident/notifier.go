@@ -0,0 +1,352 @@
+package incident
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/grafana/dskit/flagext"
+	"github.com/hashicorp/go-cleanhttp"
+)
+
+// Types of notifiers.
+const (
+	NotifierAlertmanager = "alertmanager"
+	NotifierWebhook      = "webhook"
+	NotifierSlack        = "slack"
+	NotifierPagerDuty    = "pagerduty"
+)
+
+// pagerDutyURL is the PagerDuty Events API v2 endpoint.
+const pagerDutyURL = "https://events.pagerduty.com/v2/enqueue"
+
+// NotifierConfig configures a destination of incident notifications.
+type NotifierConfig struct {
+	// Name is referred to by the escalation steps. Defaults to the type.
+	Name string `yaml:"name"`
+	Type string `yaml:"type"`
+
+	// URL is the webhook to post to, which is a secret as webhooks like
+	// Slack's carry their token in it. PagerDuty defaults to the Events API
+	// v2.
+	URL     flagext.Secret            `yaml:"url"`
+	Headers map[string]flagext.Secret `yaml:"headers"`
+	Timeout time.Duration             `yaml:"timeout"`
+
+	// RoutingKey is the integration key of the PagerDuty service.
+	RoutingKey flagext.Secret `yaml:"routing_key"`
+}
+
+// validNotifierName matches the names escalation steps can refer to.
+var validNotifierName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+func (cfg NotifierConfig) Validate() error {
+	if !validNotifierName.MatchString(cfg.name()) {
+		return fmt.Errorf("invalid name %q", cfg.name())
+	}
+	switch cfg.Type {
+	case NotifierAlertmanager, NotifierWebhook, NotifierSlack:
+		if cfg.URL.String() == "" {
+			return fmt.Errorf("url is required")
+		}
+	case NotifierPagerDuty:
+		if cfg.RoutingKey.String() == "" {
+			return fmt.Errorf("routing key is required")
+		}
+	default:
+		return fmt.Errorf("unknown type %q", cfg.Type)
+	}
+	if cfg.URL.String() != "" {
+		u, err := url.Parse(cfg.URL.String())
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid url, must be an http or https url")
+		}
+	}
+	if cfg.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	}
+	return nil
+}
+
+func (cfg NotifierConfig) name() string {
+	if cfg.Name == "" {
+		return cfg.Type
+	}
+	return cfg.Name
+}
+
+// notification is the state of an incident a notifier is told about.
+type notification struct {
+	Incident Record
+	// Step is the escalation step the notifier was first notified in.
+	Step int
+	// First is set on the first notification of the notifier about the
+	// incident.
+	First bool
+	// ExternalURL links to the incident, when the external URL of ATC is
+	// configured.
+	ExternalURL string
+}
+
+// title summarises the state of the incident.
+func (n notification) title() string {
+	if n.First {
+		title := fmt.Sprintf("Incident %s %s: %s is critical", n.Incident.ID, n.event(), n.Incident.Service)
+		if n.Incident.Status == StatusMitigated {
+			title += ", mitigated by the " + n.Incident.MitigatedBy
+		}
+		return title
+	}
+
+	switch n.Incident.Status {
+	case StatusAcknowledged:
+		return fmt.Sprintf("Incident %s acknowledged by %s", n.Incident.ID, n.Incident.AcknowledgedBy)
+	case StatusMitigated:
+		return fmt.Sprintf("Incident %s mitigated by the %s", n.Incident.ID, n.Incident.MitigatedBy)
+	case StatusResolved:
+		return fmt.Sprintf("Incident %s resolved", n.Incident.ID)
+	}
+	return fmt.Sprintf("Incident %s: %s is critical", n.Incident.ID, n.Incident.Service)
+}
+
+// event is what the notification tells the notifier: that the incident
+// opened or escalated to it, or the status the incident changed to.
+func (n notification) event() string {
+	switch {
+	case n.First && n.Step > 0:
+		return EventEscalated
+	case n.First:
+		return EventOpened
+	}
+	return n.Incident.Status
+}
+
+func (n notification) description() string {
+	return fmt.Sprintf("%d of %d instances of %s are critical, at most %d since %s.",
+		n.Incident.Critical, n.Incident.Total, n.Incident.Service, n.Incident.PeakCritical, n.Incident.Opened.Format(time.RFC3339))
+}
+
+// notifier sends notifications in the payload of its type.
+type notifier struct {
+	cfg    NotifierConfig
+	client *http.Client
+}
+
+func newNotifier(cfg NotifierConfig) *notifier {
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	client := cleanhttp.DefaultPooledClient()
+	client.Timeout = timeout
+	return &notifier{cfg: cfg, client: client}
+}
+
+func (n *notifier) send(ctx context.Context, msg notification) error {
+	var payload any
+	switch n.cfg.Type {
+	case NotifierAlertmanager:
+		payload = alertmanagerPayload(msg)
+	case NotifierSlack:
+		payload = slackPayload(msg)
+	case NotifierPagerDuty:
+		event, ok := n.pagerDutyEvent(msg)
+		if !ok {
+			return nil
+		}
+		payload = event
+	default:
+		payload = webhookPayload{Event: msg.event(), Step: msg.Step, URL: msg.ExternalURL, Incident: msg.Incident}
+	}
+	return n.post(ctx, payload)
+}
+
+func (n *notifier) post(ctx context.Context, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	address := n.cfg.URL.String()
+	if address == "" && n.cfg.Type == NotifierPagerDuty {
+		address = pagerDutyURL
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, address, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range n.cfg.Headers {
+		req.Header.Set(k, v.String())
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		// The error of the client carries the URL, which is a secret.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return fmt.Errorf("failed to post to notifier: %w", urlErr.Err)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("notifier returned %s", resp.Status)
+	}
+	return nil
+}
+
+// webhookPayload is the payload of the generic webhook.
+type webhookPayload struct {
+	Event    string `json:"event"`
+	Step     int    `json:"step"`
+	URL      string `json:"url,omitempty"`
+	Incident Record `json:"incident"`
+}
+
+// The payload Alertmanager posts to webhook receivers, version 4, with the
+// incident as a single alert.
+type (
+	alertmanagerMessage struct {
+		Version           string              `json:"version"`
+		GroupKey          string              `json:"groupKey"`
+		TruncatedAlerts   int                 `json:"truncatedAlerts"`
+		Status            string              `json:"status"`
+		Receiver          string              `json:"receiver"`
+		GroupLabels       map[string]string   `json:"groupLabels"`
+		CommonLabels      map[string]string   `json:"commonLabels"`
+		CommonAnnotations map[string]string   `json:"commonAnnotations"`
+		ExternalURL       string              `json:"externalURL"`
+		Alerts            []alertmanagerAlert `json:"alerts"`
+	}
+	alertmanagerAlert struct {
+		Status       string            `json:"status"`
+		Labels       map[string]string `json:"labels"`
+		Annotations  map[string]string `json:"annotations"`
+		StartsAt     time.Time         `json:"startsAt"`
+		EndsAt       time.Time         `json:"endsAt"`
+		GeneratorURL string            `json:"generatorURL"`
+		Fingerprint  string            `json:"fingerprint"`
+	}
+)
+
+func alertmanagerPayload(msg notification) alertmanagerMessage {
+	status := "firing"
+	var endsAt time.Time
+	if msg.Incident.Resolved != nil {
+		status, endsAt = "resolved", *msg.Incident.Resolved
+	}
+
+	labels := map[string]string{
+		"alertname": "ServiceCritical",
+		"service":   msg.Incident.Service,
+		"incident":  msg.Incident.ID,
+		"severity":  "critical",
+	}
+	annotations := map[string]string{
+		"summary":     msg.title(),
+		"description": msg.description(),
+		"status":      msg.Incident.Status,
+	}
+	return alertmanagerMessage{
+		Version:           "4",
+		GroupKey:          "{}:{incident=\"" + msg.Incident.ID + "\"}",
+		Status:            status,
+		Receiver:          "atc",
+		GroupLabels:       map[string]string{"incident": msg.Incident.ID},
+		CommonLabels:      labels,
+		CommonAnnotations: annotations,
+		ExternalURL:       msg.ExternalURL,
+		Alerts: []alertmanagerAlert{{
+			Status:       status,
+			Labels:       labels,
+			Annotations:  annotations,
+			StartsAt:     msg.Incident.Opened,
+			EndsAt:       endsAt,
+			GeneratorURL: msg.ExternalURL,
+			Fingerprint:  msg.Incident.ID,
+		}},
+	}
+}
+
+// slackMessage is the payload of a Slack incoming webhook.
+type slackMessage struct {
+	Text string `json:"text"`
+}
+
+func slackPayload(msg notification) slackMessage {
+	text := "*" + msg.title() + "*\n" + msg.description()
+	if msg.ExternalURL != "" {
+		text += "\n<" + msg.ExternalURL + "|Details>"
+		if msg.Incident.Status == StatusOpen {
+			text += ", acknowledge with `curl -X POST '" + msg.ExternalURL + "/acknowledge?by=<name>'`"
+		}
+	}
+	return slackMessage{Text: text}
+}
+
+// The PagerDuty Events API v2 payload.
+type (
+	pagerDutyEvent struct {
+		RoutingKey  string            `json:"routing_key"`
+		EventAction string            `json:"event_action"`
+		DedupKey    string            `json:"dedup_key"`
+		Payload     *pagerDutyPayload `json:"payload,omitempty"`
+		Links       []pagerDutyLink   `json:"links,omitempty"`
+	}
+	pagerDutyPayload struct {
+		Summary       string    `json:"summary"`
+		Source        string    `json:"source"`
+		Severity      string    `json:"severity"`
+		Timestamp     time.Time `json:"timestamp"`
+		Component     string    `json:"component"`
+		CustomDetails Record    `json:"custom_details"`
+	}
+	pagerDutyLink struct {
+		Href string `json:"href"`
+		Text string `json:"text"`
+	}
+)
+
+// pagerDutyEvent triggers, acknowledges or resolves the alert of an
+// incident. PagerDuty has no mitigated state, so mitigations of triggered
+// alerts are not sent.
+func (n *notifier) pagerDutyEvent(msg notification) (pagerDutyEvent, bool) {
+	event := pagerDutyEvent{
+		RoutingKey: n.cfg.RoutingKey.String(),
+		DedupKey:   "atc-" + msg.Incident.ID,
+	}
+	switch {
+	case msg.Incident.Status == StatusAcknowledged:
+		event.EventAction = "acknowledge"
+		return event, true
+	case msg.Incident.Status == StatusResolved:
+		event.EventAction = "resolve"
+		return event, true
+	case msg.Incident.Status == StatusMitigated && !msg.First:
+		return event, false
+	}
+
+	event.EventAction = "trigger"
+	event.Payload = &pagerDutyPayload{
+		Summary:       msg.title(),
+		Source:        "atc",
+		Severity:      "critical",
+		Timestamp:     msg.Incident.Opened,
+		Component:     msg.Incident.Service,
+		CustomDetails: msg.Incident,
+	}
+	if msg.ExternalURL != "" {
+		event.Links = []pagerDutyLink{{Href: msg.ExternalURL, Text: "Incident " + msg.Incident.ID}}
+	}
+	return event, true
+}
@@ -0,0 +1,120 @@
+package incident
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/dskit/flagext"
+	"go.yaml.in/yaml/v3"
+)
+
+const testToken = "T000/B000/secret"
+
+func testRecord(status string) Record {
+	opened := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	rec := Record{ID: "web-1", Service: "web", Status: status, Opened: opened, Critical: 2, Total: 3, PeakCritical: 2}
+	later := opened.Add(time.Hour)
+	switch status {
+	case StatusAcknowledged:
+		rec.Acknowledged, rec.AcknowledgedBy = &later, "alice"
+	case StatusMitigated:
+		rec.Mitigated, rec.MitigatedBy = &later, "forwarder"
+	case StatusResolved:
+		rec.Resolved = &later
+	}
+	return rec
+}
+
+func TestNotifierURLIsSecret(t *testing.T) {
+	var cfg NotifierConfig
+	if err := yaml.Unmarshal([]byte("type: slack\nurl: https://hooks.slack.com/services/"+testToken+"\n"), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	out, err := yaml.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(out), testToken) {
+		t.Errorf("marshalled config shows the url: %s", out)
+	}
+
+	cfg.URL = flagext.SecretWithValue("hooks.slack.com/services/" + testToken)
+	if err := cfg.Validate(); err == nil || strings.Contains(err.Error(), testToken) {
+		t.Errorf("invalid url error = %v, want one without the url", err)
+	}
+
+	// A failed post does not show the url either.
+	srv := httptest.NewServer(nil)
+	srv.Close()
+	cfg.URL = flagext.SecretWithValue(srv.URL + "/services/" + testToken)
+	err = newNotifier(cfg).send(context.Background(), notification{Incident: testRecord(StatusOpen), First: true})
+	if err == nil || strings.Contains(err.Error(), testToken) {
+		t.Errorf("post error = %v, want one without the url", err)
+	}
+}
+
+func TestAlertmanagerPayload(t *testing.T) {
+	msg := alertmanagerPayload(notification{Incident: testRecord(StatusOpen), First: true, ExternalURL: "https://atc.example.com/v1/incidents/web-1"})
+	if msg.Status != "firing" || len(msg.Alerts) != 1 {
+		t.Fatalf("payload = %+v, want a single firing alert", msg)
+	}
+	alert := msg.Alerts[0]
+	if alert.Labels["service"] != "web" || alert.Labels["incident"] != "web-1" || !alert.EndsAt.IsZero() {
+		t.Errorf("alert = %+v, want web-1 of web without an end", alert)
+	}
+	if want := "Incident web-1 opened: web is critical"; alert.Annotations["summary"] != want {
+		t.Errorf("summary = %q, want %q", alert.Annotations["summary"], want)
+	}
+	if alert.GeneratorURL != "https://atc.example.com/v1/incidents/web-1" {
+		t.Errorf("generator url = %q", alert.GeneratorURL)
+	}
+
+	rec := testRecord(StatusResolved)
+	msg = alertmanagerPayload(notification{Incident: rec})
+	if msg.Status != "resolved" || !msg.Alerts[0].EndsAt.Equal(*rec.Resolved) {
+		t.Errorf("payload = %+v, want an alert resolved at %s", msg, rec.Resolved)
+	}
+	if want := "Incident web-1 resolved"; msg.Alerts[0].Annotations["summary"] != want {
+		t.Errorf("summary = %q, want %q", msg.Alerts[0].Annotations["summary"], want)
+	}
+}
+
+func TestPagerDutyEvent(t *testing.T) {
+	n := newNotifier(NotifierConfig{Type: NotifierPagerDuty, RoutingKey: flagext.SecretWithValue("key")})
+
+	tests := map[string]struct {
+		msg    notification
+		action string
+		send   bool
+	}{
+		"opened":           {msg: notification{Incident: testRecord(StatusOpen), First: true}, action: "trigger", send: true},
+		"escalated":        {msg: notification{Incident: testRecord(StatusOpen), First: true, Step: 1}, action: "trigger", send: true},
+		"acknowledged":     {msg: notification{Incident: testRecord(StatusAcknowledged)}, action: "acknowledge", send: true},
+		"mitigated":        {msg: notification{Incident: testRecord(StatusMitigated)}},
+		"opened mitigated": {msg: notification{Incident: testRecord(StatusMitigated), First: true}, action: "trigger", send: true},
+		"resolved":         {msg: notification{Incident: testRecord(StatusResolved)}, action: "resolve", send: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			event, send := n.pagerDutyEvent(tc.msg)
+			if send != tc.send {
+				t.Fatalf("send = %t, want %t", send, tc.send)
+			}
+			if !send {
+				return
+			}
+			if event.EventAction != tc.action || event.RoutingKey != "key" || event.DedupKey != "atc-web-1" {
+				t.Errorf("event = %+v, want %s of atc-web-1", event, tc.action)
+			}
+			if (event.Payload != nil) != (tc.action == "trigger") {
+				t.Errorf("payload = %+v, want one only when triggering", event.Payload)
+			}
+		})
+	}
+}
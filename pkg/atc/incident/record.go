@@ -0,0 +1,132 @@
+package incident
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+
+	"github.com/attachmentgenie/atc/pkg/atc/watcher"
+)
+
+// Statuses of an incident, in the order of its lifecycle.
+const (
+	StatusOpen         = "open"
+	StatusAcknowledged = "acknowledged"
+	StatusMitigated    = "mitigated"
+	StatusResolved     = "resolved"
+)
+
+// Types of the events on the timeline of an incident.
+const (
+	EventOpened       = "opened"
+	EventAcknowledged = "acknowledged"
+	EventMitigated    = "mitigated"
+	EventRecurred     = "recurred"
+	EventResolved     = "resolved"
+	EventAccess       = "access"
+	EventEscalated    = "escalated"
+	EventNotified     = "notified"
+)
+
+// Record is an outage of a Consul service, from the moment it crossed the
+// critical threshold until it recovered.
+type Record struct {
+	ID      string    `json:"id"`
+	Service string    `json:"service"`
+	Status  string    `json:"status"`
+	Opened  time.Time `json:"opened"`
+
+	Acknowledged   *time.Time `json:"acknowledged,omitempty"`
+	AcknowledgedBy string     `json:"acknowledged_by,omitempty"`
+	Mitigated      *time.Time `json:"mitigated,omitempty"`
+	// MitigatedBy is the module whose config entry mitigates the outage.
+	MitigatedBy string     `json:"mitigated_by,omitempty"`
+	Resolved    *time.Time `json:"resolved,omitempty"`
+
+	// Critical and Total are the current instance counts of the service,
+	// PeakCritical the highest critical count during the incident.
+	Critical     int `json:"critical"`
+	Total        int `json:"total"`
+	PeakCritical int `json:"peak_critical"`
+	// Flaps counts how often the service went critical again before the
+	// incident was resolved.
+	Flaps int `json:"flaps"`
+	// Instances are the instances that were critical during the incident.
+	Instances []Instance `json:"instances"`
+	Events    []Event    `json:"events"`
+
+	// clearSince is when the service last dropped below the threshold.
+	clearSince time.Time
+}
+
+// Instance is a service instance affected by an incident.
+type Instance struct {
+	ID      string `json:"id"`
+	Node    string `json:"node"`
+	Address string `json:"address"`
+	Port    int    `json:"port"`
+}
+
+// Event is a step on the timeline of an incident.
+type Event struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Message string    `json:"message"`
+}
+
+func newRecord(service string, now time.Time) *Record {
+	return &Record{
+		ID:      fmt.Sprintf("%s-%d", service, now.Unix()),
+		Service: service,
+		Status:  StatusOpen,
+		Opened:  now,
+	}
+}
+
+// update records the current instances of the service, and reports whether
+// instances went critical that were not affected before.
+func (r *Record) update(h watcher.Health, instances []watcher.Instance) bool {
+	added := false
+	r.Critical, r.Total = h.Critical, h.Total()
+	r.PeakCritical = max(r.PeakCritical, h.Critical)
+	for _, i := range instances {
+		if i.Status != api.HealthCritical {
+			continue
+		}
+		if slices.ContainsFunc(r.Instances, func(known Instance) bool { return known.ID == i.ID && known.Node == i.Node }) {
+			continue
+		}
+		r.Instances = append(r.Instances, Instance{ID: i.ID, Node: i.Node, Address: i.Address, Port: i.Port})
+		added = true
+	}
+	return added
+}
+
+func (r *Record) event(now time.Time, typ, msg string, args ...any) {
+	r.Events = append(r.Events, Event{Time: now, Type: typ, Message: fmt.Sprintf(msg, args...)})
+	r.Status = r.status()
+}
+
+// status is the furthest step of the lifecycle the incident reached, so an
+// acknowledgement does not hide that the outage was mitigated before.
+func (r *Record) status() string {
+	switch {
+	case r.Resolved != nil:
+		return StatusResolved
+	case r.Mitigated != nil:
+		return StatusMitigated
+	case r.Acknowledged != nil:
+		return StatusAcknowledged
+	}
+	return StatusOpen
+}
+
+// clone returns a copy that is safe to hand out while the incident changes.
+func (r *Record) clone() Record {
+	c := *r
+	c.Instances = slices.Clone(r.Instances)
+	c.Events = slices.Clone(r.Events)
+	return c
+}
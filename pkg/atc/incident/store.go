@@ -0,0 +1,241 @@
+package incident
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/go-kit/log/level"
+
+	"github.com/attachmentgenie/atc/pkg/atc/leader"
+)
+
+// incidentsKey is the prefix below the leader lock that the incidents are
+// kept under in Consul KV, one key per incident.
+const incidentsKey = "incidents"
+
+// acknowledgeAttempts bounds the attempts of a follower to acknowledge an
+// incident while the leader updates it.
+const acknowledgeAttempts = 3
+
+// storedRecord is an incident as kept in Consul KV, along with the state a
+// new leader needs to continue it.
+type storedRecord struct {
+	Record
+	ClearSince time.Time   `json:"clear_since"`
+	Escalation *escalation `json:"escalation,omitempty"`
+}
+
+// storable returns the incident as kept in Consul KV. It must be called with
+// the mutex held.
+func (f *Incident) storable(rec *Record) storedRecord {
+	return storedRecord{Record: rec.clone(), ClearSince: rec.clearSince, Escalation: f.escalations[rec.ID]}
+}
+
+// load replaces the incidents with the ones in Consul KV.
+func (f *Incident) load(ctx context.Context) error {
+	states, values, err := f.elector.SharedStates(ctx, incidentsKey)
+	if err != nil {
+		return fmt.Errorf("failed to load incidents: %w", err)
+	}
+
+	open := map[string]*Record{}
+	recent := []*Record{}
+	escalations := map[string]*escalation{}
+	for id, value := range values {
+		var sr storedRecord
+		if err := json.Unmarshal(value, &sr); err != nil {
+			level.Warn(f.logger).Log("msg", "skipping invalid incident in consul", "key", states[id].Key(), "err", err)
+			continue
+		}
+		rec := sr.Record
+		rec.clearSince = sr.ClearSince
+		if rec.Resolved == nil {
+			open[rec.Service] = &rec
+		} else {
+			recent = append(recent, &rec)
+		}
+		if sr.Escalation != nil {
+			escalations[id] = sr.Escalation
+		}
+	}
+	sort.Slice(recent, func(i, j int) bool {
+		return recent[i].Resolved.Before(*recent[j].Resolved)
+	})
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.open, f.recent, f.escalations = open, recent, escalations
+	f.states, f.values = states, values
+	f.openIncidents.Set(float64(len(f.open)))
+	f.notify()
+	return nil
+}
+
+// write is a change of an incident to write to Consul KV.
+type write struct {
+	id    string
+	state *leader.SharedState
+	value []byte
+}
+
+// sync writes the incidents that changed since they were loaded or written
+// to Consul KV, and removes the ones that are no longer retained. Failed
+// writes are retried on the next sync. The changes are collected with the
+// mutex held, but written without it, so evaluating and serving the
+// incidents does not wait for Consul.
+func (f *Incident) sync(ctx context.Context) {
+	f.syncMtx.Lock()
+	defer f.syncMtx.Unlock()
+
+	f.mtx.Lock()
+	if !f.shared || !f.leading {
+		f.mtx.Unlock()
+		return
+	}
+	var writes []write
+	ids := map[string]struct{}{}
+	for _, rec := range f.all() {
+		ids[rec.ID] = struct{}{}
+		value, err := json.Marshal(f.storable(rec))
+		if err != nil {
+			level.Error(f.logger).Log("msg", "failed to store incident", "incident", rec.ID, "err", err)
+			continue
+		}
+		if bytes.Equal(value, f.values[rec.ID]) {
+			continue
+		}
+		state, ok := f.states[rec.ID]
+		if !ok {
+			state = f.elector.SharedState(incidentsKey + "/" + rec.ID)
+			f.states[rec.ID] = state
+		}
+		writes = append(writes, write{id: rec.ID, state: state, value: value})
+	}
+	removed := map[string]*leader.SharedState{}
+	for id, state := range f.states {
+		if _, ok := ids[id]; !ok {
+			removed[id] = state
+		}
+	}
+	f.mtx.Unlock()
+
+	for _, w := range writes {
+		value, err := f.store(ctx, w)
+		if err != nil {
+			level.Error(f.logger).Log("msg", "failed to store incident", "incident", w.id, "err", err)
+			continue
+		}
+		f.mtx.Lock()
+		f.values[w.id] = value
+		f.mtx.Unlock()
+	}
+	for id, state := range removed {
+		if err := state.Delete(ctx); err != nil && !errors.Is(err, leader.ErrStateConflict) {
+			level.Error(f.logger).Log("msg", "failed to remove incident", "incident", id, "err", err)
+			continue
+		}
+		f.mtx.Lock()
+		delete(f.states, id)
+		delete(f.values, id)
+		f.mtx.Unlock()
+	}
+}
+
+// store writes a change of an incident, and returns the value written.
+// Followers acknowledge incidents in Consul KV, so a write that conflicts
+// with theirs takes over the acknowledgement and is tried again.
+func (f *Incident) store(ctx context.Context, w write) ([]byte, error) {
+	err := w.state.Store(ctx, w.value)
+	if !errors.Is(err, leader.ErrStateConflict) {
+		return w.value, err
+	}
+
+	value, err := f.mergeAcknowledgement(ctx, w)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.state.Store(ctx, value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// mergeAcknowledgement takes over the acknowledgement of an incident by a
+// follower, and returns the incident to write instead.
+func (f *Incident) mergeAcknowledgement(ctx context.Context, w write) ([]byte, error) {
+	stored, err := w.state.Load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var sr storedRecord
+	if stored == nil || json.Unmarshal(stored, &sr) != nil {
+		sr = storedRecord{}
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	rec := f.find(w.id)
+	if rec == nil {
+		return w.value, nil
+	}
+	if sr.Acknowledged != nil && rec.Acknowledged == nil {
+		rec.Acknowledged, rec.AcknowledgedBy = sr.Acknowledged, sr.AcknowledgedBy
+		rec.event(*sr.Acknowledged, EventAcknowledged, "acknowledged by %s", sr.AcknowledgedBy)
+		sort.SliceStable(rec.Events, func(i, j int) bool {
+			return rec.Events[i].Time.Before(rec.Events[j].Time)
+		})
+		level.Info(f.logger).Log("msg", "incident acknowledged on a follower", "incident", rec.ID, "service", rec.Service, "by", sr.AcknowledgedBy)
+	}
+	return json.Marshal(f.storable(rec))
+}
+
+// acknowledgeStored acknowledges an incident in Consul KV, for the leader to
+// take over.
+func (f *Incident) acknowledgeStored(ctx context.Context, id, by string) (Record, error) {
+	for attempt := 0; attempt < acknowledgeAttempts; attempt++ {
+		state := f.elector.SharedState(incidentsKey + "/" + id)
+		value, err := state.Load(ctx)
+		if err != nil {
+			return Record{}, err
+		}
+		if value == nil {
+			return Record{}, ErrNotFound
+		}
+		var sr storedRecord
+		if err := json.Unmarshal(value, &sr); err != nil {
+			return Record{}, fmt.Errorf("invalid incident %s in consul: %w", id, err)
+		}
+		if sr.Resolved != nil {
+			return sr.Record, ErrResolved
+		}
+		if sr.Acknowledged != nil {
+			return sr.Record, nil
+		}
+
+		now := time.Now()
+		sr.Acknowledged, sr.AcknowledgedBy = &now, by
+		sr.event(now, EventAcknowledged, "acknowledged by %s", by)
+		if value, err = json.Marshal(sr); err != nil {
+			return Record{}, err
+		}
+		err = state.Store(ctx, value)
+		if errors.Is(err, leader.ErrStateConflict) {
+			continue
+		}
+		if err != nil {
+			return Record{}, err
+		}
+
+		level.Info(f.logger).Log("msg", "incident acknowledged", "incident", id, "service", sr.Service, "by", by)
+		if err := f.load(ctx); err != nil {
+			level.Warn(f.logger).Log("msg", "failed to reload incidents", "err", err)
+		}
+		return sr.Record, nil
+	}
+	return Record{}, fmt.Errorf("failed to acknowledge incident %s: %w", id, leader.ErrStateConflict)
+}
@@ -0,0 +1,260 @@
+package incident
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/hashicorp/consul/api"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/attachmentgenie/atc/pkg/atc/leader"
+	"github.com/attachmentgenie/atc/pkg/atc/watcher"
+)
+
+// fakeKV serves the Consul KV reads, lists, check-and-set transactions and
+// deletes of the shared state.
+type fakeKV struct {
+	mtx   sync.Mutex
+	index uint64
+	pairs map[string]*api.KVPair
+	// held, when set, holds back the transactions until it is closed.
+	held chan struct{}
+}
+
+func (kv *fakeKV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if kv.held != nil && r.URL.Path == "/v1/txn" {
+		<-kv.held
+	}
+	kv.mtx.Lock()
+	defer kv.mtx.Unlock()
+	w.Header().Set("X-Consul-Index", "1")
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+
+	switch {
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		pairs := []*api.KVPair{}
+		for k, pair := range kv.pairs {
+			if k == key || (r.URL.Query().Has("recurse") && strings.HasPrefix(k, key)) {
+				pairs = append(pairs, pair)
+			}
+		}
+		if len(pairs) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(pairs)
+
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		var current uint64
+		if pair, ok := kv.pairs[key]; ok {
+			current = pair.ModifyIndex
+		}
+		if r.URL.Query().Get("cas") != strconv.FormatUint(current, 10) {
+			_, _ = w.Write([]byte("false"))
+			return
+		}
+		delete(kv.pairs, key)
+		_, _ = w.Write([]byte("true"))
+
+	case r.Method == http.MethodPut && r.URL.Path == "/v1/txn":
+		var ops []struct{ KV api.KVTxnOp }
+		if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		op := ops[0].KV
+		var current uint64
+		if pair, ok := kv.pairs[op.Key]; ok {
+			current = pair.ModifyIndex
+		}
+		if op.Verb != api.KVCAS || op.Index != current {
+			w.WriteHeader(http.StatusConflict)
+			_ = json.NewEncoder(w).Encode(map[string]any{"Errors": []map[string]any{{"OpIndex": 0, "What": "index is stale"}}})
+			return
+		}
+		kv.index++
+		kv.pairs[op.Key] = &api.KVPair{Key: op.Key, Value: op.Value, ModifyIndex: kv.index}
+		_ = json.NewEncoder(w).Encode(map[string]any{"Results": []map[string]any{{"KV": map[string]any{"Key": op.Key, "ModifyIndex": kv.index}}}})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// testIncident returns a replica that keeps its incidents in the fake KV.
+// Its elector is not started, so it acts as a follower until it is made to
+// lead.
+func testIncident(t *testing.T, srv *httptest.Server) *Incident {
+	t.Helper()
+	client, err := api.NewClient(&api.Config{Address: strings.TrimPrefix(srv.URL, "http://")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	elector, err := leader.New(leader.Config{Enabled: true, Key: "atc/leader", SessionTTL: 15 * time.Second, RetryInterval: time.Second}, client, log.NewNopLogger(), prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cfg Config
+	cfg.RegisterFlags(flag.NewFlagSet("test", flag.PanicOnError))
+	cfg.OpenAfter = 0
+	cfg.ResolveAfter = time.Minute
+	cfg.Retention = time.Hour
+	f, err := New(cfg, nil, elector, nil, log.NewNopLogger(), prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func snapshot(status string) *watcher.Snapshot {
+	return &watcher.Snapshot{Instances: map[string][]watcher.Instance{
+		"web": {{ID: "web-1", Service: "web", Status: status}},
+	}}
+}
+
+func TestStoredIncidents(t *testing.T) {
+	kv := &fakeKV{index: 10, pairs: map[string]*api.KVPair{}}
+	srv := httptest.NewServer(kv)
+	defer srv.Close()
+	ctx := context.Background()
+	now := time.Now()
+
+	leading := testIncident(t, srv)
+	leading.leading = true
+	leading.evaluate(snapshot(api.HealthCritical), now)
+	open := leading.Open()
+	if len(open) != 1 {
+		t.Fatalf("open incidents = %d, want 1", len(open))
+	}
+	id := open[0].ID
+	leading.escalations[id] = &escalation{Step: 1, Notified: map[string]int{"pager": 0}, Sent: map[string]string{"pager": StatusOpen}}
+	leading.sync(ctx)
+	if _, ok := kv.pairs["atc/leader/incidents/"+id]; !ok {
+		t.Fatalf("incident %s not stored", id)
+	}
+
+	// A follower serves the incident of the leader and acknowledges it in
+	// Consul KV.
+	follower := testIncident(t, srv)
+	if err := follower.load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	rec, err := follower.Acknowledge(ctx, id, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.AcknowledgedBy != "alice" {
+		t.Fatalf("acknowledged by %q, want alice", rec.AcknowledgedBy)
+	}
+	if rec, _ := follower.Get(id); rec.Status != StatusAcknowledged {
+		t.Errorf("status on the follower = %s, want %s", rec.Status, StatusAcknowledged)
+	}
+
+	// The leader takes over the acknowledgement when its next write
+	// conflicts.
+	leading.evaluate(snapshot(api.HealthPassing), now.Add(time.Second))
+	leading.sync(ctx)
+	rec, _ = leading.Get(id)
+	if rec.AcknowledgedBy != "alice" {
+		t.Fatalf("acknowledged by %q on the leader, want alice", rec.AcknowledgedBy)
+	}
+	acks := 0
+	for _, e := range rec.Events {
+		if e.Type == EventAcknowledged {
+			acks++
+		}
+	}
+	if acks != 1 {
+		t.Errorf("acknowledged events = %d, want 1", acks)
+	}
+
+	// A new leader continues the incident and its escalation.
+	next := testIncident(t, srv)
+	if err := next.load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	rec, err = next.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.AcknowledgedBy != "alice" || !rec.clearSince.Equal(now.Add(time.Second)) {
+		t.Errorf("incident = %+v, want acknowledged by alice and clear since a second later", rec)
+	}
+	if e := next.escalations[id]; e == nil || e.Step != 1 || e.Sent["pager"] != StatusOpen {
+		t.Errorf("escalation = %+v, want step 1 sent to pager", e)
+	}
+
+	// Incidents past their retention are removed.
+	leading.evaluate(snapshot(api.HealthPassing), now.Add(2*time.Minute))
+	leading.evaluate(snapshot(api.HealthPassing), now.Add(2*time.Hour))
+	leading.sync(ctx)
+	if len(kv.pairs) != 0 {
+		t.Errorf("keys = %d, want none", len(kv.pairs))
+	}
+	if err := next.load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := next.Get(id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("get = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestSyncDoesNotBlockEvaluation(t *testing.T) {
+	kv := &fakeKV{index: 10, pairs: map[string]*api.KVPair{}, held: make(chan struct{})}
+	srv := httptest.NewServer(kv)
+	defer srv.Close()
+	now := time.Now()
+
+	leading := testIncident(t, srv)
+	leading.leading = true
+	leading.evaluate(snapshot(api.HealthCritical), now)
+	id := leading.Open()[0].ID
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		leading.sync(context.Background())
+	}()
+
+	// The incidents are evaluated and served while Consul is slow to
+	// write them.
+	evaluated := make(chan struct{})
+	go func() {
+		defer close(evaluated)
+		leading.evaluate(snapshot(api.HealthPassing), now.Add(time.Second))
+		_, _ = leading.Get(id)
+	}()
+	select {
+	case <-evaluated:
+	case <-time.After(5 * time.Second):
+		t.Fatal("evaluation blocked by a write to consul")
+	}
+	close(kv.held)
+	<-done
+
+	// The write is recorded, and the change made meanwhile is written by the
+	// next sync.
+	leading.sync(context.Background())
+	var sr storedRecord
+	if err := json.Unmarshal(kv.pairs["atc/leader/incidents/"+id].Value, &sr); err != nil {
+		t.Fatal(err)
+	}
+	if !sr.ClearSince.Equal(now.Add(time.Second)) {
+		t.Errorf("stored incident clear since %s, want the change of the evaluation", sr.ClearSince)
+	}
+	leading.mtx.Lock()
+	defer leading.mtx.Unlock()
+	if stored, _ := json.Marshal(leading.storable(leading.find(id))); string(stored) != string(leading.values[id]) {
+		t.Error("stored value not recorded")
+	}
+}
@@ -0,0 +1,246 @@
+package leader
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/services"
+	"github.com/hashicorp/consul/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+type Config struct {
+	Enabled       bool          `yaml:"enabled"`
+	Key           string        `yaml:"key"`
+	ID            string        `yaml:"id"`
+	SessionTTL    time.Duration `yaml:"session_ttl"`
+	RetryInterval time.Duration `yaml:"retry_interval"`
+}
+
+func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	hostname, _ := os.Hostname()
+
+	f.BoolVar(&cfg.Enabled, "leader.enabled", false, "Elect a leader among ATC replicas through a Consul lock. Only the leader writes changes. When disabled this replica always acts as leader.")
+	f.StringVar(&cfg.Key, "leader.key", "atc/leader", "Consul KV key used as leader lock.")
+	f.StringVar(&cfg.ID, "leader.id", hostname, "Identifier of this replica, stored in the leader lock.")
+	f.DurationVar(&cfg.SessionTTL, "leader.session-ttl", 15*time.Second, "TTL of the Consul session backing the leader lock.")
+	f.DurationVar(&cfg.RetryInterval, "leader.retry-interval", 5*time.Second, "Time to wait before retrying after the lock could not be acquired because of an error.")
+}
+
+func (cfg *Config) Validate() error {
+	if !cfg.Enabled {
+		return nil
+	}
+	if cfg.Key == "" {
+		return fmt.Errorf("leader key must not be empty")
+	}
+	if cfg.SessionTTL < 10*time.Second || cfg.SessionTTL > 24*time.Hour {
+		return fmt.Errorf("leader session ttl must be between 10s and 24h, got %s", cfg.SessionTTL)
+	}
+	if cfg.RetryInterval <= 0 {
+		return fmt.Errorf("invalid leader retry interval: %s", cfg.RetryInterval)
+	}
+	return nil
+}
+
+// Elector holds a Consul lock on behalf of this replica, so that only one ATC
+// replica at a time writes changes.
+type Elector struct {
+	services.Service
+
+	cfg    Config
+	client *api.Client
+	logger log.Logger
+
+	mtx    sync.Mutex
+	leader bool
+	// holder is the last known replica holding the leader lock.
+	holder      string
+	subscribers []chan struct{}
+
+	leaderGauge prometheus.Gauge
+}
+
+func (e *Elector) starting(ctx context.Context) error {
+	return nil
+}
+
+func (e *Elector) stopping(_ error) error {
+	e.setLeader(false)
+	return nil
+}
+
+func New(cfg Config, client *api.Client, logger log.Logger, reg prometheus.Registerer) (*Elector, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	e := &Elector{
+		cfg:    cfg,
+		client: client,
+		logger: log.With(logger, "module", "leader"),
+		leaderGauge: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "atc_leader",
+			Help: "Whether this replica is the leader (1) or a follower (0).",
+		}),
+	}
+	e.Service = services.NewBasicService(e.starting, e.running, e.stopping)
+	return e, nil
+}
+
+// IsLeader reports whether this replica currently holds leadership.
+func (e *Elector) IsLeader() bool {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	return e.leader
+}
+
+// Subscribe returns a channel that receives a notification whenever this
+// replica gains leadership. Subscribe must be called before the elector is
+// started.
+func (e *Elector) Subscribe() <-chan struct{} {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	ch := make(chan struct{}, 1)
+	e.subscribers = append(e.subscribers, ch)
+	return ch
+}
+
+// Leader returns the identifier of the replica last known to hold the leader
+// lock, or an empty string when there is no leader.
+func (e *Elector) Leader() string {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	if e.leader || !e.cfg.Enabled {
+		return e.cfg.ID
+	}
+	return e.holder
+}
+
+// ID returns the identifier of this replica.
+func (e *Elector) ID() string {
+	return e.cfg.ID
+}
+
+func (e *Elector) running(ctx context.Context) error {
+	if !e.cfg.Enabled {
+		e.setLeader(true)
+		<-ctx.Done()
+		return nil
+	}
+
+	go e.watchHolder(ctx)
+
+	for {
+		lock, err := e.client.LockOpts(&api.LockOptions{
+			Key:            e.cfg.Key,
+			Value:          []byte(e.cfg.ID),
+			SessionName:    "atc-leader",
+			SessionTTL:     e.cfg.SessionTTL.String(),
+			MonitorRetries: 3,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create leader lock: %w", err)
+		}
+
+		lostChan, err := lock.Lock(ctx.Done())
+		if err != nil {
+			level.Warn(e.logger).Log("msg", "failed to acquire leader lock", "key", e.cfg.Key, "err", err)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(e.cfg.RetryInterval):
+				continue
+			}
+		}
+		if lostChan == nil {
+			// Stopped while waiting for the lock.
+			return nil
+		}
+
+		level.Info(e.logger).Log("msg", "acquired leadership", "key", e.cfg.Key, "id", e.cfg.ID)
+		e.setLeader(true)
+
+		select {
+		case <-ctx.Done():
+			e.setLeader(false)
+			if err := lock.Unlock(); err != nil {
+				level.Warn(e.logger).Log("msg", "failed to release leader lock", "key", e.cfg.Key, "err", err)
+			}
+			return nil
+
+		case <-lostChan:
+			level.Warn(e.logger).Log("msg", "lost leadership", "key", e.cfg.Key, "id", e.cfg.ID)
+			e.setLeader(false)
+			// Stops renewing the session of the lost lock.
+			_ = lock.Unlock()
+		}
+	}
+}
+
+// watchHolder keeps track of the replica holding the leader lock with a
+// blocking query on the lock key, until the context is done.
+func (e *Elector) watchHolder(ctx context.Context) {
+	var index uint64
+	for {
+		pair, meta, err := e.client.KV().Get(e.cfg.Key, (&api.QueryOptions{WaitIndex: index}).WithContext(ctx))
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			level.Warn(e.logger).Log("msg", "failed to read leader key", "key", e.cfg.Key, "err", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(e.cfg.RetryInterval):
+				continue
+			}
+		}
+
+		holder := ""
+		if pair != nil && pair.Session != "" {
+			holder = string(pair.Value)
+		}
+		e.mtx.Lock()
+		e.holder = holder
+		e.mtx.Unlock()
+
+		// Start over when the index went backwards, e.g. after a restore.
+		if meta.LastIndex < index {
+			index = 0
+		} else {
+			index = meta.LastIndex
+		}
+	}
+}
+
+func (e *Elector) setLeader(leader bool) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	if leader == e.leader {
+		return
+	}
+	e.leader = leader
+
+	if leader {
+		e.leaderGauge.Set(1)
+		for _, ch := range e.subscribers {
+			select {
+			case ch <- struct{}{}:
+			default:
+				// A notification is already pending.
+			}
+		}
+	} else {
+		e.leaderGauge.Set(0)
+	}
+}
@@ -0,0 +1,267 @@
+package leader
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/services"
+	"github.com/hashicorp/consul/api"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// fakeLock serves the Consul sessions and the lock key, with blocking
+// queries on the key.
+type fakeLock struct {
+	mtx      sync.Mutex
+	index    uint64
+	next     int
+	sessions map[string]struct{}
+	pair     *api.KVPair
+	// changed is closed when the index is bumped.
+	changed chan struct{}
+}
+
+func newFakeLock() *fakeLock {
+	return &fakeLock{index: 1, sessions: map[string]struct{}{}, changed: make(chan struct{})}
+}
+
+// bump records a change of the lock key. It must be called with the mutex
+// held.
+func (l *fakeLock) bump() {
+	l.index++
+	if l.pair != nil {
+		l.pair.ModifyIndex = l.index
+	}
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+func (l *fakeLock) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if r.Method == http.MethodGet {
+		l.wait(r)
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(l.index, 10))
+
+	switch {
+	case r.URL.Path == "/v1/session/create":
+		l.next++
+		id := fmt.Sprintf("session-%d", l.next)
+		l.sessions[id] = struct{}{}
+		_ = json.NewEncoder(w).Encode(map[string]string{"ID": id})
+
+	case strings.HasPrefix(r.URL.Path, "/v1/session/renew/"):
+		id := strings.TrimPrefix(r.URL.Path, "/v1/session/renew/")
+		if _, ok := l.sessions[id]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode([]*api.SessionEntry{{ID: id}})
+
+	case strings.HasPrefix(r.URL.Path, "/v1/session/destroy/"):
+		l.invalidate(strings.TrimPrefix(r.URL.Path, "/v1/session/destroy/"))
+		_, _ = w.Write([]byte("true"))
+
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		if l.pair == nil {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode([]*api.KVPair{l.pair})
+
+	case r.Method == http.MethodPut && query.Has("acquire"):
+		id := query.Get("acquire")
+		_, ok := l.sessions[id]
+		if !ok || (l.pair != nil && l.pair.Session != "" && l.pair.Session != id) {
+			_, _ = w.Write([]byte("false"))
+			return
+		}
+		value, _ := io.ReadAll(r.Body)
+		flags, _ := strconv.ParseUint(query.Get("flags"), 10, 64)
+		l.pair = &api.KVPair{Key: strings.TrimPrefix(r.URL.Path, "/v1/kv/"), Value: value, Flags: flags, Session: id}
+		l.bump()
+		_, _ = w.Write([]byte("true"))
+
+	case r.Method == http.MethodPut && query.Has("release"):
+		if l.pair == nil || l.pair.Session != query.Get("release") {
+			_, _ = w.Write([]byte("false"))
+			return
+		}
+		l.pair.Session = ""
+		l.bump()
+		_, _ = w.Write([]byte("true"))
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// wait blocks a query until the lock key changed after the index it was made
+// at, for at most a second.
+func (l *fakeLock) wait(r *http.Request) {
+	index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+	l.mtx.Lock()
+	current, changed := l.index, l.changed
+	l.mtx.Unlock()
+	if index == 0 || index < current {
+		return
+	}
+	select {
+	case <-changed:
+	case <-r.Context().Done():
+	case <-time.After(time.Second):
+	}
+}
+
+// invalidate destroys a session, which releases the lock it holds. It must
+// be called with the mutex held.
+func (l *fakeLock) invalidate(id string) {
+	delete(l.sessions, id)
+	if l.pair != nil && l.pair.Session == id {
+		l.pair.Session = ""
+		l.bump()
+	}
+}
+
+// takeOver invalidates the session holding the lock, and has another replica
+// acquire it.
+func (l *fakeLock) takeOver(holder string) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.invalidate(l.pair.Session)
+	l.sessions["other"] = struct{}{}
+	l.pair.Session, l.pair.Value = "other", []byte(holder)
+	l.bump()
+}
+
+// release has the other replica release the lock.
+func (l *fakeLock) release() {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.invalidate("other")
+}
+
+func (l *fakeLock) holder() (session, value string) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.pair == nil {
+		return "", ""
+	}
+	return l.pair.Session, string(l.pair.Value)
+}
+
+// eventually fails the test when cond does not hold within a few seconds.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func TestElection(t *testing.T) {
+	lock := newFakeLock()
+	srv := httptest.NewServer(lock)
+	defer srv.Close()
+	client, err := api.NewClient(&api.Config{Address: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := New(Config{Enabled: true, Key: "atc/leader", ID: "replica-1", SessionTTL: 15 * time.Second, RetryInterval: 10 * time.Millisecond}, client, log.NewNopLogger(), prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	leadership := e.Subscribe()
+	if e.IsLeader() {
+		t.Fatal("leader before the lock was acquired")
+	}
+
+	ctx := context.Background()
+	if err := services.StartAndAwaitRunning(ctx, e); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = services.StopAndAwaitTerminated(ctx, e) }()
+
+	notified := func(what string) {
+		t.Helper()
+		select {
+		case <-leadership:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no notification after %s", what)
+		}
+	}
+
+	// The elector acquires the free lock and notifies its subscribers.
+	notified("acquiring the lock")
+	session, value := lock.holder()
+	if !e.IsLeader() || e.Leader() != "replica-1" || session == "" || value != "replica-1" {
+		t.Fatalf("leader = %v, lock held by %q with %q, want replica-1 to hold it", e.IsLeader(), session, value)
+	}
+
+	// When its session is invalidated and another replica acquires the
+	// lock, it follows that replica.
+	lock.takeOver("replica-2")
+	eventually(t, "losing leadership", func() bool { return !e.IsLeader() })
+	eventually(t, "replica-2 to be known as leader", func() bool { return e.Leader() == "replica-2" })
+	select {
+	case <-leadership:
+		t.Error("subscribers notified of losing leadership")
+	default:
+	}
+
+	// Once the lock is released, it acquires it again with a new session.
+	lock.release()
+	notified("acquiring the lock again")
+	newSession, value := lock.holder()
+	if !e.IsLeader() || newSession == "" || newSession == session || value != "replica-1" {
+		t.Fatalf("leader = %v, lock held by %q with %q, want replica-1 to hold it with a new session", e.IsLeader(), newSession, value)
+	}
+
+	// Stopping releases the lock.
+	if err := services.StopAndAwaitTerminated(ctx, e); err != nil {
+		t.Fatal(err)
+	}
+	if session, _ := lock.holder(); e.IsLeader() || session != "" {
+		t.Errorf("leader = %v, lock held by %q after stopping, want it released", e.IsLeader(), session)
+	}
+}
+
+func TestElectionDisabled(t *testing.T) {
+	e, err := New(Config{ID: "replica-1"}, nil, log.NewNopLogger(), prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	leadership := e.Subscribe()
+	if err := services.StartAndAwaitRunning(context.Background(), e); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-leadership:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification without leader election")
+	}
+	if !e.IsLeader() || e.Leader() != "replica-1" {
+		t.Errorf("leader = %v (%q), want this replica to lead", e.IsLeader(), e.Leader())
+	}
+	if err := services.StopAndAwaitTerminated(context.Background(), e); err != nil {
+		t.Fatal(err)
+	}
+	if e.IsLeader() {
+		t.Error("leader after stopping")
+	}
+}
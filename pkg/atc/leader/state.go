@@ -0,0 +1,125 @@
+package leader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// ErrStateConflict is returned when the state was changed by another replica
+// since it was loaded.
+var ErrStateConflict = errors.New("state was changed by another replica")
+
+// SharedState is a value kept in Consul KV next to the leader lock, so that
+// a new leader takes over where the previous one left off. Writes are
+// check-and-set against the last load or store, so a replica that lost its
+// leadership cannot overwrite the writes of the new leader.
+type SharedState struct {
+	client *api.Client
+	key    string
+
+	mtx   sync.Mutex
+	index uint64
+}
+
+// SharedState returns the state of the given name, or nil when leader
+// election is disabled, as this replica is then the only one and keeps its
+// state locally.
+func (e *Elector) SharedState(name string) *SharedState {
+	if !e.cfg.Enabled {
+		return nil
+	}
+	return &SharedState{client: e.client, key: e.cfg.Key + "/" + name}
+}
+
+// SharedStates loads the states below a prefix, by their name below the
+// prefix, along with their values. It returns nothing when leader election
+// is disabled.
+func (e *Elector) SharedStates(ctx context.Context, prefix string) (map[string]*SharedState, map[string][]byte, error) {
+	if !e.cfg.Enabled {
+		return nil, nil, nil
+	}
+	prefix = e.cfg.Key + "/" + strings.TrimSuffix(prefix, "/") + "/"
+	pairs, _, err := e.client.KV().List(prefix, (&api.QueryOptions{RequireConsistent: true}).WithContext(ctx))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list %s: %w", prefix, err)
+	}
+
+	states := make(map[string]*SharedState, len(pairs))
+	values := make(map[string][]byte, len(pairs))
+	for _, pair := range pairs {
+		name := strings.TrimPrefix(pair.Key, prefix)
+		states[name] = &SharedState{client: e.client, key: pair.Key, index: pair.ModifyIndex}
+		values[name] = pair.Value
+	}
+	return states, values, nil
+}
+
+// Key returns the Consul KV key of the state.
+func (s *SharedState) Key() string {
+	return s.key
+}
+
+// Load reads the state, which is nil when it was never stored.
+func (s *SharedState) Load(ctx context.Context) ([]byte, error) {
+	pair, _, err := s.client.KV().Get(s.key, (&api.QueryOptions{RequireConsistent: true}).WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", s.key, err)
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if pair == nil {
+		s.index = 0
+		return nil, nil
+	}
+	s.index = pair.ModifyIndex
+	return pair.Value, nil
+}
+
+// Store writes the state, provided nobody else wrote it since it was last
+// loaded or stored. It returns ErrStateConflict otherwise.
+func (s *SharedState) Store(ctx context.Context, value []byte) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	// A transaction returns the modify index of the write, for the next
+	// check-and-set.
+	ok, resp, _, err := s.client.Txn().Txn(api.TxnOps{{KV: &api.KVTxnOp{
+		Verb:  api.KVCAS,
+		Key:   s.key,
+		Value: value,
+		Index: s.index,
+	}}}, (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", s.key, err)
+	}
+	if !ok {
+		return fmt.Errorf("failed to write %s: %w", s.key, ErrStateConflict)
+	}
+	if len(resp.Results) > 0 && resp.Results[0].KV != nil {
+		s.index = resp.Results[0].KV.ModifyIndex
+	}
+	return nil
+}
+
+// Delete removes the state, provided nobody else wrote it since it was last
+// loaded or stored. It returns ErrStateConflict otherwise.
+func (s *SharedState) Delete(ctx context.Context) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	ok, _, err := s.client.KV().DeleteCAS(&api.KVPair{Key: s.key, ModifyIndex: s.index}, (&api.WriteOptions{}).WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to delete %s: %w", s.key, err)
+	}
+	if !ok {
+		return fmt.Errorf("failed to delete %s: %w", s.key, ErrStateConflict)
+	}
+	s.index = 0
+	return nil
+}
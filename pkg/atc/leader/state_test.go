@@ -0,0 +1,187 @@
+package leader
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/hashicorp/consul/api"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// fakeKV serves the Consul KV reads and the check-and-set transactions of
+// the shared state.
+type fakeKV struct {
+	mtx   sync.Mutex
+	index uint64
+	pairs map[string]*api.KVPair
+}
+
+func (kv *fakeKV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	kv.mtx.Lock()
+	defer kv.mtx.Unlock()
+	w.Header().Set("X-Consul-Index", "1")
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Query().Has("recurse"):
+		prefix := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		pairs := []*api.KVPair{}
+		for key, pair := range kv.pairs {
+			if strings.HasPrefix(key, prefix) {
+				pairs = append(pairs, pair)
+			}
+		}
+		if len(pairs) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(pairs)
+
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		pair, ok := kv.pairs[strings.TrimPrefix(r.URL.Path, "/v1/kv/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode([]*api.KVPair{pair})
+
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		var current uint64
+		if pair, ok := kv.pairs[key]; ok {
+			current = pair.ModifyIndex
+		}
+		if r.URL.Query().Get("cas") != strconv.FormatUint(current, 10) {
+			_, _ = w.Write([]byte("false"))
+			return
+		}
+		delete(kv.pairs, key)
+		_, _ = w.Write([]byte("true"))
+
+	case r.Method == http.MethodPut && r.URL.Path == "/v1/txn":
+		var ops []struct{ KV api.KVTxnOp }
+		if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		op := ops[0].KV
+		var current uint64
+		if pair, ok := kv.pairs[op.Key]; ok {
+			current = pair.ModifyIndex
+		}
+		if op.Verb != api.KVCAS || op.Index != current {
+			w.WriteHeader(http.StatusConflict)
+			_ = json.NewEncoder(w).Encode(map[string]any{"Errors": []map[string]any{{"OpIndex": 0, "What": "index is stale"}}})
+			return
+		}
+		kv.index++
+		kv.pairs[op.Key] = &api.KVPair{Key: op.Key, Value: op.Value, ModifyIndex: kv.index}
+		_ = json.NewEncoder(w).Encode(map[string]any{"Results": []map[string]any{{"KV": map[string]any{"Key": op.Key, "ModifyIndex": kv.index}}}})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func testElector(t *testing.T, srv *httptest.Server, enabled bool) *Elector {
+	t.Helper()
+	client, err := api.NewClient(&api.Config{Address: strings.TrimPrefix(srv.URL, "http://")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := New(Config{Enabled: enabled, Key: "atc/leader", SessionTTL: 15 * time.Second, RetryInterval: time.Second}, client, log.NewNopLogger(), prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestSharedState(t *testing.T) {
+	kv := &fakeKV{index: 10, pairs: map[string]*api.KVPair{}}
+	srv := httptest.NewServer(kv)
+	defer srv.Close()
+	ctx := context.Background()
+
+	if s := testElector(t, srv, false).SharedState("index"); s != nil {
+		t.Fatalf("shared state without leader election: %+v", s)
+	}
+
+	old := testElector(t, srv, true).SharedState("index")
+	if old.Key() != "atc/leader/index" {
+		t.Errorf("key = %s, want atc/leader/index", old.Key())
+	}
+	if value, err := old.Load(ctx); err != nil || value != nil {
+		t.Fatalf("load = %q, %v, want nothing", value, err)
+	}
+	for _, value := range []string{"1", "2"} {
+		if err := old.Store(ctx, []byte(value)); err != nil {
+			t.Fatalf("store %s: %v", value, err)
+		}
+	}
+
+	// A new leader takes over the state, after which the old leader can no
+	// longer write it.
+	leader := testElector(t, srv, true).SharedState("index")
+	if value, err := leader.Load(ctx); err != nil || string(value) != "2" {
+		t.Fatalf("load = %q, %v, want 2", value, err)
+	}
+	if err := leader.Store(ctx, []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	if err := old.Store(ctx, []byte("4")); !errors.Is(err, ErrStateConflict) {
+		t.Fatalf("store by the old leader: %v, want %v", err, ErrStateConflict)
+	}
+	if got := string(kv.pairs["atc/leader/index"].Value); got != "3" {
+		t.Errorf("value = %s, want 3", got)
+	}
+}
+
+func TestSharedStates(t *testing.T) {
+	kv := &fakeKV{index: 10, pairs: map[string]*api.KVPair{
+		"atc/leader/incidents/a":  {Key: "atc/leader/incidents/a", Value: []byte("1"), ModifyIndex: 3},
+		"atc/leader/incidents/b":  {Key: "atc/leader/incidents/b", Value: []byte("2"), ModifyIndex: 4},
+		"atc/leader/incidentsold": {Key: "atc/leader/incidentsold", Value: []byte("3"), ModifyIndex: 5},
+	}}
+	srv := httptest.NewServer(kv)
+	defer srv.Close()
+	ctx := context.Background()
+
+	states, values, err := testElector(t, srv, false).SharedStates(ctx, "incidents")
+	if err != nil || states != nil || values != nil {
+		t.Fatalf("shared states without leader election: %v, %v, %v", states, values, err)
+	}
+
+	states, values, err = testElector(t, srv, true).SharedStates(ctx, "incidents")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 2 || string(values["a"]) != "1" || string(values["b"]) != "2" {
+		t.Fatalf("values = %q, want a=1 and b=2", values)
+	}
+
+	// The states continue from the index they were listed at.
+	if err := states["a"].Store(ctx, []byte("4")); err != nil {
+		t.Fatal(err)
+	}
+	kv.pairs["atc/leader/incidents/b"].ModifyIndex = 20
+	if err := states["b"].Delete(ctx); !errors.Is(err, ErrStateConflict) {
+		t.Fatalf("delete of a changed state: %v, want %v", err, ErrStateConflict)
+	}
+	if err := states["a"].Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := kv.pairs["atc/leader/incidents/a"]; ok {
+		t.Error("state a not deleted")
+	}
+	if _, ok := kv.pairs["atc/leader/incidents/b"]; !ok {
+		t.Error("changed state b deleted")
+	}
+}
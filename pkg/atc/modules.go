@@ -1,6 +1,7 @@
 package atc
 
 import (
+	"github.com/go-kit/log/level"
 	"github.com/grafana/dskit/modules"
 	"github.com/grafana/dskit/server"
 	"github.com/grafana/dskit/services"
@@ -11,29 +12,35 @@ import (
 	"golang.org/x/exp/slices"
 
 	"github.com/attachmentgenie/atc/pkg/atc/autoscaler"
+	"github.com/attachmentgenie/atc/pkg/atc/configentry"
 	"github.com/attachmentgenie/atc/pkg/atc/deployer"
 	"github.com/attachmentgenie/atc/pkg/atc/event_sink"
 	"github.com/attachmentgenie/atc/pkg/atc/forwarder"
 	"github.com/attachmentgenie/atc/pkg/atc/incident"
+	"github.com/attachmentgenie/atc/pkg/atc/leader"
 	"github.com/attachmentgenie/atc/pkg/atc/radar"
 	"github.com/attachmentgenie/atc/pkg/atc/redirecter"
 	atc_server "github.com/attachmentgenie/atc/pkg/atc/server"
+	"github.com/attachmentgenie/atc/pkg/atc/watcher"
 )
 
 const (
-	API        string = "api"
-	Autoscaler string = "autoscaler"
-	Boundary   string = "boundary"
-	Consul     string = "consul"
-	Deployer   string = "deployer"
-	EventSink  string = "event_sink"
-	Forwarder  string = "forwarder"
-	Incident   string = "incident"
-	Nomad      string = "nomad"
-	Server     string = "server"
-	Radar      string = "radar"
-	Redirecter string = "redirecter"
-	All        string = "all"
+	API           string = "api"
+	Autoscaler    string = "autoscaler"
+	Boundary      string = "boundary"
+	ConfigEntries string = "config_entries"
+	Consul        string = "consul"
+	Deployer      string = "deployer"
+	EventSink     string = "event_sink"
+	Forwarder     string = "forwarder"
+	Incident      string = "incident"
+	Leader        string = "leader"
+	Nomad         string = "nomad"
+	Server        string = "server"
+	Radar         string = "radar"
+	Redirecter    string = "redirecter"
+	Watcher       string = "watcher"
+	All           string = "all"
 )
 
 func (t *Atc) initAPI() (services.Service, error) {
@@ -58,19 +65,40 @@ func (t *Atc) initAPI() (services.Service, error) {
 				Address: "/services",
 				Text:    "Services",
 			},
+			{
+				Address: "/v1/config-entries",
+				Text:    "Config entry changes",
+			},
+			{
+				Address: "/v1/incidents",
+				Text:    "Incidents",
+			},
+			{
+				Address: "/v1/radar/graph",
+				Text:    "Radar graph",
+			},
+			{
+				Address: "/v1/radar/failover",
+				Text:    "Failover targets",
+			},
+			{
+				Address: "/v1/radar/flapping",
+				Text:    "Flapping services",
+			},
 		},
 	}
-	landingPage, err := web.NewLandingPage(landingConfig)
-	if err != nil {
+	// Render the landing page on every request, so it shows the current
+	// leadership.
+	if _, err := web.NewLandingPage(landingConfig); err != nil {
 		panic(err)
 	}
-	t.Server.HTTP.Handle("/", landingPage)
+	t.Server.HTTP.Handle("/", t.landingPageHandler(landingConfig))
 
 	return nil, nil
 }
 
 func (t *Atc) initAutoscaler() (services.Service, error) {
-	autosclr, err := autoscaler.New(t.logger)
+	autosclr, err := autoscaler.New(t.Cfg.Autoscaler, t.NomadClient, t.Leader, t.Watcher.Subscribe(), t.logger, t.Server.Registerer)
 	if err != nil {
 		return nil, err
 	}
@@ -78,21 +106,46 @@ func (t *Atc) initAutoscaler() (services.Service, error) {
 	return t.Autoscaler, nil
 }
 
+func (t *Atc) initBoundary() (services.Service, error) {
+	if t.Cfg.Boundary.Address == "" {
+		level.Info(t.logger).Log("msg", "boundary address is not set, not granting access to incident hosts")
+		return nil, nil
+	}
+
+	bndry, err := incident.NewBoundary(t.Cfg.Boundary, t.Incident, t.Leader, t.logger, t.Server.Registerer)
+	if err != nil {
+		return nil, err
+	}
+	t.Boundary = bndry
+	return t.Boundary, nil
+}
+
+func (t *Atc) initConfigEntries() (services.Service, error) {
+	t.ConfigEntries = configentry.New(t.ConsulClient, t.Cfg.DryRun, t.logger, t.Server.Registerer)
+	t.Server.HTTP.Path("/v1/config-entries").Methods("GET").Handler(t.ConfigEntries.ChangesHandler())
+	return nil, nil
+}
+
 func (t *Atc) initDeployer() (services.Service, error) {
-	deploy, err := deployer.New(t.logger)
+	deploy, err := deployer.New(t.Cfg.Deployer, t.NomadClient, t.Watcher.Subscribe(), t.logger, t.Server.Registerer)
 	if err != nil {
 		return nil, err
 	}
 
-	t.Server.HTTP.Path("/v1/jobs").Methods("GET", "PUT").Handler(deploy.OkHandler())
-	t.Server.HTTP.Path("/v1/validate/job").Methods("PUT").Handler(deploy.OkHandler())
+	t.Server.HTTP.Path("/v1/jobs").Methods("GET").Handler(deploy.ProxyHandler())
+	t.Server.HTTP.Path("/v1/jobs").Methods("PUT", "POST").Handler(deploy.RegisterHandler())
+	t.Server.HTTP.Path("/v1/validate/job").Methods("PUT", "POST").Handler(deploy.ValidateHandler())
+	// Read-only endpoints used by the Nomad CLI to monitor a registered job.
+	for _, prefix := range []string{"/v1/job/", "/v1/evaluation/", "/v1/deployment/"} {
+		t.Server.HTTP.PathPrefix(prefix).Methods("GET").Handler(deploy.ProxyHandler())
+	}
 
 	t.Deployer = deploy
 	return t.Deployer, nil
 }
 
 func (t *Atc) initEventSink() (services.Service, error) {
-	sink, err := event_sink.New(t.logger)
+	sink, err := event_sink.New(t.Cfg.EventSink, t.NomadClient, t.Leader, t.logger, t.Server.Registerer)
 	if err != nil {
 		return nil, err
 	}
@@ -101,7 +154,13 @@ func (t *Atc) initEventSink() (services.Service, error) {
 }
 
 func (t *Atc) initForwarder() (services.Service, error) {
-	forward, err := forwarder.New(t.logger)
+	// The radar publishes the snapshots it mapped when the forwarder depends
+	// on it, so the failover targets and flapping services match them.
+	snapshots := t.Watcher.Subscribe()
+	if forwarderNeedsRadar(t.Cfg.Forwarder) {
+		snapshots = t.Radar.Subscribe()
+	}
+	forward, err := forwarder.New(t.Cfg.Forwarder, t.ConsulClient, t.ConfigEntries, t.Radar, t.Leader, snapshots, t.logger)
 	if err != nil {
 		return nil, err
 	}
@@ -110,16 +169,31 @@ func (t *Atc) initForwarder() (services.Service, error) {
 }
 
 func (t *Atc) initIncident() (services.Service, error) {
-	incident, err := incident.New(t.logger)
+	incident, err := incident.New(t.Cfg.Incident, t.ConfigEntries, t.Leader, t.Watcher.Subscribe(), t.logger, t.Server.Registerer)
 	if err != nil {
 		return nil, err
 	}
+
+	t.Server.HTTP.Path("/v1/incidents").Methods("GET").Handler(incident.IncidentsHandler())
+	t.Server.HTTP.Path("/v1/incidents/{id}").Methods("GET").Handler(incident.IncidentHandler())
+	t.Server.HTTP.Path("/v1/incidents/{id}/acknowledge").Methods("PUT", "POST").Handler(incident.AcknowledgeHandler())
+
 	t.Incident = incident
 	return t.Incident, nil
 }
 
+func (t *Atc) initLeader() (services.Service, error) {
+	elector, err := leader.New(t.Cfg.Leader, t.ConsulClient, t.logger, t.Server.Registerer)
+	if err != nil {
+		return nil, err
+	}
+	t.Leader = elector
+	return t.Leader, nil
+}
+
 func (t *Atc) initServer() (services.Service, error) {
 
+	t.Cfg.Server.MetricsNamespace = "atc"
 	t.Cfg.Server.RegisterInstrumentation = true
 	atc_server.DisableSignalHandling(&t.Cfg.Server)
 
@@ -159,16 +233,22 @@ func (t *Atc) initServer() (services.Service, error) {
 }
 
 func (t *Atc) initRadar() (services.Service, error) {
-	rdr, err := radar.New(t.logger)
+	rdr, err := radar.New(t.Cfg.Radar, t.ConsulClient, t.Watcher.Subscribe(), t.logger, t.Server.Registerer)
 	if err != nil {
 		return nil, err
 	}
+
+	t.Server.HTTP.Path("/v1/radar/graph").Methods("GET").Handler(rdr.GraphHandler())
+	t.Server.HTTP.Path("/v1/radar/failover").Methods("GET").Handler(rdr.FailoversHandler())
+	t.Server.HTTP.Path("/v1/radar/failover/{service}").Methods("GET").Handler(rdr.FailoverHandler())
+	t.Server.HTTP.Path("/v1/radar/flapping").Methods("GET").Handler(rdr.FlappingHandler())
+
 	t.Radar = rdr
 	return t.Radar, nil
 }
 
 func (t *Atc) initRedirecter() (services.Service, error) {
-	redirect, err := redirecter.New(t.logger)
+	redirect, err := redirecter.New(t.Cfg.Redirecter, t.ConfigEntries, t.Leader, t.Watcher.Subscribe(), t.logger)
 	if err != nil {
 		return nil, err
 	}
@@ -176,10 +256,28 @@ func (t *Atc) initRedirecter() (services.Service, error) {
 	return t.Redirecter, nil
 }
 
+func (t *Atc) initWatcher() (services.Service, error) {
+	w, err := watcher.New(t.Cfg.Watcher, t.ConsulClient, t.logger, t.Server.Registerer)
+	if err != nil {
+		return nil, err
+	}
+	t.Watcher = w
+	return t.Watcher, nil
+}
+
+// forwarderNeedsRadar reports whether the forwarder ranks its failover
+// targets or suppresses flapping services with the radar.
+func forwarderNeedsRadar(cfg forwarder.Config) bool {
+	return len(cfg.Datacenters) == 0 || cfg.SuppressFlapping
+}
+
 func (t *Atc) setupModuleManager() error {
 	mm := modules.NewManager(t.logger)
 	mm.RegisterModule(Server, t.initServer, modules.UserInvisibleModule)
 	mm.RegisterModule(API, t.initAPI, modules.UserInvisibleModule)
+	mm.RegisterModule(Watcher, t.initWatcher, modules.UserInvisibleModule)
+	mm.RegisterModule(ConfigEntries, t.initConfigEntries, modules.UserInvisibleModule)
+	mm.RegisterModule(Leader, t.initLeader, modules.UserInvisibleModule)
 	mm.RegisterModule(Autoscaler, t.initAutoscaler)
 	mm.RegisterModule(Deployer, t.initDeployer)
 	mm.RegisterModule(EventSink, t.initEventSink)
@@ -187,24 +285,30 @@ func (t *Atc) setupModuleManager() error {
 	mm.RegisterModule(Incident, t.initIncident)
 	mm.RegisterModule(Radar, t.initRadar)
 	mm.RegisterModule(Redirecter, t.initRedirecter)
-	mm.RegisterModule(Boundary, nil)
+	mm.RegisterModule(Boundary, t.initBoundary)
 	mm.RegisterModule(Consul, nil)
 	mm.RegisterModule(Nomad, nil)
 	mm.RegisterModule(All, nil)
 
 	deps := map[string][]string{
-		API:        {Server},
-		Autoscaler: {Server},
-		Boundary:   {Incident},
-		Consul:     {Forwarder, Redirecter},
-		Deployer:   {API},
-		EventSink:  {Server},
-		Forwarder:  {Server},
-		Incident:   {API},
-		Nomad:      {Autoscaler, Deployer, EventSink},
-		Radar:      {Server},
-		Redirecter: {Server},
-		All:        {Boundary, Consul, Nomad},
+		API:           {Server, Leader},
+		Autoscaler:    {Server, Leader, Watcher},
+		Boundary:      {Incident, Leader},
+		ConfigEntries: {Server},
+		Consul:        {Forwarder, Redirecter},
+		Deployer:      {API, Watcher},
+		EventSink:     {Server, Leader},
+		Forwarder:     {Server, ConfigEntries, Leader, Watcher},
+		Incident:      {API, ConfigEntries, Leader, Watcher},
+		Leader:        {Server},
+		Nomad:         {Autoscaler, Deployer, EventSink},
+		Radar:         {Server, Watcher},
+		Redirecter:    {Server, ConfigEntries, Leader, Watcher},
+		Watcher:       {Server},
+		All:           {Boundary, Consul, Nomad},
+	}
+	if forwarderNeedsRadar(t.Cfg.Forwarder) {
+		deps[Forwarder] = append(deps[Forwarder], Radar)
 	}
 	for mod, targets := range deps {
 		if err := mm.AddDependency(mod, targets...); err != nil {
@@ -0,0 +1,122 @@
+package nomad
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/grafana/dskit/flagext"
+	"github.com/hashicorp/go-cleanhttp"
+	"github.com/hashicorp/nomad/api"
+)
+
+// Config configures the Nomad client shared by all modules. Settings left
+// empty fall back to the NOMAD_* environment variables and the defaults of
+// the Nomad API client.
+type Config struct {
+	Address   string         `yaml:"address"`
+	Region    string         `yaml:"region"`
+	Namespace string         `yaml:"namespace"`
+	Token     flagext.Secret `yaml:"token"`
+	TLS       TLSConfig      `yaml:"tls"`
+}
+
+type TLSConfig struct {
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	ServerName         string `yaml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.Address, "nomad.address", "", "Address of the Nomad API, e.g. http://127.0.0.1:4646. Defaults to NOMAD_ADDR.")
+	f.StringVar(&cfg.Region, "nomad.region", "", "Region to use. Defaults to the region of the agent.")
+	f.StringVar(&cfg.Namespace, "nomad.namespace", "", "Namespace to use. Defaults to the default namespace.")
+	f.Var(&cfg.Token, "nomad.token", "ACL token used by ATC to authenticate with Nomad. Defaults to NOMAD_TOKEN.")
+	f.StringVar(&cfg.TLS.CAFile, "nomad.tls.ca-file", "", "CA certificate used to verify the Nomad API.")
+	f.StringVar(&cfg.TLS.CertFile, "nomad.tls.cert-file", "", "Client certificate presented to the Nomad API.")
+	f.StringVar(&cfg.TLS.KeyFile, "nomad.tls.key-file", "", "Private key of the client certificate.")
+	f.StringVar(&cfg.TLS.ServerName, "nomad.tls.server-name", "", "Server name used to verify the certificate of the Nomad API.")
+	f.BoolVar(&cfg.TLS.InsecureSkipVerify, "nomad.tls.insecure-skip-verify", false, "Skip verification of the certificate of the Nomad API.")
+}
+
+func (cfg *Config) Validate() error {
+	if cfg.Address != "" {
+		if _, err := url.Parse(cfg.Address); err != nil {
+			return fmt.Errorf("invalid nomad address: %w", err)
+		}
+	}
+	if (cfg.TLS.CertFile == "") != (cfg.TLS.KeyFile == "") {
+		return fmt.Errorf("nomad tls cert file and key file must be set together")
+	}
+	return nil
+}
+
+// Client is a Nomad API client that also exposes the address and HTTP client
+// it connects with, so requests can be passed through to Nomad verbatim.
+type Client struct {
+	*api.Client
+
+	Address    *url.URL
+	HTTPClient *http.Client
+}
+
+// NewClient creates a Nomad API client from the configuration.
+func NewClient(cfg Config) (*Client, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	conf := api.DefaultConfig()
+	if cfg.Address != "" {
+		conf.Address = cfg.Address
+	}
+	if cfg.Region != "" {
+		conf.Region = cfg.Region
+	}
+	if cfg.Namespace != "" {
+		conf.Namespace = cfg.Namespace
+	}
+	if token := cfg.Token.String(); token != "" {
+		conf.SecretID = token
+	}
+	if cfg.TLS.CAFile != "" {
+		conf.TLSConfig.CACert = cfg.TLS.CAFile
+	}
+	if cfg.TLS.CertFile != "" {
+		conf.TLSConfig.ClientCert = cfg.TLS.CertFile
+		conf.TLSConfig.ClientKey = cfg.TLS.KeyFile
+	}
+	if cfg.TLS.ServerName != "" {
+		conf.TLSConfig.TLSServerName = cfg.TLS.ServerName
+	}
+	if cfg.TLS.InsecureSkipVerify {
+		conf.TLSConfig.Insecure = true
+	}
+
+	address, err := url.Parse(conf.Address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid nomad address %q: %w", conf.Address, err)
+	}
+
+	// The HTTP client is set up here rather than by the Nomad API client so
+	// it can be shared with the modules that proxy requests to Nomad.
+	conf.HttpClient = cleanhttp.DefaultPooledClient()
+	conf.HttpClient.Transport.(*http.Transport).TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	if err := api.ConfigureTLS(conf.HttpClient, conf.TLSConfig); err != nil {
+		return nil, fmt.Errorf("failed to configure nomad tls: %w", err)
+	}
+
+	client, err := api.NewClient(conf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create nomad client: %w", err)
+	}
+	return &Client{
+		Client:     client,
+		Address:    address,
+		HTTPClient: conf.HttpClient,
+	}, nil
+}
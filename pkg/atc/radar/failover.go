@@ -0,0 +1,104 @@
+package radar
+
+import (
+	"sort"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Target is a datacenter or cluster peer a service can fail over to.
+type Target struct {
+	Datacenter string `json:"datacenter,omitempty"`
+	Peer       string `json:"peer,omitempty"`
+	Passing    int    `json:"passing"`
+	Total      int    `json:"total"`
+	// Ratio is the ratio of passing instances.
+	Ratio float64 `json:"ratio"`
+	// RTT is the estimated round trip time to the datacenter in seconds,
+	// from the network coordinates of the Consul servers. It is not known
+	// for cluster peers.
+	RTT float64 `json:"rtt_seconds,omitempty"`
+}
+
+// failoverTargets ranks the remote datacenters and cluster peers with
+// passing instances of a service, by the ratio of passing instances, then by
+// round trip time and then by name. Targets below the minimum ratio are left
+// out.
+func failoverTargets(s Service, local string, rtt map[string]time.Duration, minRatio float64) []Target {
+	var targets []Target
+	add := func(t Target, i Instances) {
+		t.Passing = i.Passing
+		t.Total = i.Passing + i.Warning + i.Critical + i.Maintenance
+		if t.Passing == 0 {
+			return
+		}
+		t.Ratio = float64(t.Passing) / float64(t.Total)
+		if t.Ratio < minRatio {
+			return
+		}
+		targets = append(targets, t)
+	}
+	for dc, i := range s.Datacenters {
+		if dc == local {
+			continue
+		}
+		add(Target{Datacenter: dc, RTT: rtt[dc].Seconds()}, i)
+	}
+	for peer, i := range s.Peers {
+		add(Target{Peer: peer}, i)
+	}
+
+	sort.Slice(targets, func(i, j int) bool {
+		a, b := targets[i], targets[j]
+		if a.Ratio != b.Ratio {
+			return a.Ratio > b.Ratio
+		}
+		// Targets with a known round trip time go first.
+		if (a.RTT == 0) != (b.RTT == 0) {
+			return a.RTT != 0
+		}
+		if a.RTT != b.RTT {
+			return a.RTT < b.RTT
+		}
+		if a.Datacenter != b.Datacenter {
+			return a.Datacenter < b.Datacenter
+		}
+		return a.Peer < b.Peer
+	})
+	return targets
+}
+
+// datacenterRTT estimates the round trip time from the local datacenter to
+// every other datacenter as the median of the distances between their
+// servers, like Consul sorts the datacenters.
+func datacenterRTT(local string, coords []*api.CoordinateDatacenterMap) map[string]time.Duration {
+	var servers []api.CoordinateEntry
+	for _, dc := range coords {
+		if dc.Datacenter == local {
+			servers = append(servers, dc.Coordinates...)
+		}
+	}
+
+	rtt := map[string]time.Duration{}
+	for _, dc := range coords {
+		if dc.Datacenter == local {
+			continue
+		}
+		var distances []time.Duration
+		for _, a := range servers {
+			for _, b := range dc.Coordinates {
+				if a.Coord == nil || b.Coord == nil || !a.Coord.IsCompatibleWith(b.Coord) {
+					continue
+				}
+				distances = append(distances, a.Coord.DistanceTo(b.Coord))
+			}
+		}
+		if len(distances) == 0 {
+			continue
+		}
+		sort.Slice(distances, func(i, j int) bool { return distances[i] < distances[j] })
+		rtt[dc.Datacenter] = distances[len(distances)/2]
+	}
+	return rtt
+}
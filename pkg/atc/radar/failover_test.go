@@ -0,0 +1,98 @@
+package radar
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestFailoverTargets(t *testing.T) {
+	passing := func(passing, total int) Instances { return Instances{Passing: passing, Critical: total - passing} }
+	dc := func(name string, passing, total int, rtt time.Duration) Target {
+		return Target{Datacenter: name, Passing: passing, Total: total, Ratio: float64(passing) / float64(total), RTT: rtt.Seconds()}
+	}
+	peer := func(name string, passing, total int) Target {
+		return Target{Peer: name, Passing: passing, Total: total, Ratio: float64(passing) / float64(total)}
+	}
+
+	tests := map[string]struct {
+		datacenters map[string]Instances
+		peers       map[string]Instances
+		rtt         map[string]time.Duration
+		minRatio    float64
+		want        []Target
+	}{
+		"by ratio": {
+			datacenters: map[string]Instances{"dc2": passing(1, 2), "dc3": passing(2, 2)},
+			peers:       map[string]Instances{"p1": passing(3, 4)},
+			rtt:         map[string]time.Duration{"dc2": 10 * time.Millisecond, "dc3": 90 * time.Millisecond},
+			want:        []Target{dc("dc3", 2, 2, 90*time.Millisecond), peer("p1", 3, 4), dc("dc2", 1, 2, 10*time.Millisecond)},
+		},
+		"by round trip time": {
+			datacenters: map[string]Instances{"dc2": passing(2, 2), "dc3": passing(2, 2), "dc4": passing(2, 2)},
+			rtt:         map[string]time.Duration{"dc2": 50 * time.Millisecond, "dc3": 20 * time.Millisecond},
+			want:        []Target{dc("dc3", 2, 2, 20*time.Millisecond), dc("dc2", 2, 2, 50*time.Millisecond), dc("dc4", 2, 2, 0)},
+		},
+		// Peers have no datacenter, so they go before the datacenters
+		// without a round trip time.
+		"by name": {
+			datacenters: map[string]Instances{"dc3": passing(1, 1), "dc2": passing(1, 1)},
+			peers:       map[string]Instances{"p2": passing(1, 1), "p1": passing(1, 1)},
+			want:        []Target{peer("p1", 1, 1), peer("p2", 1, 1), dc("dc2", 1, 1, 0), dc("dc3", 1, 1, 0)},
+		},
+		"without the local datacenter and unhealthy targets": {
+			datacenters: map[string]Instances{"dc1": passing(2, 2), "dc2": passing(0, 2), "dc3": passing(1, 3)},
+			peers:       map[string]Instances{"p1": passing(0, 1)},
+			want:        []Target{dc("dc3", 1, 3, 0)},
+		},
+		"below the min ratio": {
+			datacenters: map[string]Instances{"dc2": passing(1, 2), "dc3": passing(1, 3)},
+			minRatio:    0.5,
+			want:        []Target{dc("dc2", 1, 2, 0)},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			s := Service{Name: "web", Datacenters: tc.datacenters, Peers: tc.peers}
+			if got := failoverTargets(s, "dc1", tc.rtt, tc.minRatio); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("targets = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDatacenterRTT(t *testing.T) {
+	// The servers are placed on a line, with their distance in seconds.
+	server := func(x float64) string {
+		return `{"Node": "server", "Coord": {"Vec": [` + strconv.FormatFloat(x, 'f', -1, 64) + `, 0], "Error": 1.5, "Adjustment": 0, "Height": 0}}`
+	}
+	var coords []*api.CoordinateDatacenterMap
+	if err := json.Unmarshal([]byte(`[
+		{"Datacenter": "dc1", "Coordinates": [`+server(0)+`]},
+		{"Datacenter": "dc2", "Coordinates": [`+server(0.010)+`, `+server(0.030)+`, `+server(0.020)+`]},
+		{"Datacenter": "dc3", "Coordinates": [`+server(0.050)+`, {"Node": "old", "Coord": {"Vec": [0.001, 0, 0]}}, {"Node": "new"}]},
+		{"Datacenter": "dc4", "Coordinates": [{"Node": "old", "Coord": {"Vec": [0.001, 0, 0]}}]}
+	]`), &coords); err != nil {
+		t.Fatal(err)
+	}
+
+	rtt := datacenterRTT("dc1", coords)
+	want := map[string]time.Duration{
+		// The median of the distances to the servers.
+		"dc2": 20 * time.Millisecond,
+		// Servers without or with incompatible coordinates are skipped.
+		"dc3": 50 * time.Millisecond,
+	}
+	if len(rtt) != len(want) {
+		t.Fatalf("rtt = %v, want %v", rtt, want)
+	}
+	for dc, d := range want {
+		if diff := rtt[dc] - d; diff < -time.Microsecond || diff > time.Microsecond {
+			t.Errorf("rtt to %s = %s, want %s", dc, rtt[dc], d)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package radar
+
+import (
+	"sort"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+
+	"github.com/attachmentgenie/atc/pkg/atc/watcher"
+)
+
+// Kinds of transitions.
+const (
+	// TransitionCheck is a change of the status of a check.
+	TransitionCheck = "check"
+	// TransitionRegistered is a new instance of a service.
+	TransitionRegistered = "registered"
+	// TransitionDeregistered is an instance that left the catalog.
+	TransitionDeregistered = "deregistered"
+)
+
+// Transition is a change of a service in the local datacenter.
+type Transition struct {
+	Time time.Time `json:"time"`
+	Kind string    `json:"kind"`
+	Node string    `json:"node"`
+	// Instance is the ID of the instance, which is the Connect proxy of the
+	// service for transitions of its proxy.
+	Instance string `json:"instance"`
+	Check    string `json:"check,omitempty"`
+	From     string `json:"from,omitempty"`
+	To       string `json:"to,omitempty"`
+
+	service string
+	// subject is the check or instance that changed.
+	subject string
+}
+
+// Flapping is the history of a service within the flap window.
+type Flapping struct {
+	Service string `json:"service"`
+	// Score is the highest number of transitions of a single check or
+	// instance of the service within the flap window, so an outage that
+	// takes every instance down at once scores 1.
+	Score    int  `json:"score"`
+	Flapping bool `json:"flapping"`
+	// Since is when the service started flapping.
+	Since       *time.Time   `json:"since,omitempty"`
+	Transitions []Transition `json:"transitions"`
+}
+
+type instanceKey struct {
+	node string
+	id   string
+}
+
+type checkKey struct {
+	node string
+	id   string
+}
+
+type checkState struct {
+	serviceID string
+	status    string
+}
+
+// flapDetector keeps the transitions of the services between snapshots, and
+// flags the services with a check or instance that changed more than
+// threshold times within the window.
+type flapDetector struct {
+	window    time.Duration
+	threshold int
+
+	// instances maps the instances of the last snapshot to their service,
+	// checks the checks of the instances to their status. Both are nil
+	// until the first snapshot, which has no transitions.
+	instances map[instanceKey]string
+	checks    map[checkKey]checkState
+
+	history map[string][]Transition
+	since   map[string]time.Time
+}
+
+func newFlapDetector(window time.Duration, threshold int) *flapDetector {
+	return &flapDetector{
+		window:    window,
+		threshold: threshold,
+		history:   map[string][]Transition{},
+		since:     map[string]time.Time{},
+	}
+}
+
+// observe records the transitions from the previous snapshot. Connect proxies
+// count for the service they represent, checks of nodes for no service.
+func (d *flapDetector) observe(snapshot *watcher.Snapshot, now time.Time) []Transition {
+	instances := map[instanceKey]string{}
+	for name, list := range snapshot.Instances {
+		for _, i := range list {
+			service := name
+			if i.Kind == string(api.ServiceKindConnectProxy) && i.Destination != "" {
+				service = i.Destination
+			}
+			instances[instanceKey{i.Node, i.ID}] = service
+		}
+	}
+	checks := map[checkKey]checkState{}
+	for _, c := range snapshot.Checks {
+		if c.ServiceID != "" {
+			checks[checkKey{c.Node, c.CheckID}] = checkState{c.ServiceID, c.Status}
+		}
+	}
+
+	var transitions []Transition
+	record := func(service string, t Transition) {
+		t.Time, t.service = now, service
+		d.history[service] = append(d.history[service], t)
+		transitions = append(transitions, t)
+	}
+	if d.instances != nil {
+		for key, service := range instances {
+			if _, ok := d.instances[key]; !ok {
+				record(service, Transition{Kind: TransitionRegistered, Node: key.node, Instance: key.id, subject: "instance/" + key.node + "/" + key.id})
+			}
+		}
+		for key, service := range d.instances {
+			if _, ok := instances[key]; !ok {
+				record(service, Transition{Kind: TransitionDeregistered, Node: key.node, Instance: key.id, subject: "instance/" + key.node + "/" + key.id})
+			}
+		}
+		for key, c := range checks {
+			service, ok := instances[instanceKey{key.node, c.serviceID}]
+			if !ok {
+				continue
+			}
+			// Checks of new instances have no previous status.
+			prev, ok := d.checks[key]
+			if !ok || prev.status == c.status {
+				continue
+			}
+			record(service, Transition{Kind: TransitionCheck, Node: key.node, Instance: c.serviceID, Check: key.id, From: prev.status, To: c.status, subject: "check/" + key.node + "/" + key.id})
+		}
+	}
+	d.instances, d.checks = instances, checks
+	return transitions
+}
+
+// report drops the transitions outside the window and scores the services
+// with transitions within it, the highest scores first.
+func (d *flapDetector) report(now time.Time) []Flapping {
+	var result []Flapping
+	for service, history := range d.history {
+		i := sort.Search(len(history), func(i int) bool {
+			return now.Sub(history[i].Time) < d.window
+		})
+		history = history[i:]
+		if len(history) == 0 {
+			delete(d.history, service)
+			delete(d.since, service)
+			continue
+		}
+		d.history[service] = history
+
+		counts := map[string]int{}
+		score := 0
+		for _, t := range history {
+			counts[t.subject]++
+			score = max(score, counts[t.subject])
+		}
+		f := Flapping{
+			Service:     service,
+			Score:       score,
+			Flapping:    score > d.threshold,
+			Transitions: append([]Transition(nil), history...),
+		}
+		if f.Flapping {
+			since, ok := d.since[service]
+			if !ok {
+				since = now
+				d.since[service] = since
+			}
+			f.Since = &since
+		} else {
+			delete(d.since, service)
+		}
+		result = append(result, f)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Score != result[j].Score {
+			return result[i].Score > result[j].Score
+		}
+		return result[i].Service < result[j].Service
+	})
+	return result
+}
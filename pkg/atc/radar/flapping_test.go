@@ -0,0 +1,167 @@
+package radar
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+
+	"github.com/attachmentgenie/atc/pkg/atc/watcher"
+)
+
+// testInstance is a service instance with a single check of the given status.
+type testInstance struct {
+	service, id, status string
+	proxyFor            string
+}
+
+func testSnapshot(instances ...testInstance) *watcher.Snapshot {
+	s := &watcher.Snapshot{Services: map[string][]string{}, Instances: map[string][]watcher.Instance{}}
+	for _, i := range instances {
+		wi := watcher.Instance{ID: i.id, Service: i.service, Node: "n1", Status: i.status}
+		if i.proxyFor != "" {
+			wi.Kind, wi.Destination = string(api.ServiceKindConnectProxy), i.proxyFor
+		}
+		s.Services[i.service] = nil
+		s.Instances[i.service] = append(s.Instances[i.service], wi)
+		s.Checks = append(s.Checks, &api.HealthCheck{Node: "n1", CheckID: "check-" + i.id, ServiceID: i.id, ServiceName: i.service, Status: i.status})
+	}
+	return s
+}
+
+// webInstances returns n instances of web with the given status.
+func webInstances(n int, status string) []testInstance {
+	var list []testInstance
+	for i := 0; i < n; i++ {
+		list = append(list, testInstance{service: "web", id: fmt.Sprintf("web-%d", i), status: status})
+	}
+	return list
+}
+
+// flaps alternates an instance of web between passing and critical.
+func flaps(n int) [][]testInstance {
+	steps := [][]testInstance{{{service: "web", id: "web-0", status: api.HealthPassing}}}
+	for i := 0; i < n; i++ {
+		status := api.HealthCritical
+		if i%2 == 1 {
+			status = api.HealthPassing
+		}
+		steps = append(steps, []testInstance{{service: "web", id: "web-0", status: status}})
+	}
+	return steps
+}
+
+func TestFlapDetector(t *testing.T) {
+	const threshold = 5
+	window := 10 * time.Minute
+
+	tests := map[string]struct {
+		steps [][]testInstance
+		// interval between the snapshots of the steps.
+		interval time.Duration
+		// report is the time after the last snapshot of the report.
+		report   time.Duration
+		want     map[string]int
+		flapping []string
+	}{
+		"first snapshot has no transitions": {
+			steps: [][]testInstance{webInstances(3, api.HealthCritical)},
+			want:  map[string]int{},
+		},
+		"outage of every instance at once scores 1": {
+			steps: [][]testInstance{webInstances(8, api.HealthPassing), webInstances(8, api.HealthCritical)},
+			want:  map[string]int{"web": 1},
+		},
+		"outage and recovery of every instance scores 2": {
+			steps: [][]testInstance{webInstances(8, api.HealthPassing), webInstances(8, api.HealthCritical), webInstances(8, api.HealthPassing)},
+			want:  map[string]int{"web": 2},
+		},
+		"threshold of flips is not flapping": {
+			steps: flaps(threshold),
+			want:  map[string]int{"web": threshold},
+		},
+		"more flips than the threshold is flapping": {
+			steps:    flaps(threshold + 1),
+			want:     map[string]int{"web": threshold + 1},
+			flapping: []string{"web"},
+		},
+		"flips outside the window are dropped": {
+			steps:    flaps(threshold + 1),
+			interval: time.Minute,
+			report:   6 * time.Minute,
+			// The flips at 3, 4, 5 and 6 minutes are within 10 minutes
+			// of the report at 12 minutes.
+			want: map[string]int{"web": 4},
+		},
+		"every flip outside the window forgets the service": {
+			steps:  flaps(threshold + 1),
+			report: window,
+			want:   map[string]int{},
+		},
+		"instance churn": {
+			steps: [][]testInstance{
+				{}, webInstances(1, api.HealthPassing), {}, webInstances(1, api.HealthPassing),
+				{}, webInstances(1, api.HealthPassing), {},
+			},
+			want:     map[string]int{"web": 6},
+			flapping: []string{"web"},
+		},
+		"proxies count for their destination": {
+			steps: [][]testInstance{
+				{{service: "web-sidecar-proxy", id: "p", status: api.HealthPassing, proxyFor: "web"}},
+				{{service: "web-sidecar-proxy", id: "p", status: api.HealthCritical, proxyFor: "web"}},
+			},
+			want: map[string]int{"web": 1},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			d := newFlapDetector(window, threshold)
+			now := time.Unix(0, 0)
+			for i, step := range tc.steps {
+				if i > 0 {
+					now = now.Add(tc.interval)
+				}
+				d.observe(testSnapshot(step...), now)
+			}
+
+			report := d.report(now.Add(tc.report))
+			got := map[string]int{}
+			var flapping []string
+			for _, f := range report {
+				got[f.Service] = f.Score
+				if f.Flapping {
+					flapping = append(flapping, f.Service)
+					if f.Since == nil {
+						t.Errorf("flapping service %s has no since", f.Service)
+					}
+				}
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+				t.Errorf("scores = %v, want %v", got, tc.want)
+			}
+			if fmt.Sprint(flapping) != fmt.Sprint(tc.flapping) {
+				t.Errorf("flapping = %v, want %v", flapping, tc.flapping)
+			}
+		})
+	}
+}
+
+func TestFlapDetectorSince(t *testing.T) {
+	d := newFlapDetector(10*time.Minute, 1)
+	now := time.Unix(0, 0)
+	for _, step := range flaps(2) {
+		d.observe(testSnapshot(step...), now)
+	}
+
+	first := d.report(now)
+	later := d.report(now.Add(time.Minute))
+	if len(first) != 1 || len(later) != 1 || first[0].Since == nil || later[0].Since == nil {
+		t.Fatalf("expected web to be flapping, got %+v and %+v", first, later)
+	}
+	if !first[0].Since.Equal(*later[0].Since) {
+		t.Errorf("since moved from %s to %s", first[0].Since, later[0].Since)
+	}
+}
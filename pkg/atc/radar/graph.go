@@ -0,0 +1,334 @@
+package radar
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+
+	"github.com/attachmentgenie/atc/pkg/atc/watcher"
+)
+
+// Kinds of dependencies.
+const (
+	// EdgeUpstream is a Connect upstream of a service.
+	EdgeUpstream = "upstream"
+	// EdgeIntention is an intention from a source to a destination service.
+	EdgeIntention = "intention"
+)
+
+// Graph is the topology of the services in the Consul catalog.
+type Graph struct {
+	Datacenter string    `json:"datacenter"`
+	Updated    time.Time `json:"updated"`
+	Services   []Service `json:"services"`
+	Edges      []Edge    `json:"edges"`
+}
+
+// Service is a service on the graph.
+type Service struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+	// Status is the status of the service in the local datacenter: passing,
+	// warning when some instances are not passing, critical when none can
+	// serve traffic, or empty when it has no local instances.
+	Status string `json:"status,omitempty"`
+	// Datacenters holds the instances of the service per datacenter, Peers
+	// the instances imported from cluster peers.
+	Datacenters map[string]Instances `json:"datacenters"`
+	Peers       map[string]Instances `json:"peers,omitempty"`
+	// Impacted are the services that depend on the service, directly or
+	// through other services.
+	Impacted []string `json:"impacted,omitempty"`
+	// Failover ranks the healthy datacenters and peers to fail over to.
+	Failover []Target `json:"failover,omitempty"`
+	// Flapping is set when a check or instance of the service changed more
+	// than the flap threshold within the flap window.
+	Flapping bool `json:"flapping,omitempty"`
+}
+
+// Instances counts the instances of a service per aggregated status.
+type Instances struct {
+	Passing     int `json:"passing"`
+	Warning     int `json:"warning"`
+	Critical    int `json:"critical"`
+	Maintenance int `json:"maintenance"`
+}
+
+func instances(h watcher.Health) Instances {
+	return Instances{Passing: h.Passing, Warning: h.Warning, Critical: h.Critical, Maintenance: h.Maintenance}
+}
+
+// Edge is a dependency of the From service on the To service.
+type Edge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Kind string `json:"kind"`
+	// Action is the action of an intention, allow, deny or permissions.
+	Action string `json:"action,omitempty"`
+	// Datacenter or Peer are set for upstreams outside the local
+	// datacenter, Peer for intentions from a cluster peer.
+	Datacenter string `json:"datacenter,omitempty"`
+	Peer       string `json:"peer,omitempty"`
+}
+
+// local reports whether the dependency is within the local datacenter.
+func (e Edge) local() bool {
+	return e.Datacenter == "" && e.Peer == ""
+}
+
+// dependency reports whether the From service needs the To service, so it
+// is impacted when the To service goes critical.
+func (e Edge) dependency() bool {
+	if !e.local() || e.From == "*" || e.To == "*" {
+		return false
+	}
+	return e.Kind == EdgeUpstream || e.Action == string(api.IntentionActionAllow)
+}
+
+type intention struct {
+	source      string
+	destination string
+	peer        string
+	action      string
+}
+
+// buildGraph maps the services of the local snapshot, the remote datacenters
+// and the cluster peers. Connect proxies are not services of their own, their
+// upstreams are dependencies of the service they represent.
+func buildGraph(t topology, snapshot *watcher.Snapshot, minRatio float64, now time.Time) Graph {
+	local := t.local
+	g := Graph{Datacenter: local, Updated: now}
+	svcs := map[string]*Service{}
+	service := func(name string) *Service {
+		s, ok := svcs[name]
+		if !ok {
+			s = &Service{Name: name, Tags: []string{}, Datacenters: map[string]Instances{}}
+			svcs[name] = s
+		}
+		return s
+	}
+	edges := map[Edge]struct{}{}
+
+	for name, list := range snapshot.Instances {
+		proxy := false
+		for _, i := range list {
+			if i.Kind != string(api.ServiceKindConnectProxy) {
+				continue
+			}
+			proxy = true
+			for _, u := range i.Upstreams {
+				edges[Edge{From: i.Destination, To: u.Service, Kind: EdgeUpstream, Datacenter: u.Datacenter, Peer: u.Peer}] = struct{}{}
+			}
+		}
+		if proxy {
+			continue
+		}
+
+		h := snapshot.Health(name)
+		s := service(name)
+		s.Tags = mergeTags(s.Tags, snapshot.Services[name])
+		s.Datacenters[local] = instances(h)
+		s.Status = status(h)
+	}
+
+	for dc, state := range t.datacenters {
+		for name, h := range state.health {
+			s := service(name)
+			s.Tags = mergeTags(s.Tags, state.tags[name])
+			s.Datacenters[dc] = instances(h)
+		}
+	}
+	for peer, state := range t.peers {
+		for name, h := range state.health {
+			s := service(name)
+			s.Tags = mergeTags(s.Tags, state.tags[name])
+			if s.Peers == nil {
+				s.Peers = map[string]Instances{}
+			}
+			s.Peers[peer] = instances(h)
+		}
+	}
+
+	for _, i := range t.intentions {
+		edges[Edge{From: i.source, To: i.destination, Kind: EdgeIntention, Action: i.action, Peer: i.peer}] = struct{}{}
+	}
+
+	for e := range edges {
+		g.Edges = append(g.Edges, e)
+	}
+	sort.Slice(g.Edges, func(i, j int) bool {
+		a, b := g.Edges[i], g.Edges[j]
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		if a.To != b.To {
+			return a.To < b.To
+		}
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		if a.Datacenter != b.Datacenter {
+			return a.Datacenter < b.Datacenter
+		}
+		if a.Peer != b.Peer {
+			return a.Peer < b.Peer
+		}
+		return a.Action < b.Action
+	})
+
+	for _, s := range svcs {
+		s.Impacted = impacted(g.Edges, s.Name)
+		s.Failover = failoverTargets(*s, local, t.rtt, minRatio)
+		g.Services = append(g.Services, *s)
+	}
+	sort.Slice(g.Services, func(i, j int) bool {
+		return g.Services[i].Name < g.Services[j].Name
+	})
+	return g
+}
+
+func status(h watcher.Health) string {
+	switch {
+	case h.Total() == 0:
+		return ""
+	case !h.Available():
+		return api.HealthCritical
+	case h.Critical+h.Warning+h.Maintenance > 0:
+		return api.HealthWarning
+	}
+	return api.HealthPassing
+}
+
+func mergeTags(tags, more []string) []string {
+	for _, t := range more {
+		if !slices.Contains(tags, t) {
+			tags = append(tags, t)
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// impacted walks the dependencies back from a service to every service that
+// depends on it.
+func impacted(edges []Edge, service string) []string {
+	dependents := map[string][]string{}
+	for _, e := range edges {
+		if e.dependency() {
+			dependents[e.To] = append(dependents[e.To], e.From)
+		}
+	}
+
+	seen := map[string]bool{service: true}
+	queue := []string{service}
+	var result []string
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		for _, d := range dependents[name] {
+			if seen[d] {
+				continue
+			}
+			seen[d] = true
+			result = append(result, d)
+			queue = append(queue, d)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Colors of the services in the DOT rendering.
+var statusColors = map[string]string{
+	api.HealthPassing:  "palegreen",
+	api.HealthWarning:  "khaki",
+	api.HealthCritical: "salmon",
+	"":                 "lightgrey",
+}
+
+// WriteDOT renders the graph in the Graphviz DOT language. Services that
+// depend on a critical service are outlined in red, flapping services are
+// dashed.
+func (g Graph) WriteDOT(w io.Writer) error {
+	impactedBy := map[string]bool{}
+	for _, s := range g.Services {
+		if s.Status == api.HealthCritical {
+			for _, name := range s.Impacted {
+				impactedBy[name] = true
+			}
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("digraph radar {\n")
+	b.WriteString("  rankdir=LR;\n")
+	b.WriteString("  node [shape=box, style=filled];\n")
+	for _, s := range g.Services {
+		label := s.Name
+		dcs := make([]string, 0, len(s.Datacenters))
+		for dc := range s.Datacenters {
+			dcs = append(dcs, dc)
+		}
+		sort.Strings(dcs)
+		for _, dc := range dcs {
+			i := s.Datacenters[dc]
+			label += fmt.Sprintf("\n%s: %d/%d passing", dc, i.Passing, i.Passing+i.Warning+i.Critical+i.Maintenance)
+		}
+		peers := make([]string, 0, len(s.Peers))
+		for peer := range s.Peers {
+			peers = append(peers, peer)
+		}
+		sort.Strings(peers)
+		for _, peer := range peers {
+			i := s.Peers[peer]
+			label += fmt.Sprintf("\npeer %s: %d/%d passing", peer, i.Passing, i.Passing+i.Warning+i.Critical+i.Maintenance)
+		}
+
+		if s.Flapping {
+			label += "\nflapping"
+		}
+
+		attrs := fmt.Sprintf("label=%s, fillcolor=%s", dotQuote(label), statusColors[s.Status])
+		if s.Flapping {
+			attrs += `, style="filled,dashed"`
+		}
+		if impactedBy[s.Name] && s.Status != api.HealthCritical {
+			attrs += ", color=red, penwidth=2"
+		}
+		fmt.Fprintf(&b, "  %s [%s];\n", dotQuote(s.Name), attrs)
+	}
+	for _, e := range g.Edges {
+		attrs := "label=" + dotQuote(e.Kind)
+		if e.Kind == EdgeIntention {
+			attrs = "label=" + dotQuote(e.Action) + ", style=dashed"
+			if e.Action == string(api.IntentionActionDeny) {
+				attrs += ", color=red"
+			}
+		}
+		// Dependencies outside the local datacenter point at, or come from,
+		// the service in the remote datacenter or peer.
+		from, to := e.From, e.To
+		switch {
+		case e.Kind == EdgeIntention && e.Peer != "":
+			from += "@" + e.Peer
+		case !e.local():
+			to += "@" + e.Datacenter + e.Peer
+		}
+		fmt.Fprintf(&b, "  %s -> %s [%s];\n", dotQuote(from), dotQuote(to), attrs)
+	}
+	b.WriteString("}\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func dotQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + strings.ReplaceAll(s, "\n", `\n`) + `"`
+}
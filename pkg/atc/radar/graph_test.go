@@ -0,0 +1,133 @@
+package radar
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+
+	"github.com/attachmentgenie/atc/pkg/atc/watcher"
+)
+
+// shopSnapshot returns frontend, api and db with their sidecar proxies:
+// frontend calls api, and api calls db locally, in dc2 and on peer p1.
+func shopSnapshot(dbStatus string) *watcher.Snapshot {
+	s := testSnapshot(
+		testInstance{service: "frontend", id: "frontend-1", status: api.HealthPassing},
+		testInstance{service: "frontend-sidecar-proxy", id: "frontend-1-proxy", status: api.HealthPassing, proxyFor: "frontend"},
+		testInstance{service: "api", id: "api-1", status: api.HealthPassing},
+		testInstance{service: "api-sidecar-proxy", id: "api-1-proxy", status: api.HealthPassing, proxyFor: "api"},
+		testInstance{service: "api-sidecar-proxy", id: "api-2-proxy", status: api.HealthPassing, proxyFor: "api"},
+		testInstance{service: "db", id: "db-1", status: dbStatus},
+	)
+	s.Instances["frontend-sidecar-proxy"][0].Upstreams = []watcher.Upstream{{Service: "api"}}
+	s.Instances["api-sidecar-proxy"][0].Upstreams = []watcher.Upstream{{Service: "db"}, {Service: "db", Datacenter: "dc2"}}
+	// Proxies of the same service fold into the same edges.
+	s.Instances["api-sidecar-proxy"][1].Upstreams = []watcher.Upstream{{Service: "db"}, {Service: "db", Peer: "p1"}}
+	return s
+}
+
+func shopTopology() topology {
+	return topology{
+		local: "dc1",
+		datacenters: map[string]datacenter{
+			"dc2": {health: map[string]watcher.Health{"db": {Passing: 2}}},
+		},
+		peers: map[string]datacenter{
+			"p1": {health: map[string]watcher.Health{"db": {Passing: 1, Critical: 1}}},
+		},
+		intentions: []intention{
+			{source: "frontend", destination: "api", action: string(api.IntentionActionAllow)},
+			{source: "reports", destination: "db", action: string(api.IntentionActionAllow)},
+			{source: "batch", destination: "db", action: string(api.IntentionActionDeny)},
+			{source: "*", destination: "db", action: string(api.IntentionActionAllow)},
+			{source: "mobile", destination: "api", peer: "p1", action: string(api.IntentionActionAllow)},
+		},
+	}
+}
+
+func TestBuildGraph(t *testing.T) {
+	now := time.Now()
+	g := buildGraph(shopTopology(), shopSnapshot(api.HealthCritical), 0, now)
+
+	var names []string
+	for _, s := range g.Services {
+		names = append(names, s.Name)
+	}
+	if want := []string{"api", "db", "frontend"}; !slices.Equal(names, want) {
+		t.Errorf("services = %v, want %v without the proxies", names, want)
+	}
+
+	allow, deny := string(api.IntentionActionAllow), string(api.IntentionActionDeny)
+	want := []Edge{
+		{From: "*", To: "db", Kind: EdgeIntention, Action: allow},
+		{From: "api", To: "db", Kind: EdgeUpstream},
+		{From: "api", To: "db", Kind: EdgeUpstream, Peer: "p1"},
+		{From: "api", To: "db", Kind: EdgeUpstream, Datacenter: "dc2"},
+		{From: "batch", To: "db", Kind: EdgeIntention, Action: deny},
+		{From: "frontend", To: "api", Kind: EdgeIntention, Action: allow},
+		{From: "frontend", To: "api", Kind: EdgeUpstream},
+		{From: "mobile", To: "api", Kind: EdgeIntention, Action: allow, Peer: "p1"},
+		{From: "reports", To: "db", Kind: EdgeIntention, Action: allow},
+	}
+	if !reflect.DeepEqual(g.Edges, want) {
+		t.Errorf("edges = %+v, want %+v", g.Edges, want)
+	}
+
+	// The order does not depend on the iteration order of the maps.
+	for i := 0; i < 20; i++ {
+		if again := buildGraph(shopTopology(), shopSnapshot(api.HealthCritical), 0, now); !reflect.DeepEqual(again.Edges, g.Edges) {
+			t.Fatalf("edges = %+v, want %+v on every build", again.Edges, g.Edges)
+		}
+	}
+
+	db := g.Services[1]
+	if db.Status != api.HealthCritical || db.Datacenters["dc2"].Passing != 2 || db.Peers["p1"].Critical != 1 {
+		t.Errorf("db = %+v, want critical locally with instances in dc2 and p1", db)
+	}
+	// The dependents of db are impacted transitively, but not the services
+	// it only denies, matches with a wildcard or serves remotely.
+	if want := []string{"api", "frontend", "reports"}; !slices.Equal(db.Impacted, want) {
+		t.Errorf("impacted by db = %v, want %v", db.Impacted, want)
+	}
+	if len(db.Failover) != 2 || db.Failover[0].Datacenter != "dc2" || db.Failover[1].Peer != "p1" {
+		t.Errorf("failover of db = %+v, want dc2 and then p1", db.Failover)
+	}
+}
+
+func TestImpacted(t *testing.T) {
+	upstream := func(from, to string) Edge { return Edge{From: from, To: to, Kind: EdgeUpstream} }
+	tests := map[string]struct {
+		edges []Edge
+		want  []string
+	}{
+		"no dependents": {
+			edges: []Edge{upstream("a", "b")},
+		},
+		"chain": {
+			edges: []Edge{upstream("b", "db"), upstream("a", "b"), upstream("c", "a")},
+			want:  []string{"a", "b", "c"},
+		},
+		"diamond": {
+			edges: []Edge{upstream("a", "db"), upstream("b", "db"), upstream("c", "a"), upstream("c", "b")},
+			want:  []string{"a", "b", "c"},
+		},
+		"cycle": {
+			edges: []Edge{upstream("a", "db"), upstream("b", "a"), upstream("a", "b"), upstream("db", "b")},
+			want:  []string{"a", "b"},
+		},
+		"remote upstream": {
+			edges: []Edge{upstream("a", "db"), {From: "b", To: "a", Kind: EdgeUpstream, Datacenter: "dc2"}},
+			want:  []string{"a"},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := impacted(tc.edges, "db"); !slices.Equal(got, tc.want) {
+				t.Errorf("impacted = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
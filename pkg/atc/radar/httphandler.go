@@ -0,0 +1,90 @@
+package radar
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/munnerz/goautoneg"
+)
+
+const dotContentType = "text/vnd.graphviz"
+
+// GraphHandler serves the service topology as JSON, or in the Graphviz DOT
+// language when requested with format=dot or an Accept header of
+// text/vnd.graphviz.
+func (f *Radar) GraphHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		g := f.Graph()
+
+		format := r.URL.Query().Get("format")
+		if format == "" && goautoneg.Negotiate(r.Header.Get("Accept"), []string{"application/json", dotContentType}) == dotContentType {
+			format = "dot"
+		}
+
+		switch format {
+		case "dot":
+			w.Header().Set("Content-Type", dotContentType+"; charset=utf-8")
+			_ = g.WriteDOT(w)
+		case "", "json":
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(g)
+		default:
+			http.Error(w, "unknown format "+format, http.StatusBadRequest)
+		}
+	}
+}
+
+// FailoversHandler serves the ranked failover targets of every service as
+// JSON.
+func (f *Radar) FailoversHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		failovers := map[string][]Target{}
+		for _, s := range f.Graph().Services {
+			failovers[s.Name] = s.Failover
+			if s.Failover == nil {
+				failovers[s.Name] = []Target{}
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(failovers)
+	}
+}
+
+// FailoverHandler serves the ranked failover targets of a single service as
+// JSON.
+func (f *Radar) FailoverHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["service"]
+		targets, ok := f.Failover(name)
+		if !ok {
+			http.Error(w, "service not found", http.StatusNotFound)
+			return
+		}
+		if targets == nil {
+			targets = []Target{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(struct {
+			Service string   `json:"service"`
+			Targets []Target `json:"targets"`
+		}{name, targets})
+	}
+}
+
+// FlappingHandler serves the services with transitions within the flap window
+// as JSON, the highest scores first. Only the flapping services are served
+// with flapping=true.
+func (f *Radar) FlappingHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		services := []Flapping{}
+		for _, fl := range f.Flapping() {
+			if r.URL.Query().Get("flapping") == "true" && !fl.Flapping {
+				continue
+			}
+			services = append(services, fl)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(services)
+	}
+}
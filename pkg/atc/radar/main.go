@@ -2,19 +2,118 @@ package radar
 
 import (
 	"context"
+	"flag"
 	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
 	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/concurrency"
+	"github.com/grafana/dskit/flagext"
 	"github.com/grafana/dskit/services"
 	"github.com/hashicorp/consul/api"
-	"github.com/hashicorp/consul/api/watch"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/attachmentgenie/atc/pkg/atc/watcher"
 )
 
+// flapInterval is the interval at which transitions leave the flap window
+// in absence of new snapshots.
+const flapInterval = 10 * time.Second
+
+type Config struct {
+	Datacenters             flagext.StringSliceCSV `yaml:"datacenters"`
+	Peers                   flagext.StringSliceCSV `yaml:"peers"`
+	RefreshInterval         time.Duration          `yaml:"refresh_interval"`
+	CatalogConcurrency      int                    `yaml:"catalog_concurrency"`
+	FailoverMinPassingRatio float64                `yaml:"failover_min_passing_ratio"`
+	FlapWindow              time.Duration          `yaml:"flap_window"`
+	FlapThreshold           int                    `yaml:"flap_threshold"`
+}
+
+func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	f.Var(&cfg.Datacenters, "radar.datacenters", "Comma-separated list of remote datacenters to map. Defaults to all datacenters known to the local agent.")
+	f.Var(&cfg.Peers, "radar.peers", "Comma-separated list of cluster peers to map. Defaults to all active peerings of the local datacenter.")
+	f.DurationVar(&cfg.RefreshInterval, "radar.refresh-interval", time.Minute, "Interval at which the services of remote datacenters and peers, the network coordinates and the intentions are refreshed.")
+	f.IntVar(&cfg.CatalogConcurrency, "radar.catalog-concurrency", 4, "Maximum number of concurrent requests for the instances of the services of a remote datacenter or peer. Mapping one takes a request per service on every refresh.")
+	f.Float64Var(&cfg.FailoverMinPassingRatio, "radar.failover-min-passing-ratio", 0, "Minimum ratio of passing instances of a service in a datacenter or peer to be a failover target. Any passing instance is enough by default.")
+	f.DurationVar(&cfg.FlapWindow, "radar.flap-window", 10*time.Minute, "Window in which the check transitions and instance registrations and deregistrations of a service are counted.")
+	f.IntVar(&cfg.FlapThreshold, "radar.flap-threshold", 5, "A service is flapping when one of its checks or instances changed more than this number of times within the flap window.")
+}
+
+func (cfg *Config) Validate() error {
+	if cfg.RefreshInterval <= 0 {
+		return fmt.Errorf("invalid radar refresh interval: %s", cfg.RefreshInterval)
+	}
+	if cfg.CatalogConcurrency <= 0 {
+		return fmt.Errorf("invalid radar catalog concurrency: %d", cfg.CatalogConcurrency)
+	}
+	if cfg.FailoverMinPassingRatio < 0 || cfg.FailoverMinPassingRatio > 1 {
+		return fmt.Errorf("invalid radar failover min passing ratio: %v", cfg.FailoverMinPassingRatio)
+	}
+	if cfg.FlapWindow <= 0 {
+		return fmt.Errorf("invalid radar flap window: %s", cfg.FlapWindow)
+	}
+	if cfg.FlapThreshold <= 0 {
+		return fmt.Errorf("invalid radar flap threshold: %d", cfg.FlapThreshold)
+	}
+	return nil
+}
+
+// datacenter is the state of the services of a remote datacenter or a
+// cluster peer.
+type datacenter struct {
+	tags   map[string][]string
+	health map[string]watcher.Health
+}
+
+// topology is the state of the catalog outside the local snapshot.
+type topology struct {
+	// local is the name of the local datacenter.
+	local       string
+	datacenters map[string]datacenter
+	peers       map[string]datacenter
+	intentions  []intention
+	// rtt is the estimated round trip time to the remote datacenters.
+	rtt map[string]time.Duration
+}
+
+// Radar maps the services of the Consul catalog, their instances in every
+// datacenter and cluster peer and the dependencies between them declared by
+// Connect upstreams and intentions, ranks the targets each service can fail
+// over to and detects flapping services.
 type Radar struct {
 	services.Service
 
+	cfg    Config
+	client *api.Client
 	logger log.Logger
 
-	watchServicesChan chan struct{}
+	// topology and flaps are only used by the running loop.
+	topology topology
+	flaps    *flapDetector
+
+	mtx         sync.Mutex
+	graph       Graph
+	flapping    []Flapping
+	subscribers []chan *watcher.Snapshot
+
+	snapshots <-chan *watcher.Snapshot
+
+	servicesGauge        prometheus.Gauge
+	edgesGauge           *prometheus.GaugeVec
+	refreshErrors        *prometheus.CounterVec
+	rttGauge             *prometheus.GaugeVec
+	failoverTargetsGauge *prometheus.GaugeVec
+	failoverRatioGauge   *prometheus.GaugeVec
+	transitionsTotal     *prometheus.CounterVec
+	flapScoreGauge       *prometheus.GaugeVec
+	flappingGauge        prometheus.Gauge
 }
 
 func (f *Radar) starting(ctx context.Context) error {
@@ -25,69 +124,369 @@ func (f *Radar) stopping(_ error) error {
 	return nil
 }
 
-func New(logger log.Logger) (*Radar, error) {
+func New(cfg Config, client *api.Client, snapshots <-chan *watcher.Snapshot, logger log.Logger, reg prometheus.Registerer) (*Radar, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
 
 	f := &Radar{
-		logger: logger,
+		cfg:    cfg,
+		client: client,
+		logger: log.With(logger, "module", "radar"),
+		topology: topology{
+			datacenters: map[string]datacenter{},
+			peers:       map[string]datacenter{},
+		},
+		flaps:     newFlapDetector(cfg.FlapWindow, cfg.FlapThreshold),
+		snapshots: snapshots,
+		servicesGauge: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "atc_radar_services",
+			Help: "Number of services on the radar graph.",
+		}),
+		edgesGauge: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "atc_radar_edges",
+			Help: "Number of dependencies on the radar graph, by kind.",
+		}, []string{"kind"}),
+		refreshErrors: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "atc_radar_refresh_errors_total",
+			Help: "Total number of failed refreshes of remote datacenters, peers and intentions, by datacenter or peer.",
+		}, []string{"datacenter"}),
+		rttGauge: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "atc_radar_datacenter_rtt_seconds",
+			Help: "Estimated round trip time to remote datacenters, from the network coordinates of the Consul servers.",
+		}, []string{"datacenter"}),
+		failoverTargetsGauge: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "atc_radar_failover_targets",
+			Help: "Number of healthy datacenters and peers a service can fail over to.",
+		}, []string{"service"}),
+		failoverRatioGauge: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "atc_radar_failover_passing_ratio",
+			Help: "Ratio of passing instances of the failover targets of a service, by datacenter or peer.",
+		}, []string{"service", "datacenter", "peer"}),
+		transitionsTotal: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "atc_radar_transitions_total",
+			Help: "Total number of check transitions and instance registrations and deregistrations of services in the local datacenter, by kind.",
+		}, []string{"service", "kind"}),
+		flapScoreGauge: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "atc_radar_flapping_score",
+			Help: "Highest number of transitions of a single check or instance of a service within the flap window.",
+		}, []string{"service"}),
+		flappingGauge: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "atc_radar_flapping_services",
+			Help: "Number of services with a check or instance that changed more than the flap threshold within the flap window.",
+		}),
 	}
-	f.Service = services.NewBasicService(f.starting, f.watcher, f.stopping)
+	f.Service = services.NewBasicService(f.starting, f.running, f.stopping)
 	return f, nil
 }
 
-func (f *Radar) watcher(ctx context.Context) error {
-	client, err := api.NewClient(&api.Config{})
-	if err != nil {
-		return fmt.Errorf("failed to connect to consul: %s", err.Error())
-	}
+func (f *Radar) running(ctx context.Context) error {
+	ticker := time.NewTicker(f.cfg.RefreshInterval)
+	defer ticker.Stop()
+	flapTicker := time.NewTicker(flapInterval)
+	defer flapTicker.Stop()
+
+	f.refresh(ctx)
+	var snapshot *watcher.Snapshot
+	fresh := false
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case snapshot = <-f.snapshots:
+			fresh = true
+			for _, t := range f.flaps.observe(snapshot, time.Now()) {
+				f.transitionsTotal.WithLabelValues(t.service, t.Kind).Inc()
+			}
+		case <-ticker.C:
+			f.refresh(ctx)
+		case <-flapTicker.C:
+		}
 
-	servicesWatcher, parseErr := watch.Parse(map[string]interface{}{"type": "services"})
-	if parseErr != nil {
-		return fmt.Errorf("failed to create services watcher plan: %s", parseErr.Error())
+		if snapshot == nil {
+			continue
+		}
+		now := time.Now()
+		f.update(buildGraph(f.topology, snapshot, f.cfg.FailoverMinPassingRatio, now), f.flaps.report(now))
+		if fresh {
+			f.publish(snapshot)
+			fresh = false
+		}
 	}
+}
 
-	servicesWatcher.HybridHandler = func(_ watch.BlockingParamVal, _ interface{}) {
+// Subscribe returns a channel on which every snapshot is delivered once the
+// radar mapped it, so subscribers see the failover targets and flapping
+// services of the snapshot. Subscribers that fall behind only receive the
+// most recent snapshot. Subscribe must be called before the radar is started.
+func (f *Radar) Subscribe() <-chan *watcher.Snapshot {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	ch := make(chan *watcher.Snapshot, 1)
+	f.subscribers = append(f.subscribers, ch)
+	return ch
+}
+
+func (f *Radar) publish(snapshot *watcher.Snapshot) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	for _, ch := range f.subscribers {
+		// Replace a snapshot the subscriber has not picked up yet.
 		select {
-		case <-ctx.Done():
-		case f.watchServicesChan <- struct{}{}:
+		case <-ch:
 		default:
-			// Event chan is full, discard event.
+		}
+		ch <- snapshot
+	}
+}
+
+func (f *Radar) update(g Graph, flapping []Flapping) {
+	for _, fl := range flapping {
+		i := sort.Search(len(g.Services), func(i int) bool { return g.Services[i].Name >= fl.Service })
+		if i < len(g.Services) && g.Services[i].Name == fl.Service {
+			g.Services[i].Flapping = fl.Flapping
+		}
+	}
+
+	f.mtx.Lock()
+	f.graph = g
+	f.flapping = flapping
+	f.mtx.Unlock()
+
+	f.flapScoreGauge.Reset()
+	flappingServices := 0
+	for _, fl := range flapping {
+		f.flapScoreGauge.WithLabelValues(fl.Service).Set(float64(fl.Score))
+		if fl.Flapping {
+			flappingServices++
+		}
+	}
+	f.flappingGauge.Set(float64(flappingServices))
+
+	f.servicesGauge.Set(float64(len(g.Services)))
+	kinds := map[string]int{EdgeUpstream: 0, EdgeIntention: 0}
+	for _, e := range g.Edges {
+		kinds[e.Kind]++
+	}
+	for kind, n := range kinds {
+		f.edgesGauge.WithLabelValues(kind).Set(float64(n))
+	}
+
+	f.failoverTargetsGauge.Reset()
+	f.failoverRatioGauge.Reset()
+	for _, s := range g.Services {
+		f.failoverTargetsGauge.WithLabelValues(s.Name).Set(float64(len(s.Failover)))
+		for _, t := range s.Failover {
+			f.failoverRatioGauge.WithLabelValues(s.Name, t.Datacenter, t.Peer).Set(t.Ratio)
 		}
 	}
+}
 
-	checksWatcher, err := watch.Parse(map[string]interface{}{"type": "checks"})
+// refresh reads the services of the remote datacenters and the cluster peers,
+// the network coordinates and the intentions. The previous state of a
+// datacenter or peer is kept when it cannot be read.
+func (f *Radar) refresh(ctx context.Context) {
+	self, err := f.client.Agent().Self()
 	if err != nil {
-		return fmt.Errorf("failed to create checks watcher plan: %w", err)
+		level.Error(f.logger).Log("msg", "failed to get local datacenter", "err", err)
+		f.refreshErrors.WithLabelValues("").Inc()
+		return
 	}
+	f.topology.local, _ = self["Config"]["Datacenter"].(string)
 
-	checksWatcher.HybridHandler = func(_ watch.BlockingParamVal, _ interface{}) {
-		select {
-		case <-ctx.Done():
-		case f.watchServicesChan <- struct{}{}:
-		default:
-			// Event chan is full, discard event.
+	datacenters := []string(f.cfg.Datacenters)
+	if len(datacenters) == 0 {
+		if datacenters, err = f.client.Catalog().Datacenters(); err != nil {
+			level.Error(f.logger).Log("msg", "failed to list datacenters", "err", err)
+			f.refreshErrors.WithLabelValues("").Inc()
+			return
+		}
+	}
+	datacenters = slices.DeleteFunc(slices.Clone(datacenters), func(dc string) bool {
+		return dc == f.topology.local
+	})
+	f.refreshCatalogs(ctx, f.topology.datacenters, datacenters, func(dc string) *api.QueryOptions {
+		return &api.QueryOptions{Datacenter: dc}
+	})
+
+	peers := []string(f.cfg.Peers)
+	if len(peers) == 0 {
+		if peers, err = f.activePeers(); err != nil {
+			// Peering needs Consul 1.14 or later, the datacenters are still
+			// mapped without it.
+			level.Warn(f.logger).Log("msg", "failed to list cluster peers", "err", err)
+			f.refreshErrors.WithLabelValues("").Inc()
+			peers = slices.Collect(maps.Keys(f.topology.peers))
 		}
 	}
+	f.refreshCatalogs(ctx, f.topology.peers, peers, func(peer string) *api.QueryOptions {
+		return &api.QueryOptions{Peer: peer}
+	})
 
-	errChan := make(chan error, 2)
+	if coords, err := f.client.Coordinate().Datacenters(); err != nil {
+		level.Warn(f.logger).Log("msg", "failed to get network coordinates", "err", err)
+		f.refreshErrors.WithLabelValues(f.topology.local).Inc()
+	} else {
+		f.topology.rtt = datacenterRTT(f.topology.local, coords)
+		f.rttGauge.Reset()
+		for dc, rtt := range f.topology.rtt {
+			f.rttGauge.WithLabelValues(dc).Set(rtt.Seconds())
+		}
+	}
+
+	intentions, err := f.loadIntentions()
+	if err != nil {
+		level.Warn(f.logger).Log("msg", "failed to list intentions", "err", err)
+		f.refreshErrors.WithLabelValues(f.topology.local).Inc()
+		return
+	}
+	f.topology.intentions = intentions
+}
 
-	defer func() {
-		servicesWatcher.Stop()
-		checksWatcher.Stop()
-	}()
+// refreshCatalogs reads the catalogs of the named datacenters or peers into
+// state, and forgets the ones that are no longer named.
+func (f *Radar) refreshCatalogs(ctx context.Context, state map[string]datacenter, names []string, opts func(string) *api.QueryOptions) {
+	for name := range state {
+		if !slices.Contains(names, name) {
+			delete(state, name)
+		}
+	}
+	for _, name := range names {
+		catalog, err := f.catalog(ctx, opts(name).WithContext(ctx))
+		if err != nil {
+			level.Warn(f.logger).Log("msg", "failed to map remote catalog", "datacenter", name, "err", err)
+			f.refreshErrors.WithLabelValues(name).Inc()
+			continue
+		}
+		state[name] = catalog
+	}
+}
 
-	go func() {
-		errChan <- servicesWatcher.RunWithClientAndHclog(client, servicesWatcher.Logger)
-	}()
+// activePeers lists the cluster peers with an active peering.
+func (f *Radar) activePeers() ([]string, error) {
+	peerings, _, err := f.client.Peerings().List(context.Background(), nil)
+	if err != nil {
+		return nil, err
+	}
+	var peers []string
+	for _, p := range peerings {
+		if p.State == api.PeeringStateActive {
+			peers = append(peers, p.Name)
+		}
+	}
+	return peers, nil
+}
 
-	go func() {
-		errChan <- checksWatcher.RunWithClientAndHclog(client, checksWatcher.Logger)
-	}()
+// catalog reads the services of a remote datacenter or peer and the health
+// of their instances. The health is read per service, at most
+// catalog_concurrency services at a time.
+func (f *Radar) catalog(ctx context.Context, opts *api.QueryOptions) (datacenter, error) {
+	tags, _, err := f.client.Catalog().Services(opts)
+	if err != nil {
+		return datacenter{}, fmt.Errorf("failed to list services: %w", err)
+	}
 
-	select {
-	case <-ctx.Done():
+	names := slices.Sorted(maps.Keys(tags))
+	health := make([]*watcher.Health, len(names))
+	err = concurrency.ForEachJob(ctx, len(names), f.cfg.CatalogConcurrency, func(ctx context.Context, idx int) error {
+		entries, _, err := f.client.Health().Service(names[idx], "", false, opts.WithContext(ctx))
+		if err != nil {
+			return fmt.Errorf("failed to get instances of service %s: %w", names[idx], err)
+		}
+		var h watcher.Health
+		for _, entry := range entries {
+			if entry.Service.Kind == api.ServiceKindConnectProxy {
+				return nil
+			}
+			h.Add(entry.Checks.AggregatedStatus())
+		}
+		health[idx] = &h
 		return nil
+	})
+	if err != nil {
+		return datacenter{}, err
+	}
+
+	state := datacenter{tags: tags, health: make(map[string]watcher.Health, len(names))}
+	for i, name := range names {
+		if health[i] != nil {
+			state.health[name] = *health[i]
+		}
+	}
+	return state, nil
+}
+
+// loadIntentions reads the sources of the service-intentions config entries.
+func (f *Radar) loadIntentions() ([]intention, error) {
+	entries, _, err := f.client.ConfigEntries().List(api.ServiceIntentions, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var intentions []intention
+	for _, entry := range entries {
+		e, ok := entry.(*api.ServiceIntentionsConfigEntry)
+		if !ok {
+			continue
+		}
+		for _, src := range e.Sources {
+			action := string(src.Action)
+			if action == "" && len(src.Permissions) > 0 {
+				action = "permissions"
+			}
+			intentions = append(intentions, intention{source: src.Name, destination: e.Name, peer: src.Peer, action: action})
+		}
+	}
+	return intentions, nil
+}
+
+// Graph returns the current service topology.
+func (f *Radar) Graph() Graph {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.graph
+}
 
-	case err = <-errChan:
-		return fmt.Errorf("services or checks watcher terminated: %w", err)
+// Impacted returns the services that depend on a service, directly or
+// through other services, and would be impacted when it goes critical.
+func (f *Radar) Impacted(service string) []string {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return impacted(f.graph.Edges, service)
+}
+
+// Flapping returns the services with transitions within the flap window, the
+// highest scores first.
+func (f *Radar) Flapping() []Flapping {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.flapping
+}
+
+// IsFlapping reports whether a service is flapping.
+func (f *Radar) IsFlapping(service string) bool {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	for _, fl := range f.flapping {
+		if fl.Service == service {
+			return fl.Flapping
+		}
+	}
+	return false
+}
+
+// Failover returns the ranked failover targets of a service, and whether the
+// service is on the graph.
+func (f *Radar) Failover(service string) ([]Target, bool) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	for _, s := range f.graph.Services {
+		if s.Name == service {
+			return s.Failover, true
+		}
 	}
+	return nil, false
 }
@@ -0,0 +1,103 @@
+package radar
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/hashicorp/consul/api"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// fakeCatalog serves the services of dc2 and their instances, and records
+// the highest number of concurrent instance requests.
+type fakeCatalog struct {
+	services map[string][]string
+
+	mtx      sync.Mutex
+	requests int
+	inFlight int
+	peak     int
+}
+
+func (c *fakeCatalog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("dc") != "dc2" {
+		http.Error(w, "unknown datacenter", http.StatusInternalServerError)
+		return
+	}
+	switch {
+	case r.URL.Path == "/v1/catalog/services":
+		_ = json.NewEncoder(w).Encode(c.services)
+
+	case strings.HasPrefix(r.URL.Path, "/v1/health/service/"):
+		name := strings.TrimPrefix(r.URL.Path, "/v1/health/service/")
+		c.mtx.Lock()
+		c.requests++
+		c.inFlight++
+		c.peak = max(c.peak, c.inFlight)
+		c.mtx.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		c.mtx.Lock()
+		c.inFlight--
+		c.mtx.Unlock()
+
+		entry := &api.ServiceEntry{
+			Node:    &api.Node{Node: "node-1"},
+			Service: &api.AgentService{ID: name + "-1", Service: name},
+			Checks:  api.HealthChecks{{Status: api.HealthPassing}},
+		}
+		if strings.HasSuffix(name, "-sidecar-proxy") {
+			entry.Service.Kind = api.ServiceKindConnectProxy
+		}
+		_ = json.NewEncoder(w).Encode([]*api.ServiceEntry{entry})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestCatalog(t *testing.T) {
+	c := &fakeCatalog{services: map[string][]string{"web-sidecar-proxy": {}}}
+	for i := 0; i < 10; i++ {
+		c.services[fmt.Sprintf("web-%d", i)] = []string{"v1"}
+	}
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+	client, err := api.NewClient(&api.Config{Address: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cfg Config
+	cfg.RegisterFlags(flag.NewFlagSet("test", flag.PanicOnError))
+	cfg.CatalogConcurrency = 2
+	r, err := New(cfg, client, nil, log.NewNopLogger(), prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := r.catalog(context.Background(), &api.QueryOptions{Datacenter: "dc2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.health) != 10 || state.health["web-3"].Passing != 1 || len(state.tags["web-3"]) != 1 {
+		t.Errorf("health = %+v, want the 10 services without the proxy", state.health)
+	}
+	c.mtx.Lock()
+	requests, peak := c.requests, c.peak
+	c.mtx.Unlock()
+	if requests != 11 || peak > 2 {
+		t.Errorf("%d instance requests with %d at a time, want one per service and at most 2 at a time", requests, peak)
+	}
+
+	if _, err := r.catalog(context.Background(), &api.QueryOptions{Datacenter: "dc3"}); err == nil {
+		t.Error("catalog of an unreachable datacenter mapped")
+	}
+}
@@ -2,22 +2,66 @@ package redirecter
 
 import (
 	"context"
+	"flag"
 	"fmt"
+	"time"
+
 	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
 	"github.com/grafana/dskit/services"
 	"github.com/hashicorp/consul/api"
-	"github.com/hashicorp/consul/api/watch"
+
+	"github.com/attachmentgenie/atc/pkg/atc/configentry"
+	"github.com/attachmentgenie/atc/pkg/atc/leader"
+	"github.com/attachmentgenie/atc/pkg/atc/watcher"
 )
 
+type Config struct {
+	PolicyFile   string        `yaml:"policy_file"`
+	SyncInterval time.Duration `yaml:"sync_interval"`
+}
+
+func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.PolicyFile, "redirecter.policy-file", "", "YAML file listing the services to redirect, their redirect target and the conditions that trigger the redirect.")
+	f.DurationVar(&cfg.SyncInterval, "redirecter.sync-interval", time.Minute, "Interval at which redirect conditions are re-evaluated in absence of changes.")
+}
+
+func (cfg *Config) Validate() error {
+	if cfg.SyncInterval <= 0 {
+		return fmt.Errorf("invalid redirecter sync interval: %s", cfg.SyncInterval)
+	}
+	return nil
+}
+
 type Redirecter struct {
 	services.Service
 
+	cfg    Config
+	writer *configentry.Writer
 	logger log.Logger
 
-	watchServicesChan chan struct{}
+	policies []Policy
+	// redirects holds the names of the services for which this redirecter
+	// wrote a service-resolver entry. It is nil until loaded from Consul.
+	redirects map[string]struct{}
+
+	elector    *leader.Elector
+	leadership <-chan struct{}
+	snapshots  <-chan *watcher.Snapshot
 }
 
 func (f *Redirecter) starting(ctx context.Context) error {
+	if f.cfg.PolicyFile == "" {
+		level.Warn(f.logger).Log("msg", "no redirect policy file configured, no redirects will be created")
+		return nil
+	}
+
+	policies, err := LoadPolicies(f.cfg.PolicyFile)
+	if err != nil {
+		return err
+	}
+	f.policies = policies
+	level.Info(f.logger).Log("msg", "loaded redirect policies", "file", f.cfg.PolicyFile, "policies", len(policies))
 	return nil
 }
 
@@ -25,69 +69,67 @@ func (f *Redirecter) stopping(_ error) error {
 	return nil
 }
 
-func New(logger log.Logger) (*Redirecter, error) {
+func New(cfg Config, writer *configentry.Writer, elector *leader.Elector, snapshots <-chan *watcher.Snapshot, logger log.Logger) (*Redirecter, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
 
 	f := &Redirecter{
-		logger: logger,
+		cfg:        cfg,
+		writer:     writer,
+		logger:     log.With(logger, "module", "redirecter"),
+		elector:    elector,
+		leadership: elector.Subscribe(),
+		snapshots:  snapshots,
 	}
-	f.Service = services.NewBasicService(f.starting, f.watcher, f.stopping)
+	f.Service = services.NewBasicService(f.starting, f.running, f.stopping)
 	return f, nil
 }
 
-func (f *Redirecter) watcher(ctx context.Context) error {
-	client, err := api.NewClient(&api.Config{})
-	if err != nil {
-		return fmt.Errorf("failed to connect to consul: %s", err.Error())
-	}
+func (f *Redirecter) running(ctx context.Context) error {
+	ticker := time.NewTicker(f.cfg.SyncInterval)
+	defer ticker.Stop()
 
-	servicesWatcher, parseErr := watch.Parse(map[string]interface{}{"type": "services"})
-	if parseErr != nil {
-		return fmt.Errorf("failed to create services watcher plan: %s", parseErr.Error())
-	}
-
-	servicesWatcher.HybridHandler = func(_ watch.BlockingParamVal, _ interface{}) {
+	var snapshot *watcher.Snapshot
+	for {
 		select {
 		case <-ctx.Done():
-		case f.watchServicesChan <- struct{}{}:
-		default:
-			// Event chan is full, discard event.
+			return nil
+
+		case snapshot = <-f.snapshots:
+		case <-ticker.C:
+		case <-f.leadership:
+			// Another replica may have changed the redirects while this one
+			// was a follower.
+			f.redirects = nil
 		}
-	}
 
-	checksWatcher, err := watch.Parse(map[string]interface{}{"type": "checks"})
-	if err != nil {
-		return fmt.Errorf("failed to create checks watcher plan: %w", err)
-	}
-
-	checksWatcher.HybridHandler = func(_ watch.BlockingParamVal, _ interface{}) {
-		select {
-		case <-ctx.Done():
-		case f.watchServicesChan <- struct{}{}:
-		default:
-			// Event chan is full, discard event.
+		if snapshot == nil || !f.elector.IsLeader() {
+			continue
 		}
-	}
 
-	errChan := make(chan error, 2)
-
-	defer func() {
-		servicesWatcher.Stop()
-		checksWatcher.Stop()
-	}()
-
-	go func() {
-		errChan <- servicesWatcher.RunWithClientAndHclog(client, servicesWatcher.Logger)
-	}()
+		if f.redirects == nil {
+			if err := f.loadRedirects(); err != nil {
+				level.Error(f.logger).Log("msg", "failed to load redirect service-resolvers", "err", err)
+				continue
+			}
+		}
 
-	go func() {
-		errChan <- checksWatcher.RunWithClientAndHclog(client, checksWatcher.Logger)
-	}()
+		f.reconcile(snapshot)
+	}
+}
 
-	select {
-	case <-ctx.Done():
-		return nil
+// loadRedirects picks up the redirects written by earlier redirecters, so
+// they are removed once the conditions clear.
+func (f *Redirecter) loadRedirects() error {
+	owned, err := f.writer.Owned("redirecter", api.ServiceResolver)
+	if err != nil {
+		return err
+	}
 
-	case err = <-errChan:
-		return fmt.Errorf("services or checks watcher terminated: %w", err)
+	f.redirects = map[string]struct{}{}
+	for _, entry := range owned {
+		f.redirects[entry.GetName()] = struct{}{}
 	}
+	return nil
 }
@@ -0,0 +1,94 @@
+package redirecter
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// Policy describes when requests for a service should be redirected, and
+// where to.
+type Policy struct {
+	Service    string     `yaml:"service"`
+	Target     Target     `yaml:"target"`
+	Conditions Conditions `yaml:"conditions"`
+}
+
+// Target is the destination of a redirect. Fields left empty default to the
+// values of the redirected service.
+type Target struct {
+	Service    string `yaml:"service"`
+	Datacenter string `yaml:"datacenter"`
+	Partition  string `yaml:"partition"`
+	Namespace  string `yaml:"namespace"`
+	Peer       string `yaml:"peer"`
+}
+
+// Conditions trigger a redirect as soon as any one of them is met.
+type Conditions struct {
+	// MinPassing redirects when fewer than this many instances are passing.
+	MinPassing int `yaml:"min_passing"`
+	// MaxCritical redirects when more than this many instances are critical.
+	MaxCritical *int `yaml:"max_critical"`
+}
+
+type policyFile struct {
+	Redirects []Policy `yaml:"redirects"`
+}
+
+// LoadPolicies reads and validates the redirect policies from a YAML file.
+func LoadPolicies(filename string) ([]Policy, error) {
+	buf, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read redirect policy file: %w", err)
+	}
+
+	var pf policyFile
+	dec := yaml.NewDecoder(bytes.NewReader(buf))
+	dec.KnownFields(true)
+	if err := dec.Decode(&pf); err != nil {
+		return nil, fmt.Errorf("failed to parse redirect policy file %s: %w", filename, err)
+	}
+
+	seen := map[string]struct{}{}
+	for i, p := range pf.Redirects {
+		if err := p.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid redirect policy %d in %s: %w", i, filename, err)
+		}
+		if _, ok := seen[p.Service]; ok {
+			return nil, fmt.Errorf("duplicate redirect policy for service %q in %s", p.Service, filename)
+		}
+		seen[p.Service] = struct{}{}
+	}
+	return pf.Redirects, nil
+}
+
+func (p Policy) Validate() error {
+	if p.Service == "" {
+		return fmt.Errorf("service is required")
+	}
+	if p.Target == (Target{}) || p.Target == (Target{Service: p.Service}) {
+		return fmt.Errorf("target of service %q does not differ from the service itself", p.Service)
+	}
+	if p.Conditions.MinPassing <= 0 && p.Conditions.MaxCritical == nil {
+		return fmt.Errorf("no conditions set for service %q", p.Service)
+	}
+	if p.Conditions.MinPassing < 0 || (p.Conditions.MaxCritical != nil && *p.Conditions.MaxCritical < 0) {
+		return fmt.Errorf("conditions of service %q must not be negative", p.Service)
+	}
+	return nil
+}
+
+// Triggered reports whether the instance counts of the service meet any of
+// the redirect conditions.
+func (c Conditions) Triggered(passing, critical int) bool {
+	if c.MinPassing > 0 && passing < c.MinPassing {
+		return true
+	}
+	if c.MaxCritical != nil && critical > *c.MaxCritical {
+		return true
+	}
+	return false
+}
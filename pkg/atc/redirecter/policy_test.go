@@ -0,0 +1,138 @@
+package redirecter
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func TestConditionsTriggered(t *testing.T) {
+	tests := []struct {
+		name       string
+		conditions Conditions
+		passing    int
+		critical   int
+		want       bool
+	}{
+		{"min passing met", Conditions{MinPassing: 2}, 2, 5, false},
+		{"fewer passing than min passing", Conditions{MinPassing: 2}, 1, 0, true},
+		{"no max critical ignores critical instances", Conditions{MinPassing: 1}, 1, 10, false},
+		{"max critical 0 without critical instances", Conditions{MaxCritical: intPtr(0)}, 0, 0, false},
+		{"max critical 0 with a critical instance", Conditions{MaxCritical: intPtr(0)}, 3, 1, true},
+		{"max critical n not exceeded", Conditions{MaxCritical: intPtr(2)}, 0, 2, false},
+		{"max critical n exceeded", Conditions{MaxCritical: intPtr(2)}, 3, 3, true},
+		{"any condition triggers", Conditions{MinPassing: 1, MaxCritical: intPtr(2)}, 0, 0, true},
+	}
+	for _, tt := range tests {
+		if got := tt.conditions.Triggered(tt.passing, tt.critical); got != tt.want {
+			t.Errorf("%s: Triggered(%d, %d) = %t, want %t", tt.name, tt.passing, tt.critical, got, tt.want)
+		}
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy Policy
+		err    string
+	}{
+		{
+			name:   "redirect to another datacenter",
+			policy: Policy{Service: "web", Target: Target{Datacenter: "dc2"}, Conditions: Conditions{MinPassing: 1}},
+		},
+		{
+			name:   "max critical 0",
+			policy: Policy{Service: "web", Target: Target{Service: "web-fallback"}, Conditions: Conditions{MaxCritical: intPtr(0)}},
+		},
+		{
+			name:   "no service",
+			policy: Policy{Target: Target{Datacenter: "dc2"}, Conditions: Conditions{MinPassing: 1}},
+			err:    "service is required",
+		},
+		{
+			name:   "no target",
+			policy: Policy{Service: "web", Conditions: Conditions{MinPassing: 1}},
+			err:    "does not differ",
+		},
+		{
+			name:   "target is the service itself",
+			policy: Policy{Service: "web", Target: Target{Service: "web"}, Conditions: Conditions{MinPassing: 1}},
+			err:    "does not differ",
+		},
+		{
+			name:   "no conditions",
+			policy: Policy{Service: "web", Target: Target{Datacenter: "dc2"}},
+			err:    "no conditions",
+		},
+		{
+			name:   "negative max critical",
+			policy: Policy{Service: "web", Target: Target{Datacenter: "dc2"}, Conditions: Conditions{MinPassing: 1, MaxCritical: intPtr(-1)}},
+			err:    "must not be negative",
+		},
+	}
+	for _, tt := range tests {
+		err := tt.policy.Validate()
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error = %v, want it to contain %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestLoadPolicies(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) string {
+		filename := filepath.Join(dir, "redirects.yaml")
+		if err := os.WriteFile(filename, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+
+	policies, err := LoadPolicies(write(`
+redirects:
+  - service: web
+    target:
+      datacenter: dc2
+    conditions:
+      max_critical: 0
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policies) != 1 || policies[0].Conditions.MaxCritical == nil || *policies[0].Conditions.MaxCritical != 0 {
+		t.Errorf("policies = %+v, want web with max critical 0", policies)
+	}
+
+	for _, tt := range []struct {
+		content string
+		err     string
+	}{
+		{
+			content: "redirects:\n  - service: web\n    target: {datacenter: dc2}\n    conditions: {min_passing: 1}\n  - service: web\n    target: {datacenter: dc3}\n    conditions: {min_passing: 1}\n",
+			err:     "duplicate",
+		},
+		{
+			content: "redirects:\n  - service: web\n    target: {datacenter: dc2}\n    conditions: {min_critical: 1}\n",
+			err:     "field min_critical not found",
+		},
+		{
+			content: "redirects:\n  - service: web\n    target: {datacenter: dc2}\n",
+			err:     "no conditions",
+		},
+	} {
+		if _, err := LoadPolicies(write(tt.content)); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("error = %v, want it to contain %q", err, tt.err)
+		}
+	}
+}
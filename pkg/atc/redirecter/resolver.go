@@ -0,0 +1,78 @@
+package redirecter
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/go-kit/log/level"
+	"github.com/hashicorp/consul/api"
+	"golang.org/x/exp/slices"
+
+	"github.com/attachmentgenie/atc/pkg/atc/configentry"
+	"github.com/attachmentgenie/atc/pkg/atc/watcher"
+)
+
+// reconcile evaluates every redirect policy against the current health of its
+// service, and writes or deletes the redirect service-resolver entries.
+func (f *Redirecter) reconcile(snapshot *watcher.Snapshot) {
+	for _, p := range f.policies {
+		health := snapshot.Health(p.Service)
+		passing, critical := health.Passing, health.Critical
+		_, redirected := f.redirects[p.Service]
+
+		switch triggered := p.Conditions.Triggered(passing, critical); {
+		case triggered && !redirected:
+			reason := fmt.Sprintf("%d passing and %d critical instances", passing, critical)
+			if err := f.writer.Upsert("redirecter", reason, redirectResolver(p)); err != nil {
+				level.Error(f.logger).Log("msg", "failed to write redirect service-resolver", "service", p.Service, "err", err)
+				continue
+			}
+			level.Info(f.logger).Log("msg", "wrote redirect service-resolver", "service", p.Service, "passing", passing, "critical", critical, "dry_run", f.writer.DryRun())
+			f.redirects[p.Service] = struct{}{}
+
+		case !triggered && redirected:
+			f.removeRedirect(p.Service)
+		}
+	}
+
+	// Redirects whose policy was removed are retracted as well.
+	for name := range f.redirects {
+		if !slices.ContainsFunc(f.policies, func(p Policy) bool { return p.Service == name }) {
+			f.removeRedirect(name)
+		}
+	}
+}
+
+func (f *Redirecter) removeRedirect(name string) {
+	err := f.writer.Delete("redirecter", api.ServiceResolver, name)
+	if errors.Is(err, configentry.ErrUnmanaged) || errors.Is(err, configentry.ErrNotOwner) {
+		// The entry was taken over, it is no longer ours to remove.
+		delete(f.redirects, name)
+		return
+	}
+	if err != nil {
+		level.Error(f.logger).Log("msg", "failed to delete redirect service-resolver", "service", name, "err", err)
+		return
+	}
+	level.Info(f.logger).Log("msg", "deleted redirect service-resolver", "service", name, "dry_run", f.writer.DryRun())
+	delete(f.redirects, name)
+}
+
+func redirectResolver(p Policy) *api.ServiceResolverConfigEntry {
+	service := p.Target.Service
+	if service == "" {
+		service = p.Service
+	}
+
+	return &api.ServiceResolverConfigEntry{
+		Kind: api.ServiceResolver,
+		Name: p.Service,
+		Redirect: &api.ServiceResolverRedirect{
+			Service:    service,
+			Datacenter: p.Target.Datacenter,
+			Partition:  p.Target.Partition,
+			Namespace:  p.Target.Namespace,
+			Peer:       p.Target.Peer,
+		},
+	}
+}
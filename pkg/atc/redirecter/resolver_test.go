@@ -0,0 +1,223 @@
+package redirecter
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/hashicorp/consul/api"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/attachmentgenie/atc/pkg/atc/configentry"
+	"github.com/attachmentgenie/atc/pkg/atc/leader"
+	"github.com/attachmentgenie/atc/pkg/atc/watcher"
+)
+
+// fakeConfig serves the service-resolver config entries of Consul.
+type fakeConfig struct {
+	mtx       sync.Mutex
+	index     uint64
+	resolvers map[string]*api.ServiceResolverConfigEntry
+}
+
+func (c *fakeConfig) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	name, named := strings.CutPrefix(r.URL.Path, "/v1/config/service-resolver/")
+	cas, _ := strconv.ParseUint(r.URL.Query().Get("cas"), 10, 64)
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/v1/config/service-resolver":
+		entries := []*api.ServiceResolverConfigEntry{}
+		for _, e := range c.resolvers {
+			entries = append(entries, e)
+		}
+		_ = json.NewEncoder(w).Encode(entries)
+
+	case r.Method == http.MethodGet && named:
+		e, ok := c.resolvers[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(e)
+
+	case r.Method == http.MethodPut && r.URL.Path == "/v1/config":
+		var e api.ServiceResolverConfigEntry
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if current, ok := c.resolvers[e.Name]; (ok && current.ModifyIndex != cas) || (!ok && cas != 0) {
+			_, _ = w.Write([]byte("false"))
+			return
+		}
+		c.index++
+		e.ModifyIndex = c.index
+		c.resolvers[e.Name] = &e
+		_, _ = w.Write([]byte("true"))
+
+	case r.Method == http.MethodDelete && named:
+		if current, ok := c.resolvers[name]; ok && current.ModifyIndex != cas {
+			_, _ = w.Write([]byte("false"))
+			return
+		}
+		delete(c.resolvers, name)
+		_, _ = w.Write([]byte("true"))
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// redirected returns the redirect targets by service.
+func (c *fakeConfig) redirected() map[string]string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	redirects := map[string]string{}
+	for name, e := range c.resolvers {
+		if e.Redirect != nil {
+			redirects[name] = e.Redirect.Service + "@" + e.Redirect.Datacenter
+		}
+	}
+	return redirects
+}
+
+// testRedirecter returns a redirecter that loaded the policies and the
+// redirects written so far, like a leader that just started.
+func testRedirecter(t *testing.T, srv *httptest.Server, policies string) *Redirecter {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "redirects.yaml")
+	if err := os.WriteFile(filename, []byte(policies), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := api.NewClient(&api.Config{Address: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	elector, err := leader.New(leader.Config{}, nil, log.NewNopLogger(), prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cfg Config
+	cfg.RegisterFlags(flag.NewFlagSet("test", flag.PanicOnError))
+	cfg.PolicyFile = filename
+	writer := configentry.New(client, false, log.NewNopLogger(), prometheus.NewRegistry())
+	f, err := New(cfg, writer, elector, nil, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.starting(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.loadRedirects(); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func healthSnapshot(statuses map[string][]string) *watcher.Snapshot {
+	s := &watcher.Snapshot{Services: map[string][]string{}, Instances: map[string][]watcher.Instance{}}
+	for service, list := range statuses {
+		s.Services[service] = []string{}
+		for _, status := range list {
+			s.Instances[service] = append(s.Instances[service], watcher.Instance{Service: service, Status: status})
+		}
+	}
+	return s
+}
+
+const testPolicies = `
+redirects:
+  - service: web
+    target:
+      datacenter: dc2
+    conditions:
+      min_passing: 2
+  - service: api
+    target:
+      service: api-fallback
+    conditions:
+      max_critical: 0
+`
+
+func TestReconcile(t *testing.T) {
+	consul := &fakeConfig{resolvers: map[string]*api.ServiceResolverConfigEntry{}}
+	srv := httptest.NewServer(consul)
+	defer srv.Close()
+	f := testRedirecter(t, srv, testPolicies)
+
+	f.reconcile(healthSnapshot(map[string][]string{
+		"web": {api.HealthPassing, api.HealthCritical},
+		"api": {api.HealthPassing},
+	}))
+	if got := consul.redirected(); len(got) != 1 || got["web"] != "web@dc2" {
+		t.Fatalf("redirects = %v, want web to dc2", got)
+	}
+	if meta := consul.resolvers["web"].Meta; meta[configentry.MetaModule] != "redirecter" {
+		t.Errorf("meta = %v, want owned by the redirecter", meta)
+	}
+
+	f.reconcile(healthSnapshot(map[string][]string{
+		"web": {api.HealthPassing, api.HealthPassing},
+		"api": {api.HealthPassing, api.HealthCritical},
+	}))
+	if got := consul.redirected(); len(got) != 1 || got["api"] != "api-fallback@" {
+		t.Fatalf("redirects = %v, want api to api-fallback only", got)
+	}
+
+	// A redirect that is not ours is left alone.
+	consul.resolvers["web"] = &api.ServiceResolverConfigEntry{Kind: api.ServiceResolver, Name: "web", Redirect: &api.ServiceResolverRedirect{Service: "web", Datacenter: "dc3"}, ModifyIndex: 100}
+	f.reconcile(healthSnapshot(map[string][]string{
+		"web": {api.HealthCritical},
+		"api": {api.HealthCritical},
+	}))
+	if got := consul.redirected(); len(got) != 2 || got["web"] != "web@dc3" {
+		t.Fatalf("redirects = %v, want the unmanaged web redirect to be kept", got)
+	}
+}
+
+func TestReconcileRetractsRemovedPolicies(t *testing.T) {
+	consul := &fakeConfig{resolvers: map[string]*api.ServiceResolverConfigEntry{}}
+	srv := httptest.NewServer(consul)
+	defer srv.Close()
+	critical := healthSnapshot(map[string][]string{
+		"web": {api.HealthCritical},
+		"api": {api.HealthCritical},
+	})
+
+	f := testRedirecter(t, srv, testPolicies)
+	f.reconcile(critical)
+	if got := consul.redirected(); len(got) != 2 {
+		t.Fatalf("redirects = %v, want web and api", got)
+	}
+
+	// The web policy is removed from the file, a restarted redirecter
+	// retracts its redirect although web is still critical.
+	f = testRedirecter(t, srv, `
+redirects:
+  - service: api
+    target:
+      service: api-fallback
+    conditions:
+      max_critical: 0
+`)
+	f.reconcile(critical)
+	if got := consul.redirected(); len(got) != 1 || got["api"] != "api-fallback@" {
+		t.Fatalf("redirects = %v, want api only", got)
+	}
+	if _, ok := f.redirects["web"]; ok {
+		t.Errorf("redirects = %v, want web to be forgotten", f.redirects)
+	}
+}
@@ -1,23 +1,106 @@
 package atc
 
 import (
+	"encoding/json"
 	"fmt"
+	"html"
 	"net/http"
+	"net/url"
 	"sort"
+	"strings"
+	"time"
 
+	"github.com/go-kit/log/level"
 	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/munnerz/goautoneg"
+	"github.com/prometheus/exporter-toolkit/web"
+
+	"github.com/attachmentgenie/atc/pkg/atc/incident"
 )
 
+// Leadership describes which ATC replica writes changes.
+type Leadership struct {
+	ID       string `json:"id"`
+	Leader   string `json:"leader"`
+	IsLeader bool   `json:"is_leader"`
+}
+
+func (t *Atc) leadership() (Leadership, error) {
+	if t.Leader == nil {
+		return Leadership{}, fmt.Errorf("leader election is not running")
+	}
+
+	return Leadership{
+		ID:       t.Leader.ID(),
+		Leader:   t.Leader.Leader(),
+		IsLeader: t.Leader.IsLeader(),
+	}, nil
+}
+
+func (l Leadership) String() string {
+	switch {
+	case l.IsLeader:
+		return fmt.Sprintf("replica %s is the leader", l.ID)
+	case l.Leader == "":
+		return fmt.Sprintf("replica %s is a follower, there is no leader", l.ID)
+	default:
+		return fmt.Sprintf("replica %s is a follower of %s", l.ID, l.Leader)
+	}
+}
+
+func (t *Atc) landingPageHandler(landingConfig web.LandingConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := landingConfig
+		if l, err := t.leadership(); err == nil {
+			cfg.ExtraHTML = "<div>Leadership: " + html.EscapeString(l.String()) + "</div>"
+		}
+		if t.Incident != nil {
+			cfg.ExtraHTML += openIncidentsHTML(t.Incident.Open())
+		}
+
+		landingPage, err := web.NewLandingPage(cfg)
+		if err != nil {
+			level.Error(t.logger).Log("msg", "failed to render landing page", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		landingPage.ServeHTTP(w, r)
+	}
+}
+
+// openIncidentsHTML lists the open incidents on the landing page.
+func openIncidentsHTML(open []incident.Record) string {
+	if len(open) == 0 {
+		return "<div>Open incidents: none</div>"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "<div>Open incidents: %d<ul>", len(open))
+	for _, rec := range open {
+		fmt.Fprintf(&b, "<li><a href=\"/v1/incidents/%s\">%s</a>: %s, %d of %d instances critical, %s, opened %s</li>",
+			url.PathEscape(rec.ID), html.EscapeString(rec.ID), html.EscapeString(rec.Service), rec.Critical, rec.Total,
+			rec.Status, rec.Opened.Format(time.RFC3339))
+	}
+	b.WriteString("</ul></div>")
+	return b.String()
+}
+
 func OkHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "OK")
 	}
 }
 
-func (t *Atc) servicesHandler(w http.ResponseWriter, _ *http.Request) {
-	w.WriteHeader(200)
-	w.Header().Set("Content-Type", "text/plain")
+// ServiceStatus describes the state of a module.
+type ServiceStatus struct {
+	Name         string     `json:"name"`
+	State        string     `json:"state"`
+	FailureCase  string     `json:"failure_case,omitempty"`
+	Dependencies []string   `json:"dependencies"`
+	StartTime    *time.Time `json:"start_time,omitempty"`
+}
 
+func (t *Atc) serviceStatuses() []ServiceStatus {
 	svcNames := make([]string, 0, len(t.ServiceMap))
 	for name := range t.ServiceMap {
 		svcNames = append(svcNames, name)
@@ -25,24 +108,92 @@ func (t *Atc) servicesHandler(w http.ResponseWriter, _ *http.Request) {
 
 	sort.Strings(svcNames)
 
-	x := table.NewWriter()
-	x.SetOutputMirror(w)
-	x.AppendHeader(table.Row{"service name", "status", "failure case"})
+	t.startTimesMtx.Lock()
+	defer t.startTimesMtx.Unlock()
 
+	statuses := make([]ServiceStatus, 0, len(svcNames))
 	for _, name := range svcNames {
 		service := t.ServiceMap[name]
 
-		var e string
-
+		status := ServiceStatus{
+			Name:         name,
+			State:        service.State().String(),
+			Dependencies: t.ModuleManager.DependenciesForModule(name),
+		}
 		if err := service.FailureCase(); err != nil {
-			e = err.Error()
+			status.FailureCase = err.Error()
+		}
+		if start, ok := t.startTimes[name]; ok {
+			status.StartTime = &start
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+func (t *Atc) setStartTime(name string) {
+	t.startTimesMtx.Lock()
+	defer t.startTimesMtx.Unlock()
+
+	if t.startTimes == nil {
+		t.startTimes = map[string]time.Time{}
+	}
+	t.startTimes[name] = time.Now()
+}
+
+func (t *Atc) servicesHandler(w http.ResponseWriter, r *http.Request) {
+	statuses := t.serviceStatuses()
+	l, leaderErr := t.leadership()
+
+	contentType := goautoneg.Negotiate(r.Header.Get("Accept"), []string{"text/plain", "application/json", "text/html"})
+	if contentType == "application/json" {
+		resp := struct {
+			Services   []ServiceStatus `json:"services"`
+			Leadership *Leadership     `json:"leadership,omitempty"`
+		}{
+			Services: statuses,
+		}
+		if leaderErr == nil {
+			resp.Leadership = &l
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	x := table.NewWriter()
+	x.AppendHeader(table.Row{"service name", "status", "failure case", "dependencies", "start time"})
+
+	for _, status := range statuses {
+		var start string
+		if status.StartTime != nil {
+			start = status.StartTime.UTC().Format(time.RFC3339)
 		}
 
 		x.AppendRows([]table.Row{
-			{name, service.State(), e},
+			{status.Name, status.State, status.FailureCase, strings.Join(status.Dependencies, ", "), start},
 		})
 	}
 
 	x.AppendSeparator()
-	x.Render()
+
+	if contentType == "text/html" {
+		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "<!DOCTYPE html>\n<html lang=\"en\">\n<head><meta charset=\"UTF-8\"><title>ATC services</title></head>\n<body>\n%s\n", x.RenderHTML())
+		if leaderErr == nil {
+			fmt.Fprintf(w, "<p>%s</p>\n", html.EscapeString(l.String()))
+		}
+		fmt.Fprintln(w, "</body>\n</html>")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, x.Render())
+	if leaderErr == nil {
+		fmt.Fprintf(w, "\n%s\n", l)
+	}
 }
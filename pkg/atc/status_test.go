@@ -0,0 +1,283 @@
+package atc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/modules"
+	"github.com/grafana/dskit/services"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/exporter-toolkit/web"
+
+	"github.com/attachmentgenie/atc/pkg/atc/incident"
+	"github.com/attachmentgenie/atc/pkg/atc/leader"
+)
+
+// testAtc returns an Atc running the server and the watcher, which depends
+// on the server, with a failed radar that depends on the watcher.
+func testAtc(t *testing.T, elector *leader.Elector) *Atc {
+	t.Helper()
+	ctx := context.Background()
+
+	mm := modules.NewManager(log.NewNopLogger())
+	mm.RegisterModule(Server, nil)
+	mm.RegisterModule(Watcher, nil)
+	mm.RegisterModule(Radar, nil)
+	if err := mm.AddDependency(Watcher, Server); err != nil {
+		t.Fatal(err)
+	}
+	if err := mm.AddDependency(Radar, Watcher); err != nil {
+		t.Fatal(err)
+	}
+
+	server := services.NewIdleService(nil, nil)
+	watcher := services.NewIdleService(nil, nil)
+	for _, s := range []services.Service{server, watcher} {
+		if err := services.StartAndAwaitRunning(ctx, s); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = services.StopAndAwaitTerminated(ctx, s) })
+	}
+	radar := services.NewIdleService(func(context.Context) error { return errors.New("no catalog") }, nil)
+	if err := services.StartAndAwaitRunning(ctx, radar); err == nil {
+		t.Fatal("radar started, want it failed")
+	}
+
+	a := &Atc{
+		logger:        log.NewNopLogger(),
+		Leader:        elector,
+		ServiceMap:    map[string]services.Service{Server: server, Watcher: watcher, Radar: radar},
+		ModuleManager: mm,
+	}
+	a.setStartTime(Server)
+	a.setStartTime(Watcher)
+	return a
+}
+
+// runningElector returns an elector without leader election, which leads
+// this replica once started.
+func runningElector(t *testing.T) *leader.Elector {
+	t.Helper()
+	e, err := leader.New(leader.Config{ID: "replica-1"}, nil, log.NewNopLogger(), prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := services.StartAndAwaitRunning(context.Background(), e); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = services.StopAndAwaitTerminated(context.Background(), e) })
+	return e
+}
+
+// followingElector returns an elector that has not acquired the lock yet.
+func followingElector(t *testing.T) *leader.Elector {
+	t.Helper()
+	e, err := leader.New(leader.Config{Enabled: true, Key: "atc/leader", ID: "replica-1", SessionTTL: 15 * time.Second, RetryInterval: time.Second}, nil, log.NewNopLogger(), prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestServicesHandler(t *testing.T) {
+	tests := map[string]struct {
+		accept      string
+		contentType string
+	}{
+		"no accept header": {accept: "", contentType: "text/plain; charset=UTF-8"},
+		"plain text":       {accept: "text/plain", contentType: "text/plain; charset=UTF-8"},
+		"json":             {accept: "application/json", contentType: "application/json"},
+		"html":             {accept: "text/html,application/xhtml+xml;q=0.9,*/*;q=0.8", contentType: "text/html; charset=UTF-8"},
+	}
+	electors := map[string]struct {
+		elector    func(t *testing.T) *leader.Elector
+		leadership string
+	}{
+		"leader":      {elector: runningElector, leadership: "replica replica-1 is the leader"},
+		"follower":    {elector: followingElector, leadership: "replica replica-1 is a follower, there is no leader"},
+		"no election": {elector: func(*testing.T) *leader.Elector { return nil }},
+	}
+
+	for name, tc := range tests {
+		for electorName, ec := range electors {
+			t.Run(name+"/"+electorName, func(t *testing.T) {
+				a := testAtc(t, ec.elector(t))
+				req := httptest.NewRequest(http.MethodGet, "/services", nil)
+				if tc.accept != "" {
+					req.Header.Set("Accept", tc.accept)
+				}
+				rec := httptest.NewRecorder()
+				a.servicesHandler(rec, req)
+
+				if rec.Code != http.StatusOK {
+					t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+				}
+				if got := rec.Header().Get("Content-Type"); got != tc.contentType {
+					t.Fatalf("content type = %q, want %q", got, tc.contentType)
+				}
+				body := rec.Body.String()
+
+				if tc.contentType == "application/json" {
+					var resp struct {
+						Services   []ServiceStatus `json:"services"`
+						Leadership *Leadership     `json:"leadership"`
+					}
+					if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+						t.Fatal(err)
+					}
+					checkStatuses(t, resp.Services)
+					switch {
+					case ec.leadership == "" && resp.Leadership != nil:
+						t.Errorf("leadership = %+v, want none without leader election", resp.Leadership)
+					case ec.leadership != "" && (resp.Leadership == nil || resp.Leadership.String() != ec.leadership):
+						t.Errorf("leadership = %+v, want %q", resp.Leadership, ec.leadership)
+					}
+					return
+				}
+
+				for _, want := range []string{"Running", "Failed", "no catalog", "server, watcher"} {
+					if !strings.Contains(body, want) {
+						t.Errorf("body does not contain %q:\n%s", want, body)
+					}
+				}
+				if tc.contentType == "text/html; charset=UTF-8" && !strings.Contains(body, "<table") {
+					t.Errorf("body has no HTML table:\n%s", body)
+				}
+				if ec.leadership == "" {
+					if strings.Contains(body, "replica") {
+						t.Errorf("body mentions a replica without leader election:\n%s", body)
+					}
+					return
+				}
+				want := "\n" + ec.leadership + "\n"
+				if tc.contentType == "text/html; charset=UTF-8" {
+					want = "<p>" + ec.leadership + "</p>"
+				}
+				if !strings.Contains(body, want) {
+					t.Errorf("body does not contain %q:\n%s", want, body)
+				}
+			})
+		}
+	}
+}
+
+func checkStatuses(t *testing.T, statuses []ServiceStatus) {
+	t.Helper()
+	var names []string
+	for _, s := range statuses {
+		names = append(names, s.Name)
+	}
+	if want := []string{Radar, Server, Watcher}; !slices.Equal(names, want) {
+		t.Fatalf("services = %v, want %v", names, want)
+	}
+
+	radar, server, watcher := statuses[0], statuses[1], statuses[2]
+	if radar.State != "Failed" || radar.FailureCase != "no catalog" || radar.StartTime != nil {
+		t.Errorf("radar = %+v, want it failed without a start time", radar)
+	}
+	if !slices.Equal(radar.Dependencies, []string{Server, Watcher}) {
+		t.Errorf("dependencies of radar = %v, want the server and the watcher", radar.Dependencies)
+	}
+	if server.State != "Running" || server.FailureCase != "" || server.StartTime == nil || len(server.Dependencies) != 0 {
+		t.Errorf("server = %+v, want it running without dependencies", server)
+	}
+	if watcher.State != "Running" || !slices.Equal(watcher.Dependencies, []string{Server}) {
+		t.Errorf("watcher = %+v, want it running after the server", watcher)
+	}
+}
+
+func TestLeadershipString(t *testing.T) {
+	tests := map[string]struct {
+		l    Leadership
+		want string
+	}{
+		"leader":              {Leadership{ID: "a", Leader: "a", IsLeader: true}, "replica a is the leader"},
+		"follower":            {Leadership{ID: "a", Leader: "b"}, "replica a is a follower of b"},
+		"follower, no leader": {Leadership{ID: "a"}, "replica a is a follower, there is no leader"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := tc.l.String(); got != tc.want {
+				t.Errorf("String() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestOpenIncidentsHTML(t *testing.T) {
+	if got := openIncidentsHTML(nil); got != "<div>Open incidents: none</div>" {
+		t.Errorf("without incidents = %q", got)
+	}
+
+	opened := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	got := openIncidentsHTML([]incident.Record{
+		{ID: "web-1", Service: "web", Status: incident.StatusOpen, Opened: opened, Critical: 2, Total: 3},
+		{ID: "a b<c>", Service: "<script>", Status: incident.StatusMitigated, Opened: opened, Critical: 1, Total: 1},
+	})
+	for _, want := range []string{
+		"<div>Open incidents: 2<ul>",
+		`<li><a href="/v1/incidents/web-1">web-1</a>: web, 2 of 3 instances critical, open, opened 2026-10-18T12:00:00Z</li>`,
+		`<a href="/v1/incidents/a%20b%3Cc%3E">a b&lt;c&gt;</a>: &lt;script&gt;`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("open incidents do not contain %q:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "<script>") {
+		t.Errorf("open incidents are not escaped:\n%s", got)
+	}
+}
+
+func TestLandingPageHandler(t *testing.T) {
+	var cfg incident.Config
+	cfg.RegisterFlags(flag.NewFlagSet("test", flag.PanicOnError))
+	elector := runningElector(t)
+	inc, err := incident.New(cfg, nil, elector, nil, log.NewNopLogger(), prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		atc  *Atc
+		want []string
+		not  []string
+	}{
+		"leadership and incidents": {
+			atc:  &Atc{logger: log.NewNopLogger(), Leader: elector, Incident: inc},
+			want: []string{"<div>Leadership: replica replica-1 is the leader</div>", "<div>Open incidents: none</div>"},
+		},
+		"without modules": {
+			atc: &Atc{logger: log.NewNopLogger()},
+			not: []string{"Leadership:", "Open incidents:"},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			tc.atc.landingPageHandler(web.LandingConfig{Name: "ATC", Version: "test"})(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+			}
+			body := rec.Body.String()
+			for _, want := range tc.want {
+				if !strings.Contains(body, want) {
+					t.Errorf("landing page does not contain %q:\n%s", want, body)
+				}
+			}
+			for _, not := range tc.not {
+				if strings.Contains(body, not) {
+					t.Errorf("landing page contains %q:\n%s", not, body)
+				}
+			}
+		})
+	}
+}
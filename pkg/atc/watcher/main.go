@@ -0,0 +1,257 @@
+package watcher
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/services"
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/api/watch"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+type Config struct {
+	DebounceWindow time.Duration `yaml:"debounce_window"`
+	MaxDelay       time.Duration `yaml:"max_delay"`
+}
+
+func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	f.DurationVar(&cfg.DebounceWindow, "watcher.debounce-window", time.Second, "Quiet period after the last services or checks update before a snapshot is published.")
+	f.DurationVar(&cfg.MaxDelay, "watcher.max-delay", 10*time.Second, "Maximum time a snapshot is held back while updates keep arriving.")
+}
+
+func (cfg *Config) Validate() error {
+	if cfg.DebounceWindow <= 0 {
+		return fmt.Errorf("invalid watcher debounce window: %s", cfg.DebounceWindow)
+	}
+	if cfg.MaxDelay < cfg.DebounceWindow {
+		return fmt.Errorf("watcher max delay (%s) must not be shorter than the debounce window (%s)", cfg.MaxDelay, cfg.DebounceWindow)
+	}
+	return nil
+}
+
+// Watcher owns the Consul services and checks watches of the process. It
+// coalesces bursts of updates and publishes a Snapshot of the catalog to
+// every subscriber once the updates settle down.
+type Watcher struct {
+	services.Service
+
+	cfg    Config
+	client *api.Client
+	logger log.Logger
+
+	eventsChan chan struct{}
+
+	mtx      sync.Mutex
+	index    uint64
+	services map[string][]string
+	// reload is set when the catalog changed since the instances were last
+	// read.
+	reload      bool
+	checks      api.HealthChecks
+	subscribers []chan *Snapshot
+
+	// instances holds the registered instances of every service, read again
+	// after the catalog changed. It is only used when publishing.
+	instances map[string][]Instance
+
+	eventsTotal    *prometheus.CounterVec
+	snapshotsTotal prometheus.Counter
+}
+
+func (w *Watcher) starting(ctx context.Context) error {
+	return nil
+}
+
+func (w *Watcher) stopping(_ error) error {
+	return nil
+}
+
+func New(cfg Config, client *api.Client, logger log.Logger, reg prometheus.Registerer) (*Watcher, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	w := &Watcher{
+		cfg:        cfg,
+		client:     client,
+		logger:     log.With(logger, "module", "watcher"),
+		eventsChan: make(chan struct{}, 1),
+		eventsTotal: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "atc_watcher_events_total",
+			Help: "Total number of updates received from the Consul watches.",
+		}, []string{"watch"}),
+		snapshotsTotal: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "atc_watcher_snapshots_total",
+			Help: "Total number of snapshots published to subscribers.",
+		}),
+	}
+	w.Service = services.NewBasicService(w.starting, w.watcher, w.stopping)
+	return w, nil
+}
+
+// Subscribe returns a channel on which every published Snapshot is delivered.
+// Subscribers that fall behind only receive the most recent snapshot.
+// Subscribe must be called before the watcher is started.
+func (w *Watcher) Subscribe() <-chan *Snapshot {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	ch := make(chan *Snapshot, 1)
+	w.subscribers = append(w.subscribers, ch)
+	return ch
+}
+
+func (w *Watcher) watcher(ctx context.Context) error {
+	servicesWatcher, parseErr := watch.Parse(map[string]interface{}{"type": "services"})
+	if parseErr != nil {
+		return fmt.Errorf("failed to create services watcher plan: %s", parseErr.Error())
+	}
+
+	servicesWatcher.HybridHandler = func(p watch.BlockingParamVal, data interface{}) {
+		svcs, ok := data.(map[string][]string)
+		if !ok {
+			return
+		}
+		w.eventsTotal.WithLabelValues("services").Inc()
+
+		w.mtx.Lock()
+		w.services = svcs
+		w.reload = true
+		w.updateIndex(p)
+		w.mtx.Unlock()
+		w.notify(ctx)
+	}
+
+	checksWatcher, err := watch.Parse(map[string]interface{}{"type": "checks"})
+	if err != nil {
+		return fmt.Errorf("failed to create checks watcher plan: %w", err)
+	}
+
+	checksWatcher.HybridHandler = func(p watch.BlockingParamVal, data interface{}) {
+		checks, ok := data.([]*api.HealthCheck)
+		if !ok {
+			return
+		}
+		w.eventsTotal.WithLabelValues("checks").Inc()
+
+		w.mtx.Lock()
+		w.checks = checks
+		w.updateIndex(p)
+		w.mtx.Unlock()
+		w.notify(ctx)
+	}
+
+	errChan := make(chan error, 2)
+
+	defer func() {
+		servicesWatcher.Stop()
+		checksWatcher.Stop()
+	}()
+
+	go func() {
+		errChan <- servicesWatcher.RunWithClientAndHclog(w.client, servicesWatcher.Logger)
+	}()
+
+	go func() {
+		errChan <- checksWatcher.RunWithClientAndHclog(w.client, checksWatcher.Logger)
+	}()
+
+	return w.debounce(ctx, errChan)
+}
+
+// debounce publishes a snapshot once the updates settle down for the debounce
+// window, or once the max delay passed since the first update.
+func (w *Watcher) debounce(ctx context.Context, errChan <-chan error) error {
+	var (
+		debounce *time.Timer
+		deadline time.Time
+		fire     <-chan time.Time
+	)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case err := <-errChan:
+			return fmt.Errorf("services or checks watcher terminated: %w", err)
+
+		case <-w.eventsChan:
+			now := time.Now()
+			if debounce == nil {
+				deadline = now.Add(w.cfg.MaxDelay)
+				debounce = time.NewTimer(w.cfg.DebounceWindow)
+				fire = debounce.C
+				continue
+			}
+
+			// Postpone the snapshot for as long as updates keep coming in,
+			// but never beyond the max delay of the first update.
+			wait := w.cfg.DebounceWindow
+			if remaining := deadline.Sub(now); remaining < wait {
+				wait = remaining
+			}
+			debounce.Reset(wait)
+
+		case <-fire:
+			debounce, fire = nil, nil
+			w.publish()
+		}
+	}
+}
+
+func (w *Watcher) notify(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+	case w.eventsChan <- struct{}{}:
+	default:
+		// Event chan is full, the pending event covers this update.
+	}
+}
+
+func (w *Watcher) updateIndex(p watch.BlockingParamVal) {
+	if idx, ok := p.(watch.WaitIndexVal); ok && uint64(idx) > w.index {
+		w.index = uint64(idx)
+	}
+}
+
+func (w *Watcher) publish() {
+	w.mtx.Lock()
+	index, svcs, checks, reload := w.index, w.services, w.checks, w.reload
+	w.reload = false
+	w.mtx.Unlock()
+
+	if reload {
+		instances, err := loadInstances(w.client, svcs)
+		if err != nil {
+			level.Error(w.logger).Log("msg", "failed to build catalog snapshot", "err", err)
+			w.mtx.Lock()
+			w.reload = true
+			w.mtx.Unlock()
+			return
+		}
+		w.instances = instances
+	}
+	snapshot := buildSnapshot(index, svcs, w.instances, checks)
+
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	for _, ch := range w.subscribers {
+		// Replace a snapshot the subscriber has not picked up yet.
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- snapshot
+	}
+	w.snapshotsTotal.Inc()
+	level.Debug(w.logger).Log("msg", "published catalog snapshot", "index", index, "services", len(svcs))
+}
@@ -0,0 +1,127 @@
+package watcher
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/hashicorp/consul/api"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func testWatcher(t *testing.T, client *api.Client, debounce, maxDelay time.Duration) (*Watcher, <-chan *Snapshot) {
+	t.Helper()
+	w, err := New(Config{DebounceWindow: debounce, MaxDelay: maxDelay}, client, log.NewNopLogger(), prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w, w.Subscribe()
+}
+
+func TestDebounce(t *testing.T) {
+	w, snapshots := testWatcher(t, nil, 50*time.Millisecond, 200*time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errChan := make(chan error)
+	done := make(chan error)
+	go func() { done <- w.debounce(ctx, errChan) }()
+
+	// A single update is published once the debounce window passed.
+	start := time.Now()
+	w.notify(ctx)
+	select {
+	case <-snapshots:
+		if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+			t.Errorf("snapshot after %s, want it held back for the debounce window", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no snapshot after a single update")
+	}
+
+	// Updates that keep coming in postpone the snapshot up to the max delay.
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	start = time.Now()
+	w.notify(ctx)
+	burst := time.After(2 * time.Second)
+	for published := false; !published; {
+		select {
+		case <-ticker.C:
+			w.notify(ctx)
+		case <-snapshots:
+			published = true
+			if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+				t.Errorf("snapshot after %s, want it held back while updates arrive", elapsed)
+			}
+		case <-burst:
+			t.Fatal("no snapshot while updates keep arriving, want one after the max delay")
+		}
+	}
+
+	// A terminated watch stops the watcher.
+	errChan <- context.DeadlineExceeded
+	if err := <-done; err == nil {
+		t.Error("watcher kept running after a watch terminated")
+	}
+}
+
+func TestPublish(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/health/service/web" {
+			http.NotFound(w, r)
+			return
+		}
+		requests.Add(1)
+		_ = json.NewEncoder(w).Encode([]*api.ServiceEntry{{
+			Node:    &api.Node{Node: "node-1"},
+			Service: &api.AgentService{ID: "web-1", Service: "web", Address: "10.0.0.1", Port: 8080},
+			Checks:  api.HealthChecks{{Node: "node-1", ServiceID: "web-1", Status: api.HealthPassing}},
+		}})
+	}))
+	defer srv.Close()
+	client, err := api.NewClient(&api.Config{Address: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, snapshots := testWatcher(t, client, time.Second, time.Second)
+
+	checks := func(status string) {
+		w.mtx.Lock()
+		defer w.mtx.Unlock()
+		w.checks = api.HealthChecks{{Node: "node-1", ServiceID: "web-1", ServiceName: "web", Status: status}}
+	}
+	w.mtx.Lock()
+	w.services, w.reload = map[string][]string{"web": {}}, true
+	w.mtx.Unlock()
+	checks(api.HealthPassing)
+	w.publish()
+	if s := <-snapshots; s.Health("web").Passing != 1 || s.Instances["web"][0].Address != "10.0.0.1" {
+		t.Fatalf("snapshot = %+v, want web-1 passing", s.Instances)
+	}
+
+	// A change of a check is published without reading the instances again.
+	checks(api.HealthCritical)
+	w.publish()
+	if s := <-snapshots; s.Health("web").Critical != 1 {
+		t.Fatalf("health = %+v, want web-1 critical", s.Health("web"))
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("instances read %d times, want once", n)
+	}
+
+	// A change of the catalog reads them again.
+	w.mtx.Lock()
+	w.reload = true
+	w.mtx.Unlock()
+	w.publish()
+	<-snapshots
+	if n := requests.Load(); n != 2 {
+		t.Errorf("instances read %d times, want twice after the catalog changed", n)
+	}
+}
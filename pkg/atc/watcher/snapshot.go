@@ -0,0 +1,157 @@
+package watcher
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Snapshot is a point in time view of the services in the local datacenter.
+type Snapshot struct {
+	// Index is the highest Consul index the snapshot was built from.
+	Index uint64
+	// Services maps service names to the tags of their instances.
+	Services map[string][]string
+	// Instances maps service names to their registered instances.
+	Instances map[string][]Instance
+	// Checks holds the status of every check in the local datacenter.
+	Checks api.HealthChecks
+}
+
+// Instance is a single registration of a service on a node.
+type Instance struct {
+	ID      string
+	Service string
+	Node    string
+	Address string
+	Port    int
+	Tags    []string
+	Meta    map[string]string
+	// Status is the aggregated status of the node and service checks.
+	Status string
+	// Kind is the kind of the service, empty for typical services.
+	Kind string
+	// Destination is the service a Connect proxy represents, and Upstreams
+	// are the upstreams it routes to.
+	Destination string
+	Upstreams   []Upstream
+}
+
+// Upstream is a Connect upstream of a proxy.
+type Upstream struct {
+	Service string
+	// Datacenter or Peer are set for upstreams outside the local
+	// datacenter.
+	Datacenter string
+	Peer       string
+}
+
+// Health counts the instances of a service per aggregated status.
+type Health struct {
+	Passing     int
+	Warning     int
+	Critical    int
+	Maintenance int
+}
+
+func (h Health) Total() int {
+	return h.Passing + h.Warning + h.Critical + h.Maintenance
+}
+
+// Available reports whether at least one instance is able to serve traffic.
+func (h Health) Available() bool {
+	return h.Passing+h.Warning > 0
+}
+
+// Add counts an instance with the given aggregated status.
+func (h *Health) Add(status string) {
+	switch status {
+	case api.HealthPassing:
+		h.Passing++
+	case api.HealthWarning:
+		h.Warning++
+	case api.HealthCritical:
+		h.Critical++
+	case api.HealthMaint:
+		h.Maintenance++
+	}
+}
+
+// Health returns the instance counts of a service.
+func (s *Snapshot) Health(service string) Health {
+	var h Health
+	for _, instance := range s.Instances[service] {
+		h.Add(instance.Status)
+	}
+	return h
+}
+
+// buildSnapshot combines the registered instances of the services with the
+// checks, so a change of a check does not need the instances to be read again.
+func buildSnapshot(index uint64, svcs map[string][]string, registered map[string][]Instance, checks api.HealthChecks) *Snapshot {
+	s := &Snapshot{
+		Index:     index,
+		Services:  svcs,
+		Instances: make(map[string][]Instance, len(svcs)),
+		Checks:    checks,
+	}
+
+	// The status of an instance aggregates the checks of its node and its
+	// own checks, like the health endpoints of Consul do.
+	type key struct{ node, serviceID string }
+	byInstance := map[key]api.HealthChecks{}
+	for _, c := range checks {
+		k := key{c.Node, c.ServiceID}
+		byInstance[k] = append(byInstance[k], c)
+	}
+
+	for name := range svcs {
+		instances := make([]Instance, 0, len(registered[name]))
+		for _, instance := range registered[name] {
+			checks := append(slices.Clone(byInstance[key{instance.Node, ""}]), byInstance[key{instance.Node, instance.ID}]...)
+			instance.Status = checks.AggregatedStatus()
+			instances = append(instances, instance)
+		}
+		s.Instances[name] = instances
+	}
+	return s
+}
+
+// loadInstances reads the registered instances of every service. Their status
+// is left to buildSnapshot.
+func loadInstances(client *api.Client, svcs map[string][]string) (map[string][]Instance, error) {
+	registered := make(map[string][]Instance, len(svcs))
+	for name := range svcs {
+		entries, _, err := client.Health().Service(name, "", false, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get instances of service %s: %w", name, err)
+		}
+
+		instances := make([]Instance, 0, len(entries))
+		for _, entry := range entries {
+			instance := Instance{
+				ID:      entry.Service.ID,
+				Service: entry.Service.Service,
+				Node:    entry.Node.Node,
+				Address: entry.Service.Address,
+				Port:    entry.Service.Port,
+				Tags:    entry.Service.Tags,
+				Meta:    entry.Service.Meta,
+				Kind:    string(entry.Service.Kind),
+			}
+			if proxy := entry.Service.Proxy; proxy != nil {
+				instance.Destination = proxy.DestinationServiceName
+				for _, u := range proxy.Upstreams {
+					if u.DestinationType == api.UpstreamDestTypePreparedQuery {
+						continue
+					}
+					instance.Upstreams = append(instance.Upstreams, Upstream{Service: u.DestinationName, Datacenter: u.Datacenter, Peer: u.DestinationPeer})
+				}
+			}
+			instances = append(instances, instance)
+		}
+		registered[name] = instances
+	}
+	return registered, nil
+}
@@ -0,0 +1,59 @@
+package watcher
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func TestBuildSnapshot(t *testing.T) {
+	svcs := map[string][]string{"web": {"v1"}, "db": {}}
+	registered := map[string][]Instance{
+		"web": {
+			{ID: "web-1", Service: "web", Node: "node-1"},
+			{ID: "web-2", Service: "web", Node: "node-2"},
+			{ID: "web-3", Service: "web", Node: "node-3"},
+		},
+		"db": {{ID: "db-1", Service: "db", Node: "node-1"}},
+	}
+	checks := api.HealthChecks{
+		{Node: "node-1", CheckID: "serfHealth", Status: api.HealthPassing},
+		{Node: "node-1", CheckID: "web-1", ServiceID: "web-1", ServiceName: "web", Status: api.HealthWarning},
+		{Node: "node-1", CheckID: "db-1", ServiceID: "db-1", ServiceName: "db", Status: api.HealthPassing},
+		{Node: "node-2", CheckID: "serfHealth", Status: api.HealthCritical},
+		{Node: "node-2", CheckID: "web-2", ServiceID: "web-2", ServiceName: "web", Status: api.HealthPassing},
+		// A check of another instance on node-3 does not count for web-3.
+		{Node: "node-3", CheckID: "web-9", ServiceID: "web-9", ServiceName: "web", Status: api.HealthCritical},
+	}
+
+	s := buildSnapshot(42, svcs, registered, checks)
+	if s.Index != 42 || len(s.Checks) != len(checks) {
+		t.Errorf("index = %d, checks = %d, want 42 and %d", s.Index, len(s.Checks), len(checks))
+	}
+	want := map[string]string{
+		"web-1": api.HealthWarning,
+		"web-2": api.HealthCritical,
+		"web-3": api.HealthPassing,
+		"db-1":  api.HealthPassing,
+	}
+	for _, instances := range s.Instances {
+		for _, i := range instances {
+			if i.Status != want[i.ID] {
+				t.Errorf("status of %s = %q, want %q", i.ID, i.Status, want[i.ID])
+			}
+			delete(want, i.ID)
+		}
+	}
+	if len(want) != 0 {
+		t.Errorf("instances %v missing from the snapshot", want)
+	}
+	if h := s.Health("web"); h.Passing != 1 || h.Warning != 1 || h.Critical != 1 || !h.Available() {
+		t.Errorf("health of web = %+v, want 1 passing, 1 warning and 1 critical", h)
+	}
+
+	// The registered instances are shared between snapshots and keep no
+	// status.
+	if registered["web"][0].Status != "" {
+		t.Errorf("registered status = %q, want it untouched", registered["web"][0].Status)
+	}
+}